@@ -4,7 +4,11 @@
 // Package apitype contains types for the Tailscale LocalAPI and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 // LocalAPIHost is the Host header value used by the LocalAPI.
 const LocalAPIHost = "local-miraged.sock"
@@ -49,3 +53,41 @@ type ReloadConfigResponse struct {
 	Reloaded bool   // whether the config was reloaded
 	Err      string // any error message
 }
+
+// CaptivePortalStatus is the response to a LocalAPI captive-portal request.
+type CaptivePortalStatus struct {
+	// Detected is whether the network appears to be behind a captive
+	// portal that blocks traffic until the user logs in to it.
+	Detected bool
+
+	// URL, if non-empty, is where the user should log in to the portal.
+	URL string `json:",omitempty"`
+
+	// Since is when the portal was first detected, if Detected.
+	Since time.Time
+}
+
+// ServeBackendStatus is the state of a backend of a serve handler's
+// ipn.BackendPool, as returned in a LocalAPI serve-backends response.
+type ServeBackendStatus struct {
+	// Handler identifies the serve handler, such as "tcp:2222" or
+	// "foo.ts.net:443/api".
+	Handler string
+
+	// Backend is the backend, as configured.
+	Backend string
+
+	// Healthy is whether the backend passes health checks. Unhealthy
+	// backends are ejected from the pool until they pass again.
+	Healthy bool
+
+	// Active is the number of connections or requests the backend is
+	// currently handling.
+	Active int64
+
+	// LastError, if non-empty, is why the last health check failed.
+	LastError string `json:",omitempty"`
+
+	// Since is when the backend last became healthy or unhealthy.
+	Since time.Time
+}
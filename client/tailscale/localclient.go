@@ -336,6 +336,25 @@ func (lc *LocalClient) TailDaemonLogs(ctx context.Context) (io.Reader, error) {
 	return res.Body, nil
 }
 
+// StreamDNSQueryLog returns a stream of the MagicDNS query log, as
+// newline-delimited JSON dnstype.QueryLogEntry values, oldest first. If
+// follow is true, the stream continues with new entries until ctx is done.
+func (lc *LocalClient) StreamDNSQueryLog(ctx context.Context, follow bool) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/dns-query-log?follow="+strconv.FormatBool(follow), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, errors.New(res.Status)
+	}
+	return res.Body, nil
+}
+
 // Pprof returns a pprof profile of the Tailscale daemon.
 func (lc *LocalClient) Pprof(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
@@ -733,6 +752,28 @@ func (lc *LocalClient) CheckIPForwarding(ctx context.Context) error {
 	return nil
 }
 
+// CaptivePortal reports whether the local Tailscale daemon thinks the
+// network is behind a captive portal, and if so, where to log in to it.
+func (lc *LocalClient) CaptivePortal(ctx context.Context) (*apitype.CaptivePortalStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/captive-portal")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.CaptivePortalStatus](body)
+}
+
+// CheckCaptivePortal asks the local Tailscale daemon to check again for a
+// captive portal, such as after the user logs in to one. It returns the
+// status from before the check; the result of the check shows up in
+// CaptivePortal and the health state once it's done.
+func (lc *LocalClient) CheckCaptivePortal(ctx context.Context) (*apitype.CaptivePortalStatus, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/captive-portal", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.CaptivePortalStatus](body)
+}
+
 // CheckPrefs validates the provided preferences, without making any changes.
 //
 // The CLI uses this before a Start call to fail fast if the preferences won't
@@ -1222,6 +1263,17 @@ func (lc *LocalClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, er
 	return sc, nil
 }
 
+// ServeBackends returns the state of the backends of the serve handlers
+// that balance over several of them, including whether they've been
+// ejected for failing health checks.
+func (lc *LocalClient) ServeBackends(ctx context.Context) ([]apitype.ServeBackendStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-backends")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]apitype.ServeBackendStatus](body)
+}
+
 func getServeConfigFromJSON(body []byte) (sc *ipn.ServeConfig, err error) {
 	if err := json.Unmarshal(body, &sc); err != nil {
 		return nil, err
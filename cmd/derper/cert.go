@@ -47,6 +47,17 @@ func certProviderByCertMode(mode, dir, hostname string) (certProvider, error) {
 		return certManager, nil
 	case "manual":
 		return NewManualCertManager(dir, hostname)
+	case "dns01":
+		provider, err := dnsProviderByName(*dnsProviderName, *dnsID, *dnsKey)
+		if err != nil {
+			return nil, err
+		}
+		m, err := newDNS01CertManager(dir, hostname, *acmeDir, provider)
+		if err != nil {
+			return nil, err
+		}
+		dns01Manager = m
+		return m, nil
 	default:
 		return nil, fmt.Errorf("unsupport cert mode: %q", mode)
 	}
@@ -25,6 +25,7 @@
 	"time"
 
 	"go4.org/mem"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/time/rate"
 	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
@@ -37,16 +38,23 @@
 )
 
 var (
-	dev        = flag.Bool("dev", false, "run in localhost development mode (overrides -a)")
-	addr       = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
-	httpPort   = flag.Int("http-port", 80, "The port on which to serve HTTP. Set to -1 to disable. The listener is bound to the same IP (if any) as specified in the -a flag.")
-	stunPort   = flag.Int("stun-port", 3478, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
-	configPath = flag.String("c", "", "config file path")
-	certMode   = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt")
-	certDir    = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
-	hostname   = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
-	runSTUN    = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
-	runDERP    = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
+	dev         = flag.Bool("dev", false, "run in localhost development mode (overrides -a)")
+	addr        = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
+	httpPort    = flag.Int("http-port", 80, "The port on which to serve HTTP. Set to -1 to disable. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	stunPort    = flag.Int("stun-port", 3478, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	stunAltPort = flag.Int("stun-alt-port", 0, "if non-zero, a second UDP port on which to serve STUN, which lets clients classify their NAT's behavior: the server advertises it in RFC 5780 OTHER-ADDRESS and answers requests to change port from it. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	configPath  = flag.String("c", "", "config file path")
+	certMode    = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt, dns01")
+	certDir     = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
+	hostname    = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
+	acmeDir     = flag.String("acme-directory", acme.LetsEncryptURL, "ACME directory URL used by -certmode=dns01")
+	quicPort    = flag.Int("quic-port", 0, "if non-zero, the UDP port on which to serve DERP over QUIC. Requires TLS. The listener is bound to the same IP (if any) as specified in the -a flag. Clients only use it if it's set as QUICPort for the node in the DERP map.")
+	runSTUN     = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
+	runDERP     = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
+
+	dnsProviderName = flag.String("dns-provider", "", "DNS provider answering ACME DNS-01 challenges for -certmode=dns01: cloudflare or rfc2136. Set by the control server in managed mode.")
+	dnsID           = flag.String("dns-id", "", "DNS provider ID for -certmode=dns01: the zone ID for cloudflare, the nameserver host[:port] for rfc2136")
+	dnsKey          = flag.String("dns-key", "", "DNS provider secret for -certmode=dns01: the API token for cloudflare, the TSIG key as [alg:]name:secret for rfc2136")
 
 	meshPSKFile    = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith       = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
@@ -54,8 +62,23 @@
 	unpublishedDNS = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list")
 	verifyClients  = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 
+	ctrlURL         = flag.String("ctrl-url", "", "if non-empty, the Mirage control server URL to register with. Enables managed (Navi) mode, in which hostname, ports and trusted clients come from the control server.")
+	naviID          = flag.String("navi-id", "", "the Navi ID of this DERP server as registered on the control server; required with --ctrl-url")
+	naviKeyFile     = flag.String("navi-key-file", "", "path to the file holding this server's Navi machine key; created if missing. Defaults to navi.key in the directory of the -c config file.")
+	naviTrustFile   = flag.String("navi-trust-file", "", "path to the snapshot of the trusted node list kept in managed mode, used to keep serving clients across restarts while the control server is unreachable. Defaults to navi-trust.json in the directory of the -c config file.")
+	naviPullCronjob = flag.String("navi-pull-cron", "@every 5m", "cron spec for periodically pulling the trusted node list from the control server in managed mode")
+
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientRateLimit = flag.Int64("per-client-rate-limit", 0, "if non-zero, the rate limit in bytes per second for packets sent by all connections of a single node key. Overridden by the control server in managed mode.")
+	clientRateBurst = flag.Int64("per-client-rate-burst", 0, "burst size in bytes for --per-client-rate-limit; defaults to one second's worth, and is never less than a maximum-size packet")
+	ipRateLimit     = flag.Int64("per-ip-rate-limit", 0, "if non-zero, the rate limit in bytes per second for packets sent by all connections from a single source IP")
+	ipRateBurst     = flag.Int64("per-ip-rate-burst", 0, "burst size in bytes for --per-ip-rate-limit; defaults to one second's worth, and is never less than a maximum-size packet")
+	clientConnLimit = flag.Int("per-client-conn-limit", 0, "if non-zero, the maximum number of concurrent connections per node key")
+	ipConnLimit     = flag.Int("per-ip-conn-limit", 0, "if non-zero, the maximum number of concurrent connections per source IP")
+
+	drainWindow = flag.Duration("drain-window", 5*time.Minute, "when draining (on SIGUSR1 or when asked by the control server), stop accepting new clients and close existing connections spread out over this long")
 )
 
 var (
@@ -69,6 +92,7 @@
 	stunNotSTUN    = stunDisposition.Get("not_stun")
 	stunWriteError = stunDisposition.Get("write_error")
 	stunSuccess    = stunDisposition.Get("success")
+	stunBadChange  = stunDisposition.Get("unsupported_change_request")
 
 	stunIPv4 = stunAddrFamily.Get("ipv4")
 	stunIPv6 = stunAddrFamily.Get("ipv6")
@@ -141,17 +165,30 @@ func main() {
 		tsweb.DevMode = true
 	}
 
+	cfg := loadConfig()
+
+	s := derp.NewServer(cfg.PrivateKey, log.Printf)
+	s.SetVerifyClient(*verifyClients)
+	s.SetClientPolicy(derp.ClientPolicy{
+		BytesPerSec:    *clientRateLimit,
+		BytesBurst:     *clientRateBurst,
+		IPBytesPerSec:  *ipRateLimit,
+		IPBytesBurst:   *ipRateBurst,
+		MaxConnsPerKey: *clientConnLimit,
+		MaxConnsPerIP:  *ipConnLimit,
+	})
+	s.DrainWindow = *drainWindow
+	go handleDrainSignals(s)
+	if err := startManaged(s); err != nil {
+		log.Fatalf("derper: managed mode: %v", err)
+	}
+
 	listenHost, _, err := net.SplitHostPort(*addr)
 	if err != nil {
 		log.Fatalf("invalid server address: %v", err)
 	}
 
-	cfg := loadConfig()
-
-	serveTLS := tsweb.IsProd443(*addr) || *certMode == "manual"
-
-	s := derp.NewServer(cfg.PrivateKey, log.Printf)
-	s.SetVerifyClient(*verifyClients)
+	serveTLS := tsweb.IsProd443(*addr) || *certMode == "manual" || *certMode == "dns01"
 
 	if *meshPSKFile != "" {
 		b, err := os.ReadFile(*meshPSKFile)
@@ -169,6 +206,10 @@ func main() {
 		log.Fatalf("startMesh: %v", err)
 	}
 	expvar.Publish("derp", s.ExpVar())
+	metricsHandler, err := newMetricsHandler(s)
+	if err != nil {
+		log.Fatalf("metrics: %v", err)
+	}
 
 	mux := http.NewServeMux()
 	if *runDERP {
@@ -180,7 +221,12 @@ func main() {
 			http.Error(w, "derp server disabled", http.StatusNotFound)
 		}))
 	}
+	if *ctrlURL != "" {
+		// Control server connects back here to push trusted node changes.
+		mux.HandleFunc("/ts2021", s.NoiseUpgradeHandler)
+	}
 	mux.HandleFunc("/derp/probe", probeHandler)
+	mux.Handle("/metrics", metricsHandler)
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", tsweb.BrowserHeaderHandlerFunc(handleBootstrapDNS))
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -211,6 +257,12 @@ func main() {
 	debug := tsweb.Debugger(mux)
 	debug.KV("TLS hostname", *hostname)
 	debug.KV("Mesh key", s.HasMeshKey())
+	debug.KVFunc("Draining", func() any { return s.Draining() })
+	if *ctrlURL != "" {
+		debug.KV("Control URL", *ctrlURL)
+		debug.KV("Navi ID", *naviID)
+		debug.KVFunc("Trust list stale", func() any { return s.TrustListStale() })
+	}
 	debug.Handle("check", "Consistency check", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := s.ConsistencyCheck()
 		if err != nil {
@@ -220,9 +272,10 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.KVFunc("Client policy", func() any { return fmt.Sprintf("%+v", s.ClientPolicy()) })
 
 	if *runSTUN {
-		go serveSTUN(listenHost, *stunPort)
+		go serveSTUN(listenHost, *stunPort, *stunAltPort)
 	}
 
 	quietLogger := log.New(logFilter{}, "", 0)
@@ -261,6 +314,9 @@ func main() {
 		}
 		// Disable TLS 1.0 and 1.1, which are obsolete and have security issues.
 		httpsrv.TLSConfig.MinVersion = tls.VersionTLS12
+		if *runDERP && *quicPort > 0 {
+			go serveQUIC(s, listenHost, *quicPort, httpsrv.TLSConfig)
+		}
 		httpsrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.TLS != nil {
 				label := "unknown"
@@ -307,8 +363,15 @@ func main() {
 		}
 		err = rateLimitedListenAndServeTLS(httpsrv)
 	} else {
+		if *quicPort > 0 {
+			log.Printf("derper: not serving DERP over QUIC without TLS")
+		}
 		log.Printf("derper: serving on %s", *addr)
-		err = httpsrv.ListenAndServe()
+		var ln net.Listener
+		ln, err = net.Listen(naviNetwork("tcp"), *addr)
+		if err == nil {
+			err = httpsrv.Serve(ln)
+		}
 	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("derper: %v", err)
@@ -351,16 +414,54 @@ func probeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func serveSTUN(host string, port int) {
-	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, fmt.Sprint(port)))
+func serveSTUN(host string, port, altPort int) {
+	pc, err := net.ListenPacket(naviNetwork("udp"), net.JoinHostPort(host, fmt.Sprint(port)))
 	if err != nil {
 		log.Fatalf("failed to open STUN listener: %v", err)
 	}
 	log.Printf("running STUN server on %v", pc.LocalAddr())
-	serverSTUNListener(context.Background(), pc.(*net.UDPConn))
+	if altPort == 0 {
+		serverSTUNListener(context.Background(), pc.(*net.UDPConn), nil)
+		return
+	}
+	altPC, err := net.ListenPacket(naviNetwork("udp"), net.JoinHostPort(host, fmt.Sprint(altPort)))
+	if err != nil {
+		log.Fatalf("failed to open alternate STUN listener: %v", err)
+	}
+	log.Printf("running STUN server on alternate port %v", altPC.LocalAddr())
+	go serverSTUNListener(context.Background(), altPC.(*net.UDPConn), pc.(*net.UDPConn))
+	serverSTUNListener(context.Background(), pc.(*net.UDPConn), altPC.(*net.UDPConn))
+}
+
+func serveQUIC(s *derp.Server, host string, port int, tlsConf *tls.Config) {
+	pc, err := net.ListenPacket(naviNetwork("udp"), net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		log.Fatalf("failed to open QUIC listener: %v", err)
+	}
+	log.Printf("derper: serving DERP over QUIC on %v", pc.LocalAddr())
+	if err := derphttp.ServeQUIC(context.Background(), s, pc, tlsConf); err != nil {
+		log.Fatalf("derper: QUIC: %v", err)
+	}
 }
 
-func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
+// serverSTUNListener serves STUN on pc until ctx is done.
+//
+// If alt is non-nil, it's the server's socket on its other port, which is
+// advertised in responses as OTHER-ADDRESS, and from which the server
+// answers RFC 5780 requests to change port. The server has no alternate IP
+// address, so requests to change IP address are ignored.
+func serverSTUNListener(ctx context.Context, pc, alt *net.UDPConn) {
+	var other netip.AddrPort
+	if alt != nil {
+		// Unless it's bound to one, leave the IP of OTHER-ADDRESS
+		// unspecified: it's whichever IP the client reached us on.
+		ap := alt.LocalAddr().(*net.UDPAddr).AddrPort()
+		ip := ap.Addr().Unmap()
+		if ip.IsUnspecified() {
+			ip = netip.IPv4Unspecified()
+		}
+		other = netip.AddrPortFrom(ip, ap.Port())
+	}
 	var buf [64 << 10]byte
 	var (
 		n   int
@@ -394,8 +495,15 @@ func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
 			stunIPv6.Add(1)
 		}
 		addr, _ := netip.AddrFromSlice(ua.IP)
-		res := stun.Response(txid, netip.AddrPortFrom(addr, uint16(ua.Port)))
-		_, err = pc.WriteTo(res, ua)
+		res := stun.ResponseWithOtherAddress(txid, netip.AddrPortFrom(addr, uint16(ua.Port)), other)
+		from := pc
+		if changeIP, changePort := stun.ParseChangeRequest(pkt); changeIP || changePort && alt == nil {
+			stunBadChange.Add(1)
+			continue
+		} else if changePort {
+			from = alt
+		}
+		_, err = from.WriteTo(res, ua)
 		if err != nil {
 			stunWriteError.Add(1)
 		} else {
@@ -427,7 +535,7 @@ func defaultMeshPSKFile() string {
 }
 
 func rateLimitedListenAndServeTLS(srv *http.Server) error {
-	ln, err := net.Listen("tcp", cmpx.Or(srv.Addr, ":https"))
+	ln, err := net.Listen(naviNetwork("tcp"), cmpx.Or(srv.Addr, ":https"))
 	if err != nil {
 		return err
 	}
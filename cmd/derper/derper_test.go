@@ -8,11 +8,19 @@
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/derp"
 	"tailscale.com/net/stun"
 	"tailscale.com/tstest/deptest"
+	"tailscale.com/types/key"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -48,7 +56,7 @@ func BenchmarkServerSTUN(b *testing.B) {
 	defer pc.Close()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go serverSTUNListener(ctx, pc.(*net.UDPConn))
+	go serverSTUNListener(ctx, pc.(*net.UDPConn), nil)
 	addr := pc.LocalAddr().(*net.UDPAddr)
 
 	var resBuf [1500]byte
@@ -71,6 +79,65 @@ func BenchmarkServerSTUN(b *testing.B) {
 
 }
 
+func TestServerSTUNChangePort(t *testing.T) {
+	listen := func() *net.UDPConn {
+		pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	pc, altPC, cc := listen(), listen(), listen()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serverSTUNListener(ctx, pc, altPC)
+	go serverSTUNListener(ctx, altPC, pc)
+
+	addr := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+	altAddr := altPC.LocalAddr().(*net.UDPAddr).AddrPort()
+	for _, tt := range []struct {
+		name     string
+		req      func(stun.TxID) []byte
+		wantFrom netip.AddrPort
+	}{
+		{"plain", stun.Request, addr},
+		{"change-port", func(tx stun.TxID) []byte { return stun.ChangeRequest(tx, false, true) }, altAddr},
+	} {
+		tx := stun.NewTxID()
+		if _, err := cc.WriteToUDPAddrPort(tt.req(tx), addr); err != nil {
+			t.Fatal(err)
+		}
+		cc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var buf [1500]byte
+		n, from, err := cc.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if from != tt.wantFrom {
+			t.Errorf("%s: response from %v; want %v", tt.name, from, tt.wantFrom)
+		}
+		if gotTX, _, err := stun.ParseResponse(buf[:n]); err != nil || gotTX != tx {
+			t.Errorf("%s: ParseResponse = %v, %v; want %v", tt.name, gotTX, err, tx)
+		}
+		if got, want := stun.ParseOtherAddress(buf[:n]), netip.AddrPortFrom(altAddr.Addr().Unmap(), altAddr.Port()); got != want {
+			t.Errorf("%s: OTHER-ADDRESS = %v; want %v", tt.name, got, want)
+		}
+	}
+
+	// The server has no alternate IP, so it doesn't answer requests to
+	// change it.
+	tx := stun.NewTxID()
+	if _, err := cc.WriteToUDPAddrPort(stun.ChangeRequest(tx, true, true), addr); err != nil {
+		t.Fatal(err)
+	}
+	cc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var buf [1500]byte
+	if _, from, err := cc.ReadFromUDPAddrPort(buf[:]); err == nil {
+		t.Errorf("got response from %v to change-IP request; want none", from)
+	}
+}
+
 func TestNoContent(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -140,3 +207,227 @@ func TestDeps(t *testing.T) {
 		},
 	}.Check(t)
 }
+
+func TestLoadNaviKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "navi.key")
+	k1, err := loadNaviKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.IsZero() {
+		t.Fatal("generated zero key")
+	}
+	k2, err := loadNaviKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k1.Equal(k2) {
+		t.Errorf("reloaded key %v; want %v", k2.Public(), k1.Public())
+	}
+}
+
+func TestApplyIPOverrides(t *testing.T) {
+	oldAddr, oldIsLocalIP := *addr, isLocalIP
+	defer func() {
+		ipFamily, *addr, isLocalIP = "", oldAddr, oldIsLocalIP
+	}()
+	local := netip.MustParseAddr("10.0.0.1")
+	isLocalIP = func(ip netip.Addr) bool { return ip == local }
+
+	tests := []struct {
+		v4, v6   string
+		want     string // network suffix
+		wantAddr string
+		wantEPs  []netip.AddrPort
+		wantErr  bool
+	}{
+		{v4: "", v6: "", want: "", wantAddr: ":443"},
+		{v4: "1.2.3.4", v6: "2001:db8::1", want: "", wantAddr: ":443", wantEPs: []netip.AddrPort{
+			netip.MustParseAddrPort("1.2.3.4:443"),
+			netip.MustParseAddrPort("[2001:db8::1]:443"),
+		}},
+		{v4: "none", v6: "", want: "6", wantAddr: ":443"},
+		{v4: "", v6: "none", want: "4", wantAddr: ":443"},
+		{v4: "10.0.0.1", v6: "none", want: "4", wantAddr: "10.0.0.1:443", wantEPs: []netip.AddrPort{
+			netip.MustParseAddrPort("10.0.0.1:443"),
+		}},
+		// Not local, as behind 1:1 NAT: only advertised.
+		{v4: "1.2.3.4", v6: "none", want: "4", wantAddr: ":443", wantEPs: []netip.AddrPort{
+			netip.MustParseAddrPort("1.2.3.4:443"),
+		}},
+		// Both families enabled: listen on both.
+		{v4: "10.0.0.1", v6: "", want: "", wantAddr: ":443", wantEPs: []netip.AddrPort{
+			netip.MustParseAddrPort("10.0.0.1:443"),
+		}},
+		{v4: "bogus", v6: "::ffff:1.2.3.4", want: "", wantAddr: ":443"},
+		{v4: "none", v6: "none", wantAddr: ":443", wantErr: true},
+	}
+	for _, tt := range tests {
+		ipFamily, *addr = "", ":443"
+		s := derp.NewServer(key.NewNode(), t.Logf)
+		err := applyIPOverrides(s, tt.v4, tt.v6)
+		s.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("applyIPOverrides(%q, %q) error = %v; wantErr %v", tt.v4, tt.v6, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got := naviNetwork("udp"); got != "udp"+tt.want {
+			t.Errorf("applyIPOverrides(%q, %q): network = %q; want %q", tt.v4, tt.v6, got, "udp"+tt.want)
+		}
+		if *addr != tt.wantAddr {
+			t.Errorf("applyIPOverrides(%q, %q): addr = %q; want %q", tt.v4, tt.v6, *addr, tt.wantAddr)
+		}
+		if got := s.NaviEndpoints(); !slices.Equal(got, tt.wantEPs) {
+			t.Errorf("applyIPOverrides(%q, %q): endpoints = %v; want %v", tt.v4, tt.v6, got, tt.wantEPs)
+		}
+	}
+}
+
+func TestReloadNaviInfo(t *testing.T) {
+	oldHost, oldAddr, oldSTUN := *hostname, *addr, *stunPort
+	oldProv, oldID, oldKey := *dnsProviderName, *dnsID, *dnsKey
+	defer func() {
+		*hostname, *addr, *stunPort = oldHost, oldAddr, oldSTUN
+		*dnsProviderName, *dnsID, *dnsKey = oldProv, oldID, oldKey
+		dns01Manager = nil
+	}()
+	*hostname, *addr, *stunPort = "derp.example.com", ":443", 3478
+	*dnsProviderName, *dnsID, *dnsKey = "", "", ""
+	dns01Manager = &dns01CertManager{}
+
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	needRestart, err := reloadNaviInfo(s, derp.NaviNode{
+		STUNPort:    3479,
+		DNSProvider: "cloudflare",
+		DNSID:       "zone1",
+		DNSKey:      "token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"STUNPort"}; !slices.Equal(needRestart, want) {
+		t.Errorf("needRestart = %q; want %q", needRestart, want)
+	}
+	if p, ok := dns01Manager.dnsProvider().(*cloudflareProvider); !ok || p.zoneID != "zone1" {
+		t.Errorf("DNS provider = %#v; want cloudflare for zone1", dns01Manager.dnsProvider())
+	}
+	if *stunPort != 3478 {
+		t.Errorf("stun port changed to %d without a restart", *stunPort)
+	}
+
+	needRestart, err = reloadNaviInfo(s, derp.NaviNode{
+		STUNPort:    3478,
+		IPv4:        "1.2.3.4",
+		DNSProvider: "cloudflare",
+		DNSID:       "zone1",
+		DNSKey:      "token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(needRestart) != 0 {
+		t.Errorf("needRestart for a new advertised address = %q; want none", needRestart)
+	}
+	if got, want := s.NaviEndpoints(), []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:443")}; !slices.Equal(got, want) {
+		t.Errorf("endpoints after reload = %v; want %v", got, want)
+	}
+
+	if _, err := reloadNaviInfo(s, derp.NaviNode{IPv4: "none", IPv6: "none"}); err == nil {
+		t.Error("disabling both address families succeeded")
+	}
+}
+
+func TestNaviMeshUpdate(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	m := newNaviMesh(s, key.NewMachine())
+	a, b := key.NewMachine().Public(), key.NewMachine().Public()
+	peers := []derp.NaviNode{
+		{ID: "a", NaviKey: a.String(), HostName: "a.example.com"},
+		{ID: "b", NaviKey: b.String(), HostName: "b.example.com", DERPPort: 8443},
+		{ID: "c", NaviKey: key.NewMachine().Public().String(), HostName: "c.example.com", NoDERP: true},
+	}
+	m.update(peers)
+	defer m.update(nil)
+	urls := func() map[key.MachinePublic]string {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		ret := map[key.MachinePublic]string{}
+		for k, l := range m.links {
+			ret[k] = l.url
+		}
+		return ret
+	}
+	if got := urls(); len(got) != 2 || got[a] != "https://a.example.com:443/derp" || got[b] != "https://b.example.com:8443/derp" {
+		t.Errorf("links = %v", got)
+	}
+
+	m.mu.Lock()
+	linkA := m.links[a]
+	m.mu.Unlock()
+	peers[1].DERPPort = 9443
+	m.update(peers[:2])
+	m.mu.Lock()
+	if m.links[a] != linkA {
+		t.Error("unchanged peer reconnected")
+	}
+	m.mu.Unlock()
+	if got := urls()[b]; got != "https://b.example.com:9443/derp" {
+		t.Errorf("b's URL after port change = %q", got)
+	}
+
+	m.update(peers[1:2])
+	if got := urls(); len(got) != 1 || got[a] != "" {
+		t.Errorf("links after removing a = %v", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	h, err := newMetricsHandler(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stunSuccess.Add(1)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, want := range []string{
+		`derper_stun_requests_total{disposition="success"}`,
+		"derp_client_connect_seconds_count 0",
+		`derp_frame_bytes_bucket{direction="in",type="send_packet",le="16"} 0`,
+		`derp_packets_dropped_total{kind="disco",reason="UnknownDest"} 0`,
+		"derp_mesh_clients 0",
+		"go_goroutines",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+	if strings.Contains(rec.Body.String(), "derp_trust_nodes") {
+		t.Error("unmanaged server exports trust list size")
+	}
+
+	rec = httptest.NewRecorder()
+	req.RemoteAddr = "192.0.2.1:1234"
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("public access: status %d; want 403", rec.Code)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(derpCollector{s})
+	if problems, err := testutil.GatherAndLint(reg); err != nil || len(problems) > 0 {
+		t.Errorf("lint: %v, %+v", err, problems)
+	}
+}
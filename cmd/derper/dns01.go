@@ -0,0 +1,362 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"tailscale.com/atomicfile"
+	"tailscale.com/version"
+)
+
+const (
+	// dns01RenewBefore is how long before expiry a certificate is renewed.
+	dns01RenewBefore = 30 * 24 * time.Hour
+	// dns01CheckInterval is how often the renewal loop checks the certificate.
+	dns01CheckInterval = 12 * time.Hour
+	// dns01PropagationTimeout bounds how long we wait to see our TXT record
+	// in DNS before asking the CA to validate it anyway.
+	dns01PropagationTimeout = 2 * time.Minute
+)
+
+// dns01CertManager is a certProvider that obtains and renews certificates
+// from an ACME CA using DNS-01 challenges answered through a dnsProvider.
+// Unlike "letsencrypt" mode it needs no inbound port 80 or 443.
+type dns01CertManager struct {
+	hostname     string
+	dir          string
+	directoryURL string
+	logf         func(format string, args ...any)
+
+	// lookupTXT, if non-nil, is used to wait for the challenge record to
+	// become visible before accepting the challenge.
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	mu       sync.Mutex
+	provider dnsProvider
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+}
+
+// newDNS01CertManager returns a DNS-01 cert provider for hostname, storing
+// the ACME account key and certificate in certdir. It obtains a certificate
+// before returning if there's no valid one on disk yet.
+func newDNS01CertManager(certdir, hostname, directoryURL string, provider dnsProvider) (*dns01CertManager, error) {
+	var r net.Resolver
+	m := &dns01CertManager{
+		hostname:     hostname,
+		dir:          certdir,
+		directoryURL: directoryURL,
+		provider:     provider,
+		logf:         log.Printf,
+		lookupTXT:    r.LookupTXT,
+	}
+	if err := m.init(context.Background()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// init loads the certificate from disk or obtains a new one, and starts the
+// renewal loop.
+func (m *dns01CertManager) init(ctx context.Context) error {
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	if err := m.loadCert(); err != nil || m.needsRenewal(time.Now()) {
+		if err := m.obtainCert(ctx); err != nil {
+			return fmt.Errorf("dns01: obtaining certificate for %q: %w", m.hostname, err)
+		}
+	}
+	go m.renewLoop()
+	return nil
+}
+
+// setProvider replaces the DNS provider used for future challenges, such as
+// when the control server rotates the DNS credentials.
+func (m *dns01CertManager) setProvider(p dnsProvider) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.provider = p
+}
+
+func (m *dns01CertManager) dnsProvider() dnsProvider {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.provider
+}
+
+func (m *dns01CertManager) certPaths() (crtPath, keyPath string) {
+	keyname := unsafeHostnameCharacters.ReplaceAllString(m.hostname, "")
+	return filepath.Join(m.dir, keyname+".crt"), filepath.Join(m.dir, keyname+".key")
+}
+
+func (m *dns01CertManager) loadCert() error {
+	crtPath, keyPath := m.certPaths()
+	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return err
+	}
+	return m.setCert(&cert)
+}
+
+func (m *dns01CertManager) setCert(cert *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if err := leaf.VerifyHostname(m.hostname); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert, m.leaf = cert, leaf
+	return nil
+}
+
+func (m *dns01CertManager) needsRenewal(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leaf == nil || now.Add(dns01RenewBefore).After(m.leaf.NotAfter)
+}
+
+func (m *dns01CertManager) renewLoop() {
+	for {
+		time.Sleep(dns01CheckInterval)
+		if !m.needsRenewal(time.Now()) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		if err := m.obtainCert(ctx); err != nil {
+			m.logf("dns01: renewing certificate for %q: %v", m.hostname, err)
+		} else {
+			m.logf("dns01: renewed certificate for %q", m.hostname)
+		}
+		cancel()
+	}
+}
+
+func (m *dns01CertManager) acmeClient() (*acme.Client, error) {
+	k, err := m.accountKey()
+	if err != nil {
+		return nil, fmt.Errorf("account key: %w", err)
+	}
+	return &acme.Client{
+		Key:          k,
+		DirectoryURL: m.directoryURL,
+		UserAgent:    "derper/" + version.Long(),
+	}, nil
+}
+
+// accountKey returns the ACME account key, creating it if necessary.
+func (m *dns01CertManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.dir, "acme-account.key")
+	if b, err := os.ReadFile(path); err == nil {
+		p, _ := pem.Decode(b)
+		if p == nil {
+			return nil, fmt.Errorf("invalid PEM in %s", path)
+		}
+		return x509.ParseECPrivateKey(p.Bytes)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err := encodeECDSAKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func encodeECDSAKey(k *ecdsa.PrivateKey) ([]byte, error) {
+	b, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+}
+
+// obtainCert runs a full ACME order for m.hostname, answering the DNS-01
+// challenges through m.provider, and installs and saves the new certificate.
+func (m *dns01CertManager) obtainCert(ctx context.Context) error {
+	ac, err := m.acmeClient()
+	if err != nil {
+		return err
+	}
+	if _, err := ac.Register(ctx, new(acme.Account), acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("acme.Register: %w", err)
+	}
+
+	order, err := ac.AuthorizeOrder(ctx, acme.DomainIDs(m.hostname))
+	if err != nil {
+		return fmt.Errorf("acme.AuthorizeOrder: %w", err)
+	}
+	for _, aurl := range order.AuthzURLs {
+		if err := m.authorize(ctx, ac, aurl); err != nil {
+			return err
+		}
+	}
+	order, err = ac.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("acme.WaitOrder: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.hostname},
+		DNSNames: []string{m.hostname},
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	der, _, err := ac.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("acme.CreateOrderCert: %w", err)
+	}
+
+	var certPEM bytes.Buffer
+	for _, b := range der {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: b}); err != nil {
+			return err
+		}
+	}
+	keyPEM, err := encodeECDSAKey(certKey)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM.Bytes(), keyPEM)
+	if err != nil {
+		return err
+	}
+	if err := m.setCert(&cert); err != nil {
+		return err
+	}
+	crtPath, keyPath := m.certPaths()
+	if err := atomicfile.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(crtPath, certPEM.Bytes(), 0644)
+}
+
+// authorize completes the authorization at aurl with a DNS-01 challenge.
+func (m *dns01CertManager) authorize(ctx context.Context, ac *acme.Client, aurl string) error {
+	az, err := ac.GetAuthorization(ctx, aurl)
+	if err != nil {
+		return fmt.Errorf("acme.GetAuthorization: %w", err)
+	}
+	if az.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range az.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %q", az.Identifier.Value)
+	}
+	rec, err := ac.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + az.Identifier.Value
+	provider := m.dnsProvider()
+	if err := provider.SetTXT(ctx, name, rec); err != nil {
+		return fmt.Errorf("setting TXT record %q: %w", name, err)
+	}
+	defer func() {
+		if err := provider.RemoveTXT(context.WithoutCancel(ctx), name, rec); err != nil {
+			m.logf("dns01: removing TXT record %q: %v", name, err)
+		}
+	}()
+	m.waitPropagation(ctx, name, rec)
+
+	if _, err := ac.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acme.Accept: %w", err)
+	}
+	if _, err := ac.WaitAuthorization(ctx, az.URI); err != nil {
+		return fmt.Errorf("acme.WaitAuthorization: %w", err)
+	}
+	return nil
+}
+
+// waitPropagation waits, best effort, until the TXT record name has the
+// value rec in DNS.
+func (m *dns01CertManager) waitPropagation(ctx context.Context, name, rec string) {
+	if m.lookupTXT == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, dns01PropagationTimeout)
+	defer cancel()
+	for {
+		txts, _ := m.lookupTXT(ctx, name)
+		if slices.Contains(txts, rec) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			m.logf("dns01: TXT record %q not visible yet; trying anyway", name)
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (m *dns01CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{
+			"http/1.1",
+		},
+		GetCertificate: m.getCertificate,
+	}
+}
+
+func (m *dns01CertManager) getCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hi.ServerName != m.hostname {
+		return nil, fmt.Errorf("cert mismatch with hostname: %q", hi.ServerName)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Return a shallow copy of the cert so the caller can append to its
+	// Certificate field.
+	certCopy := new(tls.Certificate)
+	*certCopy = *m.cert
+	certCopy.Certificate = certCopy.Certificate[:len(certCopy.Certificate):len(certCopy.Certificate)]
+	return certCopy, nil
+}
+
+func (m *dns01CertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
@@ -0,0 +1,416 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+)
+
+// fakeACME is a minimal RFC 8555 CA with a single account, order,
+// authorization and dns-01 challenge. It doesn't verify JWS signatures.
+type fakeACME struct {
+	t        *testing.T
+	srv      *httptest.Server
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	validate func(domain, token string) bool // checks the challenge record
+
+	mu        sync.Mutex
+	domain    string
+	authzOK   bool
+	certPEM   []byte
+	numOrders int
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+	f := &fakeACME{t: t, caCert: caCert, caKey: caKey}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) dirURL() string { return f.srv.URL + "/dir" }
+
+func (f *fakeACME) orders() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.numOrders
+}
+
+func (f *fakeACME) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	base := f.srv.URL
+	w.Header().Set("Replay-Nonce", "nonce-"+time.Now().Format(time.RFC3339Nano))
+	if r.Method == "HEAD" {
+		return
+	}
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   base + "/nonce",
+			"newAccount": base + "/acct",
+			"newOrder":   base + "/order",
+		})
+		return
+	}
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON := func(code int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	order := func() map[string]any {
+		status := "pending"
+		if f.authzOK {
+			status = "ready"
+		}
+		if f.certPEM != nil {
+			status = "valid"
+		}
+		return map[string]any{
+			"status":         status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": f.domain}},
+			"authorizations": []string{base + "/authz/1"},
+			"finalize":       base + "/finalize/1",
+			"certificate":    base + "/cert/1",
+		}
+	}
+	switch r.URL.Path {
+	case "/acct":
+		w.Header().Set("Location", base+"/acct/1")
+		writeJSON(201, map[string]string{"status": "valid"})
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &req)
+		f.domain = req.Identifiers[0].Value
+		f.authzOK, f.certPEM = false, nil
+		f.numOrders++
+		w.Header().Set("Location", base+"/order/1")
+		writeJSON(201, order())
+	case "/order/1":
+		w.Header().Set("Location", base+"/order/1")
+		writeJSON(200, order())
+	case "/authz/1", "/chal/1":
+		if r.URL.Path == "/chal/1" && !f.authzOK {
+			f.authzOK = f.validate(f.domain, "tok")
+		}
+		status := "pending"
+		if f.authzOK {
+			status = "valid"
+		}
+		chal := map[string]string{"type": "dns-01", "url": base + "/chal/1", "token": "tok", "status": status}
+		if r.URL.Path == "/chal/1" {
+			writeJSON(200, chal)
+			return
+		}
+		writeJSON(200, map[string]any{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": f.domain},
+			"challenges": []any{chal},
+		})
+	case "/finalize/1":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || !f.authzOK {
+			http.Error(w, "bad finalize", 403)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, tmpl, f.caCert, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Errorf("signing cert: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		f.certPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+		w.Header().Set("Location", base+"/order/1")
+		writeJSON(200, order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeCloudflare is a stand-in for the Cloudflare DNS records API.
+type fakeCloudflare struct {
+	srv    *httptest.Server
+	mu     sync.Mutex
+	nextID int
+	recs   map[string]cloudflareRecord // by ID
+}
+
+func newFakeCloudflare(t *testing.T, zoneID, token string) *fakeCloudflare {
+	f := &fakeCloudflare{recs: map[string]cloudflareRecord{}}
+	prefix := "/zones/" + zoneID + "/dns_records"
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := func(code int, result any) {
+			w.WriteHeader(code)
+			b, _ := json.Marshal(result)
+			json.NewEncoder(w).Encode(cloudflareResponse{Success: code == 200, Result: b})
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			reply(403, nil)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch {
+		case r.Method == "POST" && r.URL.Path == prefix:
+			var rec cloudflareRecord
+			json.NewDecoder(r.Body).Decode(&rec)
+			f.nextID++
+			rec.ID = strings.Repeat("x", f.nextID)
+			f.recs[rec.ID] = rec
+			reply(200, rec)
+		case r.Method == "GET" && r.URL.Path == prefix:
+			var ret []cloudflareRecord
+			for _, rec := range f.recs {
+				if rec.Type == r.FormValue("type") && rec.Name == r.FormValue("name") {
+					ret = append(ret, rec)
+				}
+			}
+			reply(200, ret)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, prefix+"/"):
+			delete(f.recs, strings.TrimPrefix(r.URL.Path, prefix+"/"))
+			reply(200, nil)
+		default:
+			reply(404, nil)
+		}
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeCloudflare) txt(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ret []string
+	for _, rec := range f.recs {
+		if rec.Type == "TXT" && rec.Name == name {
+			ret = append(ret, rec.Content)
+		}
+	}
+	return ret
+}
+
+func TestDNS01CertManager(t *testing.T) {
+	const host = "derp1.example.com"
+	dir := t.TempDir()
+	ca := newFakeACME(t)
+	cf := newFakeCloudflare(t, "zone1", "secret-token")
+	ca.validate = func(domain, token string) bool {
+		// Check the record the provider published against the one the
+		// account key in certdir implies.
+		b, err := os.ReadFile(filepath.Join(dir, "acme-account.key"))
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		p, _ := pem.Decode(b)
+		k, err := x509.ParseECPrivateKey(p.Bytes)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		want, _ := (&acme.Client{Key: k}).DNS01ChallengeRecord(token)
+		got := cf.txt("_acme-challenge." + domain)
+		return len(got) == 1 && got[0] == want
+	}
+
+	provider, err := dnsProviderByName("cloudflare", "zone1", "secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.(*cloudflareProvider).baseURL = cf.srv.URL
+
+	newManager := func() *dns01CertManager {
+		m := &dns01CertManager{
+			hostname:     host,
+			dir:          dir,
+			directoryURL: ca.dirURL(),
+			provider:     provider,
+			logf:         t.Logf,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := m.init(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := newManager()
+	if got := ca.orders(); got != 1 {
+		t.Errorf("orders = %d; want 1", got)
+	}
+	cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		t.Error(err)
+	}
+	if _, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("got cert for wrong hostname")
+	}
+	if got := cf.txt("_acme-challenge." + host); len(got) != 0 {
+		t.Errorf("challenge records left behind: %q", got)
+	}
+
+	// A restart reuses the certificate on disk.
+	newManager()
+	if got := ca.orders(); got != 1 {
+		t.Errorf("after restart, orders = %d; want 1", got)
+	}
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	const (
+		keyName = "derper-key."
+		secret  = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	)
+	var (
+		mu   sync.Mutex
+		txts = map[string][]string{}
+	)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		switch req.Opcode {
+		case dns.OpcodeQuery:
+			m.Ns = []dns.RR{&dns.SOA{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns.example.com.", Mbox: "admin.example.com.", Serial: 1,
+			}}
+		case dns.OpcodeUpdate:
+			if req.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeNotAuth
+				break
+			}
+			mu.Lock()
+			for _, rr := range req.Ns {
+				txt := rr.(*dns.TXT)
+				name := txt.Hdr.Name
+				if txt.Hdr.Class == dns.ClassNONE {
+					txts[name] = nil
+				} else {
+					txts[name] = append(txts[name], txt.Txt...)
+				}
+			}
+			mu.Unlock()
+		}
+		if req.IsTsig() != nil && w.TsigStatus() == nil {
+			m.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w.WriteMsg(m)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener:   ln,
+		Handler:    handler,
+		TsigSecret: map[string]string{keyName: secret},
+		// The default accept func refuses UPDATE messages.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	ctx := context.Background()
+	p, err := dnsProviderByName("rfc2136", ln.Addr().String(), "hmac-sha256:"+keyName+":"+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "_acme-challenge.derp1.example.com"
+	if err := p.SetTXT(ctx, name, "value1"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got := txts[name+"."]
+	mu.Unlock()
+	if len(got) != 1 || got[0] != "value1" {
+		t.Errorf("after SetTXT, records = %q", got)
+	}
+	if err := p.RemoveTXT(ctx, name, "value1"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got = txts[name+"."]
+	mu.Unlock()
+	if len(got) != 0 {
+		t.Errorf("after RemoveTXT, records = %q", got)
+	}
+
+	// Updates signed with the wrong key are refused.
+	bad, _ := dnsProviderByName("rfc2136", ln.Addr().String(), keyName+":"+base64.StdEncoding.EncodeToString([]byte("wrong")))
+	if err := bad.SetTXT(ctx, name, "value2"); err == nil {
+		t.Error("update with wrong TSIG key succeeded")
+	}
+}
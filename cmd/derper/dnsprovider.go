@@ -0,0 +1,230 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsProvider creates and removes the TXT records needed to answer ACME
+// DNS-01 challenges.
+type dnsProvider interface {
+	// SetTXT creates a TXT record for fqdn with the given value.
+	SetTXT(ctx context.Context, fqdn, value string) error
+	// RemoveTXT removes a TXT record previously created by SetTXT.
+	RemoveTXT(ctx context.Context, fqdn, value string) error
+}
+
+// dnsProviderByName returns the dnsProvider for name, configured with the
+// provider specific id and secret key. These are the DNSProvider, DNSID and
+// DNSKey fields of a NaviNode in managed mode.
+func dnsProviderByName(name, id, key string) (dnsProvider, error) {
+	switch strings.ToLower(name) {
+	case "cloudflare":
+		if id == "" || key == "" {
+			return nil, errors.New("cloudflare DNS provider requires a zone ID and an API token")
+		}
+		return &cloudflareProvider{zoneID: id, token: key, baseURL: cloudflareAPI}, nil
+	case "rfc2136":
+		return newRFC2136Provider(id, key)
+	case "":
+		return nil, errors.New("no DNS provider configured")
+	default:
+		return nil, fmt.Errorf("unsupported DNS provider %q", name)
+	}
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareProvider is a dnsProvider using the Cloudflare v4 REST API.
+type cloudflareProvider struct {
+	zoneID  string
+	token   string // API token with DNS edit permission on the zone
+	baseURL string
+	hc      *http.Client // or nil for http.DefaultClient
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+type cloudflareResponse struct {
+	Success bool              `json:"success"`
+	Errors  []json.RawMessage `json:"errors"`
+	Result  json.RawMessage   `json:"result"`
+}
+
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := p.hc
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var cr cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&cr); err != nil {
+		return fmt.Errorf("cloudflare %s %s: http %d: %w", method, path, res.StatusCode, err)
+	}
+	if !cr.Success || res.StatusCode/100 != 2 {
+		return fmt.Errorf("cloudflare %s %s: http %d: %s", method, path, res.StatusCode, cr.Errors)
+	}
+	if out != nil {
+		return json.Unmarshal(cr.Result, out)
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) SetTXT(ctx context.Context, fqdn, value string) error {
+	rec := cloudflareRecord{Type: "TXT", Name: strings.TrimSuffix(fqdn, "."), Content: value, TTL: 120}
+	return p.do(ctx, "POST", "/zones/"+url.PathEscape(p.zoneID)+"/dns_records", rec, nil)
+}
+
+func (p *cloudflareProvider) RemoveTXT(ctx context.Context, fqdn, value string) error {
+	q := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(fqdn, ".")}}
+	var recs []cloudflareRecord
+	if err := p.do(ctx, "GET", "/zones/"+url.PathEscape(p.zoneID)+"/dns_records?"+q.Encode(), nil, &recs); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rec.Content != value {
+			continue
+		}
+		if err := p.do(ctx, "DELETE", "/zones/"+url.PathEscape(p.zoneID)+"/dns_records/"+url.PathEscape(rec.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rfc2136Provider is a dnsProvider sending RFC 2136 dynamic updates,
+// optionally signed with TSIG, to an authoritative nameserver.
+type rfc2136Provider struct {
+	server    string // host:port of the primary nameserver
+	keyName   string // TSIG key name, or empty for unsigned updates
+	keyAlg    string
+	keySecret string // base64
+}
+
+// newRFC2136Provider returns an RFC 2136 provider for server (the DNSID,
+// "host" or "host:port") using the TSIG key in nsupdate -y format,
+// "[alg:]name:secret" (the DNSKey). An empty key sends unsigned updates.
+func newRFC2136Provider(server, tsigKey string) (*rfc2136Provider, error) {
+	if server == "" {
+		return nil, errors.New("rfc2136 DNS provider requires a nameserver address")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	p := &rfc2136Provider{server: server}
+	if tsigKey != "" {
+		parts := strings.Split(tsigKey, ":")
+		switch len(parts) {
+		case 2:
+			p.keyAlg, p.keyName, p.keySecret = dns.HmacSHA256, parts[0], parts[1]
+		case 3:
+			p.keyAlg, p.keyName, p.keySecret = dns.Fqdn(parts[0]), parts[1], parts[2]
+		default:
+			return nil, errors.New(`rfc2136 TSIG key must be in the form "[alg:]name:secret"`)
+		}
+		p.keyName = dns.Fqdn(p.keyName)
+	}
+	return p, nil
+}
+
+func (p *rfc2136Provider) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if p.keyName != "" {
+		c.TsigSecret = map[string]string{p.keyName: p.keySecret}
+		m.SetTsig(p.keyName, p.keyAlg, 300, time.Now().Unix())
+	}
+	r, _, err := c.ExchangeContext(ctx, m, p.server)
+	return r, err
+}
+
+// findZone returns the zone containing fqdn, as reported by the SOA in the
+// nameserver's answer or authority section.
+func (p *rfc2136Provider) findZone(ctx context.Context, fqdn string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	r, err := p.exchange(ctx, m)
+	if err != nil {
+		return "", fmt.Errorf("rfc2136: SOA query for %s: %w", fqdn, err)
+	}
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("rfc2136: no SOA found for %s", fqdn)
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, insert bool) error {
+	fqdn = dns.Fqdn(fqdn)
+	zone, err := p.findZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	r, err := p.exchange(ctx, m)
+	if err != nil {
+		return fmt.Errorf("rfc2136: update %s: %w", fqdn, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: update %s: %s", fqdn, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) SetTXT(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *rfc2136Provider) RemoveTXT(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
@@ -0,0 +1,26 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+
+	"tailscale.com/derp"
+)
+
+// handleDrainSignals drains s whenever derper receives one of the
+// drainSignals, such as before the relay is taken down for maintenance.
+func handleDrainSignals(s *derp.Server) {
+	if len(drainSignals) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, drainSignals...)
+	for sig := range ch {
+		log.Printf("derper: received %v; draining clients over %v", sig, *drainWindow)
+		s.Drain(*drainWindow)
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var drainSignals = []os.Signal{syscall.SIGUSR1}
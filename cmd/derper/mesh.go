@@ -10,7 +10,9 @@
 	"log"
 	"net"
 	"net/netip"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"tailscale.com/derp"
@@ -36,11 +38,22 @@ func startMesh(s *derp.Server) error {
 
 func startMeshWithHost(s *derp.Server, host string) error {
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
-	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
+	c, err := newMeshClient(s, "https://"+host+"/derp", logf)
 	if err != nil {
 		return err
 	}
 	c.MeshKey = s.MeshKey()
+	go runMeshClient(context.Background(), s, c, logf)
+	return nil
+}
+
+// newMeshClient returns a client for meshing s with the DERP server at
+// url. The caller sets how it authenticates before running it.
+func newMeshClient(s *derp.Server, url string, logf logger.Logf) (*derphttp.Client, error) {
+	c, err := derphttp.NewClient(s.PrivateKey(), url, logf)
+	if err != nil {
+		return nil, err
+	}
 
 	// For meshed peers within a region, connect via VPC addresses.
 	c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -67,9 +80,94 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		}
 		return d.DialContext(ctx, network, addr)
 	})
+	return c, nil
+}
 
+// runMeshClient forwards packets for the peers connected to c's server
+// until ctx is done.
+func runMeshClient(ctx context.Context, s *derp.Server, c *derphttp.Client, logf logger.Logf) {
 	add := func(k key.NodePublic, _ netip.AddrPort) { s.AddPacketForwarder(k, c) }
 	remove := func(k key.NodePublic) { s.RemovePacketForwarder(k, c) }
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
-	return nil
+	c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, add, remove)
+}
+
+// naviMesh keeps a managed server meshed with the other relays of its
+// region, as reported by the control server. Peers authenticate with their
+// Navi keys, so no --mesh-psk-file is needed.
+type naviMesh struct {
+	s       *derp.Server
+	naviKey key.MachinePrivate
+
+	mu    sync.Mutex
+	links map[key.MachinePublic]*naviMeshLink
+}
+
+type naviMeshLink struct {
+	url    string
+	cancel context.CancelFunc
+	c      *derphttp.Client
+}
+
+func newNaviMesh(s *derp.Server, naviKey key.MachinePrivate) *naviMesh {
+	return &naviMesh{
+		s:       s,
+		naviKey: naviKey,
+		links:   map[key.MachinePublic]*naviMeshLink{},
+	}
+}
+
+// naviMeshURL returns the DERP URL of the region peer n, or "" if n
+// doesn't serve DERP.
+func naviMeshURL(n derp.NaviNode) string {
+	if n.NoDERP || n.HostName == "" {
+		return ""
+	}
+	port := n.DERPPort
+	if port == 0 {
+		port = 443
+	}
+	return "https://" + net.JoinHostPort(n.HostName, strconv.Itoa(port)) + "/derp"
+}
+
+// update connects to the peers that are new or whose URL changed and
+// disconnects from those no longer in peers.
+func (m *naviMesh) update(peers []derp.NaviNode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	want := map[key.MachinePublic]string{}
+	for _, p := range peers {
+		var k key.MachinePublic
+		if err := k.UnmarshalText([]byte(p.NaviKey)); err != nil {
+			continue
+		}
+		if url := naviMeshURL(p); url != "" {
+			want[k] = url
+		}
+	}
+	for k, l := range m.links {
+		if want[k] != l.url {
+			log.Printf("mesh: disconnecting from region peer %v (%s)", k.ShortString(), l.url)
+			l.cancel()
+			l.c.Close()
+			delete(m.links, k)
+		}
+	}
+	for k, url := range want {
+		if _, ok := m.links[k]; ok {
+			continue
+		}
+		logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", url))
+		c, err := newMeshClient(m.s, url, logf)
+		if err != nil {
+			log.Printf("mesh: region peer %v: %v", k.ShortString(), err)
+			continue
+		}
+		c.NaviMeshKey = m.naviKey
+		c.NaviMeshPeer = k
+		ctx, cancel := context.WithCancel(context.Background())
+		m.links[k] = &naviMeshLink{url: url, cancel: cancel, c: c}
+		log.Printf("mesh: connecting to region peer %v (%s)", k.ShortString(), url)
+		go runMeshClient(ctx, m.s, c, logf)
+	}
 }
@@ -0,0 +1,166 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"tailscale.com/derp"
+	"tailscale.com/metrics"
+	"tailscale.com/tsweb"
+)
+
+// newMetricsHandler returns the handler for /metrics, which serves the
+// metrics of s, the STUN server and the Go runtime in the Prometheus
+// format. Access is restricted like /debug/.
+func newMetricsHandler(s *derp.Server) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{
+		derpCollector{s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		labelMapCollector{
+			desc: prometheus.NewDesc("derper_stun_requests_total",
+				"STUN packets received, by disposition.", []string{"disposition"}, nil),
+			m: stunDisposition,
+		},
+		labelMapCollector{
+			desc: prometheus.NewDesc("derper_stun_binding_requests_total",
+				"STUN binding requests received, by address family.", []string{"family"}, nil),
+			m: stunAddrFamily,
+		},
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return tsweb.Protected(promhttp.HandlerFor(reg, promhttp.HandlerOpts{})), nil
+}
+
+var (
+	derpFrameBytesDesc = prometheus.NewDesc("derp_frame_bytes",
+		"Size of DERP frames by direction and frame type, excluding the frame header.", []string{"direction", "type"}, nil)
+	derpQueueDepthDesc = prometheus.NewDesc("derp_send_queue_depth",
+		"Number of packets already in a client's send queue when a packet is enqueued.", nil, nil)
+	derpQueueDelayDesc = prometheus.NewDesc("derp_send_queue_delay_seconds",
+		"Time packets spend in a client's send queue.", nil, nil)
+	derpConnectDesc = prometheus.NewDesc("derp_client_connect_seconds",
+		"Time from accepting a DERP connection to registering the client.", nil, nil)
+	derpDropsDesc = prometheus.NewDesc("derp_packets_dropped_total",
+		"Packets dropped, by reason and whether they were disco packets.", []string{"reason", "kind"}, nil)
+	derpMeshClientsDesc = prometheus.NewDesc("derp_mesh_clients",
+		"Connected mesh peers (other DERP servers of the region).", nil, nil)
+	derpRegionPeerUpDesc = prometheus.NewDesc("derp_region_peer_up",
+		"Whether a region peer reported by control is meshed with this server (managed mode).", []string{"peer"}, nil)
+	derpTrustNodesDesc = prometheus.NewDesc("derp_trust_nodes",
+		"Number of trusted nodes (managed mode).", nil, nil)
+	derpTrustEpochDesc = prometheus.NewDesc("derp_trust_epoch",
+		"Epoch of the trusted node list (managed mode).", nil, nil)
+	derpTrustSeqDesc = prometheus.NewDesc("derp_trust_seqnum",
+		"Sequence number of the last trust delta applied (managed mode).", nil, nil)
+	derpTrustStaleDesc = prometheus.NewDesc("derp_trust_stale",
+		"Whether the trusted node list comes from a snapshot not yet confirmed by control (managed mode).", nil, nil)
+	derpTrustLastPullDesc = prometheus.NewDesc("derp_trust_last_pull_timestamp_seconds",
+		"Time of the last full trusted node list pull from control (managed mode).", nil, nil)
+	derpTrustDeltaErrsDesc = prometheus.NewDesc("derp_trust_delta_errors_total",
+		"Trust delta pushes that were rejected or couldn't be applied (managed mode).", nil, nil)
+)
+
+// derpCollector exports the derp.MetricsSnapshot of a DERP server.
+type derpCollector struct {
+	s *derp.Server
+}
+
+// Describe implements prometheus.Collector.
+func (derpCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		derpFrameBytesDesc,
+		derpQueueDepthDesc,
+		derpQueueDelayDesc,
+		derpConnectDesc,
+		derpDropsDesc,
+		derpMeshClientsDesc,
+		derpRegionPeerUpDesc,
+		derpTrustNodesDesc,
+		derpTrustEpochDesc,
+		derpTrustSeqDesc,
+		derpTrustStaleDesc,
+		derpTrustLastPullDesc,
+		derpTrustDeltaErrsDesc,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c derpCollector) Collect(ch chan<- prometheus.Metric) {
+	ms := c.s.MetricsSnapshot()
+	for l, h := range ms.FrameBytes {
+		ch <- constHistogram(derpFrameBytesDesc, h, l.Direction, l.Type)
+	}
+	ch <- constHistogram(derpQueueDepthDesc, ms.QueueDepth)
+	ch <- constHistogram(derpQueueDelayDesc, ms.QueueDelay)
+	ch <- constHistogram(derpConnectDesc, ms.ConnectLatency)
+	for l, n := range ms.Drops {
+		ch <- prometheus.MustNewConstMetric(derpDropsDesc, prometheus.CounterValue, float64(n), l.Reason, l.Kind)
+	}
+	ch <- prometheus.MustNewConstMetric(derpMeshClientsDesc, prometheus.GaugeValue, float64(ms.MeshClients))
+
+	if !ms.Managed {
+		return
+	}
+	for id, up := range ms.RegionPeerUp {
+		ch <- prometheus.MustNewConstMetric(derpRegionPeerUpDesc, prometheus.GaugeValue, boolToFloat(up), id)
+	}
+	ch <- prometheus.MustNewConstMetric(derpTrustNodesDesc, prometheus.GaugeValue, float64(ms.TrustNodes))
+	ch <- prometheus.MustNewConstMetric(derpTrustEpochDesc, prometheus.GaugeValue, float64(ms.TrustEpoch))
+	ch <- prometheus.MustNewConstMetric(derpTrustSeqDesc, prometheus.GaugeValue, float64(ms.TrustSeq))
+	ch <- prometheus.MustNewConstMetric(derpTrustStaleDesc, prometheus.GaugeValue, boolToFloat(ms.TrustStale))
+	if !ms.TrustLastPull.IsZero() {
+		ch <- prometheus.MustNewConstMetric(derpTrustLastPullDesc, prometheus.GaugeValue,
+			float64(ms.TrustLastPull.UnixNano())/float64(time.Second))
+	}
+	ch <- prometheus.MustNewConstMetric(derpTrustDeltaErrsDesc, prometheus.CounterValue, float64(ms.TrustDeltaErrors))
+}
+
+func constHistogram(desc *prometheus.Desc, h derp.HistogramSnapshot, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Buckets))
+	for i, b := range h.Buckets {
+		buckets[b] = uint64(h.Counts[i])
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(h.Count), h.Sum, buckets, labels...)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// labelMapCollector exports the counters of a metrics.LabelMap, which are
+// also published as expvars, as a Prometheus counter with one label.
+type labelMapCollector struct {
+	desc *prometheus.Desc
+	m    *metrics.LabelMap
+}
+
+// Describe implements prometheus.Collector.
+func (c labelMapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c labelMapCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(v.Value()), kv.Key)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/derp"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/key"
+)
+
+// ipFamily restricts the listeners to a single address family. It is empty
+// for both, "4" for IPv4 only and "6" for IPv6 only.
+var ipFamily string
+
+// naviNetwork returns the network name to listen on for base ("tcp" or
+// "udp"), honoring the managed mode IPv4/IPv6 overrides.
+func naviNetwork(base string) string {
+	return base + ipFamily
+}
+
+// loadNaviKey reads the Navi machine key from path, generating and
+// persisting a new one if the file doesn't exist yet.
+func loadNaviKey(path string) (key.MachinePrivate, error) {
+	var k key.MachinePrivate
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		k = key.NewMachine()
+		b, err := k.MarshalText()
+		if err != nil {
+			return k, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return k, err
+		}
+		if err := atomicfile.WriteFile(path, b, 0600); err != nil {
+			return k, err
+		}
+		log.Printf("derper: generated new Navi machine key %v", k.Public().ShortString())
+		return k, nil
+	case err != nil:
+		return k, err
+	}
+	if err := k.UnmarshalText([]byte(strings.TrimSpace(string(b)))); err != nil {
+		return k, fmt.Errorf("invalid Navi machine key in %s: %w", path, err)
+	}
+	return k, nil
+}
+
+// startManaged registers s with the control server, applies the returned
+// NaviNode to the command line settings, meshes with the other relays of
+// its region and schedules the periodic pull of the trusted node list and
+// region peers. It's a no-op if --ctrl-url isn't set.
+func startManaged(s *derp.Server) error {
+	if *ctrlURL == "" {
+		return nil
+	}
+	if *naviID == "" {
+		return errors.New("--ctrl-url requires --navi-id")
+	}
+	if *naviKeyFile == "" {
+		*naviKeyFile = filepath.Join(filepath.Dir(*configPath), "navi.key")
+	}
+	if *naviTrustFile == "" {
+		*naviTrustFile = filepath.Join(filepath.Dir(*configPath), "navi-trust.json")
+	}
+	naviKey, err := loadNaviKey(*naviKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading Navi key: %w", err)
+	}
+	s.SetTrustSnapshotPath(*naviTrustFile)
+	if err := s.PrepareManaged(strings.TrimSuffix(*ctrlURL, "/"), *naviID, naviKey); err != nil {
+		return err
+	}
+	naviInfo, err := s.TryLogin()
+	if err != nil {
+		last, ok := s.LastNaviInfo()
+		if !ok {
+			return err
+		}
+		// Serve from the last-known-good config and trust list until
+		// the control server answers again.
+		log.Printf("derper: %v; serving stale trusted node list from %s", err, *naviTrustFile)
+		naviInfo = last
+		go refreshStaleTrustList(s)
+	}
+	var setIPv4, setIPv6 string
+	if err := s.UpdateNaviInfo(naviInfo,
+		hostname, addr, &setIPv4, &setIPv6, dnsProviderName, dnsID, dnsKey,
+		stunPort, quicPort,
+		runDERP, runSTUN,
+	); err != nil {
+		return err
+	}
+	if err := applyIPOverrides(s, setIPv4, setIPv6); err != nil {
+		return err
+	}
+	log.Printf("derper: managed by %s as %q in region %d (hostname %q, addr %q)",
+		*ctrlURL, *naviID, naviInfo.NaviRegionID, *hostname, *addr)
+
+	// Trust is decided by the control server from now on.
+	s.SetVerifyClient(true)
+	s.SetNaviInfoHook(func(n derp.NaviNode) ([]string, error) {
+		return reloadNaviInfo(s, n)
+	})
+
+	// Mesh with the other relays of the region as control reports them.
+	mesh := newNaviMesh(s, naviKey)
+	s.SetRegionPeersHook(mesh.update)
+	if err := s.PullRegionPeers(); err != nil {
+		log.Printf("derper: pulling region peers: %v", err)
+	}
+	mesh.update(s.RegionPeers())
+
+	if _, err := s.Cronjob.AddFunc(*naviPullCronjob, func() {
+		if err := s.PullNodesList(); err != nil {
+			log.Printf("derper: pulling trusted nodes: %v", err)
+		}
+		if err := s.PullRegionPeers(); err != nil {
+			log.Printf("derper: pulling region peers: %v", err)
+		}
+	}); err != nil {
+		return fmt.Errorf("invalid --navi-pull-cron %q: %w", *naviPullCronjob, err)
+	}
+	s.Cronjob.Start()
+	return nil
+}
+
+// naviIPFamily returns the ipFamily for the IPv4 and IPv6 settings of a
+// NaviNode. The value "none" disables the address family.
+func naviIPFamily(v4, v6 string) (string, error) {
+	no4, no6 := v4 == "none", v6 == "none"
+	switch {
+	case no4 && no6:
+		return "", errors.New("control server disabled both IPv4 and IPv6")
+	case no4:
+		return "6", nil
+	case no6:
+		return "4", nil
+	}
+	return "", nil
+}
+
+// naviIPs returns the addresses in the IPv4 and IPv6 settings of a
+// NaviNode. Either is the zero Addr if its setting isn't an address of its
+// family.
+func naviIPs(v4, v6 string) (ip4, ip6 netip.Addr) {
+	if ip, err := netip.ParseAddr(v4); err == nil && ip.Is4() {
+		ip4 = ip
+	}
+	if ip, err := netip.ParseAddr(v6); err == nil && ip.Is6() && !ip.Is4In6() {
+		ip6 = ip
+	}
+	return ip4, ip6
+}
+
+// isLocalIP reports whether ip is assigned to one of the host's interfaces.
+// It's a variable for tests.
+var isLocalIP = func(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if pfx, err := netip.ParsePrefix(a.String()); err == nil && pfx.Addr() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// naviListenIP returns the IP to listen on for the IPv4 and IPv6 settings
+// of a NaviNode: the address of the only enabled family, if it's one of the
+// host's, or else the zero Addr to listen on all addresses. Addresses that
+// aren't local, such as the public IP of a cloud VM behind 1:1 NAT, are
+// only advertised.
+func naviListenIP(v4, v6 string) netip.Addr {
+	ip4, ip6 := naviIPs(v4, v6)
+	switch {
+	case ip4.IsValid() && v6 == "none" && isLocalIP(ip4):
+		return ip4
+	case ip6.IsValid() && v4 == "none" && isLocalIP(ip6):
+		return ip6
+	}
+	return netip.Addr{}
+}
+
+// naviEndpoints returns the DERP addresses of the relay to report to the
+// control server for the IPv4 and IPv6 settings of a NaviNode, given its
+// listen address.
+func naviEndpoints(v4, v6, listenAddr string) []netip.AddrPort {
+	_, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil
+	}
+	var eps []netip.AddrPort
+	ip4, ip6 := naviIPs(v4, v6)
+	for _, ip := range []netip.Addr{ip4, ip6} {
+		if ip.IsValid() {
+			eps = append(eps, netip.AddrPortFrom(ip, uint16(port)))
+		}
+	}
+	return eps
+}
+
+// applyIPOverrides applies the IPv4 and IPv6 settings of a NaviNode. The
+// value "none" disables the address family; anything that isn't an address
+// of that family is ignored. Addresses are reported to the control server
+// as the relay's DERP endpoints, and listened on per naviListenIP.
+func applyIPOverrides(s *derp.Server, v4, v6 string) error {
+	fam, err := naviIPFamily(v4, v6)
+	if err != nil {
+		return err
+	}
+	ipFamily = fam
+	if ip := naviListenIP(v4, v6); ip.IsValid() {
+		_, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			return fmt.Errorf("invalid server address: %w", err)
+		}
+		*addr = net.JoinHostPort(ip.String(), port)
+		log.Printf("derper: listening on %v as set by the control server", ip)
+	}
+	if *runDERP {
+		eps := naviEndpoints(v4, v6, *addr)
+		s.SetNaviEndpoints(eps)
+		if len(eps) > 0 {
+			log.Printf("derper: advertising DERP endpoints %v", eps)
+		}
+	}
+	return nil
+}
+
+// refreshStaleTrustList retries pulling the trusted node list from the
+// control server until it succeeds, so a relay started from its snapshot
+// doesn't have to wait for the next cron tick.
+func refreshStaleTrustList(s *derp.Server) {
+	bo := backoff.NewBackoff("navi-pull", log.Printf, time.Minute)
+	for s.TrustListStale() {
+		err := s.PullNodesList()
+		if err == nil {
+			log.Printf("derper: control server reachable again; trusted node list refreshed")
+			return
+		}
+		bo.BackOff(context.Background(), err)
+	}
+}
+
+// dns01Manager is the cert provider when --certmode=dns01, so that DNS
+// credentials pushed by the control server can be applied without a restart.
+var dns01Manager *dns01CertManager
+
+// reloadNaviInfo is the derp.NaviInfoHook of s applying a NaviNode pushed by the
+// control server. The DNS provider settings and the advertised IPv4 and
+// IPv6 addresses take effect immediately; the returned fields only take
+// effect once derper is restarted, since they determine the listeners and
+// the certificate.
+func reloadNaviInfo(s *derp.Server, n derp.NaviNode) (needRestart []string, err error) {
+	host, a := *hostname, *addr
+	port, qport := *stunPort, *quicPort
+	var setIPv4, setIPv6, prov, id, key string
+	derpOn, stunOn := true, true
+	if err := s.UpdateNaviInfo(n,
+		&host, &a, &setIPv4, &setIPv6, &prov, &id, &key,
+		&port, &qport,
+		&derpOn, &stunOn,
+	); err != nil {
+		return nil, err
+	}
+	fam, err := naviIPFamily(setIPv4, setIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	curHost, curPort, _ := net.SplitHostPort(*addr)
+	_, newPort, _ := net.SplitHostPort(a)
+	var listenHost string
+	if ip := naviListenIP(setIPv4, setIPv6); ip.IsValid() {
+		listenHost = ip.String()
+	}
+
+	if host != *hostname {
+		needRestart = append(needRestart, "HostName")
+	}
+	if derpOn != *runDERP {
+		needRestart = append(needRestart, "NoDERP")
+	} else if derpOn && newPort != curPort {
+		needRestart = append(needRestart, "DERPPort")
+	}
+	if stunOn != *runSTUN {
+		needRestart = append(needRestart, "NoSTUN")
+	} else if stunOn && port != *stunPort {
+		needRestart = append(needRestart, "STUNPort")
+	}
+	if qport != *quicPort {
+		needRestart = append(needRestart, "QUICPort")
+	}
+	if fam != ipFamily || listenHost != curHost {
+		needRestart = append(needRestart, "IPv4", "IPv6")
+	}
+	if *runDERP {
+		// The advertised addresses don't depend on the listeners.
+		s.SetNaviEndpoints(naviEndpoints(setIPv4, setIPv6, *addr))
+	}
+
+	if prov != *dnsProviderName || id != *dnsID || key != *dnsKey {
+		if dns01Manager != nil {
+			p, err := dnsProviderByName(prov, id, key)
+			if err != nil {
+				return needRestart, fmt.Errorf("DNS provider: %w", err)
+			}
+			dns01Manager.setProvider(p)
+		}
+		*dnsProviderName, *dnsID, *dnsKey = prov, id, key
+		log.Printf("derper: DNS provider updated by control server to %q", prov)
+	}
+	if len(needRestart) > 0 {
+		log.Printf("derper: NaviNode changes to %v take effect after a restart", needRestart)
+	}
+	return needRestart, nil
+}
@@ -125,6 +125,7 @@ func Run(args []string) (err error) {
 			//			bugReportCmd,
 			//			licensesCmd,
 			exitNodeCmd,
+			dnsCmd,
 			updateCmd,
 		},
 		FlagSet:   rootfs,
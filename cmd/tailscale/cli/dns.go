@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/types/dnstype"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <subcommand> [flags]",
+	ShortHelp:  "Inspect MagicDNS",
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "log",
+			ShortUsage: "dns log [--follow] [--json]",
+			ShortHelp:  "Show the names MagicDNS resolved recently",
+			LongHelp: strings.TrimSpace(`
+"mirage dns log" prints the queries MagicDNS answered recently: the name and
+type asked for, the response code, how it was answered (from MagicDNS names,
+the cache, a policy rule, or an upstream resolver), how long that took, and
+who asked.
+
+With --follow, it keeps printing queries as they're answered.
+`),
+			Exec: runDNSLog,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("log")
+				fs.BoolVar(&dnsLogArgs.follow, "follow", false, "keep printing queries as they're answered")
+				fs.BoolVar(&dnsLogArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("dns subcommand required; run 'mirage dns -h' for details")
+	},
+}
+
+var dnsLogArgs struct {
+	follow bool
+	json   bool
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'mirage dns log'")
+	}
+	rc, err := localClient.StreamDNSQueryLog(ctx, dnsLogArgs.follow)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	defer rc.Close()
+	if dnsLogArgs.json {
+		_, err := io.Copy(Stdout, rc)
+		return err
+	}
+	dec := json.NewDecoder(rc)
+	for {
+		var e dnstype.QueryLogEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		outln(formatDNSQueryLogEntry(e))
+	}
+}
+
+// formatDNSQueryLogEntry returns e as a line for "mirage dns log".
+func formatDNSQueryLogEntry(e dnstype.QueryLogEntry) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s %s", e.Time.Local().Format("15:04:05.000"), e.Source.Addr(), e.Type, e.Name)
+	if e.RCode != "" {
+		fmt.Fprintf(&sb, " %s", e.RCode)
+	}
+	how := e.Resolution
+	if e.Upstream != "" {
+		how += " via " + e.Upstream
+	}
+	if how != "" {
+		fmt.Fprintf(&sb, " (%s)", how)
+	}
+	fmt.Fprintf(&sb, " %v", e.Latency.Round(time.Microsecond*100))
+	if e.Err != "" {
+		fmt.Fprintf(&sb, " error: %s", e.Err)
+	}
+	return sb.String()
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/types/dnstype"
+)
+
+func TestFormatDNSQueryLogEntry(t *testing.T) {
+	when := time.Date(2023, 10, 17, 12, 34, 56, 789_000_000, time.Local)
+	tests := []struct {
+		name string
+		e    dnstype.QueryLogEntry
+		want string
+	}{
+		{
+			name: "forward",
+			e: dnstype.QueryLogEntry{
+				Time:       when,
+				Source:     netip.MustParseAddrPort("100.64.0.2:53211"),
+				Name:       "example.com.",
+				Type:       "A",
+				RCode:      "NOERROR",
+				Resolution: dnstype.ResolutionForward,
+				Upstream:   "tls://dns.example.net",
+				Latency:    12345678 * time.Nanosecond,
+			},
+			want: "12:34:56.789 100.64.0.2 A example.com. NOERROR (forward via tls://dns.example.net) 12.3ms",
+		},
+		{
+			name: "local",
+			e: dnstype.QueryLogEntry{
+				Time:       when,
+				Source:     netip.MustParseAddrPort("127.0.0.1:1234"),
+				Name:       "peer.example.ts.net.",
+				Type:       "AAAA",
+				RCode:      "NOERROR",
+				Resolution: dnstype.ResolutionLocal,
+				Latency:    40 * time.Microsecond,
+			},
+			want: "12:34:56.789 127.0.0.1 AAAA peer.example.ts.net. NOERROR (local) 0s",
+		},
+		{
+			name: "error",
+			e: dnstype.QueryLogEntry{
+				Time:       when,
+				Source:     netip.MustParseAddrPort("127.0.0.1:1234"),
+				Name:       "slow.example.",
+				Type:       "TXT",
+				Resolution: dnstype.ResolutionForward,
+				Latency:    10 * time.Second,
+				Err:        "context deadline exceeded",
+			},
+			want: "12:34:56.789 127.0.0.1 TXT slow.example. (forward) 10s error: context deadline exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatDNSQueryLogEntry(tt.e); got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -143,8 +143,16 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	printf("\t* MappingVariesByDestIP: %v\n", report.MappingVariesByDestIP)
 	printf("\t* HairPinning: %v\n", report.HairPinning)
 	printf("\t* PortMapping: %v\n", portMapping(report))
+	if netcheckArgs.verbose {
+		printf("\t* NAT mapping: %v\n", natBehavior(report.MappingBehavior))
+		printf("\t* NAT filtering: %v\n", natBehavior(report.FilteringBehavior))
+		printf("\t* NAT mapping lifetime: %v\n", mappingLifetime(report))
+	}
 	if report.CaptivePortal != "" {
 		printf("\t* CaptivePortal: %v\n", report.CaptivePortal)
+		if report.CaptivePortalURL != "" {
+			printf("\t* CaptivePortalURL: %v\n", report.CaptivePortalURL)
+		}
 	}
 
 	// When DERP latency checking failed,
@@ -208,6 +216,26 @@ func portMapping(r *netcheck.Report) string {
 	return strings.Join(got, ", ")
 }
 
+func natBehavior(b netcheck.NATBehavior) string {
+	if b == "" {
+		return "unknown"
+	}
+	return string(b)
+}
+
+func mappingLifetime(r *netcheck.Report) string {
+	lo, hi := r.MappingLifetimeMin.Round(time.Second), r.MappingLifetimeMax.Round(time.Second)
+	switch {
+	case lo == 0 && hi == 0:
+		return "not measured"
+	case hi == 0:
+		return fmt.Sprintf("at least %v", lo)
+	case lo == 0:
+		return fmt.Sprintf("under %v", hi)
+	}
+	return fmt.Sprintf("between %v and %v", lo, hi)
+}
+
 func prodDERPMap(ctx context.Context, httpc *http.Client) (*tailcfg.DERPMap, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", ipn.DefaultControlURL+"/derpmap/default", nil)
 	if err != nil {
@@ -144,6 +144,8 @@ func runPing(ctx context.Context, args []string) error {
 		via := pr.Endpoint
 		if pr.DERPRegionID != 0 {
 			via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
+		} else if pr.PeerRelay != "" {
+			via = fmt.Sprintf("peer-relay(%s)", pr.PeerRelay)
 		}
 		if via == "" {
 			// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
@@ -12,6 +12,7 @@
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -21,13 +22,16 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ptr"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
 )
@@ -82,6 +86,30 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
   - To serve simple static text:
     $ tailscale serve https:8080 / text:"Hello, world!"
 
+  - To redirect requests elsewhere, with an optional status code:
+    $ tailscale serve --status=301 https /old/ redirect:https://example.com/new
+    The target may include ${HOST} and ${REQUEST_URI} from the request.
+
+  - To serve something for a limited time, after which it's removed:
+    $ tailscale serve --ttl=2h https /demo http://127.0.0.1:3000
+
+  - To only let some users, tagged nodes or nodes with a capability use a
+    mount point, replying 403 Forbidden to others:
+    $ tailscale serve --allow-from=alice@example.com --allow-from=tag:admin \
+        https /admin http://127.0.0.1:8080
+
+  - To balance requests over several local servers, skipping those that
+    fail health checks:
+    $ tailscale serve --backend=http://127.0.0.1:3001 --lb-policy=least-conn \
+        --health-check-path=/healthz https / http://127.0.0.1:3000
+
+  - To proxy to a gRPC or other HTTP/2 server without TLS (h2c):
+    $ tailscale serve https / h2c://127.0.0.1:50051
+
+  - To add and remove request or response headers for a mount point:
+    $ tailscale serve --add-response-header="Cache-Control: no-store" \
+        --remove-request-header=Cookie https / http://127.0.0.1:3000
+
   - To serve over HTTP (tailnet only):
     $ tailscale serve http:80 / http://127.0.0.1:3000
 
@@ -96,7 +124,13 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
     local plaintext server on port 80:
     $ tailscale serve tls-terminated-tcp:443 tcp://localhost:80
 `),
-		Exec:      e.runServe,
+		Exec: e.runServe,
+		FlagSet: e.newFlags("serve", func(fs *flag.FlagSet) {
+			e.addTTLFlag(fs)
+			e.addAllowFromFlag(fs)
+			e.addBackendPoolFlags(fs)
+			e.addWebHandlerFlags(fs)
+		}),
 		UsageFunc: usageFunc,
 		Subcommands: []*ffcli.Command{
 			{
@@ -148,6 +182,7 @@ type localServeClient interface {
 	QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error)
 	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error)
 	IncrementCounter(ctx context.Context, name string, delta int) error
+	ServeBackends(context.Context) ([]apitype.ServeBackendStatus, error)
 }
 
 // serveEnv is the environment the serve command runs within. All I/O should be
@@ -169,11 +204,29 @@ type serveEnv struct {
 	tlsTerminatedTCP string    // a TLS terminated TCP port
 	subcmd           serveMode // subcommand
 
+	// web handler flags, shared by v1 and v2
+	status                int         // HTTP status code for redirect and text handlers
+	addRequestHeaders     headerFlag  // request headers to set
+	removeRequestHeaders  stringsFlag // request headers to remove
+	addResponseHeaders    headerFlag  // response headers to set
+	removeResponseHeaders stringsFlag // response headers to remove
+
+	// new handler flags, shared by v1 and v2
+	ttl       time.Duration // how long until a new handler expires, or zero for never
+	allowFrom stringsFlag   // access rules for a new handler
+
+	// backend pool flags, shared by v1 and v2
+	backends            stringsFlag   // backends besides the target
+	lbPolicy            string        // ipn.BackendPool.Policy
+	healthCheckPath     string        // ipn.BackendPool.HealthCheckPath
+	healthCheckInterval time.Duration // ipn.BackendPool.HealthCheckIntervalSec, or zero for the default
+
 	lc localServeClient // localClient interface, specific to serve
 
 	// optional stuff for tests:
 	testFlagOut io.Writer
 	testStdout  io.Writer
+	testTimeNow func() time.Time
 }
 
 // getSelfDNSName returns the DNS name of the current node.
@@ -318,12 +371,21 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case ts == "redirect":
+		target, err := redirectTarget(source)
+		if err != nil {
+			return err
+		}
+		h.Redirect = target
 	case isProxyTarget(source):
 		t, err := expandProxyTarget(source)
 		if err != nil {
 			return err
 		}
 		h.Proxy = t
+		if h.Pool, err = e.backendPool(true, expandProxyTarget); err != nil {
+			return err
+		}
 	default: // assume path
 		if version.IsSandboxedMacOS() {
 			// don't allow path serving for now on macOS (2022-11-15)
@@ -346,6 +408,10 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 		}
 		h.Path = source
 	}
+	if err := e.applyWebHandlerFlags(h); err != nil {
+		return err
+	}
+	h.Expires = e.expiry()
 
 	cursc, err := e.lc.GetServeConfig(ctx)
 	if err != nil {
@@ -402,7 +468,8 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 func isProxyTarget(source string) bool {
 	if strings.HasPrefix(source, "http://") ||
 		strings.HasPrefix(source, "https://") ||
-		strings.HasPrefix(source, "https+insecure://") {
+		strings.HasPrefix(source, "https+insecure://") ||
+		strings.HasPrefix(source, "h2c://") {
 		return true
 	}
 	// support "localhost:3000", for example
@@ -509,10 +576,10 @@ func expandProxyTarget(source string) (string, error) {
 		return "", fmt.Errorf("parsing url: %w", err)
 	}
 	switch u.Scheme {
-	case "http", "https", "https+insecure":
+	case "http", "https", "https+insecure", "h2c":
 		// ok
 	default:
-		return "", fmt.Errorf("must be a URL starting with http://, https://, or https+insecure://")
+		return "", fmt.Errorf("must be a URL starting with http://, https://, https+insecure://, or h2c://")
 	}
 
 	port, err := strconv.ParseUint(u.Port(), 10, 16)
@@ -594,7 +661,15 @@ func (e *serveEnv) handleTCPServe(ctx context.Context, srcType string, srcPort u
 		return fmt.Errorf("cannot serve TCP; already serving web on %d", srcPort)
 	}
 
-	mak.Set(&sc.TCP, srcPort, &ipn.TCPPortHandler{TCPForward: fwdAddr})
+	allowFrom, err := e.allowedFrom()
+	if err != nil {
+		return err
+	}
+	pool, err := e.backendPool(false, expandTCPTarget)
+	if err != nil {
+		return err
+	}
+	mak.Set(&sc.TCP, srcPort, &ipn.TCPPortHandler{TCPForward: fwdAddr, Expires: e.expiry(), AllowFrom: allowFrom, Pool: pool})
 
 	dnsName, err := e.getSelfDNSName(ctx)
 	if err != nil {
@@ -650,7 +725,19 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return err
 	}
 	if e.json {
-		j, err := json.MarshalIndent(sc, "", "  ")
+		var v any = sc
+		if hasBackendPools(sc) {
+			// Include the health of the pools' backends.
+			backends, err := e.lc.ServeBackends(ctx)
+			if err != nil {
+				return err
+			}
+			v = struct {
+				*ipn.ServeConfig
+				Backends []apitype.ServeBackendStatus
+			}{sc, backends}
+		}
+		j, err := json.MarshalIndent(v, "", "  ")
 		if err != nil {
 			return err
 		}
@@ -706,12 +793,17 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 		if sc.AllowFunnel[hp] {
 			fStatus = "Funnel on"
 		}
-		printf("|-- tcp://%s (%s, %s)\n", hp, tlsStatus, fStatus)
+		printf("|-- tcp://%s (%s, %s)%s%s\n", hp, tlsStatus, fStatus, expiryDesc(h.Expires, time.Now()), allowFromDesc(h.AllowFrom))
 		for _, a := range st.TailscaleIPs {
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
 			printf("|-- tcp://%s\n", ipp)
 		}
 		printf("|--> tcp://%s\n", h.TCPForward)
+		if h.Pool != nil {
+			for _, b := range h.Pool.Backends {
+				printf("|--> tcp://%s\n", b)
+			}
+		}
 	}
 	return nil
 }
@@ -747,18 +839,6 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		printf("%s://%s%s (%s)\n", scheme, hostname, portPart, fStatus)
 	}
 	printf("%s://%s%s (%s)\n", scheme, host, portPart, fStatus)
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
-
 	var mounts []string
 	for k := range sc.Web[hp].Handlers {
 		mounts = append(mounts, k)
@@ -770,10 +850,291 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 
 	for _, m := range mounts {
 		h := sc.Web[hp].Handlers[m]
-		t, d := srvTypeAndDesc(h)
-		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
+		t, d := webHandlerTypeAndDesc(h)
+		printf("%s %s%s %-5s %s%s%s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d, expiryDesc(h.Expires, time.Now()), allowFromDesc(h.AllowFrom))
+	}
+
+	return nil
+}
+
+// webHandlerTypeAndDesc returns the kind of web handler h is, and a short
+// description of it, for status output.
+func webHandlerTypeAndDesc(h *ipn.HTTPHandler) (string, string) {
+	switch {
+	case h.Path != "":
+		return "path", h.Path
+	case h.Proxy != "" && h.Pool != nil:
+		d := strings.Join(append([]string{h.Proxy}, h.Pool.Backends...), ", ")
+		if h.Pool.Policy != "" {
+			d += " (" + h.Pool.Policy + ")"
+		}
+		return "proxy", d
+	case h.Proxy != "":
+		return "proxy", h.Proxy
+	case h.Text != "":
+		d := "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		if h.Status != 0 {
+			d = fmt.Sprintf("%d %s", h.Status, d)
+		}
+		return "text", d
+	case h.Redirect != "":
+		code := h.Status
+		if code == 0 {
+			code = http.StatusFound
+		}
+		return "redirect", fmt.Sprintf("%d %s", code, h.Redirect)
+	case h.Status != 0:
+		return "status", fmt.Sprintf("%d %s", h.Status, http.StatusText(h.Status))
+	}
+	return "", ""
+}
+
+// addTTLFlag registers the --ttl flag.
+func (e *serveEnv) addTTLFlag(fs *flag.FlagSet) {
+	fs.DurationVar(&e.ttl, "ttl", 0, "remove the handler after this long, e.g. 2h (default never)")
+}
+
+// expiry returns when a handler created now should expire, per --ttl, or
+// nil if it shouldn't.
+func (e *serveEnv) expiry() *time.Time {
+	if e.ttl <= 0 {
+		return nil
+	}
+	now := time.Now
+	if e.testTimeNow != nil {
+		now = e.testTimeNow
+	}
+	return ptr.To(now().Add(e.ttl).Truncate(time.Second))
+}
+
+// expiryDesc describes the expiry time t, if any, relative to now, for
+// status output. It returns the empty string if t is nil.
+func expiryDesc(t *time.Time, now time.Time) string {
+	if t == nil {
+		return ""
+	}
+	d := t.Sub(now)
+	if d <= 0 {
+		return " (expired)"
+	}
+	return fmt.Sprintf(" (expires in %v)", d.Round(time.Second))
+}
+
+// addAllowFromFlag registers the --allow-from flag.
+func (e *serveEnv) addAllowFromFlag(fs *flag.FlagSet) {
+	fs.Var(&e.allowFrom, "allow-from", `only allow tailnet peers matching this login name, "tag:<tag>" or "cap:<capability>" to use the handler; may be repeated (default everyone)`)
+}
+
+// allowedFrom returns the access rules for a new handler, per
+// --allow-from.
+func (e *serveEnv) allowedFrom() ([]string, error) {
+	for _, rule := range e.allowFrom {
+		if err := ipn.CheckServeAccessRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	return e.allowFrom, nil
+}
+
+// allowFromDesc describes the access rules of a handler, if any, for
+// status output.
+func allowFromDesc(rules []string) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	return " (allow from " + strings.Join(rules, ", ") + ")"
+}
+
+// addBackendPoolFlags registers the flags that configure load balancing
+// over several backends.
+func (e *serveEnv) addBackendPoolFlags(fs *flag.FlagSet) {
+	fs.Var(&e.backends, "backend", "another backend to balance proxy or TCP traffic over, in the same format as the target; may be repeated")
+	fs.StringVar(&e.lbPolicy, "lb-policy", "", `how to pick a backend: "round-robin" or "least-conn" (default round-robin)`)
+	fs.StringVar(&e.healthCheckPath, "health-check-path", "", "path to GET to check the health of proxy backends (default connect to them)")
+	fs.DurationVar(&e.healthCheckInterval, "health-check-interval", 0, fmt.Sprintf("how often to check the health of backends (default %ds)", ipn.DefaultHealthCheckIntervalSec))
+}
+
+// backendPool returns the backend pool for a new proxy (if web) or TCP
+// forwarding handler, per the --backend flags, or nil if there are no
+// more backends than the target. expand validates and expands each
+// backend like the target.
+func (e *serveEnv) backendPool(web bool, expand func(string) (string, error)) (*ipn.BackendPool, error) {
+	if len(e.backends) == 0 {
+		if e.lbPolicy != "" || e.healthCheckPath != "" || e.healthCheckInterval != 0 {
+			return nil, errors.New("--lb-policy and --health-check-* require --backend")
+		}
+		return nil, nil
+	}
+	p := &ipn.BackendPool{HealthCheckPath: e.healthCheckPath}
+	for _, b := range e.backends {
+		t, err := expand(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend %q: %w", b, err)
+		}
+		p.Backends = append(p.Backends, t)
+	}
+	switch e.lbPolicy {
+	case "", ipn.LBRoundRobin, ipn.LBLeastConn:
+		p.Policy = e.lbPolicy
+	default:
+		return nil, fmt.Errorf("invalid --lb-policy %q; must be %q or %q", e.lbPolicy, ipn.LBRoundRobin, ipn.LBLeastConn)
+	}
+	if p.HealthCheckPath != "" {
+		if !web {
+			return nil, errors.New("--health-check-path is only supported for proxy targets")
+		}
+		if !strings.HasPrefix(p.HealthCheckPath, "/") {
+			return nil, fmt.Errorf("invalid --health-check-path %q; must start with /", p.HealthCheckPath)
+		}
+	}
+	if d := e.healthCheckInterval; d != 0 {
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid --health-check-interval %v; must be at least 1s", d)
+		}
+		p.HealthCheckIntervalSec = int(d / time.Second)
+	}
+	return p, nil
+}
+
+// expandTCPTarget validates a TCP forwarding target such as
+// "tcp://localhost:22" and returns the address to forward to.
+func expandTCPTarget(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return "", err
 	}
+	if host != "localhost" && host != "127.0.0.1" {
+		return "", errors.New("must be one of localhost or 127.0.0.1")
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); p == 0 || err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return "127.0.0.1:" + port, nil
+}
+
+// hasBackendPools reports whether any handler of sc, including its
+// foreground configs, has a backend pool.
+func hasBackendPools(sc *ipn.ServeConfig) bool {
+	if sc == nil {
+		return false
+	}
+	for _, h := range sc.TCP {
+		if h.Pool != nil {
+			return true
+		}
+	}
+	for _, w := range sc.Web {
+		for _, h := range w.Handlers {
+			if h.Pool != nil {
+				return true
+			}
+		}
+	}
+	for _, fg := range sc.Foreground {
+		if hasBackendPools(fg) {
+			return true
+		}
+	}
+	return false
+}
+
+// addWebHandlerFlags registers the flags that customize a web handler.
+func (e *serveEnv) addWebHandlerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&e.status, "status", 0, "HTTP status code to reply with for redirect: and text: targets (default 302 and 200)")
+	fs.Var(&e.addRequestHeaders, "add-request-header", `request header to set, as "Name: value"; may be repeated`)
+	fs.Var(&e.removeRequestHeaders, "remove-request-header", "request header to remove; may be repeated")
+	fs.Var(&e.addResponseHeaders, "add-response-header", `response header to set, as "Name: value"; may be repeated`)
+	fs.Var(&e.removeResponseHeaders, "remove-response-header", "response header to remove; may be repeated")
+}
+
+// applyWebHandlerFlags applies the flags registered by addWebHandlerFlags
+// to the web handler h, whose target is already set.
+func (e *serveEnv) applyWebHandlerFlags(h *ipn.HTTPHandler) error {
+	if h.Proxy == "" && len(e.backends) > 0 {
+		return errors.New("--backend is only supported for proxy and TCP targets")
+	}
+	if e.status != 0 {
+		switch {
+		case h.Redirect != "":
+			if e.status < 300 || e.status > 399 {
+				return fmt.Errorf("invalid redirect status %d; must be 3xx", e.status)
+			}
+		case h.Text != "":
+			if e.status < 200 || e.status > 599 || http.StatusText(e.status) == "" {
+				return fmt.Errorf("invalid status %d", e.status)
+			}
+		default:
+			return errors.New("--status is only supported for redirect: and text: targets")
+		}
+		h.Status = e.status
+	}
+	h.AddRequestHeaders = e.addRequestHeaders
+	h.RemoveRequestHeaders = e.removeRequestHeaders
+	h.AddResponseHeaders = e.addResponseHeaders
+	h.RemoveResponseHeaders = e.removeResponseHeaders
+	allowFrom, err := e.allowedFrom()
+	if err != nil {
+		return err
+	}
+	h.AllowFrom = allowFrom
+	return nil
+}
+
+// redirectTarget returns the target URL of a "redirect:<url>" source. The
+// URL must be absolute http(s), or a path on the same host.
+func redirectTarget(source string) (string, error) {
+	target := strings.TrimPrefix(source, "redirect:")
+	// Check the URL with its placeholders filled in, as they aren't valid
+	// in a host.
+	u, err := url.Parse(strings.NewReplacer("${HOST}", "example.com", "${REQUEST_URI}", "/").Replace(target))
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect target %q: %w", target, err)
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		if u.Host == "" {
+			return "", fmt.Errorf("invalid redirect target %q: missing host", target)
+		}
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/"):
+	default:
+		return "", fmt.Errorf("invalid redirect target %q: must be an http(s) URL or an absolute path", target)
+	}
+	return target, nil
+}
+
+// headerFlag is a flag.Value for repeatable "Name: value" header flags.
+type headerFlag map[string]string
+
+func (f *headerFlag) String() string {
+	var hs []string
+	for k, v := range *f {
+		hs = append(hs, k+": "+v)
+	}
+	sort.Strings(hs)
+	return strings.Join(hs, ", ")
+}
+
+func (f *headerFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" {
+		return fmt.Errorf("invalid header %q; want \"Name: value\"", s)
+	}
+	mak.Set((*map[string]string)(f), http.CanonicalHeaderKey(k), strings.TrimSpace(v))
+	return nil
+}
+
+// stringsFlag is a flag.Value for repeatable string flags.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
 
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, http.CanonicalHeaderKey(strings.TrimSpace(s)))
 	return nil
 }
 
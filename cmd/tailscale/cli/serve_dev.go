@@ -19,6 +19,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -40,6 +41,7 @@ type commandInfo struct {
 var serveHelpCommon = strings.TrimSpace(`
 <target> can be a port number (e.g., 3000), a partial URL (e.g., localhost:3000), or a
 full URL including a path (e.g., http://localhost:3000/foo, https+insecure://localhost:3000/foo).
+Use an h2c:// URL (e.g., h2c://localhost:50051) for gRPC and other HTTP/2 servers without TLS.
 
 EXAMPLES
   - Mount a local web server at 127.0.0.1:3000 in the foreground:
@@ -120,7 +122,10 @@ func newServeDevCommand(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			fs.StringVar(&e.http, "http", "", "HTTP listener")
 			fs.StringVar(&e.tcp, "tcp", "", "TCP listener")
 			fs.StringVar(&e.tlsTerminatedTCP, "tls-terminated-tcp", "", "TLS terminated TCP listener")
-
+			e.addTTLFlag(fs)
+			e.addAllowFromFlag(fs)
+			e.addBackendPoolFlags(fs)
+			e.addWebHandlerFlags(fs)
 		}),
 		UsageFunc: usageFunc,
 		Subcommands: []*ffcli.Command{
@@ -179,6 +184,10 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 		}
 
 		funnel := subcmd == funnel
+		if funnel && len(e.allowFrom) > 0 {
+			// Funnel traffic has no tailnet identity to match.
+			return errors.New("--allow-from is not supported with funnel")
+		}
 		if funnel {
 			// verify node has funnel capabilities
 			if err := e.verifyFunnelEnabled(ctx, st, 443); err != nil {
@@ -408,18 +417,6 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 		return output.String()
 	}
 
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
-
 	if sc.Web[hp] != nil {
 		var mounts []string
 
@@ -433,8 +430,8 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 
 		for _, m := range mounts {
 			h := sc.Web[hp].Handlers[m]
-			t, d := srvTypeAndDesc(h)
-			output.WriteString(fmt.Sprintf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d))
+			t, d := webHandlerTypeAndDesc(h)
+			output.WriteString(fmt.Sprintf("%s %s%s %-5s %s%s%s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d, expiryDesc(h.Expires, time.Now()), allowFromDesc(h.AllowFrom)))
 		}
 	} else if sc.TCP[srvPort] != nil {
 		h := sc.TCP[srvPort]
@@ -444,12 +441,17 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			tlsStatus = "TLS terminated"
 		}
 
-		output.WriteString(fmt.Sprintf("|-- tcp://%s (%s)\n", hp, tlsStatus))
+		output.WriteString(fmt.Sprintf("|-- tcp://%s (%s)%s%s\n", hp, tlsStatus, expiryDesc(h.Expires, time.Now()), allowFromDesc(h.AllowFrom)))
 		for _, a := range st.TailscaleIPs {
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(srvPort)))
 			output.WriteString(fmt.Sprintf("|-- tcp://%s\n", ipp))
 		}
 		output.WriteString(fmt.Sprintf("|--> tcp://%s\n", h.TCPForward))
+		if h.Pool != nil {
+			for _, b := range h.Pool.Backends {
+				output.WriteString(fmt.Sprintf("|--> tcp://%s\n", b))
+			}
+		}
 	}
 
 	output.WriteString("\nServe started and running in the background.\n")
@@ -468,6 +470,12 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case strings.HasPrefix(target, "redirect:"):
+		t, err := redirectTarget(target)
+		if err != nil {
+			return err
+		}
+		h.Redirect = t
 	case filepath.IsAbs(target):
 		if version.IsSandboxedMacOS() {
 			// don't allow path serving for now on macOS (2022-11-15)
@@ -493,7 +501,14 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return err
 		}
 		h.Proxy = t
+		if h.Pool, err = e.backendPool(true, expandProxyTargetDev); err != nil {
+			return err
+		}
+	}
+	if err := e.applyWebHandlerFlags(h); err != nil {
+		return err
 	}
+	h.Expires = e.expiry()
 
 	// TODO: validation needs to check nested foreground configs
 	if sc.IsTCPForwardingOnPort(srvPort) {
@@ -565,7 +580,15 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 		return fmt.Errorf("cannot serve TCP; already serving web on %d", srcPort)
 	}
 
-	mak.Set(&sc.TCP, srcPort, &ipn.TCPPortHandler{TCPForward: fwdAddr})
+	allowFrom, err := e.allowedFrom()
+	if err != nil {
+		return err
+	}
+	pool, err := e.backendPool(false, expandTCPTarget)
+	if err != nil {
+		return err
+	}
+	mak.Set(&sc.TCP, srcPort, &ipn.TCPPortHandler{TCPForward: fwdAddr, Expires: e.expiry(), AllowFrom: allowFrom, Pool: pool})
 
 	if terminateTLS {
 		sc.TCP[srcPort].TerminateTLS = dnsName
@@ -729,6 +752,7 @@ func (e *serveEnv) removeTCPServe(sc *ipn.ServeConfig, src uint16) error {
 //   - https://localhost:3000
 //   - https-insecure://localhost:3000
 //   - https-insecure://localhost:3000/foo
+//   - h2c://localhost:50051
 func expandProxyTargetDev(target string) (string, error) {
 	var (
 		scheme = "http"
@@ -753,9 +777,9 @@ func expandProxyTargetDev(target string) (string, error) {
 
 	// ensure a supported scheme
 	switch u.Scheme {
-	case "http", "https", "https+insecure":
+	case "http", "https", "https+insecure", "h2c":
 	default:
-		return "", errors.New("must be a URL starting with http://, https://, or https+insecure://")
+		return "", errors.New("must be a URL starting with http://, https://, https+insecure://, or h2c://")
 	}
 
 	// validate the port
@@ -682,6 +682,24 @@ type step struct {
 		},
 	})
 
+	// redirects and header rules
+	add(step{reset: true})
+	add(step{
+		command: cmd("serve --bg --set-path=/docs --status=308 --add-response-header=X-Frame-Options:DENY redirect:https://docs.example.com/"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/docs": {
+						Redirect:           "https://docs.example.com/",
+						Status:             308,
+						AddResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+					},
+				}},
+			},
+		},
+	})
+
 	// // error states
 	add(step{reset: true})
 	add(step{ // tcp forward 5432 on serve port 443
@@ -966,6 +984,7 @@ func TestExpandProxyTargetDev(t *testing.T) {
 		{input: "http://127.0.0.1:8080/foo", expected: "http://127.0.0.1:8080/foo"},
 		{input: "https://localhost:8080", expected: "https://127.0.0.1:8080"},
 		{input: "https+insecure://localhost:8080", expected: "https+insecure://127.0.0.1:8080"},
+		{input: "h2c://localhost:50051", expected: "h2c://127.0.0.1:50051"},
 
 		// errors
 		{input: "localhost:9999999", wantErr: true},
@@ -6,6 +6,7 @@
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,13 +16,16 @@
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/ptr"
 )
 
 func TestCleanMountPoint(t *testing.T) {
@@ -296,6 +300,22 @@ type step struct {
 		},
 	})
 	add(step{reset: true})
+	add(step{
+		command: cmd("https:443 / h2c://localhost:50051"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "h2c://127.0.0.1:50051"},
+				}},
+			},
+		},
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("https:443 / h2c://example.com:50051"),
+		wantErr: anyErr(),
+	})
 	add(step{
 		command: cmd("https:443 /foo localhost:3000"),
 		want: &ipn.ServeConfig{
@@ -650,6 +670,181 @@ type step struct {
 		},
 	})
 
+	// redirects, status codes and header rules
+	add(step{reset: true})
+	add(step{
+		command: cmd("--status=301 https:443 /old/ redirect:https://${HOST}/new${REQUEST_URI}"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old/": {Redirect: "https://${HOST}/new${REQUEST_URI}", Status: 301},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--status=404 https:443 /missing text:nope"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old/":    {Redirect: "https://${HOST}/new${REQUEST_URI}", Status: 301},
+					"/missing": {Text: "nope", Status: 404},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--add-request-header=x-env:prod --remove-request-header=cookie --add-response-header=Cache-Control:no-store --remove-response-header=Server https:443 / localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old/":    {Redirect: "https://${HOST}/new${REQUEST_URI}", Status: 301},
+					"/missing": {Text: "nope", Status: 404},
+					"/": {
+						Proxy:                 "http://127.0.0.1:3000",
+						AddRequestHeaders:     map[string]string{"X-Env": "prod"},
+						RemoveRequestHeaders:  []string{"Cookie"},
+						AddResponseHeaders:    map[string]string{"Cache-Control": "no-store"},
+						RemoveResponseHeaders: []string{"Server"},
+					},
+				}},
+			},
+		},
+	})
+	add(step{ // redirect status must be 3xx
+		command: cmd("--status=200 https:443 /r redirect:/elsewhere"),
+		wantErr: anyErr(),
+	})
+	add(step{ // status isn't for proxies
+		command: cmd("--status=404 https:443 /p localhost:3001"),
+		wantErr: anyErr(),
+	})
+	add(step{ // redirect target must be absolute
+		command: cmd("https:443 /r redirect:elsewhere"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("--add-request-header=bogus https:443 /p localhost:3001"),
+		wantErr: anyErr(),
+	})
+
+	// time-limited handlers
+	add(step{reset: true})
+	add(step{
+		command: cmd("--ttl=2h https:443 /demo http://127.0.0.1:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/demo": {Proxy: "http://127.0.0.1:3000", Expires: ptr.To(testServeNow.Add(2 * time.Hour))},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--ttl=30m tcp:2222 tcp://localhost:22"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true},
+				2222: {TCPForward: "127.0.0.1:22", Expires: ptr.To(testServeNow.Add(30 * time.Minute))},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/demo": {Proxy: "http://127.0.0.1:3000", Expires: ptr.To(testServeNow.Add(2 * time.Hour))},
+				}},
+			},
+		},
+	})
+
+	// access rules
+	add(step{reset: true})
+	add(step{
+		command: cmd("--allow-from=alice@example.com --allow-from=tag:admin https:443 /admin http://127.0.0.1:8080"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/admin": {Proxy: "http://127.0.0.1:8080", AllowFrom: []string{"alice@example.com", "tag:admin"}},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--allow-from=cap:example.com/cap/db tcp:5432 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true},
+				5432: {TCPForward: "127.0.0.1:5432", AllowFrom: []string{"cap:example.com/cap/db"}},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/admin": {Proxy: "http://127.0.0.1:8080", AllowFrom: []string{"alice@example.com", "tag:admin"}},
+				}},
+			},
+		},
+	})
+	add(step{ // not a login name, tag or capability
+		command: cmd("--allow-from=alice https:443 /alice http://127.0.0.1:8080"),
+		wantErr: anyErr(),
+	})
+
+	// backend pools
+	add(step{reset: true})
+	add(step{
+		command: cmd("--backend=localhost:3001 --backend=http://127.0.0.1:3002 --lb-policy=least-conn --health-check-path=/healthz --health-check-interval=30s https:443 / http://127.0.0.1:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", Pool: &ipn.BackendPool{
+						Backends:               []string{"http://127.0.0.1:3001", "http://127.0.0.1:3002"},
+						Policy:                 ipn.LBLeastConn,
+						HealthCheckPath:        "/healthz",
+						HealthCheckIntervalSec: 30,
+					}},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--backend=tcp://localhost:2223 tcp:2222 tcp://localhost:22"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true},
+				2222: {TCPForward: "127.0.0.1:22", Pool: &ipn.BackendPool{Backends: []string{"127.0.0.1:2223"}}},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", Pool: &ipn.BackendPool{
+						Backends:               []string{"http://127.0.0.1:3001", "http://127.0.0.1:3002"},
+						Policy:                 ipn.LBLeastConn,
+						HealthCheckPath:        "/healthz",
+						HealthCheckIntervalSec: 30,
+					}},
+				}},
+			},
+		},
+	})
+	add(step{ // HTTP health checks need a proxy target
+		command: cmd("--backend=tcp://localhost:2225 --health-check-path=/ tcp:2224 tcp://localhost:22"),
+		wantErr: anyErr(),
+	})
+	add(step{ // unknown policy
+		command: cmd("--backend=localhost:3001 --lb-policy=random https:443 /x http://127.0.0.1:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // pool options without backends
+		command: cmd("--lb-policy=least-conn https:443 /x http://127.0.0.1:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // only proxies have backends
+		command: cmd("--backend=localhost:3001 https:443 /x text:hi"),
+		wantErr: anyErr(),
+	})
+
 	// error states
 	add(step{reset: true})
 	add(step{ // tcp forward 5432 on serve port 443
@@ -705,6 +900,7 @@ type step struct {
 			lc:          lc,
 			testFlagOut: &flagOut,
 			testStdout:  &stdout,
+			testTimeNow: func() time.Time { return testServeNow },
 		}
 		lastCount := lc.setCount
 		var cmd *ffcli.Command
@@ -847,6 +1043,7 @@ type fakeLocalServeClient struct {
 	config               *ipn.ServeConfig
 	setCount             int                       // counts calls to SetServeConfig
 	queryFeatureResponse *mockQueryFeatureResponse // mock response to QueryFeature calls
+	backends             []apitype.ServeBackendStatus
 }
 
 // fakeStatus is a fake ipnstate.Status value for tests.
@@ -897,6 +1094,10 @@ func (lc *fakeLocalServeClient) WatchIPNBus(ctx context.Context, mask ipn.Notify
 	return nil, nil // unused in tests
 }
 
+func (lc *fakeLocalServeClient) ServeBackends(ctx context.Context) ([]apitype.ServeBackendStatus, error) {
+	return lc.backends, nil
+}
+
 func (lc *fakeLocalServeClient) IncrementCounter(ctx context.Context, name string, delta int) error {
 	return nil // unused in tests
 }
@@ -922,6 +1123,70 @@ func anyErr() func(error) string {
 	}
 }
 
+func TestServeStatusJSONBackends(t *testing.T) {
+	lc := &fakeLocalServeClient{
+		config: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				2222: {TCPForward: "127.0.0.1:22", Pool: &ipn.BackendPool{Backends: []string{"127.0.0.1:2223"}}},
+			},
+		},
+		backends: []apitype.ServeBackendStatus{
+			{Handler: "tcp:2222", Backend: "127.0.0.1:22", Healthy: true},
+			{Handler: "tcp:2222", Backend: "127.0.0.1:2223", LastError: "connection refused"},
+		},
+	}
+	var stdout bytes.Buffer
+	e := &serveEnv{lc: lc, json: true, testStdout: &stdout}
+	if err := e.runServeStatus(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ipn.ServeConfig
+		Backends []apitype.ServeBackendStatus
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("%v; output: %s", err, stdout.Bytes())
+	}
+	if !reflect.DeepEqual(got.ServeConfig.TCP, lc.config.TCP) {
+		t.Errorf("TCP = %v; want %v", got.ServeConfig.TCP, lc.config.TCP)
+	}
+	if !reflect.DeepEqual(got.Backends, lc.backends) {
+		t.Errorf("Backends = %+v; want %+v", got.Backends, lc.backends)
+	}
+
+	// Without pools, the output is just the config.
+	lc.config.TCP[2222].Pool = nil
+	stdout.Reset()
+	if err := e.runServeStatus(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stdout.String(), "Backends") {
+		t.Errorf("output without pools has backends: %s", stdout.Bytes())
+	}
+}
+
+// testServeNow is the current time as seen by serve commands in tests.
+var testServeNow = time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+func TestExpiryDesc(t *testing.T) {
+	now := testServeNow
+	tests := []struct {
+		expires *time.Time
+		want    string
+	}{
+		{nil, ""},
+		{ptr.To(now.Add(2 * time.Hour)), " (expires in 2h0m0s)"},
+		{ptr.To(now.Add(90*time.Second + 300*time.Millisecond)), " (expires in 1m30s)"},
+		{ptr.To(now), " (expired)"},
+		{ptr.To(now.Add(-time.Minute)), " (expired)"},
+	}
+	for _, tt := range tests {
+		if got := expiryDesc(tt.expires, now); got != tt.want {
+			t.Errorf("expiryDesc(%v) = %q; want %q", tt.expires, got, tt.want)
+		}
+	}
+}
+
 func cmd(s string) []string {
 	return strings.Fields(s)
 }
@@ -139,6 +139,7 @@ func defaultPort() uint16 {
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
 	disableLogs    bool
+	pathPrefs      string // see magicsock.Options.PathPrefs
 }
 
 var (
@@ -175,6 +176,7 @@ func main() {
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	//	flag.BoolVar(&args.disableLogs, "no-logs-no-support", true, "disable log uploads; this also disables any technical support")
 	flag.StringVar(&args.confFile, "config", "", "path to config file")
+	flag.StringVar(&args.pathPrefs, "path-prefs", "", `optional comma-separated peer=preference pairs pinning the kind of UDP path to use to peers, where peer is a Tailscale IP, a node name or "*" for all others, and preference is "ipv4", "ipv6" or a local interface name (e.g. "laptop=eth0,*=ipv4")`)
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "mirage" && beCLI != nil {
 		beCLI()
@@ -623,6 +625,7 @@ func handleSubnetsInNetstack() bool {
 func tryEngine(logf logger.Logf, sys *tsd.System, name string) (onlyNetstack bool, err error) {
 	conf := wgengine.Config{
 		ListenPort:   args.port,
+		PathPrefs:    args.pathPrefs,
 		NetMon:       sys.NetMon.Get(),
 		Dialer:       sys.Dialer.Get(),
 		SetSubsystem: sys.Set,
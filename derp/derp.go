@@ -117,6 +117,14 @@
 	// and how long to try total. See ServerRestartingMessage docs for
 	// more details on how the client should interpret them.
 	frameRestarting = frameType(0x15)
+
+	// frameDraining is sent from server to client when the server
+	// is being drained ahead of maintenance: it no longer accepts
+	// new clients and will close this connection soon. The client
+	// should make another region its home. Payload is a big endian
+	// uint32 duration in milliseconds until the server closes the
+	// connection. See ServerDrainingMessage.
+	frameDraining = frameType(0x16)
 )
 
 // PeerGoneReasonType is a one byte reason code explaining why a
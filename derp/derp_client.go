@@ -34,6 +34,9 @@ type Client struct {
 	canAckPings bool
 	isProber    bool
 
+	naviMeshKey  key.MachinePrivate // or zero
+	naviMeshPeer key.MachinePublic  // Navi key of the server, if naviMeshKey is set
+
 	wmu  sync.Mutex // hold while writing to bw
 	bw   *bufio.Writer
 	rate *rate.Limiter // if non-nil, rate limiter to use
@@ -60,6 +63,9 @@ type clientOpt struct {
 	ServerPub   key.NodePublic
 	CanAckPings bool
 	IsProber    bool
+
+	NaviMeshKey  key.MachinePrivate
+	NaviMeshPeer key.MachinePublic
 }
 
 // MeshKey returns a ClientOpt to pass to the DERP server during connect to get
@@ -107,6 +113,9 @@ func newClient(privateKey key.NodePrivate, nc Conn, brw *bufio.ReadWriter, logf
 		canAckPings: opt.CanAckPings,
 		isProber:    opt.IsProber,
 		clock:       tstime.StdClock{},
+
+		naviMeshKey:  opt.NaviMeshKey,
+		naviMeshPeer: opt.NaviMeshPeer,
 	}
 	if opt.ServerPub.IsZero() {
 		if err := c.recvServerKey(); err != nil {
@@ -175,15 +184,28 @@ type clientInfo struct {
 
 	// IsProber is whether this client is a prober.
 	IsProber bool `json:",omitempty"`
+
+	// NaviMesh optionally lets a managed DERP server join the mesh
+	// of another server in its region instead of using MeshKey.
+	// See NaviMeshAuth.
+	NaviMesh *naviMeshInfo `json:"naviMesh,omitempty"`
 }
 
 func (c *Client) sendClientKey() error {
-	msg, err := json.Marshal(clientInfo{
+	info := clientInfo{
 		Version:     ProtocolVersion,
 		MeshKey:     c.meshKey,
 		CanAckPings: c.canAckPings,
 		IsProber:    c.isProber,
-	})
+	}
+	if !c.naviMeshKey.IsZero() {
+		nm, err := newNaviMeshInfo(c.naviMeshKey, c.naviMeshPeer, c.publicKey, c.serverKey, c.clock.Now())
+		if err != nil {
+			return err
+		}
+		info.NaviMesh = nm
+	}
+	msg, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
@@ -445,6 +467,16 @@ type ServerRestartingMessage struct {
 
 func (ServerRestartingMessage) msg() {}
 
+// ServerDrainingMessage is a one-way message from server to client,
+// advertising that the server is being drained and won't accept new
+// connections. The client should move its home to another region.
+type ServerDrainingMessage struct {
+	// CloseIn is how long until the server closes this connection.
+	CloseIn time.Duration
+}
+
+func (ServerDrainingMessage) msg() {}
+
 // Recv reads a message from the DERP server.
 //
 // The returned message may alias memory owned by the Client; it
@@ -601,6 +633,15 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			m.ReconnectIn = time.Duration(binary.BigEndian.Uint32(b[0:4])) * time.Millisecond
 			m.TryFor = time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Millisecond
 			return m, nil
+
+		case frameDraining:
+			if n < 4 {
+				c.logf("[unexpected] dropping short server draining frame")
+				continue
+			}
+			return ServerDrainingMessage{
+				CloseIn: time.Duration(binary.BigEndian.Uint32(b[0:4])) * time.Millisecond,
+			}, nil
 		}
 	}
 }
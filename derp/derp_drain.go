@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"math/rand"
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+// defaultDrainWindow is how long Drain spreads out closing client
+// connections if neither its argument nor Server.DrainWindow is set.
+const defaultDrainWindow = 5 * time.Minute
+
+// SetDraining sets whether the server refuses new client connections.
+// Mesh peers are always accepted. Existing connections aren't affected,
+// except that SetDraining(false) stops an in-progress Drain, leaving the
+// connections it hasn't closed yet open.
+func (s *Server) SetDraining(v bool) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if !v {
+		s.stopDrainLocked()
+	}
+	if s.draining.Swap(v) != v {
+		s.logf("derp: draining=%v", v)
+	}
+}
+
+// Draining reports whether the server refuses new client connections.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+func (s *Server) stopDrainLocked() {
+	if s.drainStop != nil {
+		close(s.drainStop)
+		s.drainStop = nil
+	}
+}
+
+// Drain takes the server out of service gracefully ahead of maintenance.
+// It stops accepting new clients, tells each connected client (with a
+// frameDraining) to make another region its home and when its connection
+// will be closed, then closes the connections one at a time, spread evenly
+// over window. This avoids the thundering herd of every client reconnecting
+// at once. If window is zero, s.DrainWindow or defaultDrainWindow is used.
+//
+// Mesh peers are neither notified nor disconnected, so packets keep being
+// forwarded between clients that remain here and their peers elsewhere in
+// the region.
+//
+// Drain returns immediately. Calling it again restarts the drain with the
+// new window for the clients still connected.
+func (s *Server) Drain(window time.Duration) {
+	if window <= 0 {
+		window = s.DrainWindow
+	}
+	if window <= 0 {
+		window = defaultDrainWindow
+	}
+
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	s.stopDrainLocked()
+	s.draining.Store(true)
+
+	var victims []*sclient
+	s.mu.Lock()
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if !c.canMesh {
+				victims = append(victims, c)
+			}
+		})
+	}
+	s.mu.Unlock()
+	rand.Shuffle(len(victims), func(i, j int) { victims[i], victims[j] = victims[j], victims[i] })
+
+	timers := make([]drainTimer, len(victims))
+	for i, c := range victims {
+		closeIn := window * time.Duration(i+1) / time.Duration(len(victims))
+		timers[i].tc, timers[i].ch = s.clock.NewTimer(closeIn)
+		select {
+		case c.drainNotify <- closeIn:
+		default:
+			// Already notified by an earlier Drain.
+		}
+	}
+	s.logf("derp: draining %d clients over %v", len(victims), window)
+
+	stop := make(chan struct{})
+	s.drainStop = stop
+	go s.drainLoop(stop, victims, timers)
+}
+
+type drainTimer struct {
+	tc tstime.TimerController
+	ch <-chan time.Time
+}
+
+// drainLoop closes victims[i] when timers[i] fires, until stop is closed.
+func (s *Server) drainLoop(stop <-chan struct{}, victims []*sclient, timers []drainTimer) {
+	defer func() {
+		for _, t := range timers {
+			t.tc.Stop()
+		}
+	}()
+	stopped := func(i int) bool {
+		select {
+		case <-stop:
+			s.logf("derp: drain stopped with %d clients left", len(victims)-i)
+			return true
+		default:
+			return false
+		}
+	}
+	for i, c := range victims {
+		select {
+		case <-stop:
+		case <-c.done:
+			continue // already gone
+		case <-timers[i].ch:
+		}
+		// Check stop again, in case the timer fired after the drain was
+		// stopped and select picked it.
+		if stopped(i) {
+			return
+		}
+		c.nc.Close()
+		s.drainClosedConns.Add(1)
+	}
+	s.logf("derp: drain complete")
+}
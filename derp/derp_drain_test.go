@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// waitDraining returns the CloseIn of the first ServerDrainingMessage c
+// receives.
+func waitDraining(t *testing.T, c *adminTestClient) time.Duration {
+	t.Helper()
+	for {
+		select {
+		case m := <-c.recv:
+			if dm, ok := m.(ServerDrainingMessage); ok {
+				return dm.CloseIn
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for ServerDrainingMessage")
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	s.clock = clock
+	meshKey := strings.Repeat("ab", 32)
+	s.SetMeshKey(meshKey)
+
+	var clients []*adminTestClient
+	for _, addr := range []string{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3"} {
+		c := connectAdminTestClient(t, s, addr)
+		waitConnected(t, s, c.pub, true)
+		clients = append(clients, c)
+	}
+	mesh := connectAdminTestClient(t, s, "192.0.2.9:9", MeshKey(meshKey))
+	waitConnected(t, s, mesh.pub, true)
+
+	s.Drain(30 * time.Second)
+
+	closeAt := map[time.Duration]*adminTestClient{}
+	for _, c := range clients {
+		closeAt[waitDraining(t, c)] = c
+	}
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		if closeAt[want] == nil {
+			t.Fatalf("no client told to expect close in %v; got %v", want, closeAt)
+		}
+	}
+
+	late := connectAdminTestClient(t, s, "192.0.2.4:4")
+	select {
+	case <-late.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("new client accepted while draining")
+	}
+
+	clock.Advance(10 * time.Second)
+	waitConnected(t, s, closeAt[10*time.Second].pub, false)
+	for _, d := range []time.Duration{20 * time.Second, 30 * time.Second} {
+		if !s.IsClientConnectedForTest(closeAt[d].pub) {
+			t.Errorf("client due at %v closed early", d)
+		}
+	}
+
+	clock.Advance(20 * time.Second)
+	waitConnected(t, s, closeAt[20*time.Second].pub, false)
+	waitConnected(t, s, closeAt[30*time.Second].pub, false)
+	if !s.IsClientConnectedForTest(mesh.pub) {
+		t.Error("mesh peer disconnected by drain")
+	}
+	select {
+	case m := <-mesh.recv:
+		if _, ok := m.(ServerDrainingMessage); ok {
+			t.Error("mesh peer was sent a ServerDrainingMessage")
+		}
+	default:
+	}
+	if got := s.drainClosedConns.Value(); got != 3 {
+		t.Errorf("drainClosedConns = %d; want 3", got)
+	}
+}
+
+func TestDrainStop(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	s.clock = clock
+
+	a := connectAdminTestClient(t, s, "192.0.2.1:1")
+	waitConnected(t, s, a.pub, true)
+	s.Drain(time.Minute)
+	waitDraining(t, a)
+	s.SetDraining(false)
+
+	clock.Advance(2 * time.Minute)
+	b := connectAdminTestClient(t, s, "192.0.2.2:2")
+	waitConnected(t, s, b.pub, true)
+	if !s.IsClientConnectedForTest(a.pub) {
+		t.Error("client closed after drain was stopped")
+	}
+}
@@ -8,12 +8,12 @@
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/dgraph-io/ristretto"
 	"github.com/gorilla/mux"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog/log"
@@ -75,27 +75,16 @@ func (s *Server) prepareNoiseClient() error {
 	}
 	dialer := &tsdial.Dialer{Logf: s.logf}
 	httpc := s.createHttpc(dialer)
-	res, err := httpc.Do(req)
-	if err != nil {
-		return fmt.Errorf("fetch control key: %v", err)
-	}
-	defer res.Body.Close()
-	b, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	ctrlPubkey, err := fetchControlKey(httpc, req)
 	if err != nil {
-		return fmt.Errorf("fetch control key response: %v", err)
-	}
-	if res.StatusCode != 200 {
-		return fmt.Errorf("fetch control key: %d", res.StatusCode)
-	}
-	var keys tailcfg.OverTLSPublicKeyResponse
-	jsonErr := json.Unmarshal(b, &keys)
-	if jsonErr != nil {
-		return fmt.Errorf("fetch control key response: %v", jsonErr)
-	}
-	if !keys.PublicKey.IsZero() {
-		httpc.CloseIdleConnections()
+		// 控制器不可达时，使用快照中记录的控制器公钥，以便稍后恢复连接
+		ctrlPubkey = s.snapshotCtrlPubkey()
+		if ctrlPubkey.IsZero() {
+			return err
+		}
+		s.logf("%v; using control key from trust snapshot", err)
 	}
-	s.ctrlPubkey = keys.PublicKey
+	s.ctrlPubkey = ctrlPubkey
 
 	s.dnsCache = &dnscache.Resolver{
 		Forward:          dnscache.Get().Forward, // use default cache's forwarder
@@ -110,7 +99,7 @@ func (s *Server) prepareNoiseClient() error {
 
 		nc, err := controlclient.NewNoiseClient(controlclient.NoiseOpts{
 			PrivKey:      s.naviPriKey,
-			ServerPubKey: keys.PublicKey,
+			ServerPubKey: s.ctrlPubkey,
 			ServerURL:    s.ctrlURL,
 			Dialer:       dialer,
 			DNSCache:     s.dnsCache,
@@ -126,9 +115,35 @@ func (s *Server) prepareNoiseClient() error {
 	if err != nil {
 		return err
 	}
+	s.ctrlClient = s.nc
 	return nil
 }
 
+// fetchControlKey 通过req获取控制器的noise公钥
+func fetchControlKey(httpc *http.Client, req *http.Request) (key.MachinePublic, error) {
+	res, err := httpc.Do(req)
+	if err != nil {
+		return key.MachinePublic{}, fmt.Errorf("fetch control key: %v", err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return key.MachinePublic{}, fmt.Errorf("fetch control key response: %v", err)
+	}
+	if res.StatusCode != 200 {
+		return key.MachinePublic{}, fmt.Errorf("fetch control key: %d", res.StatusCode)
+	}
+	var keys tailcfg.OverTLSPublicKeyResponse
+	jsonErr := json.Unmarshal(b, &keys)
+	if jsonErr != nil {
+		return key.MachinePublic{}, fmt.Errorf("fetch control key response: %v", jsonErr)
+	}
+	if !keys.PublicKey.IsZero() {
+		httpc.CloseIdleConnections()
+	}
+	return keys.PublicKey, nil
+}
+
 func decode(res *http.Response, v any) error {
 	defer res.Body.Close()
 	msg, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
@@ -142,21 +157,15 @@ func decode(res *http.Response, v any) error {
 }
 
 // 在受管情况下进行初始化
-func (s *Server) PrepareManaged(url, id string, naviKey key.MachinePrivate) (err error) {
+func (s *Server) PrepareManaged(url, id string, naviKey key.MachinePrivate) error {
 	s.ctx = context.Background()
 	s.ctrlURL = url
 	s.derpID = id
 	s.naviPriKey = naviKey
-	s.trustNodesCache, err = ristretto.NewCache(&ristretto.Config{
-		NumCounters:        1000000,
-		MaxCost:            100000,
-		BufferItems:        64,
-		IgnoreInternalCost: true,
-	})
-	if err != nil {
-		return fmt.Errorf("create trustNodesCache: %v", err)
-	}
 	s.Cronjob = cron.New()
+	if err := s.loadTrustSnapshot(); err != nil {
+		s.logf("derp: %v; starting without trusted nodes", err)
+	}
 	return s.prepareNoiseClient()
 }
 
@@ -172,15 +181,29 @@ type NaviNode struct {
 	STUNPort    int    `json:"STUNPort"`    //0代表3478，-1代表禁用
 	NoDERP      bool   `json:"NoDERP"`      //禁用DERP
 	DERPPort    int    `json:"DERPPort"`    //0代表443
+	QUICPort    int    `json:"QUICPort"`    //DERP over QUIC的UDP端口，0代表禁用
 	DNSProvider string `json:"DNSProvider"` //DNS服务商
 	DNSID       string `json:"DNSID"`       //DNS服务商的ID
 	DNSKey      string `json:"DNSKey"`      //DNS服务商的Key
 	Arch        string `json:"Arch"`        //所在环境架构，x86_64或aarch64
 }
+
+// redacted 返回去掉DNSKey等密钥的副本，用于写日志。
+func (n NaviNode) redacted() NaviNode {
+	if n.DNSKey != "" {
+		n.DNSKey = "<redacted>"
+	}
+	return n
+}
+
 type RegisterResponse struct {
 	NaviInfo   NaviNode
 	TrustNodes []string `json:"TrustNodes"`
-	Timestamp  *time.Time
+	Epoch      uint64   `json:"Epoch"`  // 受信列表的epoch，见TrustDeltaBatch
+	SeqNum     uint64   `json:"SeqNum"` // TrustNodes对应的增量序号
+	// ClientPolicy 非空时覆盖本地配置的客户端限速与连接数策略
+	ClientPolicy *ClientPolicy `json:",omitempty"`
+	Timestamp    *time.Time
 }
 
 func (s *Server) TryLogin() (NaviNode, error) {
@@ -198,7 +221,7 @@ func (s *Server) TryLogin() (NaviNode, error) {
 		return NaviNode{}, fmt.Errorf("register request: %w", err)
 	}
 
-	res, err := s.nc.Do(req)
+	res, err := s.ctrlClient.Do(req)
 	if err != nil {
 		return NaviNode{}, fmt.Errorf("register request: %w", err)
 	}
@@ -215,12 +238,16 @@ func (s *Server) TryLogin() (NaviNode, error) {
 		return NaviNode{}, fmt.Errorf("register request: %v", err)
 	}
 
-	s.trustNodesCache.Clear()
-	s.trustNodesCache.SetWithTTL("seqnum", uint32(0), 1, 0)
-	for _, nkey := range resp.TrustNodes {
-		s.trustNodesCache.SetWithTTL(nkey, struct{}{}, 1, 0)
+	if err := s.replaceTrustNodes(resp.TrustNodes, resp.Epoch, resp.SeqNum, &resp.NaviInfo); err != nil {
+		return NaviNode{}, fmt.Errorf("register request: %w", err)
+	}
+	s.setNaviInfo(resp.NaviInfo)
+	if resp.ClientPolicy != nil {
+		s.SetClientPolicy(*resp.ClientPolicy)
 	}
-	s.logf("register response: %v", resp)
+	logResp := resp
+	logResp.NaviInfo = resp.NaviInfo.redacted()
+	s.logf("register response: %v", logResp)
 
 	return resp.NaviInfo, nil
 }
@@ -228,20 +255,30 @@ func (s *Server) TryLogin() (NaviNode, error) {
 func (s *Server) UpdateNaviInfo(
 	naviInfo NaviNode,
 	hostname, addr, setIPv4, setIPv6, dnsProvider, dnsID, dnsKey *string,
-	stunPort *int,
+	stunPort, quicPort *int,
 	runDERP, runSTUN *bool,
 ) error {
-	*hostname = naviInfo.HostName
+	if naviInfo.HostName != "" {
+		*hostname = naviInfo.HostName
+	}
 	if !naviInfo.NoDERP {
-		*addr = ":" + strconv.Itoa(naviInfo.DERPPort)
+		derpPort := naviInfo.DERPPort
+		if derpPort == 0 {
+			derpPort = 443
+		}
+		*addr = ":" + strconv.Itoa(derpPort)
 	} else {
 		*runDERP = false
 	}
-	if !naviInfo.NoSTUN {
-		*stunPort = naviInfo.STUNPort
-	} else {
+	switch {
+	case naviInfo.NoSTUN || naviInfo.STUNPort < 0:
 		*runSTUN = false
+	case naviInfo.STUNPort == 0:
+		*stunPort = 3478
+	default:
+		*stunPort = naviInfo.STUNPort
 	}
+	*quicPort = max(naviInfo.QUICPort, 0)
 	*setIPv4 = naviInfo.IPv4
 	*setIPv6 = naviInfo.IPv6
 	*dnsProvider = naviInfo.DNSProvider
@@ -250,9 +287,28 @@ func (s *Server) UpdateNaviInfo(
 	return nil
 }
 
+// SetNaviEndpoints 设置本中继的DERP地址（NaviNode的IPv4/IPv6地址加DERP端口），
+// 在每次拉取受信列表时作为MapRequest.Endpoints报告给控制器。
+func (s *Server) SetNaviEndpoints(eps []netip.AddrPort) {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	s.naviEndpoints = append([]netip.AddrPort(nil), eps...)
+}
+
+// NaviEndpoints 返回SetNaviEndpoints设置的地址。
+func (s *Server) NaviEndpoints() []netip.AddrPort {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	return append([]netip.AddrPort(nil), s.naviEndpoints...)
+}
+
 type PullNodesListResponse struct {
-	TrustNodes []string   `json:"TrustNodes"`
-	Timestamp  *time.Time `json:"Timestamp"`
+	TrustNodes []string `json:"TrustNodes"`
+	Epoch      uint64   `json:"Epoch"`
+	SeqNum     uint64   `json:"SeqNum"`
+	// ClientPolicy 非空时覆盖本地配置的客户端限速与连接数策略
+	ClientPolicy *ClientPolicy `json:",omitempty"`
+	Timestamp    *time.Time    `json:"Timestamp"`
 }
 
 func (s *Server) PullNodesList() error {
@@ -261,6 +317,7 @@ func (s *Server) PullNodesList() error {
 		FrontendLogID: "MirageNavi",
 		BackendLogID:  s.derpID,
 	}
+	request.Endpoints = s.NaviEndpoints()
 	url := fmt.Sprintf("%s/navi/nodes", s.ctrlURL)
 	url = strings.Replace(url, "http:", "https:", 1)
 	bodyData, err := json.Marshal(request)
@@ -271,7 +328,7 @@ func (s *Server) PullNodesList() error {
 	if err != nil {
 		return fmt.Errorf("map request: %w", err)
 	}
-	res, err := s.nc.Do(req)
+	res, err := s.ctrlClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("map request: %w", err)
 	}
@@ -289,12 +346,12 @@ func (s *Server) PullNodesList() error {
 	}
 	s.logf("map response: %v", resp)
 
-	s.trustNodesCache.Clear()
-	s.trustNodesCache.SetWithTTL("seqnum", uint32(0), 1, 0)
-	for _, nkey := range resp.TrustNodes {
-		s.trustNodesCache.SetWithTTL(nkey, struct{}{}, 1, 0)
+	if err := s.replaceTrustNodes(resp.TrustNodes, resp.Epoch, resp.SeqNum, nil); err != nil {
+		return fmt.Errorf("map request: %w", err)
+	}
+	if resp.ClientPolicy != nil {
+		s.SetClientPolicy(*resp.ClientPolicy)
 	}
-
 	return nil
 }
 
@@ -355,12 +412,8 @@ func (s *Server) NoiseUpgradeHandler(
 		conn: noiseConn,
 	}
 
-	router := mux.NewRouter()
+	router := ts2021App.newRouter()
 	router.Use(ts2021App.NoiseAuthMiddleware)
-	router.HandleFunc("/ctrl/nodes", ts2021App.NoiseNodeChangeHandler).
-		Methods(http.MethodPost)
-	router.Handle("/ctrl/vars", expvar.Handler())
-	router.Handle("/generate_204", http.HandlerFunc(serveNoContent))
 
 	server := http.Server{
 		ReadTimeout: 30 * time.Second,
@@ -372,6 +425,21 @@ func (s *Server) NoiseUpgradeHandler(
 	}
 }
 
+// newRouter 返回控制器可访问的接口路由，调用方负责添加鉴权中间件。
+func (t *ts2021App) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/ctrl/nodes", t.NoiseNodeChangeHandler).
+		Methods(http.MethodPost)
+	router.HandleFunc("/ctrl/policy", t.NoisePolicyHandler).
+		Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/ctrl/mesh", t.NoiseMeshHandler).
+		Methods(http.MethodGet, http.MethodPost)
+	t.addAdminRoutes(router)
+	router.Handle("/ctrl/vars", expvar.Handler())
+	router.Handle("/generate_204", http.HandlerFunc(serveNoContent))
+	return router
+}
+
 func (t *ts2021App) NoiseAuthMiddleware(
 	next http.Handler,
 ) http.Handler {
@@ -387,60 +455,59 @@ func (t *ts2021App) NoiseAuthMiddleware(
 	})
 }
 
-type NodesChange struct {
-	SeqNum     uint32
-	AddNode    string
-	RemoveNode string
-}
-
+// NoiseNodeChangeHandler 接收控制器推送的受信列表增量（TrustDeltaBatch），
+// 并以TrustDeltaAck应答。
 func (t *ts2021App) NoiseNodeChangeHandler(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
 	log.Trace().Caller().Msg("noise node change handler for controlserver " + r.RemoteAddr)
 
-	var nodesChange NodesChange
-	err := json.NewDecoder(r.Body).Decode(&nodesChange)
+	sealed, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
 	if err != nil {
-		log.Error().Err(err).Msg("error decoding node change")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Error().Err(err).Msg("error reading node change")
+		t.navi.trustDeltaErrors.Add(1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	log.Trace().Caller().Msgf("node change: %+v", nodesChange)
-
-	sq, ok := t.navi.trustNodesCache.Get("seqnum")
+	msg, ok := t.navi.naviPriKey.OpenFrom(t.navi.ctrlPubkey, sealed)
 	if !ok {
-		log.Error().Msg("seqnum not found")
-		http.Error(w, "seqnum not found", http.StatusInternalServerError)
+		log.Error().Msg("node change not sealed by control server")
+		t.navi.trustDeltaErrors.Add(1)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
 		return
 	}
-	seqnum, ok := sq.(uint32)
-	if !ok {
-		log.Error().Msg("seqnum not int")
-		http.Error(w, "seqnum not int", http.StatusInternalServerError)
-		return
-	}
-	if nodesChange.SeqNum != seqnum+1 {
-		log.Warn().Msg("seqnum not match! Need to pull nodes list again ")
-		err := t.navi.PullNodesList()
-		if err != nil {
-			log.Error().Err(err).Msg("error pull nodes list")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	var batch TrustDeltaBatch
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		log.Error().Err(err).Msg("error decoding node change")
+		t.navi.trustDeltaErrors.Add(1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	t.navi.trustNodesCache.SetWithTTL("seqnum", nodesChange.SeqNum, 1, 0)
-	if nodesChange.AddNode != "" {
-		addedNodes := strings.Split(nodesChange.AddNode, ",")
-		for _, addedNode := range addedNodes {
-			t.navi.trustNodesCache.SetWithTTL(addedNode, struct{}{}, 1, 0)
-		}
+	log.Trace().Caller().Msgf("node change: epoch %d, %d deltas", batch.Epoch, len(batch.Deltas))
+
+	ack := t.navi.applyTrustDeltas(&batch)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ack); err != nil {
+		log.Error().Err(err).Msg("error encoding node change ack")
 	}
-	if nodesChange.RemoveNode != "" {
-		removedNodes := strings.Split(nodesChange.RemoveNode, ",")
-		for _, removedNode := range removedNodes {
-			t.navi.trustNodesCache.Del(removedNode)
+}
+
+// NoisePolicyHandler 供控制器读取（GET）或下发（POST）客户端限速与连接数策略
+func (t *ts2021App) NoisePolicyHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == http.MethodPost {
+		var p ClientPolicy
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&p); err != nil {
+			log.Error().Err(err).Msg("error decoding client policy")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		t.navi.SetClientPolicy(p)
+		log.Info().Msgf("client policy updated by control: %+v", p)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.navi.ClientPolicy())
 }
@@ -0,0 +1,260 @@
+package derp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/types/key"
+)
+
+// ClientStats 描述一个已连接的客户端连接及其流量统计，由/ctrl/clients返回。
+type ClientStats struct {
+	NodeKey     key.NodePublic
+	ConnNum     int64  // 连接序号，进程内唯一
+	RemoteAddr  string // 通常为ip:port
+	Mesh        bool   `json:",omitempty"` // 是否为同区域的mesh对端
+	Dup         bool   `json:",omitempty"` // 该key是否有多个连接
+	ConnectedAt time.Time
+	Duration    time.Duration // 已连接时长
+
+	PacketsRecv int64 // 客户端发来的包
+	BytesRecv   int64
+	PacketsSent int64 // 发往客户端的包
+	BytesSent   int64
+}
+
+// Clients 返回所有已连接客户端的统计，按连接序号排序。
+func (s *Server) Clients() []ClientStats {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []ClientStats
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			ret = append(ret, ClientStats{
+				NodeKey:     c.key,
+				ConnNum:     c.connNum,
+				RemoteAddr:  c.remoteAddr,
+				Mesh:        c.canMesh,
+				Dup:         c.isDup.Load(),
+				ConnectedAt: c.connectedAt,
+				Duration:    now.Sub(c.connectedAt),
+				PacketsRecv: c.packetsRecv.Load(),
+				BytesRecv:   c.bytesRecv.Load(),
+				PacketsSent: c.packetsSent.Load(),
+				BytesSent:   c.bytesSent.Load(),
+			})
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ConnNum < ret[j].ConnNum })
+	return ret
+}
+
+// DisconnectClient 关闭k的所有连接并返回关闭的连接数。
+//
+// 客户端随后可以重连；若要禁止其连接，应由控制器将其移出受信列表。
+func (s *Server) DisconnectClient(k key.NodePublic) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.clients[k]
+	if !ok {
+		return 0
+	}
+	n := set.Len()
+	s.logf("derp: disconnecting %d connection(s) of %v by admin request", n, k.ShortString())
+	set.ForeachClient(func(c *sclient) {
+		go c.nc.Close()
+	})
+	return n
+}
+
+// NaviInfoHook 在NaviNode配置被热更新时调用，返回需要重启才能生效的字段名。
+type NaviInfoHook func(NaviNode) (needRestart []string, err error)
+
+// SetNaviInfoHook 设置NaviNode热更新时的回调，由derper负责应用配置。
+func (s *Server) SetNaviInfoHook(fn NaviInfoHook) {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	s.naviInfoHook = fn
+}
+
+// NaviInfo 返回当前生效的NaviNode配置。
+func (s *Server) NaviInfo() NaviNode {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	return s.naviInfo
+}
+
+func (s *Server) setNaviInfo(n NaviNode) {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	s.naviInfo = n
+}
+
+// NaviReloadResponse 是/ctrl/navi热更新的应答。
+//
+// 热更新只立即应用DNS服务商设置与向控制器报告的IPv4/IPv6地址；
+// 主机名、端口、地址族等决定监听与证书的字段保存后需重启derper才能生效，
+// 在NeedRestart中列出。
+type NaviReloadResponse struct {
+	NaviInfo    NaviNode
+	NeedRestart []string `json:",omitempty"` // 已保存但需重启derper才能生效的字段
+}
+
+// ReloadNaviInfo 热更新NaviNode配置。n为nil时重新向控制器注册以获取最新配置。
+// 新配置会写入快照，并交给NaviInfoHook应用；哪些字段需要重启见NaviReloadResponse。
+func (s *Server) ReloadNaviInfo(n *NaviNode) (NaviReloadResponse, error) {
+	var naviInfo NaviNode
+	if n == nil {
+		var err error
+		if naviInfo, err = s.TryLogin(); err != nil {
+			return NaviReloadResponse{}, err
+		}
+	} else {
+		naviInfo = *n
+		s.setNaviInfo(naviInfo)
+		s.saveTrustSnapshot(&naviInfo)
+	}
+
+	s.naviMu.Lock()
+	hook := s.naviInfoHook
+	s.naviMu.Unlock()
+	resp := NaviReloadResponse{NaviInfo: naviInfo}
+	if hook != nil {
+		var err error
+		if resp.NeedRestart, err = hook(naviInfo); err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// addAdminRoutes 注册供控制器管理DERP服务器的接口。
+func (t *ts2021App) addAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/ctrl/clients", t.NoiseClientsHandler).
+		Methods(http.MethodGet)
+	router.HandleFunc("/ctrl/clients/{nodekey}", t.NoiseDisconnectHandler).
+		Methods(http.MethodDelete)
+	router.HandleFunc("/ctrl/drain", t.NoiseDrainHandler).
+		Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/ctrl/navi", t.NoiseNaviHandler).
+		Methods(http.MethodGet, http.MethodPost)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("error encoding response")
+	}
+}
+
+// NoiseClientsHandler 列出已连接的客户端及其流量统计
+func (t *ts2021App) NoiseClientsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJSON(w, t.navi.Clients())
+}
+
+// NoiseDisconnectHandler 强制断开某个node key的所有连接
+func (t *ts2021App) NoiseDisconnectHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	var k key.NodePublic
+	if err := k.UnmarshalText([]byte(mux.Vars(r)["nodekey"])); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := t.navi.DisconnectClient(k)
+	if n == 0 {
+		http.Error(w, "client not connected", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, struct{ Disconnected int }{n})
+}
+
+// DrainStatus 是/ctrl/drain的请求与应答。
+type DrainStatus struct {
+	Draining bool
+	// Window 仅用于请求：在多长时间内逐步关闭已有连接，为0则使用默认值
+	Window  time.Duration `json:",omitempty"`
+	Clients int           `json:",omitempty"` // 应答中为当前仍连接的（非mesh）客户端数
+}
+
+// NoiseDrainHandler 供控制器读取（GET）或设置（POST）排空状态。
+// 开始排空时见Server.Drain；Draining为false时停止排空并重新接受新客户端。
+func (t *ts2021App) NoiseDrainHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == http.MethodPost {
+		var req DrainStatus
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Draining {
+			t.navi.Drain(req.Window)
+		} else {
+			t.navi.SetDraining(false)
+		}
+	}
+	// 与Server.Drain一致，mesh连接不被排空，不计入
+	var n int
+	t.navi.mu.Lock()
+	for _, cs := range t.navi.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if !c.canMesh {
+				n++
+			}
+		})
+	}
+	t.navi.mu.Unlock()
+	writeJSON(w, DrainStatus{Draining: t.navi.Draining(), Clients: n})
+}
+
+// NoiseNaviHandler 供控制器读取（GET）或热更新（POST）NaviNode配置。
+// POST请求体为空时，DERP重新向控制器注册以获取最新配置。
+// 应答中的NeedRestart为需重启derper才能生效的字段。
+func (t *ts2021App) NoiseNaviHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, t.navi.NaviInfo())
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var n *NaviNode
+	if len(body) > 0 {
+		n = new(NaviNode)
+		if err := json.Unmarshal(body, n); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n.ID != "" && n.ID != t.navi.derpID {
+			http.Error(w, "NaviNode is for another server", http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := t.navi.ReloadNaviInfo(n)
+	if err != nil {
+		log.Error().Err(err).Msg("error reloading NaviNode")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logResp := resp
+	logResp.NaviInfo = resp.NaviInfo.redacted()
+	log.Info().Msgf("NaviNode reloaded by control: %+v", logResp)
+	writeJSON(w, resp)
+}
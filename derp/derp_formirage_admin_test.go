@@ -0,0 +1,216 @@
+package derp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+type adminTestClient struct {
+	pub    key.NodePublic
+	c      *Client
+	recv   chan ReceivedMessage
+	closed chan error // receives the Recv error once the connection ends
+}
+
+// connectAdminTestClient connects a new client to s over a net.Pipe and
+// returns once the server has registered it.
+func connectAdminTestClient(t *testing.T, s *Server, remoteAddr string, opts ...ClientOpt) *adminTestClient {
+	t.Helper()
+	priv := key.NewNode()
+	sc, cc := net.Pipe()
+	go s.Accept(context.Background(), sc, bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc)), remoteAddr)
+	c, err := NewClient(priv, cc, bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc)), logger.Discard, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &adminTestClient{
+		pub:    priv.Public(),
+		c:      c,
+		recv:   make(chan ReceivedMessage, 16),
+		closed: make(chan error, 1),
+	}
+	go func() {
+		for {
+			m, err := c.Recv()
+			if err != nil {
+				tc.closed <- err
+				return
+			}
+			tc.recv <- m
+		}
+	}()
+	t.Cleanup(func() { cc.Close() })
+	return tc
+}
+
+// newAdminTestRouter returns the Noise routes of s without the Noise
+// authentication middleware.
+func newAdminTestRouter(s *Server) http.Handler {
+	return (&ts2021App{navi: s}).newRouter()
+}
+
+func waitConnected(t *testing.T, s *Server, k key.NodePublic, want bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if s.IsClientConnectedForTest(k) == want {
+			return
+		}
+	}
+	t.Fatalf("client %v connected != %v", k.ShortString(), want)
+}
+
+func TestAdminClients(t *testing.T) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+
+	a := connectAdminTestClient(t, s, "192.0.2.1:1001")
+	b := connectAdminTestClient(t, s, "192.0.2.2:1002")
+	waitConnected(t, s, a.pub, true)
+	waitConnected(t, s, b.pub, true)
+
+	if err := a.c.Send(b.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for got := false; !got; {
+		select {
+		case m := <-b.recv:
+			_, got = m.(ReceivedPacket)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for packet")
+		}
+	}
+
+	stats := map[key.NodePublic]ClientStats{}
+	for _, cs := range s.Clients() {
+		stats[cs.NodeKey] = cs
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Clients() = %d entries; want 2", len(stats))
+	}
+	if got := stats[a.pub]; got.PacketsRecv != 1 || got.BytesRecv != 5 || got.RemoteAddr != "192.0.2.1:1001" {
+		t.Errorf("sender stats = %+v", got)
+	}
+	if got := stats[b.pub]; got.PacketsSent != 1 || got.BytesSent != 5 {
+		t.Errorf("receiver stats = %+v", got)
+	}
+
+	// Disconnect through the Noise handler.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/ctrl/clients/"+a.pub.String(), nil)
+	router := newAdminTestRouter(s)
+	router.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("disconnect: status %d: %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case <-a.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not disconnected")
+	}
+	waitConnected(t, s, a.pub, false)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("DELETE", "/ctrl/clients/"+a.pub.String(), nil))
+	if rec.Code != 404 {
+		t.Errorf("disconnecting gone client: status %d; want 404", rec.Code)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	const meshKey = "0000000000000000000000000000000000000000000000000000000000000001"
+	s.SetMeshKey(meshKey)
+	a := connectAdminTestClient(t, s, "192.0.2.1:1001")
+	mesh := connectAdminTestClient(t, s, "192.0.2.9:1009", MeshKey(meshKey))
+	waitConnected(t, s, a.pub, true)
+	waitConnected(t, s, mesh.pub, true)
+
+	rec := httptest.NewRecorder()
+	newAdminTestRouter(s).ServeHTTP(rec, httptest.NewRequest("POST", "/ctrl/drain", bytes.NewReader([]byte(`{"Draining":true}`))))
+	var st DrainStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if !st.Draining || st.Clients != 1 {
+		t.Errorf("drain status = %+v; want draining with 1 client", st)
+	}
+
+	b := connectAdminTestClient(t, s, "192.0.2.2:1002")
+	select {
+	case <-b.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("new client accepted while draining")
+	}
+	if !s.IsClientConnectedForTest(a.pub) {
+		t.Error("existing client dropped by drain")
+	}
+
+	s.SetDraining(false)
+	c := connectAdminTestClient(t, s, "192.0.2.3:1003")
+	waitConnected(t, s, c.pub, true)
+}
+
+func TestAdminReloadNaviInfo(t *testing.T) {
+	s, _ := newManagedTestServer(t)
+	var hooked NaviNode
+	s.SetNaviInfoHook(func(n NaviNode) ([]string, error) {
+		hooked = n
+		return []string{"DERPPort"}, nil
+	})
+
+	body := `{"Name":"navi-test","RegionID":900,"DERPPort":8443,"DNSProvider":"cloudflare"}`
+	rec := httptest.NewRecorder()
+	newAdminTestRouter(s).ServeHTTP(rec, httptest.NewRequest("POST", "/ctrl/navi", bytes.NewReader([]byte(body))))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp NaviReloadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.NeedRestart) != 1 || resp.NeedRestart[0] != "DERPPort" {
+		t.Errorf("NeedRestart = %v", resp.NeedRestart)
+	}
+	if hooked.DERPPort != 8443 || hooked.DNSProvider != "cloudflare" {
+		t.Errorf("hook got %+v", hooked)
+	}
+	if got := s.NaviInfo(); got.NaviRegionID != 900 {
+		t.Errorf("NaviInfo() = %+v", got)
+	}
+	if got, ok := s.LastNaviInfo(); !ok || got.DERPPort != 8443 {
+		t.Errorf("snapshot NaviInfo = %+v, %v", got, ok)
+	}
+
+	rec = httptest.NewRecorder()
+	newAdminTestRouter(s).ServeHTTP(rec, httptest.NewRequest("POST", "/ctrl/navi", bytes.NewReader([]byte(`{"Name":"other"}`))))
+	if rec.Code != 400 {
+		t.Errorf("NaviNode for another server: status %d; want 400", rec.Code)
+	}
+}
+
+func TestNaviNodeRedacted(t *testing.T) {
+	n := NaviNode{ID: "navi-test", DNSProvider: "cloudflare", DNSID: "zone1", DNSKey: "s3cret-token"}
+	got := fmt.Sprintf("%+v", NaviReloadResponse{NaviInfo: n.redacted()})
+	if strings.Contains(got, "s3cret-token") {
+		t.Errorf("redacted NaviNode logs the DNS key: %s", got)
+	}
+	if !strings.Contains(got, "zone1") {
+		t.Errorf("redacted NaviNode lost non-secret fields: %s", got)
+	}
+	if n.DNSKey != "s3cret-token" {
+		t.Error("redacted modified the original")
+	}
+}
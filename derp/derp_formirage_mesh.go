@@ -0,0 +1,215 @@
+package derp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/set"
+)
+
+// naviMeshMaxSkew 是mesh凭据中时间戳允许的最大偏差。
+const naviMeshMaxSkew = 5 * time.Minute
+
+// NaviMeshAuth 返回一个ClientOpt，使受管DERP以其Navi machine key（priv）
+// 向同区域的另一台DERP（其Navi公钥为serverNaviKey）证明身份并加入mesh，
+// 而无需预共享的mesh key。priv为零值时不起作用。
+func NaviMeshAuth(priv key.MachinePrivate, serverNaviKey key.MachinePublic) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) {
+		o.NaviMeshKey = priv
+		o.NaviMeshPeer = serverNaviKey
+	})
+}
+
+// naviMeshInfo 是clientInfo中的mesh凭据。
+type naviMeshInfo struct {
+	Key   key.MachinePublic // 客户端（发起mesh的DERP）的Navi公钥
+	Proof []byte            // Key对应私钥SealTo服务端Navi公钥的naviMeshProof
+}
+
+// naviMeshProof 将凭据绑定到本次连接的双方DERP公钥和时间，防止被用于其他连接。
+type naviMeshProof struct {
+	ClientKey key.NodePublic
+	ServerKey key.NodePublic
+	Time      time.Time
+}
+
+func newNaviMeshInfo(priv key.MachinePrivate, serverNaviKey key.MachinePublic, clientKey, serverKey key.NodePublic, now time.Time) (*naviMeshInfo, error) {
+	msg, err := json.Marshal(naviMeshProof{ClientKey: clientKey, ServerKey: serverKey, Time: now})
+	if err != nil {
+		return nil, err
+	}
+	return &naviMeshInfo{Key: priv.Public(), Proof: priv.SealTo(serverNaviKey, msg)}, nil
+}
+
+// verifyNaviMesh 校验clientKey的mesh凭据，成功时返回其Navi公钥。
+func (s *Server) verifyNaviMesh(clientKey key.NodePublic, nm *naviMeshInfo) (key.MachinePublic, error) {
+	var zero key.MachinePublic
+	if s.naviPriKey.IsZero() {
+		return zero, errors.New("not a managed server")
+	}
+	if !s.isRegionPeer(nm.Key) {
+		return zero, fmt.Errorf("%v is not a relay in this region", nm.Key.ShortString())
+	}
+	msg, ok := s.naviPriKey.OpenFrom(nm.Key, nm.Proof)
+	if !ok {
+		return zero, errors.New("bad mesh proof")
+	}
+	var p naviMeshProof
+	if err := json.Unmarshal(msg, &p); err != nil {
+		return zero, fmt.Errorf("bad mesh proof: %w", err)
+	}
+	if p.ClientKey != clientKey || p.ServerKey != s.publicKey {
+		return zero, errors.New("mesh proof is for another connection")
+	}
+	if d := s.clock.Since(p.Time); d > naviMeshMaxSkew || d < -naviMeshMaxSkew {
+		return zero, fmt.Errorf("mesh proof time off by %v", d.Round(time.Second))
+	}
+	return nm.Key, nil
+}
+
+// RegionPeersResponse 是控制器对/navi/region请求的应答，
+// 也是控制器在区域成员变化时推送到/ctrl/mesh的请求体。
+type RegionPeersResponse struct {
+	RegionID int
+	Peers    []NaviNode // NaviRegionID相同的所有中继，可以包含自身
+}
+
+// PullRegionPeers 从控制器获取同区域的其他中继，用于自动组建mesh。
+func (s *Server) PullRegionPeers() error {
+	request := tailcfg.MapRequest{}
+	request.Hostinfo = &tailcfg.Hostinfo{
+		FrontendLogID: "MirageNavi",
+		BackendLogID:  s.derpID,
+	}
+	url := fmt.Sprintf("%s/navi/region", s.ctrlURL)
+	url = strings.Replace(url, "http:", "https:", 1)
+	bodyData, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("region request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(s.ctx, "POST", url, bytes.NewReader(bodyData))
+	if err != nil {
+		return fmt.Errorf("region request: %w", err)
+	}
+	res, err := s.ctrlClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("region request: %w", err)
+	}
+	resp := RegionPeersResponse{}
+	if err := decode(res, &resp); err != nil {
+		return fmt.Errorf("region request: %w", err)
+	}
+	s.setRegionPeers(resp.Peers)
+	s.saveTrustSnapshot(nil)
+	return nil
+}
+
+// RegionPeers 返回当前已知的同区域其他中继。
+func (s *Server) RegionPeers() []NaviNode {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	return append([]NaviNode(nil), s.regionPeers...)
+}
+
+// SetRegionPeersHook 设置同区域中继变化时的回调，由derper负责建立或断开mesh连接。
+func (s *Server) SetRegionPeersHook(fn func([]NaviNode)) {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	s.regionPeersHook = fn
+}
+
+func (s *Server) isRegionPeer(k key.MachinePublic) bool {
+	s.naviMu.Lock()
+	defer s.naviMu.Unlock()
+	return s.regionPeerKeys.Contains(k)
+}
+
+// setRegionPeers 替换同区域中继列表：忽略自身和NaviKey无效的条目，
+// 断开已不在区域内的中继的mesh连接，并调用回调。
+func (s *Server) setRegionPeers(peers []NaviNode) {
+	var self key.MachinePublic
+	if !s.naviPriKey.IsZero() {
+		self = s.naviPriKey.Public()
+	}
+	var kept []NaviNode
+	keys := set.Set[key.MachinePublic]{}
+	for _, p := range peers {
+		var k key.MachinePublic
+		if err := k.UnmarshalText([]byte(p.NaviKey)); err != nil {
+			s.logf("derp: ignoring region peer %q with bad NaviKey: %v", p.ID, err)
+			continue
+		}
+		if p.ID == s.derpID || k == self {
+			continue
+		}
+		kept = append(kept, p)
+		keys.Add(k)
+	}
+
+	s.naviMu.Lock()
+	old := s.regionPeerKeys
+	s.regionPeers = kept
+	s.regionPeerKeys = keys
+	hook := s.regionPeersHook
+	s.naviMu.Unlock()
+
+	var removed []key.MachinePublic
+	for k := range old {
+		if !keys.Contains(k) {
+			removed = append(removed, k)
+		}
+	}
+	if len(removed) > 0 {
+		s.closeNaviMeshConns(removed)
+	}
+	if hook != nil {
+		hook(kept)
+	}
+}
+
+// closeNaviMeshConns 断开以keys中的Navi key认证的mesh连接。
+func (s *Server) closeNaviMeshConns(keys []key.MachinePublic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			for _, k := range keys {
+				if c.canMesh && c.naviKey == k {
+					s.logf("derp: closing mesh connection of %v, no longer in region", k.ShortString())
+					go c.nc.Close()
+				}
+			}
+		})
+	}
+}
+
+// NoiseMeshHandler 供控制器读取（GET）或推送（POST）同区域中继列表
+func (t *ts2021App) NoiseMeshHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == http.MethodPost {
+		var resp RegionPeersResponse
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&resp); err != nil {
+			log.Error().Err(err).Msg("error decoding region peers")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.navi.setRegionPeers(resp.Peers)
+		t.navi.saveTrustSnapshot(nil)
+		log.Info().Msgf("region %d peers updated by control: %d relays", resp.RegionID, len(resp.Peers))
+	}
+	writeJSON(w, RegionPeersResponse{
+		RegionID: t.navi.NaviInfo().NaviRegionID,
+		Peers:    t.navi.RegionPeers(),
+	})
+}
@@ -0,0 +1,75 @@
+package derp
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+func TestNaviMesh(t *testing.T) {
+	s, fc := newManagedTestServer(t)
+	peerKey, strangerKey := key.NewMachine(), key.NewMachine()
+	fc.region = []NaviNode{
+		{ID: "navi-test", NaviKey: s.naviPriKey.Public().String()},
+		{ID: "navi-peer", NaviKey: peerKey.Public().String(), HostName: "peer.example.com"},
+	}
+	if err := s.PullRegionPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.RegionPeers(); len(got) != 1 || got[0].ID != "navi-peer" {
+		t.Fatalf("RegionPeers() = %+v; want only navi-peer", got)
+	}
+
+	// A region peer joins the mesh without being a trusted node.
+	peer := connectAdminTestClient(t, s, "192.0.2.1:1001", NaviMeshAuth(peerKey, s.naviPriKey.Public()))
+	waitConnected(t, s, peer.pub, true)
+	if cs := s.Clients(); len(cs) != 1 || !cs[0].Mesh {
+		t.Errorf("Clients() = %+v; want one mesh client", cs)
+	}
+	if err := peer.c.WatchConnectionChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown relays, and proofs made out to another server, are rejected.
+	for name, opt := range map[string]ClientOpt{
+		"stranger":    NaviMeshAuth(strangerKey, s.naviPriKey.Public()),
+		"wrongServer": NaviMeshAuth(peerKey, key.NewMachine().Public()),
+	} {
+		c := connectAdminTestClient(t, s, "192.0.2.2:1002", opt)
+		select {
+		case <-c.closed:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: mesh client accepted", name)
+		}
+	}
+
+	// Removing the peer from the region closes its mesh connection.
+	var hooked []NaviNode
+	s.SetRegionPeersHook(func(peers []NaviNode) { hooked = peers })
+	fc.region = fc.region[:1]
+	if err := s.PullRegionPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(hooked) != 0 || len(s.RegionPeers()) != 0 {
+		t.Errorf("after removal: hook got %+v, RegionPeers() = %+v", hooked, s.RegionPeers())
+	}
+	select {
+	case <-peer.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removed peer still connected")
+	}
+
+	// Region peers survive a restart through the trust snapshot.
+	fc.region = []NaviNode{{ID: "navi-peer", NaviKey: peerKey.Public().String()}}
+	if err := s.PullRegionPeers(); err != nil {
+		t.Fatal(err)
+	}
+	s.setRegionPeers(nil)
+	if err := s.loadTrustSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isRegionPeer(peerKey.Public()) {
+		t.Error("region peers not restored from snapshot")
+	}
+}
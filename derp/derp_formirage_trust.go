@@ -0,0 +1,271 @@
+package derp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/jsondb"
+	"tailscale.com/types/key"
+	"tailscale.com/util/set"
+)
+
+// maxPendingTrustDeltas 是乱序到达、等待前序增量的最大缓存数量，超过后改为全量同步。
+const maxPendingTrustDeltas = 256
+
+// TrustDelta 是受信列表的一次增量变更。
+type TrustDelta struct {
+	Seq    uint64           // epoch内从1开始连续递增
+	Add    []key.NodePublic `json:",omitempty"`
+	Remove []key.NodePublic `json:",omitempty"`
+}
+
+// TrustDeltaBatch 是控制器推送到/ctrl/nodes的一批增量。
+//
+// 请求体是控制器用其machine key对JSON编码的TrustDeltaBatch做SealTo(Navi公钥)的结果，
+// DERP据此校验增量确实来自控制器。
+type TrustDeltaBatch struct {
+	// Epoch 在控制器重建受信列表时递增。epoch不一致时DERP会进行全量同步。
+	Epoch  uint64
+	Deltas []TrustDelta
+}
+
+// TrustDeltaAck 是DERP对TrustDeltaBatch的应答，描述处理后受信列表所处的版本。
+type TrustDeltaAck struct {
+	Epoch     uint64 // 当前epoch
+	Seq       uint64 // 已连续应用的最大Seq
+	Applied   int    // 本批次中被应用的增量数（含因本批次补齐而应用的缓存增量）
+	Duplicate int    // 本批次中已应用过或已缓存、被忽略的增量数
+	Pending   int    // 因前序缺失而缓存、尚未应用的增量数
+	NeedFull  bool   // DERP需要全量同步且未能完成，控制器应稍后重推
+}
+
+// trustStore 是受管DERP的受信客户端列表。与之前的ristretto缓存不同，写入总会被接受。
+type trustStore struct {
+	mu      sync.Mutex
+	epoch   uint64
+	seq     uint64
+	nodes   set.Set[key.NodePublic]
+	pending map[uint64]TrustDelta // 乱序到达的增量，按Seq索引
+}
+
+func (ts *trustStore) contains(k key.NodePublic) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.nodes.Contains(k)
+}
+
+func (ts *trustStore) len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.nodes)
+}
+
+func (ts *trustStore) version() (epoch, seq uint64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.epoch, ts.seq
+}
+
+// reset 以完整列表替换受信客户端，并丢弃所有缓存的增量。
+func (ts *trustStore) reset(epoch, seq uint64, nodes []key.NodePublic) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.epoch, ts.seq = epoch, seq
+	ts.nodes = set.SetOf(nodes)
+	ts.pending = nil
+}
+
+// apply 应用一批增量。重复的增量被忽略；乱序的增量被缓存，直到前序增量到达。
+func (ts *trustStore) apply(b *TrustDeltaBatch) (ack TrustDeltaAck) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	defer func() {
+		ack.Epoch, ack.Seq, ack.Pending = ts.epoch, ts.seq, len(ts.pending)
+	}()
+
+	switch {
+	case b.Epoch < ts.epoch:
+		// 旧epoch的重放，已被之后的全量同步覆盖
+		ack.Duplicate = len(b.Deltas)
+		return ack
+	case b.Epoch > ts.epoch:
+		ack.NeedFull = true
+		return ack
+	}
+	for _, d := range b.Deltas {
+		if _, ok := ts.pending[d.Seq]; ok || d.Seq <= ts.seq {
+			ack.Duplicate++
+			continue
+		}
+		if ts.pending == nil {
+			ts.pending = map[uint64]TrustDelta{}
+		}
+		ts.pending[d.Seq] = d
+	}
+	for {
+		d, ok := ts.pending[ts.seq+1]
+		if !ok {
+			break
+		}
+		delete(ts.pending, d.Seq)
+		if ts.nodes == nil {
+			ts.nodes = set.Set[key.NodePublic]{}
+		}
+		ts.nodes.AddSlice(d.Add)
+		for _, k := range d.Remove {
+			ts.nodes.Delete(k)
+		}
+		ts.seq = d.Seq
+		ack.Applied++
+	}
+	if len(ts.pending) > maxPendingTrustDeltas {
+		ack.NeedFull = true
+	}
+	return ack
+}
+
+// parseTrustNodes 解析控制器在全量列表中给出的节点公钥，允许省略"nodekey:"前缀。
+func parseTrustNodes(nodes []string) ([]key.NodePublic, error) {
+	ret := make([]key.NodePublic, 0, len(nodes))
+	for _, n := range nodes {
+		k, err := key.ParseNodePublicUntyped(mem.S(strings.TrimPrefix(n, "nodekey:")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted node %q: %w", n, err)
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+// trustSnapshot 是受信客户端列表在磁盘上的快照，使得受管DERP在重启后、
+// 控制器尚未应答前，仍可按最后一次成功获取的列表服务客户端。
+type trustSnapshot struct {
+	Epoch       uint64
+	SeqNum      uint64
+	TrustNodes  []key.NodePublic
+	NaviInfo    NaviNode          // 最后一次登录时控制器下发的配置
+	RegionPeers []NaviNode        `json:",omitempty"` // 同区域的其他中继，用于自动mesh
+	CtrlPubkey  key.MachinePublic // 控制器的noise公钥，控制器不可达时用于建立noise客户端
+	Timestamp   time.Time         // 快照写入时间
+}
+
+// SetTrustSnapshotPath 设置受信客户端列表快照的存储路径。
+//
+// It must be called before PrepareManaged.
+func (s *Server) SetTrustSnapshotPath(path string) {
+	s.trustSnapshotPath = path
+}
+
+// loadTrustSnapshot 从磁盘读取上次保存的受信列表，此时列表被标记为过期，
+// 直到控制器应答。
+func (s *Server) loadTrustSnapshot() error {
+	if s.trustSnapshotPath == "" {
+		return nil
+	}
+	db, err := jsondb.Open[trustSnapshot](s.trustSnapshotPath)
+	if err != nil {
+		return fmt.Errorf("open trust snapshot: %w", err)
+	}
+	s.trustDB = db
+	snap := db.Data
+	if snap.Timestamp.IsZero() {
+		return nil // 尚未保存过
+	}
+	s.trust.reset(snap.Epoch, snap.SeqNum, snap.TrustNodes)
+	s.setNaviInfo(snap.NaviInfo)
+	s.setRegionPeers(snap.RegionPeers)
+	s.trustStale.Store(true)
+	s.logf("derp: loaded %d trusted nodes from snapshot of %v (stale until control answers)",
+		len(snap.TrustNodes), snap.Timestamp.Format(time.RFC3339))
+	return nil
+}
+
+// LastNaviInfo 返回快照中保存的NaviNode配置，供控制器不可达时启动使用。
+func (s *Server) LastNaviInfo() (NaviNode, bool) {
+	if s.trustDB == nil || s.trustDB.Data.Timestamp.IsZero() {
+		return NaviNode{}, false
+	}
+	return s.trustDB.Data.NaviInfo, true
+}
+
+// snapshotCtrlPubkey 返回快照中记录的控制器公钥（可能为零值）。
+func (s *Server) snapshotCtrlPubkey() key.MachinePublic {
+	if s.trustDB == nil {
+		return key.MachinePublic{}
+	}
+	return s.trustDB.Data.CtrlPubkey
+}
+
+// TrustListStale 报告当前受信列表是否仅来自磁盘快照，尚未得到控制器确认。
+func (s *Server) TrustListStale() bool {
+	return s.trustStale.Load()
+}
+
+// replaceTrustNodes 以控制器给出的完整列表替换受信客户端并保存快照。
+func (s *Server) replaceTrustNodes(nodes []string, epoch, seq uint64, naviInfo *NaviNode) error {
+	keys, err := parseTrustNodes(nodes)
+	if err != nil {
+		return err
+	}
+	s.trust.reset(epoch, seq, keys)
+	s.trustStale.Store(false)
+	s.trustLastPull.Store(s.clock.Now().UnixNano())
+	s.saveTrustSnapshot(naviInfo)
+	return nil
+}
+
+// applyTrustDeltas 应用控制器推送的增量；若需要全量同步则立即进行。
+func (s *Server) applyTrustDeltas(b *TrustDeltaBatch) TrustDeltaAck {
+	ack := s.trust.apply(b)
+	if ack.NeedFull {
+		s.trustDeltaErrors.Add(1)
+		s.logf("derp: trust delta epoch %d seq %d not applicable at epoch %d seq %d; pulling full list",
+			b.Epoch, lastDeltaSeq(b), ack.Epoch, ack.Seq)
+		if err := s.PullNodesList(); err != nil {
+			s.logf("derp: pulling full trust list: %v", err)
+			return ack
+		}
+		ack.Epoch, ack.Seq = s.trust.version()
+		ack.Pending = 0
+		ack.NeedFull = false
+		return ack
+	}
+	if ack.Applied > 0 {
+		s.saveTrustSnapshot(nil)
+	}
+	return ack
+}
+
+func lastDeltaSeq(b *TrustDeltaBatch) uint64 {
+	if len(b.Deltas) == 0 {
+		return 0
+	}
+	return b.Deltas[len(b.Deltas)-1].Seq
+}
+
+// saveTrustSnapshot 将当前受信列表写入磁盘。写入失败只记录日志，不影响服务。
+func (s *Server) saveTrustSnapshot(naviInfo *NaviNode) {
+	if s.trustDB == nil {
+		return
+	}
+	s.trustSnapMu.Lock()
+	defer s.trustSnapMu.Unlock()
+
+	snap := s.trustDB.Data
+	s.trust.mu.Lock()
+	snap.Epoch, snap.SeqNum = s.trust.epoch, s.trust.seq
+	snap.TrustNodes = s.trust.nodes.Slice()
+	s.trust.mu.Unlock()
+	if naviInfo != nil {
+		snap.NaviInfo = *naviInfo
+	}
+	snap.RegionPeers = s.RegionPeers()
+	snap.CtrlPubkey = s.ctrlPubkey
+	snap.Timestamp = s.clock.Now()
+	if err := s.trustDB.Save(); err != nil {
+		s.logf("derp: saving trust snapshot: %v", err)
+	}
+}
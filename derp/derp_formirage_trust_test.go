@@ -0,0 +1,209 @@
+package derp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// fakeControl is a stand-in for the Mirage control server: it serves the
+// full trusted node list and pushes sealed delta batches at a DERP server.
+type fakeControl struct {
+	t        *testing.T
+	priv     key.MachinePrivate
+	naviPub  key.MachinePublic
+	srv      *httptest.Server
+	mu       sync.Mutex
+	epoch    uint64
+	seq      uint64
+	nodes    []key.NodePublic
+	numPulls int
+	region   []NaviNode // served at /navi/region
+}
+
+func newFakeControl(t *testing.T, naviPub key.MachinePublic) *fakeControl {
+	fc := &fakeControl{t: t, priv: key.NewMachine(), naviPub: naviPub, epoch: 1}
+	fc.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		switch r.URL.Path {
+		case "/navi/nodes":
+		case "/navi/region":
+			json.NewEncoder(w).Encode(RegionPeersResponse{RegionID: 900, Peers: fc.region})
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		fc.numPulls++
+		resp := PullNodesListResponse{Epoch: fc.epoch, SeqNum: fc.seq}
+		for _, k := range fc.nodes {
+			resp.TrustNodes = append(resp.TrustNodes, k.UntypedHexString())
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(fc.srv.Close)
+	return fc
+}
+
+func (fc *fakeControl) pulls() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.numPulls
+}
+
+// push delivers b to s the way the Noise handler would and returns the ack.
+func (fc *fakeControl) push(s *Server, b TrustDeltaBatch) TrustDeltaAck {
+	fc.t.Helper()
+	msg, err := json.Marshal(b)
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+	body := fc.priv.SealTo(fc.naviPub, msg)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/ctrl/nodes", bytes.NewReader(body))
+	(&ts2021App{navi: s}).NoiseNodeChangeHandler(rec, req)
+	if rec.Code != 200 {
+		fc.t.Fatalf("push: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var ack TrustDeltaAck
+	if err := json.Unmarshal(rec.Body.Bytes(), &ack); err != nil {
+		fc.t.Fatal(err)
+	}
+	return ack
+}
+
+func newManagedTestServer(t *testing.T) (*Server, *fakeControl) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	t.Cleanup(func() { s.Close() })
+	s.naviPriKey = key.NewMachine()
+	s.derpID = "navi-test"
+	s.SetVerifyClient(true)
+	s.SetTrustSnapshotPath(filepath.Join(t.TempDir(), "trust.json"))
+	if err := s.loadTrustSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	fc := newFakeControl(t, s.naviPriKey.Public())
+	s.ctx = context.Background()
+	s.ctrlURL = fc.srv.URL
+	s.ctrlPubkey = fc.priv.Public()
+	s.ctrlClient = fc.srv.Client()
+	return s, fc
+}
+
+func TestTrustDeltas(t *testing.T) {
+	s, fc := newManagedTestServer(t)
+	n := make([]key.NodePublic, 5)
+	for i := range n {
+		n[i] = key.NewNode().Public()
+	}
+	fc.nodes = n[:1]
+	if err := s.PullNodesList(); err != nil {
+		t.Fatal(err)
+	}
+	checkTrusted := func(want ...key.NodePublic) {
+		t.Helper()
+		wantSet := map[key.NodePublic]bool{}
+		for _, k := range want {
+			wantSet[k] = true
+		}
+		for i, k := range n {
+			err := s.verifyClient(k, nil)
+			if got := err == nil; got != wantSet[k] {
+				t.Errorf("node %d trusted = %v; want %v", i, got, wantSet[k])
+			}
+		}
+	}
+	checkTrusted(n[0])
+
+	// Out of order: seq 2 arrives before seq 1.
+	ack := fc.push(s, TrustDeltaBatch{Epoch: 1, Deltas: []TrustDelta{{Seq: 2, Add: n[2:3]}}})
+	if ack.Applied != 0 || ack.Pending != 1 || ack.Seq != 0 {
+		t.Errorf("after seq 2: ack = %+v", ack)
+	}
+	checkTrusted(n[0])
+	ack = fc.push(s, TrustDeltaBatch{Epoch: 1, Deltas: []TrustDelta{{Seq: 1, Add: n[1:2]}}})
+	if ack.Applied != 2 || ack.Pending != 0 || ack.Seq != 2 {
+		t.Errorf("after seq 1: ack = %+v", ack)
+	}
+	checkTrusted(n[0], n[1], n[2])
+
+	// Duplicates are ignored, even when they'd undo a later delta.
+	ack = fc.push(s, TrustDeltaBatch{Epoch: 1, Deltas: []TrustDelta{
+		{Seq: 3, Remove: n[0:1]},
+		{Seq: 3, Remove: n[0:1]},
+		{Seq: 1, Add: n[1:2]},
+	}})
+	if ack.Applied != 1 || ack.Duplicate != 2 || ack.Seq != 3 {
+		t.Errorf("after dups: ack = %+v", ack)
+	}
+	checkTrusted(n[1], n[2])
+	if got := fc.pulls(); got != 1 {
+		t.Errorf("pulls = %d; want 1", got)
+	}
+
+	// A new epoch forces a full pull.
+	fc.mu.Lock()
+	fc.epoch, fc.seq, fc.nodes = 2, 7, n[3:5]
+	fc.mu.Unlock()
+	ack = fc.push(s, TrustDeltaBatch{Epoch: 2, Deltas: []TrustDelta{{Seq: 8, Add: n[0:1]}}})
+	if ack.NeedFull || ack.Epoch != 2 || ack.Seq != 7 {
+		t.Errorf("after epoch change: ack = %+v", ack)
+	}
+	checkTrusted(n[3], n[4])
+	if got := fc.pulls(); got != 2 {
+		t.Errorf("pulls = %d; want 2", got)
+	}
+
+	// Deltas replayed from the old epoch are dropped.
+	ack = fc.push(s, TrustDeltaBatch{Epoch: 1, Deltas: []TrustDelta{{Seq: 4, Add: n[0:1]}}})
+	if ack.Duplicate != 1 || ack.Applied != 0 {
+		t.Errorf("after old epoch: ack = %+v", ack)
+	}
+	checkTrusted(n[3], n[4])
+
+	// The snapshot reflects the latest state.
+	s2 := NewServer(key.NewNode(), logger.Discard)
+	defer s2.Close()
+	s2.SetVerifyClient(true)
+	s2.ctrlURL, s2.derpID = "https://ctrl.invalid", "navi-test"
+	s2.SetTrustSnapshotPath(s.trustSnapshotPath)
+	if err := s2.loadTrustSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.TrustListStale() {
+		t.Error("trust list loaded from snapshot not marked stale")
+	}
+	if epoch, seq := s2.trust.version(); epoch != 2 || seq != 7 {
+		t.Errorf("snapshot version = %d/%d; want 2/7", epoch, seq)
+	}
+	if err := s2.verifyClient(n[4], nil); err != nil {
+		t.Errorf("snapshot: %v", err)
+	}
+	if err := s2.verifyClient(n[1], nil); err == nil {
+		t.Error("snapshot: removed node still trusted")
+	}
+}
+
+func TestTrustDeltaBadSeal(t *testing.T) {
+	s, fc := newManagedTestServer(t)
+	fc.priv = key.NewMachine() // not the key s trusts
+	msg, _ := json.Marshal(TrustDeltaBatch{Epoch: 0, Deltas: []TrustDelta{{Seq: 1, Add: []key.NodePublic{key.NewNode().Public()}}}})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/ctrl/nodes", bytes.NewReader(fc.priv.SealTo(fc.naviPub, msg)))
+	(&ts2021App{navi: s}).NoiseNodeChangeHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if n := s.trust.len(); n != 0 {
+		t.Errorf("trust list has %d nodes; want 0", n)
+	}
+}
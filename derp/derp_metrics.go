@@ -0,0 +1,198 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"expvar"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/types/key"
+)
+
+// frameTypeNames are the metric label values of the frame types.
+var frameTypeNames = map[frameType]string{
+	frameServerKey:     "server_key",
+	frameClientInfo:    "client_info",
+	frameServerInfo:    "server_info",
+	frameSendPacket:    "send_packet",
+	frameForwardPacket: "forward_packet",
+	frameRecvPacket:    "recv_packet",
+	frameKeepAlive:     "keep_alive",
+	frameNotePreferred: "note_preferred",
+	framePeerGone:      "peer_gone",
+	framePeerPresent:   "peer_present",
+	frameWatchConns:    "watch_conns",
+	frameClosePeer:     "close_peer",
+	framePing:          "ping",
+	framePong:          "pong",
+	frameHealth:        "health",
+	frameRestarting:    "restarting",
+	frameDraining:      "draining",
+}
+
+// Directions of a frame, from the server's point of view.
+const (
+	frameIn  = 0 // read from a client
+	frameOut = 1 // written to a client
+)
+
+var frameDirNames = [2]string{frameIn: "in", frameOut: "out"}
+
+// Bucket boundaries of the histograms of serverMetrics.
+var (
+	frameBytesBuckets = []float64{16, 64, 256, 1024, 4096, 16384, 65536}
+	queueDepthBuckets = []float64{0, 1, 2, 4, 8, 16, perClientSendQueueDepth}
+	// 100µs to 1.6s.
+	queueDelayBuckets = []float64{0.0001, 0.0004, 0.0016, 0.0064, 0.0256, 0.1024, 0.4096, 1.6384}
+	connectBuckets    = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// serverMetrics are the distributions of a Server, which unlike the
+// expvars returned by ExpVar can't be summed up in a single counter. See
+// MetricsSnapshot.
+type serverMetrics struct {
+	frames         [2][256]*metrics.Histogram // frame bytes by direction and frame type
+	queueDepth     *metrics.Histogram
+	queueDelay     *metrics.Histogram // seconds
+	connectLatency *metrics.Histogram // seconds
+	dropBy         [][2]expvar.Int    // by dropReason and disco (1) or not (0)
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		queueDepth:     metrics.NewHistogram(queueDepthBuckets),
+		queueDelay:     metrics.NewHistogram(queueDelayBuckets),
+		connectLatency: metrics.NewHistogram(connectBuckets),
+		dropBy:         make([][2]expvar.Int, len(_dropReason_index)-1),
+	}
+	for dir := range m.frames {
+		unknown := metrics.NewHistogram(frameBytesBuckets)
+		for i := range m.frames[dir] {
+			m.frames[dir][i] = unknown
+		}
+		for ft := range frameTypeNames {
+			m.frames[dir][ft] = metrics.NewHistogram(frameBytesBuckets)
+		}
+	}
+	return m
+}
+
+func (m *serverMetrics) noteFrame(dir int, ft frameType, fl uint32) {
+	m.frames[dir][ft].Observe(float64(fl))
+}
+
+func (m *serverMetrics) noteDrop(reason dropReason, disco bool) {
+	i := 0
+	if disco {
+		i = 1
+	}
+	m.dropBy[reason][i].Add(1)
+}
+
+// HistogramSnapshot is the state of a histogram metric.
+type HistogramSnapshot struct {
+	Buckets []float64 // upper bounds, in increasing order
+	Counts  []int64   // observations at or below each of Buckets
+	Count   int64     // all observations
+	Sum     float64
+}
+
+func snapshotHistogram(h *metrics.Histogram) HistogramSnapshot {
+	var hs HistogramSnapshot
+	hs.Buckets, hs.Counts, hs.Count, hs.Sum = h.Snapshot()
+	return hs
+}
+
+// FrameLabels are the labels of a frame size histogram.
+type FrameLabels struct {
+	Direction string // "in" (from clients) or "out" (to clients)
+	Type      string // frame type, or "unknown"
+}
+
+// DropLabels are the labels of a dropped packet counter.
+type DropLabels struct {
+	Reason string
+	Kind   string // "disco" or "other"
+}
+
+// MetricsSnapshot is the state of the metrics of a Server that the expvars
+// returned by ExpVar don't cover, for exporting them in other formats such
+// as derper's Prometheus /metrics.
+type MetricsSnapshot struct {
+	FrameBytes     map[FrameLabels]HistogramSnapshot
+	QueueDepth     HistogramSnapshot // packets in the send queue when enqueuing one
+	QueueDelay     HistogramSnapshot // seconds packets spent in send queues
+	ConnectLatency HistogramSnapshot // seconds from accept to client registration
+	Drops          map[DropLabels]int64
+	MeshClients    int
+
+	// The rest is only set in managed mode.
+	Managed          bool
+	RegionPeerUp     map[string]bool // by NaviNode ID
+	TrustNodes       int
+	TrustEpoch       uint64
+	TrustSeq         uint64
+	TrustStale       bool
+	TrustLastPull    time.Time // or zero if never pulled
+	TrustDeltaErrors int64
+}
+
+// MetricsSnapshot returns the current state of the metrics of s.
+func (s *Server) MetricsSnapshot() MetricsSnapshot {
+	m := s.metrics
+	ms := MetricsSnapshot{
+		FrameBytes:     map[FrameLabels]HistogramSnapshot{},
+		QueueDepth:     snapshotHistogram(m.queueDepth),
+		QueueDelay:     snapshotHistogram(m.queueDelay),
+		ConnectLatency: snapshotHistogram(m.connectLatency),
+		Drops:          map[DropLabels]int64{},
+	}
+	for dir, name := range frameDirNames {
+		ms.FrameBytes[FrameLabels{name, "unknown"}] = snapshotHistogram(m.frames[dir][0])
+		for ft, typ := range frameTypeNames {
+			ms.FrameBytes[FrameLabels{name, typ}] = snapshotHistogram(m.frames[dir][ft])
+		}
+	}
+	for r := range m.dropBy {
+		reason := dropReason(r).String()
+		ms.Drops[DropLabels{reason, "other"}] = m.dropBy[r][0].Value()
+		ms.Drops[DropLabels{reason, "disco"}] = m.dropBy[r][1].Value()
+	}
+
+	meshed := map[key.MachinePublic]bool{}
+	s.mu.Lock()
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				ms.MeshClients++
+				if !c.naviKey.IsZero() {
+					meshed[c.naviKey] = true
+				}
+			}
+		})
+	}
+	s.mu.Unlock()
+
+	if s.naviPriKey.IsZero() {
+		return ms
+	}
+	ms.Managed = true
+	ms.RegionPeerUp = map[string]bool{}
+	for _, p := range s.RegionPeers() {
+		var k key.MachinePublic
+		if k.UnmarshalText([]byte(p.NaviKey)) != nil {
+			continue
+		}
+		ms.RegionPeerUp[p.ID] = meshed[k]
+	}
+	ms.TrustNodes = s.trust.len()
+	ms.TrustEpoch, ms.TrustSeq = s.trust.version()
+	ms.TrustStale = s.trustStale.Load()
+	if t := s.trustLastPull.Load(); t != 0 {
+		ms.TrustLastPull = time.Unix(0, t)
+	}
+	ms.TrustDeltaErrors = s.trustDeltaErrors.Value()
+	return ms
+}
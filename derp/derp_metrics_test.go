@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+func TestMetrics(t *testing.T) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+
+	a := connectAdminTestClient(t, s, "192.0.2.1:1001")
+	b := connectAdminTestClient(t, s, "192.0.2.2:1002")
+	waitConnected(t, s, a.pub, true)
+	waitConnected(t, s, b.pub, true)
+	if err := a.c.Send(b.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for got := false; !got; {
+		select {
+		case m := <-b.recv:
+			_, got = m.(ReceivedPacket)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for packet")
+		}
+	}
+	// Unknown destination.
+	if err := a.c.Send(key.NewNode().Public(), []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.packetsDropped.Value() == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for drop")
+		}
+	}
+
+	ms := s.MetricsSnapshot()
+	if h := ms.FrameBytes[FrameLabels{"in", "send_packet"}]; h.Count != 2 {
+		t.Errorf("send_packet frames in = %+v; want 2", h)
+	}
+	if h := ms.FrameBytes[FrameLabels{"out", "recv_packet"}]; h.Count != 1 || h.Sum == 0 {
+		t.Errorf("recv_packet frames out = %+v; want 1", h)
+	}
+	if n := ms.Drops[DropLabels{dropReasonUnknownDest.String(), "other"}]; n != 1 {
+		t.Errorf("unknown dest drops = %v; want 1", n)
+	}
+	if h := ms.ConnectLatency; h.Count != 2 {
+		t.Errorf("connect latency samples = %+v; want 2", h)
+	}
+	if h := ms.QueueDepth; h.Count != 1 || len(h.Counts) != len(h.Buckets) || h.Counts[0] != 1 {
+		t.Errorf("queue depth = %+v; want 1 sample in the first bucket", h)
+	}
+	if ms.Managed || ms.TrustNodes != 0 {
+		t.Errorf("unmanaged server reports managed state: %+v", ms)
+	}
+}
+
+func TestMetricsManaged(t *testing.T) {
+	s, fc := newManagedTestServer(t)
+	fc.epoch, fc.seq = 3, 7
+	fc.nodes = []key.NodePublic{key.NewNode().Public(), key.NewNode().Public()}
+	if err := s.PullNodesList(); err != nil {
+		t.Fatal(err)
+	}
+	peerKey := key.NewMachine()
+	fc.region = []NaviNode{{ID: "navi-peer", NaviKey: peerKey.Public().String()}}
+	if err := s.PullRegionPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A push not sealed by control counts as a delta error.
+	rec := httptest.NewRecorder()
+	(&ts2021App{navi: s}).NoiseNodeChangeHandler(rec, httptest.NewRequest("POST", "/ctrl/nodes", bytes.NewReader([]byte("junk"))))
+
+	ms := s.MetricsSnapshot()
+	if !ms.Managed || ms.TrustDeltaErrors != 1 || ms.TrustEpoch != 3 || ms.TrustNodes != 2 || ms.TrustSeq != 7 {
+		t.Errorf("trust metrics = %+v; want 1 delta error, epoch 3, 2 nodes, seq 7", ms)
+	}
+	if up, ok := ms.RegionPeerUp["navi-peer"]; !ok || up {
+		t.Errorf("region peer up = %v, %v; want false, true", up, ok)
+	}
+	if ms.TrustLastPull.IsZero() {
+		t.Error("last pull time not reported")
+	}
+
+	peer := connectAdminTestClient(t, s, "192.0.2.1:1001", NaviMeshAuth(peerKey, s.naviPriKey.Public()))
+	waitConnected(t, s, peer.pub, true)
+	ms = s.MetricsSnapshot()
+	if !ms.RegionPeerUp["navi-peer"] {
+		t.Errorf("region peer up = %v; want true", ms.RegionPeerUp)
+	}
+	if ms.MeshClients != 1 {
+		t.Errorf("mesh clients = %v; want 1", ms.MeshClients)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/types/key"
+)
+
+// ClientPolicy limits how much of the server a single client can use, so
+// one noisy node can't saturate a shared relay. The zero value imposes no
+// limits.
+//
+// Mesh peers are exempt.
+type ClientPolicy struct {
+	// BytesPerSec and BytesBurst bound the rate at which all connections
+	// of a node key may send packets. Zero means unlimited.
+	BytesPerSec int64 `json:",omitempty"`
+	BytesBurst  int64 `json:",omitempty"`
+
+	// IPBytesPerSec and IPBytesBurst bound the rate at which all
+	// connections from a source IP may send packets. Zero means unlimited.
+	IPBytesPerSec int64 `json:",omitempty"`
+	IPBytesBurst  int64 `json:",omitempty"`
+
+	// MaxConnsPerKey and MaxConnsPerIP bound the number of concurrent
+	// connections per node key and per source IP. Zero means unlimited.
+	MaxConnsPerKey int `json:",omitempty"`
+	MaxConnsPerIP  int `json:",omitempty"`
+}
+
+func limitAndBurst(perSec, burst int64) (rate.Limit, int) {
+	if perSec <= 0 {
+		return rate.Inf, 0
+	}
+	if burst <= 0 {
+		// Default to a second's worth.
+		burst = perSec
+	}
+	// Always allow a full packet, or the limiter would reject every
+	// packet bigger than the burst.
+	return rate.Limit(perSec), int(max(burst, MaxPacketSize))
+}
+
+// policyEntry is the state shared by all connections of one node key or
+// one source IP.
+type policyEntry struct {
+	conns int
+	lim   *rate.Limiter // rate.Inf if unlimited
+}
+
+// clientPolicyState tracks connections and byte rates per node key and
+// per source IP.
+type clientPolicyState struct {
+	mu     sync.Mutex
+	policy ClientPolicy
+	byKey  map[key.NodePublic]*policyEntry
+	byIP   map[netip.Addr]*policyEntry
+}
+
+// SetClientPolicy sets the per-client limits. It may be called at any time;
+// limits of connected clients are updated in place, but existing
+// connections are never closed for exceeding a lowered connection limit.
+func (s *Server) SetClientPolicy(p ClientPolicy) {
+	ps := &s.clientPolicy
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.policy = p
+	keyLim, keyBurst := limitAndBurst(p.BytesPerSec, p.BytesBurst)
+	for _, e := range ps.byKey {
+		e.lim.SetLimit(keyLim)
+		e.lim.SetBurst(keyBurst)
+	}
+	ipLim, ipBurst := limitAndBurst(p.IPBytesPerSec, p.IPBytesBurst)
+	for _, e := range ps.byIP {
+		e.lim.SetLimit(ipLim)
+		e.lim.SetBurst(ipBurst)
+	}
+}
+
+// ClientPolicy returns the current per-client limits.
+func (s *Server) ClientPolicy() ClientPolicy {
+	s.clientPolicy.mu.Lock()
+	defer s.clientPolicy.mu.Unlock()
+	return s.clientPolicy.policy
+}
+
+// admitClient checks the connection limits for a new connection from k at
+// ip and, if admitted, counts it. The returned release func must be called
+// when the connection ends; it returns the limiters the connection must
+// charge its sent bytes to.
+func (s *Server) admitClient(k key.NodePublic, ip netip.Addr) (keyLim, ipLim *rate.Limiter, release func(), err error) {
+	ps := &s.clientPolicy
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ke := ps.byKey[k]
+	if p := ps.policy.MaxConnsPerKey; p > 0 && ke != nil && ke.conns >= p {
+		s.policyRejectedKey.Add(1)
+		return nil, nil, nil, fmt.Errorf("too many connections for key (limit %d)", p)
+	}
+	var ie *policyEntry
+	if ip.IsValid() {
+		ie = ps.byIP[ip]
+		if p := ps.policy.MaxConnsPerIP; p > 0 && ie != nil && ie.conns >= p {
+			s.policyRejectedIP.Add(1)
+			return nil, nil, nil, fmt.Errorf("too many connections from %v (limit %d)", ip, p)
+		}
+	}
+
+	if ke == nil {
+		if ps.byKey == nil {
+			ps.byKey = map[key.NodePublic]*policyEntry{}
+		}
+		ke = &policyEntry{lim: rate.NewLimiter(limitAndBurst(ps.policy.BytesPerSec, ps.policy.BytesBurst))}
+		ps.byKey[k] = ke
+	}
+	ke.conns++
+	if ip.IsValid() {
+		if ie == nil {
+			if ps.byIP == nil {
+				ps.byIP = map[netip.Addr]*policyEntry{}
+			}
+			ie = &policyEntry{lim: rate.NewLimiter(limitAndBurst(ps.policy.IPBytesPerSec, ps.policy.IPBytesBurst))}
+			ps.byIP[ip] = ie
+		}
+		ie.conns++
+		ipLim = ie.lim
+	}
+
+	release = func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		if ke.conns--; ke.conns == 0 {
+			delete(ps.byKey, k)
+		}
+		if ie != nil {
+			if ie.conns--; ie.conns == 0 {
+				delete(ps.byIP, ip)
+			}
+		}
+	}
+	return ke.lim, ipLim, release, nil
+}
+
+// allowSend reports whether c may send a packet of n bytes under the
+// client policy. If not, it returns the drop reason.
+func (c *sclient) allowSend(n int) (dropReason, bool) {
+	if c.canMesh {
+		return 0, true
+	}
+	now := c.s.clock.Now()
+	var keyRes *rate.Reservation
+	if c.keyLim != nil {
+		keyRes = c.keyLim.ReserveN(now, n)
+		if !keyRes.OK() || keyRes.DelayFrom(now) > 0 {
+			keyRes.CancelAt(now)
+			return dropReasonRateLimitedKey, false
+		}
+	}
+	if c.ipLim != nil && !c.ipLim.AllowN(now, n) {
+		// Give back the key's tokens: the packet isn't sent.
+		if keyRes != nil {
+			keyRes.CancelAt(now)
+		}
+		return dropReasonRateLimitedIP, false
+	}
+	return 0, true
+}
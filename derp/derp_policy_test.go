@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+func TestClientPolicyConns(t *testing.T) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	s.SetClientPolicy(ClientPolicy{MaxConnsPerKey: 2, MaxConnsPerIP: 3})
+
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	var releases []func()
+	admit := func(k key.NodePublic, ip netip.Addr) error {
+		_, _, release, err := s.admitClient(k, ip)
+		if err == nil {
+			releases = append(releases, release)
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := admit(k1, ip); err != nil {
+			t.Fatalf("conn %d: %v", i, err)
+		}
+	}
+	if err := admit(k1, netip.MustParseAddr("192.0.2.2")); err == nil {
+		t.Error("third conn for key admitted")
+	}
+	if err := admit(k2, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := admit(key.NewNode().Public(), ip); err == nil {
+		t.Error("fourth conn from IP admitted")
+	}
+	if got := s.policyRejectedKey.Value(); got != 1 {
+		t.Errorf("key rejections = %d; want 1", got)
+	}
+	if got := s.policyRejectedIP.Value(); got != 1 {
+		t.Errorf("IP rejections = %d; want 1", got)
+	}
+
+	releases[0]()
+	if err := admit(k1, ip); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+	if n := len(s.clientPolicy.byKey) + len(s.clientPolicy.byIP); n != 0 {
+		t.Errorf("%d policy entries left after all releases", n)
+	}
+}
+
+func TestClientPolicyRate(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	s.clock = clock
+	s.SetClientPolicy(ClientPolicy{BytesPerSec: 100 << 10, IPBytesPerSec: 1 << 20})
+
+	k := key.NewNode().Public()
+	keyLim, ipLim, release, err := s.admitClient(k, netip.MustParseAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	c := &sclient{s: s, key: k, keyLim: keyLim, ipLim: ipLim}
+
+	// The burst defaults to one second's worth.
+	for sent := 0; sent < 100<<10; sent += 1 << 10 {
+		if reason, ok := c.allowSend(1 << 10); !ok {
+			t.Fatalf("dropped after %d bytes: %v", sent, reason)
+		}
+	}
+	if reason, ok := c.allowSend(1 << 10); ok || reason != dropReasonRateLimitedKey {
+		t.Errorf("over limit: got (%v, %v); want (%v, false)", reason, ok, dropReasonRateLimitedKey)
+	}
+	clock.Advance(time.Second)
+	if _, ok := c.allowSend(1 << 10); !ok {
+		t.Error("still limited after refill")
+	}
+
+	// Lifting the limit applies to connected clients.
+	s.SetClientPolicy(ClientPolicy{})
+	for i := 0; i < 1000; i++ {
+		if reason, ok := c.allowSend(64 << 10); !ok {
+			t.Fatalf("unlimited policy dropped packet %d: %v", i, reason)
+		}
+	}
+
+	c.canMesh = true
+	s.SetClientPolicy(ClientPolicy{BytesPerSec: 1})
+	if _, ok := c.allowSend(64 << 10); !ok {
+		t.Error("mesh peer was rate limited")
+	}
+}
+
+func TestLimitAndBurst(t *testing.T) {
+	tests := []struct {
+		perSec, burst int64
+		wantBurst     int
+	}{
+		{0, 100, 0},
+		{100 << 10, 0, 100 << 10},
+		{100 << 10, 200 << 10, 200 << 10},
+		{100 << 10, 80 << 10, 80 << 10}, // smaller than a second's worth is kept
+		{1 << 10, 0, MaxPacketSize},
+		{100 << 10, 1, MaxPacketSize},
+	}
+	for _, tt := range tests {
+		if _, got := limitAndBurst(tt.perSec, tt.burst); got != tt.wantBurst {
+			t.Errorf("limitAndBurst(%d, %d) burst = %d; want %d", tt.perSec, tt.burst, got, tt.wantBurst)
+		}
+	}
+}
+
+func TestClientPolicyRateIPRejectKeepsKeyBudget(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	s.clock = clock
+	s.SetClientPolicy(ClientPolicy{
+		BytesPerSec:   200 << 10,
+		IPBytesPerSec: 100 << 10,
+	})
+	ip := netip.MustParseAddr("192.0.2.1")
+	newClient := func() *sclient {
+		k := key.NewNode().Public()
+		keyLim, ipLim, release, err := s.admitClient(k, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(release)
+		return &sclient{s: s, key: k, keyLim: keyLim, ipLim: ipLim}
+	}
+	c1, c2 := newClient(), newClient()
+
+	// c2 uses up the IP's budget, so c1's packets are refused by the IP
+	// limiter without being charged to c1's key.
+	for sent := 0; sent < 100<<10; sent += 1 << 10 {
+		if reason, ok := c2.allowSend(1 << 10); !ok {
+			t.Fatalf("dropped after %d bytes: %v", sent, reason)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if reason, ok := c1.allowSend(1 << 10); ok || reason != dropReasonRateLimitedIP {
+			t.Fatalf("packet %d over IP limit: got (%v, %v); want (%v, false)", i, reason, ok, dropReasonRateLimitedIP)
+		}
+	}
+	if got := c1.keyLim.TokensAt(clock.Now()); got != 200<<10 {
+		t.Errorf("c1 key tokens after IP rejections = %v; want %v", got, 200<<10)
+	}
+}
@@ -33,14 +33,15 @@
 	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/ristretto"
 	"github.com/robfig/cron/v3"
 	"go4.org/mem"
 	"golang.org/x/sync/errgroup"
+	xrate "golang.org/x/time/rate"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/disco"
 	"tailscale.com/envknob"
+	"tailscale.com/jsondb"
 	"tailscale.com/metrics"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/netmon"
@@ -110,13 +111,42 @@ type Server struct {
 	netMon   *netmon.Monitor    // or nil
 	dnsCache *dnscache.Resolver // or nil
 
-	trustNodesCache *ristretto.Cache // 用于存储受信客户端信息
-	Cronjob         *cron.Cron       // 用于定时从控制器拉取受信客户端信息
+	// ctrlClient 用于向控制器发起请求，通常为nc
+	ctrlClient interface {
+		Do(*http.Request) (*http.Response, error)
+	}
+
+	trust   trustStore // 受信客户端列表
+	Cronjob *cron.Cron // 用于定时从控制器拉取受信客户端信息
+
+	trustSnapshotPath string                    // 受信列表快照路径，为空则不持久化
+	trustDB           *jsondb.DB[trustSnapshot] // or nil
+	trustSnapMu       sync.Mutex                // 串行化快照写入
+	trustStale        atomic.Bool               // 受信列表仅来自快照，尚未被控制器确认
+	trustLastPull     atomic.Int64              // 最近一次全量拉取受信列表的时间（UnixNano），0表示尚未拉取
+	trustDeltaErrors  expvar.Int                // 被拒绝或无法应用的受信增量推送数
+
+	naviMu        sync.Mutex
+	naviInfo      NaviNode         // 当前生效的NaviNode配置
+	naviInfoHook  NaviInfoHook     // or nil
+	naviEndpoints []netip.AddrPort // 向控制器报告的本中继地址
+
+	regionPeers     []NaviNode                 // 同区域的其他中继
+	regionPeerKeys  set.Set[key.MachinePublic] // regionPeers的NaviKey，可用于mesh认证
+	regionPeersHook func([]NaviNode)           // or nil
+	draining        atomic.Bool                // 不再接受新的（非mesh）客户端
+	drainMu         sync.Mutex
+	drainStop       chan struct{} // closed to stop an in-progress Drain; nil if none
 
 	// WriteTimeout, if non-zero, specifies how long to wait
 	// before failing when writing to a client.
 	WriteTimeout time.Duration
 
+	// DrainWindow, if non-zero, is how long Drain spreads out
+	// closing client connections when not given a window.
+	// The default is defaultDrainWindow.
+	DrainWindow time.Duration
+
 	privateKey  key.NodePrivate
 	publicKey   key.NodePublic
 	logf        logger.Logf
@@ -145,6 +175,7 @@ type Server struct {
 	packetsForwardedIn           expvar.Int
 	peerGoneDisconnectedFrames   expvar.Int // number of peer disconnected frames sent
 	peerGoneNotHereFrames        expvar.Int // number of peer not here frames sent
+	drainClosedConns             expvar.Int // number of client connections closed by Drain
 	gotPing                      expvar.Int // number of ping frames from client
 	sentPong                     expvar.Int // number of pong frames enqueued to client
 	accepts                      expvar.Int
@@ -161,6 +192,12 @@ type Server struct {
 	removePktForwardOther        expvar.Int
 	avgQueueDuration             *uint64          // In milliseconds; accessed atomically
 	tcpRtt                       metrics.LabelMap // histogram
+	metrics                      *serverMetrics   // distributions; see MetricsSnapshot
+
+	clientPolicy      clientPolicyState
+	policyRejectedKey *expvar.Int // connections rejected by ClientPolicy.MaxConnsPerKey
+	policyRejectedIP  *expvar.Int // connections rejected by ClientPolicy.MaxConnsPerIP
+	policyRejected    metrics.LabelMap
 
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's LocalAPI.
@@ -331,6 +368,7 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		packetsRecvByKind:    metrics.LabelMap{Label: "kind"},
 		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
 		packetsDroppedType:   metrics.LabelMap{Label: "type"},
+		policyRejected:       metrics.LabelMap{Label: "limit"},
 		clients:              map[key.NodePublic]clientSet{},
 		clientsMesh:          map[key.NodePublic]PacketForwarder{},
 		netConns:             map[Conn]chan struct{}{},
@@ -341,20 +379,25 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		tcpRtt:               metrics.LabelMap{Label: "le"},
 		keyOfAddr:            map[netip.AddrPort]key.NodePublic{},
 		clock:                tstime.StdClock{},
+		metrics:              newServerMetrics(),
 	}
 
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
 	s.packetsRecvOther = s.packetsRecvByKind.Get("other")
 	s.packetsDroppedReasonCounters = []*expvar.Int{
-		s.packetsDroppedReason.Get("unknown_dest"),
-		s.packetsDroppedReason.Get("unknown_dest_on_fwd"),
-		s.packetsDroppedReason.Get("gone_disconnected"),
-		s.packetsDroppedReason.Get("gone_not_here"),
-		s.packetsDroppedReason.Get("queue_head"),
-		s.packetsDroppedReason.Get("queue_tail"),
-		s.packetsDroppedReason.Get("write_error"),
-	}
+		dropReasonUnknownDest:      s.packetsDroppedReason.Get("unknown_dest"),
+		dropReasonUnknownDestOnFwd: s.packetsDroppedReason.Get("unknown_dest_on_fwd"),
+		dropReasonGoneDisconnected: s.packetsDroppedReason.Get("gone_disconnected"),
+		dropReasonQueueHead:        s.packetsDroppedReason.Get("queue_head"),
+		dropReasonQueueTail:        s.packetsDroppedReason.Get("queue_tail"),
+		dropReasonWriteError:       s.packetsDroppedReason.Get("write_error"),
+		dropReasonDupClient:        s.packetsDroppedReason.Get("dup_client"),
+		dropReasonRateLimitedKey:   s.packetsDroppedReason.Get("rate_limited_key"),
+		dropReasonRateLimitedIP:    s.packetsDroppedReason.Get("rate_limited_ip"),
+	}
+	s.policyRejectedKey = s.policyRejected.Get("conns_per_key")
+	s.policyRejectedIP = s.policyRejected.Get("conns_per_ip")
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
 	return s
@@ -699,6 +742,7 @@ func (s *Server) addWatcher(c *sclient) {
 }
 
 func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, remoteAddr string, connNum int64) error {
+	start := s.clock.Now()
 	br := brw.Reader
 	nc.SetDeadline(time.Now().Add(10 * time.Second))
 	bw := &lazyBufioWriter{w: nc, lbw: brw.Writer}
@@ -710,8 +754,34 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
-		return fmt.Errorf("client %x rejected: %v", clientKey, err)
+	canMesh := clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey
+	var naviKey key.MachinePublic
+	if !canMesh && clientInfo.NaviMesh != nil {
+		naviKey, err = s.verifyNaviMesh(clientKey, clientInfo.NaviMesh)
+		if err != nil {
+			return fmt.Errorf("client %x rejected: %v", clientKey, err)
+		}
+		canMesh = true
+	}
+	// Mesh peers are other DERP servers, not clients control knows about.
+	if !canMesh {
+		if err := s.verifyClient(clientKey, clientInfo); err != nil {
+			return fmt.Errorf("client %x rejected: %v", clientKey, err)
+		}
+	}
+
+	remoteIPPort, _ := netip.ParseAddrPort(remoteAddr)
+	if !canMesh && s.draining.Load() {
+		return fmt.Errorf("client %x rejected: server draining", clientKey)
+	}
+	var keyLim, ipLim *xrate.Limiter
+	if !canMesh {
+		var release func()
+		keyLim, ipLim, release, err = s.admitClient(clientKey, remoteIPPort.Addr())
+		if err != nil {
+			return fmt.Errorf("client %x rejected: %v", clientKey, err)
+		}
+		defer release()
 	}
 
 	// At this point we trust the client so we don't time out.
@@ -720,8 +790,6 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	remoteIPPort, _ := netip.ParseAddrPort(remoteAddr)
-
 	c := &sclient{
 		connNum:        connNum,
 		s:              s,
@@ -738,8 +806,12 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		sendPongCh:     make(chan [8]byte, 1),
 		peerGone:       make(chan peerGoneMsg),
-		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
+		drainNotify:    make(chan time.Duration, 1),
+		canMesh:        canMesh,
+		naviKey:        naviKey,
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
+		keyLim:         keyLim,
+		ipLim:          ipLim,
 	}
 
 	if c.canMesh {
@@ -757,6 +829,7 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 
 	s.registerClient(c)
 	defer s.unregisterClient(c)
+	s.metrics.connectLatency.Observe(s.clock.Since(start).Seconds())
 
 	err = s.sendServerInfo(c.bw, clientKey)
 	if err != nil {
@@ -812,6 +885,7 @@ func (c *sclient) run(ctx context.Context) error {
 			return fmt.Errorf("client %s: readFrameHeader: %w", c.key.ShortString(), err)
 		}
 		c.s.noteClientActivity(c)
+		c.s.metrics.noteFrame(frameIn, ft, fl)
 		switch ft {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
@@ -934,6 +1008,8 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %x: recvForwardPacket: %v", c.key, err)
 	}
 	s.packetsForwardedIn.Add(1)
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
 
 	var dstLen int
 	var dst *sclient
@@ -988,6 +1064,13 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
+	if reason, ok := c.allowSend(len(contents)); !ok {
+		s.recordDrop(contents, c.key, dstKey, reason)
+		c.debugLogf("SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), reason)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -1055,12 +1138,15 @@ func (c *sclient) debugLogf(format string, v ...any) {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimitedKey                     // the source key exceeded its ClientPolicy byte rate
+	dropReasonRateLimitedIP                      // the source IP exceeded its ClientPolicy byte rate
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
 	s.packetsDropped.Add(1)
 	s.packetsDroppedReasonCounters[reason].Add(1)
 	looksDisco := disco.LooksLikeDiscoWrapper(packetBytes)
+	s.metrics.noteDrop(reason, looksDisco)
 	if looksDisco {
 		s.packetsDroppedTypeDisco.Add(1)
 	} else {
@@ -1096,8 +1182,10 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 			return nil
 		default:
 		}
+		depth := len(sendQueue)
 		select {
 		case sendQueue <- p:
+			s.metrics.queueDepth.Observe(float64(depth))
 			dst.debugLogf("sendPkt attempt %d enqueued", attempt)
 			return nil
 		default:
@@ -1160,11 +1248,10 @@ func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error
 		}
 	} else { // 受管，采用控制器验证
 		log.Printf("derp: verify client %v", clientKey.String())
-		if _, ok := s.trustNodesCache.Get(strings.TrimPrefix(clientKey.String(), "nodekey:")); !ok {
+		if !s.trust.contains(clientKey) {
 			return fmt.Errorf("client %v not acceptable due to ctrl server", clientKey)
 		}
 	}
-	// TODO(bradfitz): add policy for configurable bandwidth rate per client?
 	return nil
 }
 
@@ -1349,18 +1436,20 @@ type sclient struct {
 	key            key.NodePublic
 	info           clientInfo
 	logf           logger.Logf
-	done           <-chan struct{}  // closed when connection closes
-	remoteAddr     string           // usually ip:port from net.Conn.RemoteAddr().String()
-	remoteIPPort   netip.AddrPort   // zero if remoteAddr is not ip:port.
-	sendQueue      chan pkt         // packets queued to this client; never closed
-	discoSendQueue chan pkt         // important packets queued to this client; never closed
-	sendPongCh     chan [8]byte     // pong replies to send to the client; never closed
-	peerGone       chan peerGoneMsg // write request that a peer is not at this server (not used by mesh peers)
-	meshUpdate     chan struct{}    // write request to write peerStateChange
-	canMesh        bool             // clientInfo had correct mesh token for inter-region routing
-	isDup          atomic.Bool      // whether more than 1 sclient for key is connected
-	isDisabled     atomic.Bool      // whether sends to this peer are disabled due to active/active dups
-	debug          bool             // turn on for verbose logging
+	done           <-chan struct{}    // closed when connection closes
+	remoteAddr     string             // usually ip:port from net.Conn.RemoteAddr().String()
+	remoteIPPort   netip.AddrPort     // zero if remoteAddr is not ip:port.
+	sendQueue      chan pkt           // packets queued to this client; never closed
+	discoSendQueue chan pkt           // important packets queued to this client; never closed
+	sendPongCh     chan [8]byte       // pong replies to send to the client; never closed
+	peerGone       chan peerGoneMsg   // write request that a peer is not at this server (not used by mesh peers)
+	meshUpdate     chan struct{}      // write request to write peerStateChange
+	drainNotify    chan time.Duration // write request for frameDraining; buffered 1
+	canMesh        bool               // clientInfo had correct mesh token for inter-region routing
+	naviKey        key.MachinePublic  // if canMesh through NaviMeshAuth, the peer's Navi key
+	isDup          atomic.Bool        // whether more than 1 sclient for key is connected
+	isDisabled     atomic.Bool        // whether sends to this peer are disabled due to active/active dups
+	debug          bool               // turn on for verbose logging
 
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
@@ -1382,6 +1471,14 @@ type sclient struct {
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// keyLim and ipLim, if non-nil, are the ClientPolicy byte rate
+	// limiters shared by all connections of this key and source IP.
+	keyLim, ipLim *xrate.Limiter
+
+	// Per-connection counters, for the admin API.
+	packetsRecv, bytesRecv atomic.Int64
+	packetsSent, bytesSent atomic.Int64
 }
 
 // peerConnState represents whether a peer is connected to the server
@@ -1446,7 +1543,9 @@ func expMovingAverage(prev, newValue, alpha float64) float64 {
 
 // recordQueueTime updates the average queue duration metric after a packet has been sent.
 func (c *sclient) recordQueueTime(enqueuedAt time.Time) {
-	elapsed := float64(c.s.clock.Since(enqueuedAt).Milliseconds())
+	d := c.s.clock.Since(enqueuedAt)
+	c.s.metrics.queueDelay.Observe(d.Seconds())
+	elapsed := float64(d.Milliseconds())
 	for {
 		old := atomic.LoadUint64(c.s.avgQueueDuration)
 		newAvg := expMovingAverage(math.Float64frombits(old), elapsed, 0.1)
@@ -1495,6 +1594,9 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case d := <-c.drainNotify:
+			werr = c.sendDraining(d)
+			continue
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1526,6 +1628,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case d := <-c.drainNotify:
+			werr = c.sendDraining(d)
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1541,6 +1645,12 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 	}
 }
 
+// writeFrameHeader writes the header of a frame to c, without flushing.
+func (c *sclient) writeFrameHeader(t frameType, frameLen uint32) error {
+	c.s.metrics.noteFrame(frameOut, t, frameLen)
+	return writeFrameHeader(c.bw.bw(), t, frameLen)
+}
+
 func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
@@ -1548,20 +1658,32 @@ func (c *sclient) setWriteDeadline() {
 // sendKeepAlive sends a keep-alive frame, without flushing.
 func (c *sclient) sendKeepAlive() error {
 	c.setWriteDeadline()
-	return writeFrameHeader(c.bw.bw(), frameKeepAlive, 0)
+	return c.writeFrameHeader(frameKeepAlive, 0)
 }
 
 // sendPong sends a pong reply, without flushing.
 func (c *sclient) sendPong(data [8]byte) error {
 	c.s.sentPong.Add(1)
 	c.setWriteDeadline()
-	if err := writeFrameHeader(c.bw.bw(), framePong, uint32(len(data))); err != nil {
+	if err := c.writeFrameHeader(framePong, uint32(len(data))); err != nil {
 		return err
 	}
 	_, err := c.bw.Write(data[:])
 	return err
 }
 
+// sendDraining sends a frameDraining, without flushing.
+func (c *sclient) sendDraining(closeIn time.Duration) error {
+	c.setWriteDeadline()
+	if err := c.writeFrameHeader(frameDraining, 4); err != nil {
+		return err
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(closeIn.Milliseconds()))
+	_, err := c.bw.Write(buf[:])
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.NodePublic, reason PeerGoneReasonType) error {
 	switch reason {
@@ -1574,7 +1696,7 @@ func (c *sclient) sendPeerGone(peer key.NodePublic, reason PeerGoneReasonType) e
 	data := make([]byte, 0, keyLen+1)
 	data = peer.AppendTo(data)
 	data = append(data, byte(reason))
-	if err := writeFrameHeader(c.bw.bw(), framePeerGone, uint32(len(data))); err != nil {
+	if err := c.writeFrameHeader(framePeerGone, uint32(len(data))); err != nil {
 		return err
 	}
 
@@ -1586,7 +1708,7 @@ func (c *sclient) sendPeerGone(peer key.NodePublic, reason PeerGoneReasonType) e
 func (c *sclient) sendPeerPresent(peer key.NodePublic, ipPort netip.AddrPort) error {
 	c.setWriteDeadline()
 	const frameLen = keyLen + 16 + 2
-	if err := writeFrameHeader(c.bw.bw(), framePeerPresent, frameLen); err != nil {
+	if err := c.writeFrameHeader(framePeerPresent, frameLen); err != nil {
 		return err
 	}
 	payload := make([]byte, frameLen)
@@ -1654,6 +1776,8 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.packetsSent.Add(1)
+			c.bytesSent.Add(int64(len(contents)))
 		}
 		c.debugLogf("sendPacket from %s: %v", srcKey.ShortString(), err)
 	}()
@@ -1665,7 +1789,7 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 	if withKey {
 		pktLen += key.NodePublicRawLen
 	}
-	if err = writeFrameHeader(c.bw.bw(), frameRecvPacket, uint32(pktLen)); err != nil {
+	if err = c.writeFrameHeader(frameRecvPacket, uint32(pktLen)); err != nil {
 		return err
 	}
 	if withKey {
@@ -1848,6 +1972,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("packets_dropped", &s.packetsDropped)
 	m.Set("counter_packets_dropped_reason", &s.packetsDroppedReason)
 	m.Set("counter_packets_dropped_type", &s.packetsDroppedType)
+	m.Set("counter_policy_rejected_conns", &s.policyRejected)
 	m.Set("counter_packets_received_kind", &s.packetsRecvByKind)
 	m.Set("packets_sent", &s.packetsSent)
 	m.Set("packets_received", &s.packetsRecv)
@@ -1858,6 +1983,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("sent_pong", &s.sentPong)
 	m.Set("peer_gone_disconnected_frames", &s.peerGoneDisconnectedFrames)
 	m.Set("peer_gone_not_here_frames", &s.peerGoneNotHereFrames)
+	m.Set("counter_drain_closed_conns", &s.drainClosedConns)
 	m.Set("packets_forwarded_out", &s.packetsForwardedOut)
 	m.Set("packets_forwarded_in", &s.packetsForwardedIn)
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
@@ -1867,6 +1993,22 @@ func (s *Server) ExpVar() expvar.Var {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
 	m.Set("counter_tcp_rtt", &s.tcpRtt)
+	m.Set("gauge_trust_list_stale", expvar.Func(func() any {
+		if s.trustStale.Load() {
+			return 1
+		}
+		return 0
+	}))
+	m.Set("gauge_trust_list_size", expvar.Func(func() any {
+		return s.trust.len()
+	}))
+	m.Set("counter_trust_delta_errors", &s.trustDeltaErrors)
+	m.Set("gauge_draining", expvar.Func(func() any {
+		if s.draining.Load() {
+			return 1
+		}
+		return 0
+	}))
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long())
 	m.Set("version", &expvarVersion)
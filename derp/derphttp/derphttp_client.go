@@ -56,6 +56,13 @@ type Client struct {
 	MeshKey   string             // optional; for trusted clients
 	IsProber  bool               // optional; for probers to optional declare themselves as such
 
+	// NaviMeshKey and NaviMeshPeer optionally authenticate a managed
+	// DERP server to another one in its region (whose Navi key is
+	// NaviMeshPeer) as a mesh peer, instead of MeshKey.
+	// See derp.NaviMeshAuth.
+	NaviMeshKey  key.MachinePrivate
+	NaviMeshPeer key.MachinePublic
+
 	// BaseContext, if non-nil, returns the base context to use for dialing a
 	// new derp server. If nil, context.Background is used.
 	// In either case, additional timeouts may be added to the base context.
@@ -90,6 +97,7 @@ type Client struct {
 	tlsState     *tls.ConnectionState
 	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
 	clock        tstime.Clock
+	quicFailedAt time.Time // last failure to connect over QUIC, or zero
 }
 
 func (c *Client) String() string {
@@ -350,6 +358,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 		derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
 			derp.MeshKey(c.MeshKey),
+			derp.NaviMeshAuth(c.NaviMeshKey, c.NaviMeshPeer),
 			derp.CanAckPings(c.canAckPings),
 			derp.IsProber(c.IsProber),
 		)
@@ -371,6 +380,14 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		c.logf("%s: connecting to %v", caller, c.url)
 		tcpConn, err = c.dialURL(ctx)
 	default:
+		if c.shouldTryQUIC(reg) {
+			derpClient, err := c.connectQUIC(ctx, caller, reg)
+			if err == nil {
+				return derpClient, c.connGen, nil
+			}
+			c.logf("%s: QUIC to derp-%d failed, falling back to TCP: %v", caller, reg.RegionID, err)
+			c.quicFailedAt = c.clock.Now()
+		}
 		c.logf("%s: connecting to derp-%d (%v)", caller, reg.RegionID, reg.RegionCode)
 		tcpConn, node, err = c.dialRegion(ctx, reg)
 	}
@@ -481,6 +498,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	}
 	derpClient, err = derp.NewClient(c.privateKey, httpConn, brw, c.logf,
 		derp.MeshKey(c.MeshKey),
+		derp.NaviMeshAuth(c.NaviMeshKey, c.NaviMeshPeer),
 		derp.ServerPublicKey(serverPub),
 		derp.CanAckPings(c.canAckPings),
 		derp.IsProber(c.IsProber),
@@ -567,6 +585,12 @@ func (c *Client) dialRegion(ctx context.Context, reg *tailcfg.DERPRegion) (net.C
 }
 
 func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
+	return tls.Client(nc, c.tlsConfig(node))
+}
+
+// tlsConfig returns the TLS config for connecting to node, which may be
+// nil when using c.url.
+func (c *Client) tlsConfig(node *tailcfg.DERPNode) *tls.Config {
 	tlsConf := tlsdial.Config(c.tlsServerName(node), c.TLSConfig)
 	if node != nil {
 		if node.InsecureForTests {
@@ -577,7 +601,7 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 			tlsdial.SetConfigExpectedCert(tlsConf, node.CertName)
 		}
 	}
-	return tls.Client(nc, tlsConf)
+	return tlsConf
 }
 
 // DialRegionTLS returns a TLS connection to a DERP node in the given region.
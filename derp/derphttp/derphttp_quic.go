@@ -0,0 +1,274 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"tailscale.com/derp"
+	"tailscale.com/envknob"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// QUICNextProto is the TLS ALPN protocol of DERP over QUIC.
+//
+// The client opens a single bidirectional stream and speaks the DERP
+// protocol on it, exactly as it would after an HTTP upgrade. Unlike over
+// TCP there's no HTTP exchange, so the client must learn the server's DERP
+// key from the meta certificate in the TLS handshake (see
+// derp.Server.MetaCert) and speak first.
+const QUICNextProto = "derp"
+
+const (
+	// quicDialTimeout bounds the QUIC handshake plus the DERP client
+	// handshake. It's shorter than the overall connect timeout so
+	// there's time left to fall back to TCP.
+	quicDialTimeout = 3 * time.Second
+
+	// quicRetryInterval is how long a client sticks to TCP after failing
+	// to connect over QUIC, as UDP is probably blocked on its network.
+	quicRetryInterval = 10 * time.Minute
+)
+
+var debugNoQUIC = envknob.RegisterBool("TS_DEBUG_DERP_NO_QUIC")
+
+// quicConfig is the QUIC configuration of both ends. The DERP protocol has
+// its own keep-alives, but they're too infrequent to keep NAT mappings for
+// UDP alive.
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:  90 * time.Second,
+	KeepAlivePeriod: 25 * time.Second,
+}
+
+// quicConn is a DERP connection over the stream of a QUIC connection. It
+// implements derp.Conn.
+type quicConn struct {
+	quic.Stream
+	qc quic.Connection
+	pc net.PacketConn // the client's socket, or nil on the server
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.qc.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.qc.RemoteAddr() }
+
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	c.Stream.Close()
+	err := c.qc.CloseWithError(0, "")
+	if c.pc != nil {
+		c.pc.Close()
+	}
+	return err
+}
+
+// quicNode returns the first node of reg that serves DERP over QUIC, or
+// nil if there isn't one.
+func quicNode(reg *tailcfg.DERPRegion) *tailcfg.DERPNode {
+	for _, n := range reg.Nodes {
+		if !n.STUNOnly && n.QUICPort > 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// shouldTryQUIC reports whether to try connecting to reg over QUIC before
+// TCP. c.mu must be held.
+func (c *Client) shouldTryQUIC(reg *tailcfg.DERPRegion) bool {
+	if debugNoQUIC() || quicNode(reg) == nil {
+		return false
+	}
+	if !c.quicFailedAt.IsZero() && c.clock.Since(c.quicFailedAt) < quicRetryInterval {
+		return false
+	}
+	// A proxy in the environment means we can't go direct, and most
+	// likely that UDP isn't allowed out either.
+	proxyReq := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "https", Host: c.tlsServerName(quicNode(reg)), Path: "/"},
+	}
+	if proxyURL, err := tshttpproxy.ProxyFromEnvironment(proxyReq); err == nil && proxyURL != nil {
+		return false
+	}
+	return true
+}
+
+// resolveQUIC returns the UDP address of node n's QUIC port.
+func (c *Client) resolveQUIC(ctx context.Context, n *tailcfg.DERPNode) (netip.AddrPort, error) {
+	port := uint16(n.QUICPort)
+	var v4, v6 netip.Addr
+	if ip, err := netip.ParseAddr(n.IPv4); err == nil && ip.Is4() {
+		v4 = ip
+	}
+	if ip, err := netip.ParseAddr(n.IPv6); err == nil && ip.Is6() {
+		v6 = ip
+	}
+	if !v4.IsValid() && !v6.IsValid() {
+		var ips []netip.Addr
+		if c.DNSCache != nil {
+			var err error
+			if _, _, ips, err = c.DNSCache.LookupIP(ctx, n.HostName); err != nil {
+				return netip.AddrPort{}, err
+			}
+		} else {
+			var err error
+			if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", n.HostName); err != nil {
+				return netip.AddrPort{}, err
+			}
+		}
+		for _, ip := range ips {
+			ip = ip.Unmap()
+			switch {
+			case ip.Is4() && !v4.IsValid() && shouldDialProto(n.IPv4, netip.Addr.Is4):
+				v4 = ip
+			case ip.Is6() && !v6.IsValid() && shouldDialProto(n.IPv6, netip.Addr.Is6):
+				v6 = ip
+			}
+		}
+	}
+	switch {
+	case v6.IsValid() && (c.preferIPv6() || !v4.IsValid()):
+		return netip.AddrPortFrom(v6, port), nil
+	case v4.IsValid():
+		return netip.AddrPortFrom(v4, port), nil
+	}
+	return netip.AddrPort{}, fmt.Errorf("no usable address for %v", n.HostName)
+}
+
+// dialQUIC opens a DERP connection to node n over QUIC and returns it
+// along with the server's DERP key from the TLS meta certificate.
+func (c *Client) dialQUIC(ctx context.Context, n *tailcfg.DERPNode) (_ *quicConn, serverPub key.NodePublic, err error) {
+	dst, err := c.resolveQUIC(ctx, n)
+	if err != nil {
+		return nil, serverPub, err
+	}
+	pc, err := netns.Listener(c.logf, c.netMon).ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, serverPub, err
+	}
+	defer func() {
+		if err != nil {
+			pc.Close()
+		}
+	}()
+
+	tlsConf := c.tlsConfig(n)
+	tlsConf.NextProtos = []string{QUICNextProto}
+	qc, err := quic.Dial(ctx, pc, net.UDPAddrFromAddrPort(dst), tlsConf, quicConfig)
+	if err != nil {
+		return nil, serverPub, err
+	}
+	defer func() {
+		if err != nil {
+			qc.CloseWithError(0, "")
+		}
+	}()
+	cs := qc.ConnectionState().TLS
+	serverPub, serverProtoVersion := parseMetaCert(cs.PeerCertificates)
+	if serverPub.IsZero() || serverProtoVersion == 0 {
+		return nil, serverPub, errors.New("no DERP meta certificate in TLS handshake")
+	}
+	st, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, serverPub, err
+	}
+	return &quicConn{Stream: st, qc: qc, pc: pc}, serverPub, nil
+}
+
+// connectQUIC connects to reg over QUIC. It's called by connect, with
+// c.mu held, before falling back to TCP.
+func (c *Client) connectQUIC(ctx context.Context, caller string, reg *tailcfg.DERPRegion) (*derp.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, quicDialTimeout)
+	defer cancel()
+
+	n := quicNode(reg)
+	c.logf("%s: connecting to derp-%d (%v) over QUIC", caller, reg.RegionID, reg.RegionCode)
+	conn, serverPub, err := c.dialQUIC(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	// Bound the DERP handshake by the same deadline.
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
+		derp.MeshKey(c.MeshKey),
+		derp.NaviMeshAuth(c.NaviMeshKey, c.NaviMeshPeer),
+		derp.ServerPublicKey(serverPub),
+		derp.CanAckPings(c.canAckPings),
+		derp.IsProber(c.IsProber),
+	)
+	if err == nil && c.preferred {
+		err = derpClient.NotePreferred(true)
+	}
+	if err != nil {
+		go conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	tlsState := conn.qc.ConnectionState().TLS
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = conn
+	c.tlsState = &tlsState
+	c.connGen++
+	return derpClient, nil
+}
+
+// ServeQUIC serves DERP over QUIC on pc until ctx is done. tlsConf must
+// provide the server's certificate with s.MetaCert appended to its chain,
+// as clients rely on it to learn the server's key; its NextProtos are
+// replaced with QUICNextProto.
+func ServeQUIC(ctx context.Context, s *derp.Server, pc net.PacketConn, tlsConf *tls.Config) error {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{QUICNextProto}
+	tlsConf.MinVersion = tls.VersionTLS13
+	ln, err := quic.Listen(pc, tlsConf, quicConfig)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		qc, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveQUICConn(ctx, s, qc)
+	}
+}
+
+func serveQUICConn(ctx context.Context, s *derp.Server, qc quic.Connection) {
+	actx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	st, err := qc.AcceptStream(actx)
+	cancel()
+	if err != nil {
+		qc.CloseWithError(0, "")
+		if ctx.Err() == nil {
+			log.Printf("derphttp: QUIC stream from %v: %v", qc.RemoteAddr(), err)
+		}
+		return
+	}
+	conn := &quicConn{Stream: st, qc: qc}
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	s.Accept(ctx, conn, brw, qc.RemoteAddr().String())
+}
@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// newQUICTestServer returns a DERP server serving over both TLS and QUIC
+// on localhost, and a DERP region for it.
+func newQUICTestServer(t *testing.T) (*derp.Server, *tailcfg.DERPRegion) {
+	t.Helper()
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	t.Cleanup(func() { s.Close() })
+
+	ts := httptest.NewTLSServer(Handler(s))
+	t.Cleanup(ts.Close)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort, _ := strconv.Atoi(u.Port())
+
+	cert := ts.TLS.Certificates[0]
+	cert.Certificate = append(cert.Certificate[:len(cert.Certificate):len(cert.Certificate)], s.MetaCert())
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		pc.Close()
+	})
+	go ServeQUIC(ctx, s, pc, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	return s, &tailcfg.DERPRegion{
+		RegionID:   1,
+		RegionCode: "test",
+		Nodes: []*tailcfg.DERPNode{{
+			Name:             "1a",
+			RegionID:         1,
+			HostName:         "localhost",
+			IPv4:             "127.0.0.1",
+			IPv6:             "none",
+			DERPPort:         tcpPort,
+			QUICPort:         pc.LocalAddr().(*net.UDPAddr).Port,
+			InsecureForTests: true,
+		}},
+	}
+}
+
+func isQUIC(c *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.netConn.(*quicConn)
+	return ok
+}
+
+func TestQUIC(t *testing.T) {
+	s, reg := newQUICTestServer(t)
+	tcpReg := reg.Clone()
+	tcpReg.Nodes[0].QUICPort = 0
+
+	a := NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return reg })
+	defer a.Close()
+	bPriv := key.NewNode()
+	b := NewRegionClient(bPriv, t.Logf, nil, func() *tailcfg.DERPRegion { return tcpReg })
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !isQUIC(a) {
+		t.Error("client didn't connect over QUIC")
+	}
+	if isQUIC(b) {
+		t.Error("client connected over QUIC to a node without QUICPort")
+	}
+	if got, want := a.ServerPublicKey(), s.PublicKey(); got != want {
+		t.Errorf("server key = %v; want %v", got, want)
+	}
+
+	for !s.IsClientConnectedForTest(bPriv.Public()) {
+		if ctx.Err() != nil {
+			t.Fatal("receiver never registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := a.Send(bPriv.Public(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	go func() {
+		for {
+			m, err := b.Recv()
+			if err != nil {
+				return
+			}
+			if p, ok := m.(derp.ReceivedPacket); ok {
+				got <- string(p.Data)
+				return
+			}
+		}
+	}()
+	select {
+	case p := <-got:
+		if p != "hello" {
+			t.Errorf("got %q", p)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for packet")
+	}
+}
+
+func TestQUICFallback(t *testing.T) {
+	_, reg := newQUICTestServer(t)
+	// Nothing answers on this port, as if UDP were blocked.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	reg.Nodes[0].QUICPort = pc.LocalAddr().(*net.UDPAddr).Port
+
+	c := NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return reg })
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if isQUIC(c) {
+		t.Fatal("connected over QUIC to a black hole")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.quicFailedAt.IsZero() {
+		t.Error("QUIC failure not recorded")
+	}
+	if c.shouldTryQUIC(reg) {
+		t.Error("QUIC retried right after failing")
+	}
+}
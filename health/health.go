@@ -73,6 +73,10 @@
 
 	// SysTKA is the name of the tailnet key authority subsystem.
 	SysTKA = Subsystem("tailnet-lock")
+
+	// SysCaptivePortal is the name of the captive portal detection
+	// subsystem. Its error, when set, is a *CaptivePortalError.
+	SysCaptivePortal = Subsystem("captive-portal")
 )
 
 // NewWarnable returns a new warnable item that the caller can mark
@@ -203,6 +207,48 @@ func SetTKAHealth(err error) { setErr(SysTKA, err) }
 // TKAHealth returns the tailnet key authority error state.
 func TKAHealth() error { return get(SysTKA) }
 
+// CaptivePortalError is the SysCaptivePortal error when the network is
+// behind a captive portal, such as a hotel Wi-Fi login page, that blocks
+// access until the user logs in.
+type CaptivePortalError struct {
+	// URL is where the user can log in to the portal, if known.
+	URL string
+	// Since is when the portal was first detected.
+	Since time.Time
+}
+
+func (e *CaptivePortalError) Error() string {
+	if e.URL == "" {
+		return "network is behind a captive portal; log in to it to connect"
+	}
+	return fmt.Sprintf("network is behind a captive portal; log in at %s to connect", e.URL)
+}
+
+// SetCaptivePortal sets whether the network is behind a captive portal
+// and, if so, the URL where the user can log in to it.
+func SetCaptivePortal(detected bool, loginURL string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !detected {
+		setLocked(SysCaptivePortal, nil)
+		return
+	}
+	since := time.Now()
+	if old, ok := sysErr[SysCaptivePortal].(*CaptivePortalError); ok {
+		since = old.Since
+	}
+	setLocked(SysCaptivePortal, &CaptivePortalError{URL: loginURL, Since: since})
+}
+
+// CaptivePortal returns the captive portal the network is behind, or nil
+// if none was detected.
+func CaptivePortal() *CaptivePortalError {
+	mu.Lock()
+	defer mu.Unlock()
+	e, _ := sysErr[SysCaptivePortal].(*CaptivePortalError)
+	return e
+}
+
 // SetLocalLogConfigHealth sets the error state of this client's local log configuration.
 func SetLocalLogConfigHealth(err error) {
 	mu.Lock()
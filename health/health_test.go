@@ -7,6 +7,7 @@
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"tailscale.com/util/set"
@@ -39,3 +40,51 @@ func resetWarnables() {
 	defer mu.Unlock()
 	warnables = set.Set[*Warnable]{}
 }
+
+func TestCaptivePortal(t *testing.T) {
+	defer SetCaptivePortal(false, "")
+	SetIPNState("Running", true)
+	defer SetIPNState("", false)
+	GotStreamedMapResponse()
+	defer SetOutOfPollNetMap()
+	SetMagicSockDERPHome(1)
+	defer SetMagicSockDERPHome(0)
+	SetDERPRegionConnectedState(1, true)
+	defer SetDERPRegionConnectedState(1, false)
+	NoteDERPRegionReceivedFrame(1)
+	SetDNSHealth(errors.New("no DNS"))
+	defer SetDNSHealth(nil)
+
+	if cp := CaptivePortal(); cp != nil {
+		t.Fatalf("initial CaptivePortal = %v; want nil", cp)
+	}
+
+	SetCaptivePortal(true, "http://login.example/")
+	cp := CaptivePortal()
+	if cp == nil || cp.URL != "http://login.example/" || cp.Since.IsZero() {
+		t.Fatalf("CaptivePortal = %+v; want URL http://login.example/", cp)
+	}
+	// It's reported along with the other problems.
+	var cpErr *CaptivePortalError
+	err := OverallError()
+	if !errors.As(err, &cpErr) {
+		t.Errorf("OverallError = %v; want a *CaptivePortalError", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "no DNS") {
+		t.Errorf("OverallError = %v; want the DNS error too", err)
+	}
+
+	// A new URL for the same portal keeps when it was first seen.
+	SetCaptivePortal(true, "http://login.example/other")
+	if cp2 := CaptivePortal(); cp2.URL != "http://login.example/other" || !cp2.Since.Equal(cp.Since) {
+		t.Errorf("CaptivePortal = %+v; want new URL, Since %v", cp2, cp.Since)
+	}
+
+	SetCaptivePortal(false, "")
+	if cp := CaptivePortal(); cp != nil {
+		t.Errorf("CaptivePortal after clearing = %v; want nil", cp)
+	}
+	if err := OverallError(); errors.As(err, &cpErr) {
+		t.Errorf("OverallError after clearing = %v", err)
+	}
+}
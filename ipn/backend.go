@@ -121,6 +121,11 @@ type Notify struct {
 	// is available.
 	ClientVersion *tailcfg.ClientVersion `json:",omitempty"`
 
+	// ServeExpired, if non-empty, lists the serve and funnel handlers that
+	// just expired and were removed from the ServeConfig, as described by
+	// ServeConfig.RemoveExpired.
+	ServeExpired []string `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -160,6 +165,9 @@ func (n Notify) String() string {
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if len(n.ServeExpired) != 0 {
+		fmt.Fprintf(&sb, "ServeExpired=%v ", n.ServeExpired)
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
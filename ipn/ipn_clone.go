@@ -8,10 +8,12 @@
 import (
 	"maps"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/ptr"
 )
 
 // Clone makes a deep copy of Prefs.
@@ -103,6 +105,11 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	}
 	dst := new(TCPPortHandler)
 	*dst = *src
+	if dst.Expires != nil {
+		dst.Expires = ptr.To(*src.Expires)
+	}
+	dst.AllowFrom = append(src.AllowFrom[:0:0], src.AllowFrom...)
+	dst.Pool = src.Pool.Clone()
 	return dst
 }
 
@@ -112,6 +119,9 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	HTTP         bool
 	TCPForward   string
 	TerminateTLS string
+	Expires      *time.Time
+	AllowFrom    []string
+	Pool         *BackendPool
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -122,14 +132,32 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.AddRequestHeaders = maps.Clone(src.AddRequestHeaders)
+	dst.RemoveRequestHeaders = append(src.RemoveRequestHeaders[:0:0], src.RemoveRequestHeaders...)
+	dst.AddResponseHeaders = maps.Clone(src.AddResponseHeaders)
+	dst.RemoveResponseHeaders = append(src.RemoveResponseHeaders[:0:0], src.RemoveResponseHeaders...)
+	if dst.Expires != nil {
+		dst.Expires = ptr.To(*src.Expires)
+	}
+	dst.AllowFrom = append(src.AllowFrom[:0:0], src.AllowFrom...)
+	dst.Pool = src.Pool.Clone()
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	Status                int
+	AddRequestHeaders     map[string]string
+	RemoveRequestHeaders  []string
+	AddResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+	Expires               *time.Time
+	AllowFrom             []string
+	Pool                  *BackendPool
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -153,3 +181,23 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 var _WebServerConfigCloneNeedsRegeneration = WebServerConfig(struct {
 	Handlers map[string]*HTTPHandler
 }{})
+
+// Clone makes a deep copy of BackendPool.
+// The result aliases no memory with the original.
+func (src *BackendPool) Clone() *BackendPool {
+	if src == nil {
+		return nil
+	}
+	dst := new(BackendPool)
+	*dst = *src
+	dst.Backends = append(src.Backends[:0:0], src.Backends...)
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _BackendPoolCloneNeedsRegeneration = BackendPool(struct {
+	Backends               []string
+	Policy                 string
+	HealthCheckPath        string
+	HealthCheckIntervalSec int
+}{})
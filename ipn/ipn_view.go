@@ -9,6 +9,7 @@
 	"encoding/json"
 	"errors"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -16,7 +17,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig,BackendPool
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -244,6 +245,16 @@ func (v TCPPortHandlerView) HTTPS() bool          { return v.ж.HTTPS }
 func (v TCPPortHandlerView) HTTP() bool           { return v.ж.HTTP }
 func (v TCPPortHandlerView) TCPForward() string   { return v.ж.TCPForward }
 func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
+func (v TCPPortHandlerView) Expires() *time.Time {
+	if v.ж.Expires == nil {
+		return nil
+	}
+	x := *v.ж.Expires
+	return &x
+}
+
+func (v TCPPortHandlerView) AllowFrom() views.Slice[string] { return views.SliceOf(v.ж.AllowFrom) }
+func (v TCPPortHandlerView) Pool() BackendPoolView          { return v.ж.Pool.View() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
@@ -251,6 +262,9 @@ func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
 	HTTP         bool
 	TCPForward   string
 	TerminateTLS string
+	Expires      *time.Time
+	AllowFrom    []string
+	Pool         *BackendPool
 }{})
 
 // View returns a readonly view of HTTPHandler.
@@ -298,15 +312,50 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string     { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string    { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string     { return v.ж.Text }
+func (v HTTPHandlerView) Redirect() string { return v.ж.Redirect }
+func (v HTTPHandlerView) Status() int      { return v.ж.Status }
+
+func (v HTTPHandlerView) AddRequestHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.AddRequestHeaders)
+}
+func (v HTTPHandlerView) RemoveRequestHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveRequestHeaders)
+}
+
+func (v HTTPHandlerView) AddResponseHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.AddResponseHeaders)
+}
+func (v HTTPHandlerView) RemoveResponseHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveResponseHeaders)
+}
+func (v HTTPHandlerView) Expires() *time.Time {
+	if v.ж.Expires == nil {
+		return nil
+	}
+	x := *v.ж.Expires
+	return &x
+}
+
+func (v HTTPHandlerView) AllowFrom() views.Slice[string] { return views.SliceOf(v.ж.AllowFrom) }
+func (v HTTPHandlerView) Pool() BackendPoolView          { return v.ж.Pool.View() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	Status                int
+	AddRequestHeaders     map[string]string
+	RemoveRequestHeaders  []string
+	AddResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+	Expires               *time.Time
+	AllowFrom             []string
+	Pool                  *BackendPool
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -364,3 +413,61 @@ func (v WebServerConfigView) Handlers() views.MapFn[string, *HTTPHandler, HTTPHa
 var _WebServerConfigViewNeedsRegeneration = WebServerConfig(struct {
 	Handlers map[string]*HTTPHandler
 }{})
+
+// View returns a readonly view of BackendPool.
+func (p *BackendPool) View() BackendPoolView {
+	return BackendPoolView{ж: p}
+}
+
+// BackendPoolView provides a read-only view over BackendPool.
+//
+// Its methods should only be called if `Valid()` returns true.
+type BackendPoolView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *BackendPool
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v BackendPoolView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v BackendPoolView) AsStruct() *BackendPool {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v BackendPoolView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *BackendPoolView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x BackendPool
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v BackendPoolView) Backends() views.Slice[string] { return views.SliceOf(v.ж.Backends) }
+func (v BackendPoolView) Policy() string                { return v.ж.Policy }
+func (v BackendPoolView) HealthCheckPath() string       { return v.ж.HealthCheckPath }
+func (v BackendPoolView) HealthCheckIntervalSec() int   { return v.ж.HealthCheckIntervalSec }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _BackendPoolViewNeedsRegeneration = BackendPool(struct {
+	Backends               []string
+	Policy                 string
+	HealthCheckPath        string
+	HealthCheckIntervalSec int
+}{})
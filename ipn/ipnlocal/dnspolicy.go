@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
+	"tailscale.com/util/dnsname"
+)
+
+// dnsPolicyFile is the path of a JSON file of []tailcfg.DNSPolicyRule to
+// apply before the rules from control, if set. The file is read whenever
+// the DNS config is computed, and checked for changes every
+// dnsPolicyFileCheckInterval; see watchDNSPolicyFile.
+var dnsPolicyFile = envknob.RegisterString("TS_DNS_POLICY_FILE")
+
+// dnsPolicyFileCheckInterval is how often the DNS policy file is checked
+// for changes.
+const dnsPolicyFileCheckInterval = 10 * time.Second
+
+// watchDNSPolicyFile starts a goroutine that calls reconfig, which should
+// reapply the DNS config, whenever the DNS policy file at path is written,
+// created or removed, until b.ctx is done.
+func (b *LocalBackend) watchDNSPolicyFile(path string, reconfig func()) {
+	ticker, tickerChannel := b.clock.NewTicker(dnsPolicyFileCheckInterval)
+	last := dnsPolicyFileStamp(path)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-tickerChannel:
+			}
+			if s := dnsPolicyFileStamp(path); s != last {
+				last = s
+				b.logf("dns: policy file %s changed; reconfiguring", path)
+				reconfig()
+			}
+		}
+	}()
+}
+
+// dnsPolicyFileStamp returns a description of the state of the file at
+// path that changes when it's written, created or removed.
+func dnsPolicyFileStamp(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// dnsPolicyForNetmap returns the MagicDNS resolver's policy rules: the
+// ones in the local policy file, if any, followed by the ones from
+// control, with their Sources resolved to addresses using nm and peers.
+func dnsPolicyForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.NodeView, logf logger.Logf) []resolver.PolicyRule {
+	var ret []resolver.PolicyRule
+	if path := dnsPolicyFile(); path != "" {
+		rules, err := readDNSPolicyFile(path)
+		if err != nil {
+			logf("dns: reading policy file: %v", err)
+		}
+		ret = appendDNSPolicyRules(ret, rules, path, nm, peers, logf)
+	}
+	return appendDNSPolicyRules(ret, nm.DNS.Policy, "control", nm, peers, logf)
+}
+
+func readDNSPolicyFile(path string) ([]*tailcfg.DNSPolicyRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rules []*tailcfg.DNSPolicyRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// appendDNSPolicyRules appends the rules from origin to dst, converted to
+// resolver.PolicyRules. Invalid rules, and rules none of whose Sources are
+// in the netmap, are skipped.
+func appendDNSPolicyRules(dst []resolver.PolicyRule, rules []*tailcfg.DNSPolicyRule, origin string, nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.NodeView, logf logger.Logf) []resolver.PolicyRule {
+	for _, r := range rules {
+		if r == nil {
+			continue
+		}
+		suffix, err := dnsname.ToFQDN(r.Suffix)
+		if err != nil {
+			logf("dns: %s policy rule: bad suffix %q: %v", origin, r.Suffix, err)
+			continue
+		}
+		pr := resolver.PolicyRule{
+			Suffix: suffix,
+			Action: r.Action,
+			Addrs:  r.Addrs,
+			Origin: origin,
+		}
+		switch r.Action {
+		case tailcfg.DNSPolicyBlock, tailcfg.DNSPolicyNull, tailcfg.DNSPolicyPass:
+		case tailcfg.DNSPolicyAnswer:
+			if len(r.Addrs) == 0 {
+				logf("dns: %s policy rule for %q: answer without Addrs", origin, r.Suffix)
+				continue
+			}
+		case tailcfg.DNSPolicyRewrite:
+			pr.Target, err = dnsname.ToFQDN(r.Target)
+			if err != nil || pr.Target == "." {
+				logf("dns: %s policy rule for %q: bad rewrite target %q", origin, r.Suffix, r.Target)
+				continue
+			}
+		default:
+			logf("dns: %s policy rule for %q: unknown action %q", origin, r.Suffix, r.Action)
+			continue
+		}
+		if len(r.Sources) > 0 {
+			pr.Sources = dnsPolicySources(r.Sources, nm, peers)
+			if len(pr.Sources) == 0 {
+				// None of the sources are in the netmap, so the
+				// rule can't match. It mustn't turn into a rule
+				// for everyone.
+				continue
+			}
+		}
+		dst = append(dst, pr)
+	}
+	return dst
+}
+
+// dnsPolicySources resolves the Sources of a tailcfg.DNSPolicyRule to the
+// addresses they stand for: IPs and CIDRs to themselves, tags to the
+// addresses of the nodes with that tag, and login names to the addresses
+// of the user's nodes.
+func dnsPolicySources(sources []string, nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.NodeView) []netip.Prefix {
+	var ret []netip.Prefix
+	addNodes := func(match func(tailcfg.NodeView) bool) {
+		add := func(n tailcfg.NodeView) {
+			if n.Valid() && match(n) {
+				ret = append(ret, n.Addresses().AsSlice()...)
+			}
+		}
+		add(nm.SelfNode)
+		for _, p := range peers {
+			add(p)
+		}
+	}
+	for _, s := range sources {
+		if pfx, err := netip.ParsePrefix(s); err == nil {
+			ret = append(ret, pfx.Masked())
+			continue
+		}
+		if ip, err := netip.ParseAddr(s); err == nil {
+			ret = append(ret, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		if strings.HasPrefix(s, "tag:") {
+			addNodes(func(n tailcfg.NodeView) bool {
+				return views.SliceContains(n.Tags(), s)
+			})
+			continue
+		}
+		addNodes(func(n tailcfg.NodeView) bool {
+			if n.IsTagged() {
+				return false
+			}
+			up, ok := nm.UserProfiles[n.User()]
+			return ok && strings.EqualFold(up.LoginName, s)
+		})
+	}
+	return ret
+}
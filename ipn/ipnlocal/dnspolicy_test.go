@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/ipn"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/netmap"
+)
+
+func TestDNSPolicyForNetmap(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ID:        1,
+			User:      10,
+			Addresses: ipps("100.64.0.1"),
+		}).View(),
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			10: {ID: 10, LoginName: "alice@example.com"},
+			20: {ID: 20, LoginName: "bob@example.com"},
+		},
+		DNS: tailcfg.DNSConfig{
+			Policy: []*tailcfg.DNSPolicyRule{
+				{Suffix: "ads.example.com", Action: tailcfg.DNSPolicyBlock},
+				{Suffix: "tracker.example.com", Action: tailcfg.DNSPolicyNull, Sources: []string{"tag:kiosk"}},
+				{Suffix: "git.corp", Action: tailcfg.DNSPolicyRewrite, Target: "git-eu.corp", Sources: []string{"Bob@example.com", "192.0.2.0/24"}},
+				{Suffix: "wiki.corp", Action: tailcfg.DNSPolicyAnswer, Addrs: ips("100.64.0.9"), Sources: []string{"10.0.0.1"}},
+				{Suffix: "nobody.corp", Action: tailcfg.DNSPolicyBlock, Sources: []string{"tag:none", "carol@example.com"}},
+				{Suffix: "bad.corp", Action: "explode"},
+				{Suffix: "noaddrs.corp", Action: tailcfg.DNSPolicyAnswer},
+				{Suffix: "rewrite.corp", Action: tailcfg.DNSPolicyRewrite},
+			},
+		},
+	}
+	peers := peersMap(nodeViews([]*tailcfg.Node{
+		{
+			ID:        2,
+			User:      20,
+			Addresses: ipps("100.64.0.2", "fd7a:115c:a1e0::2"),
+		},
+		{
+			ID:        3,
+			User:      20,
+			Tags:      []string{"tag:kiosk"},
+			Addresses: ipps("100.64.0.3"),
+		},
+	}))
+
+	want := []resolver.PolicyRule{
+		{Suffix: "ads.example.com.", Action: tailcfg.DNSPolicyBlock, Origin: "control"},
+		{Suffix: "tracker.example.com.", Action: tailcfg.DNSPolicyNull, Sources: ipps("100.64.0.3"), Origin: "control"},
+		{Suffix: "git.corp.", Action: tailcfg.DNSPolicyRewrite, Target: "git-eu.corp.", Sources: ipps("100.64.0.2", "fd7a:115c:a1e0::2", "192.0.2.0/24"), Origin: "control"},
+		{Suffix: "wiki.corp.", Action: tailcfg.DNSPolicyAnswer, Addrs: ips("100.64.0.9"), Sources: ipps("10.0.0.1"), Origin: "control"},
+	}
+	got := dnsPolicyForNetmap(nm, peers, t.Logf)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	// Local rules come first.
+	path := filepath.Join(t.TempDir(), "dnspolicy.json")
+	if err := os.WriteFile(path, []byte(`[{"Suffix":".","Action":"pass","Sources":["alice@example.com"]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	envknob.Setenv("TS_DNS_POLICY_FILE", path)
+	defer envknob.Setenv("TS_DNS_POLICY_FILE", "")
+	got = dnsPolicyForNetmap(nm, peers, t.Logf)
+	want = append([]resolver.PolicyRule{
+		{Suffix: ".", Action: tailcfg.DNSPolicyPass, Sources: ipps("100.64.0.1"), Origin: path},
+	}, want...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("with policy file: got %+v\nwant %+v", got, want)
+	}
+
+	// Without MagicDNS there's no policy.
+	dcfg := dnsConfigForNetmap(nm, peers, (&ipn.Prefs{}).View(), t.Logf, "")
+	if dcfg.Policy != nil {
+		t.Errorf("policy without CorpDNS: %+v", dcfg.Policy)
+	}
+	dcfg = dnsConfigForNetmap(nm, peers, (&ipn.Prefs{CorpDNS: true}).View(), t.Logf, "")
+	if !reflect.DeepEqual(dcfg.Policy, want) {
+		t.Errorf("dnsConfigForNetmap policy = %+v\nwant %+v", dcfg.Policy, want)
+	}
+}
+
+func TestWatchDNSPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &LocalBackend{ctx: ctx, clock: clock, logf: t.Logf}
+	reconfigs := make(chan bool, 1)
+	b.watchDNSPolicyFile(path, func() { reconfigs <- true })
+
+	waitReconfig := func(what string) {
+		t.Helper()
+		clock.Advance(dnsPolicyFileCheckInterval)
+		select {
+		case <-reconfigs:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no reconfig after %s", what)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"Suffix":"ads.example.com","Action":"block"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitReconfig("creating the file")
+
+	clock.Advance(dnsPolicyFileCheckInterval)
+	select {
+	case <-reconfigs:
+		t.Fatal("reconfig without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitReconfig("removing the file")
+}
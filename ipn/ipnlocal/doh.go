@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/net/netutil"
+	"tailscale.com/tailcfg"
+)
+
+// dohPort is the port on the node's Tailscale IPs at which it answers
+// DNS-over-HTTPS queries, if enabled.
+const dohPort = 443
+
+// forceServeDoH makes the node answer DNS-over-HTTPS queries, whether or
+// not control sets NodeAttrServeDoH.
+var forceServeDoH = envknob.RegisterBool("TS_DEBUG_SERVE_DOH")
+
+// SetServeDoH sets whether the node answers DNS-over-HTTPS (RFC 8484)
+// queries from its peers with its MagicDNS resolver, at
+// https://<its cert domain>/dns-query on its Tailscale IPs, even if
+// control doesn't ask for it.
+//
+// It's meant for tsnet.
+func (b *LocalBackend) SetServeDoH(v bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.serveDoH == v {
+		return
+	}
+	b.serveDoH = v
+	b.setTCPPortsInterceptedFromNetmapAndPrefsLocked(b.pm.CurrentPrefs())
+}
+
+// shouldServeDoHLocked reports whether the node answers DNS-over-HTTPS
+// queries on dohPort. It needs a certificate to, and gives way to a serve
+// config for that port.
+//
+// b.mu must be held.
+func (b *LocalBackend) shouldServeDoHLocked() bool {
+	if !b.serveDoH && !forceServeDoH() && !hasCapability(b.netMap, tailcfg.NodeAttrServeDoH) {
+		return false
+	}
+	if b.netMap == nil || len(b.netMap.DNS.CertDomains) == 0 {
+		return false
+	}
+	if _, ok := b.sys.DNSManager.GetOK(); !ok {
+		return false
+	}
+	if b.serveConfig.Valid() {
+		if _, ok := b.serveConfig.FindTCP(dohPort); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// tcpHandlerForDoH returns a handler for a TCP connection from src to
+// dohPort, or nil if the node doesn't answer DNS-over-HTTPS queries.
+func (b *LocalBackend) tcpHandlerForDoH(src netip.AddrPort) (handler func(net.Conn) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.shouldServeDoHLocked() {
+		return nil
+	}
+	dm, _ := b.sys.DNSManager.GetOK()
+	hs := &http.Server{
+		Handler: dm.Resolver().DoHHandler(b.allowDoHFrom),
+		TLSConfig: &tls.Config{
+			GetCertificate: b.getDoHCert,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return func(c net.Conn) error {
+		return hs.ServeTLS(netutil.NewOneConnListener(c, nil), "", "")
+	}
+}
+
+// allowDoHFrom reports whether the peer at src may send DNS-over-HTTPS
+// queries. It must be a node of the tailnet, whose identity the resolver's
+// policy can then go by, and be allowed DNS queries like over the peerapi:
+// owned by the node's user, or allowed to use the node as an exit node.
+func (b *LocalBackend) allowDoHFrom(src netip.AddrPort) bool {
+	n, _, ok := b.WhoIs(src)
+	if !ok {
+		return false
+	}
+	b.mu.Lock()
+	isSelf := b.netMap != nil && b.netMap.SelfNode.Valid() && b.netMap.SelfNode.User() == n.User()
+	b.mu.Unlock()
+	return isSelf || b.replyToDNSQueriesFrom(src)
+}
+
+// getDoHCert returns the certificate for the DNS-over-HTTPS server: the
+// one for the requested cert domain, or the node's first one without SNI,
+// as clients configured with an IP address don't send any.
+func (b *LocalBackend) getDoHCert(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	b.mu.Lock()
+	var domains []string
+	if b.netMap != nil {
+		domains = b.netMap.DNS.CertDomains
+	}
+	b.mu.Unlock()
+	if len(domains) == 0 {
+		return nil, errors.New("no cert domains")
+	}
+	name := domains[0]
+	if hi != nil && hi.ServerName != "" {
+		if !slices.Contains(domains, hi.ServerName) {
+			return nil, errors.New("unknown SNI ServerName")
+		}
+		name = hi.ServerName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pair, err := b.GetCertPEM(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(pair.CertPEM, pair.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
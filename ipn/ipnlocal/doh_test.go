@@ -0,0 +1,51 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"testing"
+
+	"go4.org/netipx"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestAllowDoHFrom(t *testing.T) {
+	b := newTestBackend(t)
+	peer := netip.MustParseAddrPort("100.150.151.152:12345")
+
+	if b.allowDoHFrom(netip.MustParseAddrPort("100.150.151.200:12345")) {
+		t.Error("allowed a non-tailnet address")
+	}
+	if b.allowDoHFrom(peer) {
+		t.Error("allowed a peer of another user while not an exit node")
+	}
+
+	b.pm.SetPrefs((&ipn.Prefs{
+		AdvertiseRoutes: []netip.Prefix{
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::/0"),
+		},
+	}).View(), "")
+	b.setFilter(filter.NewAllowNone(logger.Discard, new(netipx.IPSet)))
+	if b.allowDoHFrom(peer) {
+		t.Error("allowed a peer not allowed to use the exit node")
+	}
+	b.setFilter(filter.NewAllowAllForTest(logger.Discard))
+	if !b.allowDoHFrom(peer) {
+		t.Error("refused a peer allowed to use the exit node")
+	}
+
+	b.pm.SetPrefs(new(ipn.Prefs).View(), "")
+	b.netMap.SelfNode = (&tailcfg.Node{
+		Name: "example.ts.net",
+		User: tailcfg.UserID(1),
+	}).View()
+	if !b.allowDoHFrom(peer) {
+		t.Error("refused a peer of the same user")
+	}
+}
@@ -51,6 +51,7 @@
 	"tailscale.com/log/sockstatlog"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/interfaces"
@@ -212,6 +213,7 @@ type LocalBackend struct {
 	tka            *tkaState
 	state          ipn.State
 	capFileSharing bool // whether netMap contains the file sharing capability
+	serveDoH       bool // whether SetServeDoH(true) was called
 	capTailnetLock bool // whether netMap contains the tailnet lock capability
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
@@ -263,12 +265,14 @@ type LocalBackend struct {
 	c2nUpdateStatus updateStatus
 
 	// ServeConfig fields. (also guarded by mu)
-	lastServeConfJSON   mem.RO              // last JSON that was parsed into serveConfig
-	serveConfig         ipn.ServeConfigView // or !Valid if none
-	activeWatchSessions set.Set[string]     // of WatchIPN SessionID
+	lastServeConfJSON   mem.RO                 // last JSON that was parsed into serveConfig
+	serveConfig         ipn.ServeConfigView    // or !Valid if none
+	activeWatchSessions set.Set[string]        // of WatchIPN SessionID
+	serveExpiryTimer    tstime.TimerController // for removing expired serve handlers; can be nil
 
 	serveListeners     map[netip.AddrPort]*serveListener // addrPort => serveListener
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *httputil.ReverseProxy
+	servePools         map[string]*backendPool           // backendPool.handler => its running pool
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -399,6 +403,10 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 		}
 	}
 
+	if path := dnsPolicyFile(); path != "" {
+		b.watchDNSPolicyFile(path, b.authReconfig)
+	}
+
 	return b, nil
 }
 
@@ -3071,6 +3079,11 @@ func (b *LocalBackend) TCPHandlerForDst(src, dst netip.AddrPort) (handler func(c
 	if handler := b.tcpHandlerForServe(dst.Port(), src); handler != nil {
 		return handler, opts
 	}
+	if dst.Port() == dohPort {
+		if handler := b.tcpHandlerForDoH(src); handler != nil {
+			return handler, opts
+		}
+	}
 	return nil, nil
 }
 
@@ -3350,6 +3363,8 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 		return dcfg
 	}
 
+	dcfg.Policy = dnsPolicyForNetmap(nm, peers, logf)
+
 	for _, dom := range nm.DNS.Domains {
 		fqdn, err := dnsname.ToFQDN(dom)
 		if err != nil {
@@ -4330,6 +4345,7 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.reloadServeConfigLocked(prefs)
+	b.armServeExpiryTimerLocked()
 	if b.serveConfig.Valid() {
 		servePorts := make([]uint16, 0, 3)
 		b.serveConfig.RangeOverTCPs(func(port uint16, _ ipn.TCPPortHandlerView) bool {
@@ -4347,6 +4363,10 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 			b.updateServeTCPPortNetMapAddrListenersLocked(servePorts)
 		}
 	}
+	b.setServePoolsLocked()
+	if b.shouldServeDoHLocked() {
+		handlePorts = append(handlePorts, dohPort)
+	}
 	// Kick off a Hostinfo update to control if WireIngress changed.
 	if wire := b.wantIngressLocked(); b.hostinfo != nil && b.hostinfo.WireIngress != wire {
 		b.logf("Hostinfo.WireIngress changed to %v", wire)
@@ -4364,28 +4384,33 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	if !b.serveConfig.Valid() {
 		return
 	}
-	var backends map[string]bool
+	var allBackends map[string]bool
 	b.serveConfig.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
 		conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
-			backend := h.Proxy()
-			if backend == "" {
+			if h.Proxy() == "" {
 				// Only create proxy handlers for servers with a proxy backend.
 				return true
 			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				return true
+			backends := []string{h.Proxy()}
+			if pool := h.Pool(); pool.Valid() {
+				backends = append(backends, pool.Backends().AsSlice()...)
 			}
+			for _, backend := range backends {
+				mak.Set(&allBackends, backend, true)
+				if _, ok := b.serveProxyHandlers.Load(backend); ok {
+					continue
+				}
 
-			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
-			if err != nil {
-				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
-				// in the CLI, so just log the error here.
-				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
-				return true
+				b.logf("serve: creating a new proxy handler for %s", backend)
+				p, err := b.proxyHandlerForBackend(backend)
+				if err != nil {
+					// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
+					// in the CLI, so just log the error here.
+					b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+					continue
+				}
+				b.serveProxyHandlers.Store(backend, p)
 			}
-			b.serveProxyHandlers.Store(backend, p)
 			return true
 		})
 		return true
@@ -4395,9 +4420,9 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	// in configuration.
 	b.serveProxyHandlers.Range(func(key, value any) bool {
 		backend := key.(string)
-		if !backends[backend] {
+		if !allBackends[backend] {
 			b.logf("serve: closing idle connections to %s", backend)
-			value.(*httputil.ReverseProxy).Transport.(*http.Transport).CloseIdleConnections()
+			value.(*httputil.ReverseProxy).Transport.(interface{ CloseIdleConnections() }).CloseIdleConnections()
 			b.serveProxyHandlers.Delete(backend)
 		}
 		return true
@@ -4847,6 +4872,12 @@ func (b *LocalBackend) DebugReSTUN() error {
 	return nil
 }
 
+// CheckCaptivePortal re-runs netcheck, which looks for a captive portal,
+// in the background. The result is reported via the health package.
+func (b *LocalBackend) CheckCaptivePortal() {
+	b.magicConn().ReSTUN("captive-portal-check")
+}
+
 // ControlKnobs returns the node's control knobs.
 func (b *LocalBackend) ControlKnobs() *controlknobs.Knobs {
 	return b.sys.ControlKnobs()
@@ -5278,6 +5309,39 @@ func (b *LocalBackend) ResetAuth() error {
 	return b.resetForProfileChangeLockedOnEntry()
 }
 
+// StreamDNSQueryLog calls fn with the entries of the MagicDNS query log,
+// oldest first, and then, if follow is set, with new ones as they're
+// added, until ctx is done or fn returns an error.
+func (b *LocalBackend) StreamDNSQueryLog(ctx context.Context, follow bool, fn func(dnstype.QueryLogEntry) error) error {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return errors.New("DNS not wired up")
+	}
+	r := dm.Resolver()
+	if !follow {
+		for _, e := range r.QueryLog() {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ch := make(chan dnstype.QueryLogEntry, 2*resolver.QueryLogSize)
+	unsubscribe := r.SubscribeQueryLog(ch, true)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-ch:
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // StreamDebugCapture writes a pcap stream of packets traversing
 // tailscaled to the provided response writer.
 func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
@@ -5,7 +5,6 @@
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -48,9 +47,14 @@
 var initListenConfig func(*net.ListenConfig, netip.Addr, *interfaces.State, string) error
 
 // addH2C is non-nil on platforms where we want to add H2C
-// ("cleartext" HTTP/2) support to the peerAPI.
+// ("cleartext" HTTP/2) support to the peerAPI and serve.
 var addH2C func(*http.Server)
 
+// newH2CTransport is non-nil on platforms where we support H2C serve
+// backends. It returns a transport speaking cleartext HTTP/2 to
+// connections from dial.
+var newH2CTransport func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) http.RoundTripper
+
 type peerAPIServer struct {
 	b        *LocalBackend
 	resolver *resolver.Resolver
@@ -848,13 +852,19 @@ func (h *peerAPIHandler) replyToDNSQueries() bool {
 		// without further checks.
 		return true
 	}
-	b := h.ps.b
+	return h.ps.b.replyToDNSQueriesFrom(h.remoteAddr)
+}
+
+// replyToDNSQueriesFrom reports whether the node answers DNS queries, over
+// the peerapi or DNS-over-HTTPS, from the peer at remoteAddr, which isn't
+// owned by the node's user.
+func (b *LocalBackend) replyToDNSQueriesFrom(remoteAddr netip.AddrPort) bool {
 	if !b.OfferingExitNode() {
 		// If we're not an exit node, there's no point to
 		// being a DNS server for somebody.
 		return false
 	}
-	if !h.remoteAddr.IsValid() {
+	if !remoteAddr.IsValid() {
 		// This should never be the case if the peerAPIHandler
 		// was wired up correctly, but just in case.
 		return false
@@ -874,7 +884,7 @@ func (h *peerAPIHandler) replyToDNSQueries() bool {
 	// arbitrary. DNS runs over TCP and UDP, so sure... we check
 	// TCP.
 	dstIP := netaddr.IPv4(0, 0, 0, 0)
-	remoteIP := h.remoteAddr.Addr()
+	remoteIP := remoteAddr.Addr()
 	if remoteIP.Is6() {
 		// autogroup:internet for IPv6 is defined to start with 2000::/3,
 		// so use 2000::0 as the probe "the internet" address.
@@ -896,7 +906,7 @@ func (h *peerAPIHandler) handleDNSQuery(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	pretty := false // non-DoH debug mode for humans
-	q, publicError := dohQuery(r)
+	q, publicError := resolver.ParseDoHQuery(r)
 	if publicError != "" && r.Method == "GET" {
 		if name := r.FormValue("q"); name != "" {
 			pretty = true
@@ -936,39 +946,6 @@ func (h *peerAPIHandler) handleDNSQuery(w http.ResponseWriter, r *http.Request)
 	w.Write(res)
 }
 
-func dohQuery(r *http.Request) (dnsQuery []byte, publicErr string) {
-	const maxQueryLen = 256 << 10
-	switch r.Method {
-	default:
-		return nil, "bad HTTP method"
-	case "GET":
-		q64 := r.FormValue("dns")
-		if q64 == "" {
-			return nil, "missing 'dns' parameter"
-		}
-		if base64.RawURLEncoding.DecodedLen(len(q64)) > maxQueryLen {
-			return nil, "query too large"
-		}
-		q, err := base64.RawURLEncoding.DecodeString(q64)
-		if err != nil {
-			return nil, "invalid 'dns' base64 encoding"
-		}
-		return q, ""
-	case "POST":
-		if r.Header.Get("Content-Type") != "application/dns-message" {
-			return nil, "unexpected Content-Type"
-		}
-		q, err := io.ReadAll(io.LimitReader(r.Body, maxQueryLen+1))
-		if err != nil {
-			return nil, "error reading post body with DNS query"
-		}
-		if len(q) > maxQueryLen {
-			return nil, "query too large"
-		}
-		return q, ""
-	}
-}
-
 func dnsQueryForName(name, typStr string) []byte {
 	typ := dnsmessage.TypeA
 	switch strings.ToLower(typStr) {
@@ -6,6 +6,9 @@
 package ipnlocal
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 
 	"golang.org/x/net/http2"
@@ -17,4 +20,12 @@ func init() {
 		h2s := &http2.Server{}
 		s.Handler = h2c.NewHandler(s.Handler, h2s)
 	}
+	newH2CTransport = func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) http.RoundTripper {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	}
 }
@@ -31,6 +31,7 @@
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
 )
@@ -237,6 +238,9 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 	if config.IsFunnelOn() && prefs.ShieldsUp() {
 		return errors.New("Unable to turn on Funnel while shields-up is enabled")
 	}
+	if err := config.CheckValid(); err != nil {
+		return err
+	}
 
 	nm := b.netMap
 	if nm == nil {
@@ -304,6 +308,56 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 	return nil
 }
 
+// armServeExpiryTimerLocked (re)starts the timer that removes serve
+// handlers from the serve config when they expire. If some already have,
+// such as while tailscaled wasn't running, it fires right away.
+//
+// b.mu must be held.
+func (b *LocalBackend) armServeExpiryTimerLocked() {
+	if b.serveExpiryTimer != nil {
+		b.serveExpiryTimer.Stop()
+		b.serveExpiryTimer = nil
+	}
+	if !b.serveConfig.Valid() {
+		return
+	}
+	now := b.clock.Now()
+	expired, next := b.serveConfig.AsStruct().RemoveExpired(now)
+	if len(expired) > 0 {
+		next = now
+	}
+	if next.IsZero() {
+		return
+	}
+	b.serveExpiryTimer = b.clock.AfterFunc(next.Sub(now), b.removeExpiredServeHandlers)
+}
+
+// removeExpiredServeHandlers is called by serveExpiryTimer to remove the
+// expired handlers from the serve config, and announce them on the IPN bus.
+func (b *LocalBackend) removeExpiredServeHandlers() {
+	b.mu.Lock()
+	if !b.serveConfig.Valid() {
+		b.mu.Unlock()
+		return
+	}
+	sc := b.serveConfig.AsStruct()
+	expired, _ := sc.RemoveExpired(b.clock.Now())
+	if len(expired) == 0 {
+		// Raced with a config change; the timer was re-armed.
+		b.mu.Unlock()
+		return
+	}
+	b.logf("serve: removing expired handlers: %v", expired)
+	if err := b.setServeConfigLocked(sc, ""); err != nil {
+		b.logf("serve: removing expired handlers: %v", err)
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+
+	b.send(ipn.Notify{ServeExpired: expired})
+}
+
 // ServeConfig provides a view of the current serve mappings.
 // If serving is not configured, the returned view is not Valid.
 func (b *LocalBackend) ServeConfig() ipn.ServeConfigView {
@@ -407,10 +461,18 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 	}
 
 	tcph, ok := sc.FindTCP(dport)
-	if !ok {
+	if !ok || tcph.IsExpired(b.clock.Now()) {
+		// An expired handler is normally already gone from the config,
+		// unless the expiry timer lagged, such as across a suspend.
 		return nil
 	}
 
+	if tcph.TCPForward() != "" && !b.serveAccessAllowed(tcph.AllowFrom(), srcAddr, fmt.Sprintf("tcp:%d", dport)) {
+		return func(c net.Conn) error {
+			return c.Close()
+		}
+	}
+
 	if tcph.HTTPS() || tcph.HTTP() {
 		hs := &http.Server{
 			Handler: http.HandlerFunc(b.serveWebHandler),
@@ -430,14 +492,33 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 			}
 		}
 
+		if addH2C != nil {
+			// Let gRPC clients of h2c backends speak HTTP/2
+			// without TLS too.
+			addH2C(hs)
+		}
 		return func(c net.Conn) error {
 			return hs.Serve(netutil.NewOneConnListener(c, nil))
 		}
 	}
 
 	if backDst := tcph.TCPForward(); backDst != "" {
+		var pool *backendPool
+		if tcph.Pool().Valid() {
+			pool = b.servePool(fmt.Sprintf("tcp:%d", dport))
+		}
 		return func(conn net.Conn) error {
 			defer conn.Close()
+			if pool != nil {
+				pb := pool.pick()
+				if pb == nil {
+					b.logf("localbackend: no healthy backend to TCP proxy port %v (from %v) to", dport, srcAddr)
+					return nil
+				}
+				pb.active.Add(1)
+				defer pb.active.Add(-1)
+				backDst = pb.target
+			}
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
 			cancel()
@@ -487,9 +568,9 @@ func getServeHTTPContext(r *http.Request) (c *serveHTTPContext, ok bool) {
 	return c, ok
 }
 
-func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
-	var z ipn.HTTPHandlerView // zero value
-
+// serveHostPort returns the ipn.ServeConfig.Web key of the web server
+// handling r.
+func (b *LocalBackend) serveHostPort(r *http.Request) (hp ipn.HostPort, ok bool) {
 	hostname := r.Host
 	if r.TLS == nil {
 		tcd := "." + b.Status().CurrentTailnet.MagicDNSSuffix
@@ -506,23 +587,39 @@ func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView,
 	sctx, ok := getServeHTTPContext(r)
 	if !ok {
 		b.logf("[unexpected] localbackend: no serveHTTPContext in request")
+		return "", false
+	}
+	return ipn.HostPort(fmt.Sprintf("%s:%v", hostname, sctx.DestPort)), true
+}
+
+func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
+	var z ipn.HTTPHandlerView // zero value
+
+	hp, ok := b.serveHostPort(r)
+	if !ok {
 		return z, "", false
 	}
-	wsc, ok := b.webServerConfig(hostname, sctx.DestPort)
+	wsc, ok := b.serveWebConfig(hp)
 	if !ok {
 		return z, "", false
 	}
 
-	if h, ok := wsc.Handlers().GetOk(r.URL.Path); ok {
+	// Skip expired handlers; see tcpHandlerForServe.
+	now := b.clock.Now()
+	get := func(mount string) (ipn.HTTPHandlerView, bool) {
+		h, ok := wsc.Handlers().GetOk(mount)
+		return h, ok && !h.IsExpired(now)
+	}
+	if h, ok := get(r.URL.Path); ok {
 		return h, r.URL.Path, true
 	}
 	pth := path.Clean(r.URL.Path)
 	for {
 		withSlash := pth + "/"
-		if h, ok := wsc.Handlers().GetOk(withSlash); ok {
+		if h, ok := get(withSlash); ok {
 			return h, withSlash, true
 		}
-		if h, ok := wsc.Handlers().GetOk(pth); ok {
+		if h, ok := get(pth); ok {
 			return h, pth, true
 		}
 		if pth == "/" {
@@ -560,6 +657,15 @@ func (b *LocalBackend) proxyHandlerForBackend(backend string) (*httputil.Reverse
 			ExpectContinueTimeout: 1 * time.Second,
 		},
 	}
+	if strings.HasPrefix(backend, "h2c://") {
+		if newH2CTransport == nil {
+			return nil, fmt.Errorf("h2c backends are not supported on this platform")
+		}
+		rp.Transport = newH2CTransport(b.dialer.SystemDial)
+		// Stream gRPC and the like as it comes, rather than in
+		// batches.
+		rp.FlushInterval = -1
+	}
 	return rp, nil
 }
 
@@ -599,6 +705,61 @@ func (b *LocalBackend) addTailscaleIdentityHeaders(r *httputil.ProxyRequest) {
 	r.Out.Header.Set("Tailscale-Headers-Info", "https://tailscale.com/s/serve-headers")
 }
 
+// serveAccessAllowed reports whether the peer at src may use a serve
+// handler with the given AllowFrom rules, and logs the decision for
+// handlers that have any. target describes the handler for the log.
+func (b *LocalBackend) serveAccessAllowed(allowFrom views.Slice[string], src netip.AddrPort, target string) bool {
+	if allowFrom.Len() == 0 {
+		return true
+	}
+	node, user, ok := b.WhoIs(src)
+	if !ok {
+		// Traffic from outside of the tailnet (funneled) has no
+		// identity to match.
+		b.logf("serve: denied %v (funnel) access to %s", src, target)
+		return false
+	}
+	var caps tailcfg.PeerCapMap
+	if views.SliceContainsFunc(allowFrom, func(r string) bool { return strings.HasPrefix(r, "cap:") }) {
+		caps = b.PeerCaps(src.Addr())
+	}
+	who := user.LoginName
+	if node.IsTagged() {
+		who = strings.Join(node.Tags().AsSlice(), ",")
+	}
+	if rule, ok := matchServeAccessRule(allowFrom, node, user, caps); ok {
+		b.logf("serve: allowed %v (%s, %s) access to %s by rule %q", src, node.ComputedName(), who, target, rule)
+		return true
+	}
+	b.logf("serve: denied %v (%s, %s) access to %s", src, node.ComputedName(), who, target)
+	return false
+}
+
+// matchServeAccessRule returns the first of rules matching the tailnet
+// node and its user, which has the peer capabilities caps towards this
+// node. See ipn.CheckServeAccessRule for the rule syntax.
+func matchServeAccessRule(rules views.Slice[string], node tailcfg.NodeView, user tailcfg.UserProfile, caps tailcfg.PeerCapMap) (rule string, ok bool) {
+	for i := range rules.LenIter() {
+		rule := rules.At(i)
+		var match bool
+		switch {
+		case strings.HasPrefix(rule, "tag:"):
+			match = node.IsTagged() && views.SliceContains(node.Tags(), rule)
+		case strings.HasPrefix(rule, "cap:"):
+			c := strings.TrimPrefix(rule, "cap:")
+			match = node.HasCap(tailcfg.NodeCapability(c)) || caps.HasCapability(tailcfg.PeerCapability(c))
+		default:
+			// Like the identity headers, login names only identify
+			// untagged nodes.
+			match = !node.IsTagged() && rule == user.LoginName
+		}
+		if match {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
 // serveWebHandler is an http.HandlerFunc that maps incoming requests to the
 // correct *http.
 func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
@@ -607,8 +768,29 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	// Without a serve context, there's no source to check the handler's
+	// access rules against, so deny.
+	if c, ok := getServeHTTPContext(r); !ok || !b.serveAccessAllowed(h.AllowFrom(), c.SrcAddr, r.Host+mountPoint) {
+		http.Error(w, "403 Forbidden: you don't have access to this page", http.StatusForbidden)
+		return
+	}
+	rewriteHeaders(r.Header, h.AddRequestHeaders(), h.RemoveRequestHeaders())
+	if h.AddResponseHeaders().Len() > 0 || h.RemoveResponseHeaders().Len() > 0 {
+		w = &responseHeaderRewriter{ResponseWriter: w, h: h}
+	}
+	if v := h.Redirect(); v != "" {
+		code := h.Status()
+		if code == 0 {
+			code = http.StatusFound
+		}
+		http.Redirect(w, r, expandRedirectURL(v, r), code)
+		return
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if code := h.Status(); code != 0 {
+			w.WriteHeader(code)
+		}
 		io.WriteString(w, s)
 		return
 	}
@@ -617,6 +799,22 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if v := h.Proxy(); v != "" {
+		var pool *backendPool
+		if h.Pool().Valid() {
+			if hp, ok := b.serveHostPort(r); ok {
+				pool = b.servePool(string(hp) + mountPoint)
+			}
+		}
+		if pool != nil {
+			pb := pool.pick()
+			if pb == nil {
+				http.Error(w, "no healthy backends", http.StatusBadGateway)
+				return
+			}
+			pb.active.Add(1)
+			defer pb.active.Add(-1)
+			v = pb.target
+		}
 		p, ok := b.serveProxyHandlers.Load(v)
 		if !ok {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
@@ -630,10 +828,73 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		h.ServeHTTP(w, r)
 		return
 	}
+	if code := h.Status(); code != 0 {
+		// A static response with no body.
+		w.WriteHeader(code)
+		return
+	}
 
 	http.Error(w, "empty handler", 500)
 }
 
+// expandRedirectURL returns the HTTPHandler.Redirect target for r, with
+// ${HOST} and ${REQUEST_URI} replaced.
+func expandRedirectURL(target string, r *http.Request) string {
+	return strings.NewReplacer(
+		"${HOST}", r.Host,
+		"${REQUEST_URI}", r.URL.RequestURI(),
+	).Replace(target)
+}
+
+// rewriteHeaders removes the headers named in remove from hdr, then sets
+// those in add.
+func rewriteHeaders(hdr http.Header, add views.Map[string, string], remove views.Slice[string]) {
+	for i := 0; i < remove.Len(); i++ {
+		hdr.Del(remove.At(i))
+	}
+	add.Range(func(k, v string) bool {
+		hdr.Set(k, v)
+		return true
+	})
+}
+
+// responseHeaderRewriter is an http.ResponseWriter that applies an
+// HTTPHandler's response header rules before the response header is sent.
+type responseHeaderRewriter struct {
+	http.ResponseWriter
+	h           ipn.HTTPHandlerView
+	wroteHeader bool
+}
+
+func (w *responseHeaderRewriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		rewriteHeaders(w.Header(), w.h.AddResponseHeaders(), w.h.RemoveResponseHeaders())
+		// Informational (1xx) responses may be followed by more headers.
+		w.wroteHeader = code >= 200
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseHeaderRewriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, for streaming proxied responses.
+func (w *responseHeaderRewriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *responseHeaderRewriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
@@ -708,6 +969,8 @@ func (w *fixLocationHeaderResponseWriter) Write(p []byte) (int, error) {
 // * host:port ("localhost:8080")
 // * full URL ("http://localhost:8080", in which case it's returned unchanged)
 // * insecure TLS ("https+insecure://127.0.0.1:4430")
+// * cleartext HTTP/2 ("h2c://127.0.0.1:50051"), as an http URL with the
+// port defaulting to 80
 func expandProxyArg(s string) (targetURL string, insecureSkipVerify bool) {
 	if s == "" {
 		return "", false
@@ -718,6 +981,14 @@ func expandProxyArg(s string) (targetURL string, insecureSkipVerify bool) {
 	if rest, ok := strings.CutPrefix(s, "https+insecure://"); ok {
 		return "https://" + rest, true
 	}
+	if rest, ok := strings.CutPrefix(s, "h2c://"); ok {
+		u, err := url.Parse("http://" + rest)
+		if err == nil && u.Port() == "" && u.Hostname() != "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+			return u.String(), false
+		}
+		return "http://" + rest, false
+	}
 	if allNumeric(s) {
 		return "http://127.0.0.1:" + s, false
 	}
@@ -734,8 +1005,10 @@ func allNumeric(s string) bool {
 }
 
 func (b *LocalBackend) webServerConfig(hostname string, port uint16) (c ipn.WebServerConfigView, ok bool) {
-	key := ipn.HostPort(fmt.Sprintf("%s:%v", hostname, port))
+	return b.serveWebConfig(ipn.HostPort(fmt.Sprintf("%s:%v", hostname, port)))
+}
 
+func (b *LocalBackend) serveWebConfig(key ipn.HostPort) (c ipn.WebServerConfigView, ok bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
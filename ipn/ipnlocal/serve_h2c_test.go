@@ -0,0 +1,208 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ios && !android && !js
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"tailscale.com/ipn"
+)
+
+// writeGRPCMessage writes msg to w as a gRPC length-prefixed message.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var hdr [5]byte // uncompressed flag, then big-endian length
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// readGRPCMessage reads a gRPC length-prefixed message from r.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// newGRPCEchoServer starts an h2c gRPC service whose methods echo each
+// request message back, and returns its address.
+//
+// It speaks the gRPC wire protocol directly: HTTP/2 requests with
+// length-prefixed messages, and the call status in the trailers.
+func newGRPCEchoServer(t *testing.T) string {
+	mux := http.NewServeMux()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, fmt.Sprintf("not gRPC: %s %q", r.Proto, r.Header.Get("Content-Type")), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush() // let streaming clients see the headers before sending
+		n := 0
+		for {
+			msg, err := readGRPCMessage(r.Body)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				w.Header().Set("Grpc-Status", "13") // INTERNAL
+				w.Header().Set("Grpc-Message", err.Error())
+				return
+			}
+			writeGRPCMessage(w, msg)
+			w.(http.Flusher).Flush()
+			n++
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", fmt.Sprintf("echoed %d", n))
+		// Also send a trailer not announced in the headers.
+		w.Header().Set(http.TrailerPrefix+"Echo-Count", fmt.Sprint(n))
+	}
+	mux.HandleFunc("/echo.Echo/Unary", echo)
+	mux.HandleFunc("/echo.Echo/Stream", echo)
+
+	s := httptest.NewUnstartedServer(h2c.NewHandler(mux, &http2.Server{}))
+	s.Start()
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String()
+}
+
+func TestServeH2CBackend(t *testing.T) {
+	b := newTestBackend(t)
+	b.netMap.Name = "example.ts.net" // for the MagicDNS suffix of plain HTTP hosts
+	backend := newGRPCEchoServer(t)
+
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "h2c://" + backend},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hand connections to the serve port's handler, as netstack would.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h := b.tcpHandlerForServe(80, netip.MustParseAddrPort("100.150.151.152:1234"))
+			if h == nil {
+				t.Errorf("no serve handler for port 80")
+				c.Close()
+				return
+			}
+			go h(c)
+		}
+	}()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, ln.Addr().String())
+		},
+	}}
+	call := func(t *testing.T, method string, body io.Reader) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://example.ts.net/echo.Echo/"+method, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+			msg, _ := io.ReadAll(res.Body)
+			t.Fatalf("%s: %s %s: %s", method, res.Proto, res.Status, msg)
+		}
+		return res
+	}
+	checkTrailers := func(t *testing.T, res *http.Response, wantCount int) {
+		t.Helper()
+		want := map[string]string{
+			"Grpc-Status":  "0",
+			"Grpc-Message": fmt.Sprintf("echoed %d", wantCount),
+			"Echo-Count":   fmt.Sprint(wantCount),
+		}
+		for k, v := range want {
+			if got := res.Trailer.Get(k); got != v {
+				t.Errorf("trailer %s = %q; want %q", k, got, v)
+			}
+		}
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		var req bytes.Buffer
+		writeGRPCMessage(&req, []byte("hello"))
+		res := call(t, "Unary", &req)
+		defer res.Body.Close()
+		msg, err := readGRPCMessage(res.Body)
+		if err != nil || string(msg) != "hello" {
+			t.Fatalf("reply = %q, %v; want hello", msg, err)
+		}
+		if _, err := io.ReadAll(res.Body); err != nil {
+			t.Fatal(err)
+		}
+		checkTrailers(t, res, 1)
+	})
+
+	t.Run("bidi-stream", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		res := call(t, "Stream", pr)
+		defer res.Body.Close()
+		// Each reply must arrive before the next request is sent, so
+		// neither direction may be buffered along the way.
+		msgs := []string{"one", "two", "three"}
+		for _, m := range msgs {
+			if err := writeGRPCMessage(pw, []byte(m)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readGRPCMessage(res.Body)
+			if err != nil || string(got) != m {
+				t.Fatalf("reply = %q, %v; want %q", got, err, m)
+			}
+		}
+		pw.Close()
+		if rest, err := io.ReadAll(res.Body); err != nil || len(rest) > 0 {
+			t.Fatalf("after half-close, read %q, %v; want EOF", rest, err)
+		}
+		checkTrailers(t, res, len(msgs))
+	})
+}
@@ -0,0 +1,330 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// servePoolUnhealthyThreshold is how many health checks in a row a
+	// backend must fail to be ejected from its pool. One passing check
+	// brings it back.
+	servePoolUnhealthyThreshold = 2
+
+	// servePoolCheckTimeout is the longest a health check may take.
+	servePoolCheckTimeout = 5 * time.Second
+)
+
+// backendPool balances the traffic of a serve handler over the backends
+// of its ipn.BackendPool, checking their health in the background.
+type backendPool struct {
+	logf      logger.Logf
+	handler   string // as in apitype.ServeBackendStatus.Handler
+	conf      string // the handler and its backend config, to spot changes
+	leastConn bool
+	interval  time.Duration
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	backends  []*poolBackend
+	next      atomic.Uint32 // for round-robin
+	cancel    context.CancelFunc
+}
+
+// poolBackend is a backend of a backendPool.
+type poolBackend struct {
+	target   string       // as configured
+	dialAddr string       // ip:port to connect to
+	checkURL string       // URL to GET for HTTP health checks, or empty for TCP ones
+	client   *http.Client // for HTTP health checks
+	active   atomic.Int64 // connections or requests in progress
+
+	mu      sync.Mutex
+	healthy bool
+	fails   int    // health checks failed in a row
+	lastErr string // of the last failed health check
+	since   time.Time
+}
+
+// backendPoolConf returns the backendPool.conf of a pool for the given
+// handler, primary backend and pool config. The order of pv's backends
+// doesn't matter, so reordering them keeps the running pool.
+func backendPoolConf(handler, primary string, pv ipn.BackendPoolView) string {
+	pool := pv.AsStruct()
+	slices.Sort(pool.Backends)
+	pool.Backends = slices.Compact(pool.Backends)
+	j, _ := json.Marshal(pool)
+	return fmt.Sprintf("%s %s %s", handler, primary, j)
+}
+
+// newBackendPool returns a pool for the serve handler described by
+// handler, balancing over the primary backend (its TCPForward or Proxy)
+// and those of pv. Web handlers have proxy URL backends, and others TCP
+// addresses. Call run to start health checks.
+func newBackendPool(logf logger.Logf, handler, primary string, pv ipn.BackendPoolView, web bool, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *backendPool {
+	interval := pv.HealthCheckIntervalSec()
+	if interval <= 0 {
+		interval = ipn.DefaultHealthCheckIntervalSec
+	}
+	p := &backendPool{
+		logf:      logf,
+		handler:   handler,
+		conf:      backendPoolConf(handler, primary, pv),
+		leastConn: pv.Policy() == ipn.LBLeastConn,
+		interval:  time.Duration(interval) * time.Second,
+		dial:      dial,
+	}
+	now := time.Now()
+	for _, target := range append([]string{primary}, pv.Backends().AsSlice()...) {
+		pb := &poolBackend{target: target, dialAddr: target, healthy: true, since: now}
+		if web {
+			targetURL, insecure := expandProxyArg(target)
+			u, err := url.Parse(targetURL)
+			if err != nil {
+				logf("[unexpected] serve: invalid backend %q for %s: %v", target, handler, err)
+				continue
+			}
+			pb.dialAddr = u.Host
+			if u.Port() == "" {
+				pb.dialAddr = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+			}
+			if path := pv.HealthCheckPath(); path != "" {
+				pb.checkURL = u.JoinPath(path).String()
+				pb.client = &http.Client{
+					Transport: &http.Transport{
+						DialContext:       dial,
+						TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecure},
+						DisableKeepAlives: true,
+					},
+					CheckRedirect: func(*http.Request, []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+			}
+		}
+		p.backends = append(p.backends, pb)
+	}
+	return p
+}
+
+// run checks the health of the backends until ctx is done or the pool is
+// closed.
+func (p *backendPool) run(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	go func() {
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		for {
+			p.checkAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// close stops health checks.
+func (p *backendPool) close() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// checkAll checks the health of all backends concurrently.
+func (p *backendPool) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, pb := range p.backends {
+		wg.Add(1)
+		go func(pb *poolBackend) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, min(p.interval, servePoolCheckTimeout))
+			err := p.check(cctx, pb)
+			cancel()
+			if ctx.Err() != nil {
+				return // pool closed
+			}
+			p.setHealth(pb, err)
+		}(pb)
+	}
+	wg.Wait()
+}
+
+// check runs a health check of pb.
+func (p *backendPool) check(ctx context.Context, pb *poolBackend) error {
+	if pb.checkURL == "" {
+		c, err := p.dial(ctx, "tcp", pb.dialAddr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", pb.checkURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := pb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("health check status %s", res.Status)
+	}
+	return nil
+}
+
+// setHealth records the result of a health check of pb, ejecting it from
+// or returning it to the pool as needed.
+func (p *backendPool) setHealth(pb *poolBackend, err error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if err == nil {
+		pb.fails = 0
+		pb.lastErr = ""
+		if !pb.healthy {
+			pb.healthy = true
+			pb.since = time.Now()
+			p.logf("serve: %s backend %s is healthy again", p.handler, pb.target)
+		}
+		return
+	}
+	pb.fails++
+	pb.lastErr = err.Error()
+	if pb.healthy && pb.fails >= servePoolUnhealthyThreshold {
+		pb.healthy = false
+		pb.since = time.Now()
+		p.logf("serve: ejected %s backend %s: %v", p.handler, pb.target, err)
+	}
+}
+
+func (pb *poolBackend) isHealthy() bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.healthy
+}
+
+// pick returns the backend to use for a new connection or request, per
+// the pool's policy, or nil if none is healthy. The caller should count
+// the connection or request in the backend's active count.
+func (p *backendPool) pick() *poolBackend {
+	n := uint32(len(p.backends))
+	start := p.next.Add(1) - 1
+	var best *poolBackend
+	for i := uint32(0); i < n; i++ {
+		pb := p.backends[(start+i)%n]
+		if !pb.isHealthy() {
+			continue
+		}
+		if !p.leastConn {
+			return pb
+		}
+		if best == nil || pb.active.Load() < best.active.Load() {
+			best = pb
+		}
+	}
+	return best
+}
+
+// status returns the state of the pool's backends.
+func (p *backendPool) status() []apitype.ServeBackendStatus {
+	ret := make([]apitype.ServeBackendStatus, 0, len(p.backends))
+	for _, pb := range p.backends {
+		pb.mu.Lock()
+		ret = append(ret, apitype.ServeBackendStatus{
+			Handler:   p.handler,
+			Backend:   pb.target,
+			Healthy:   pb.healthy,
+			Active:    pb.active.Load(),
+			LastError: pb.lastErr,
+			Since:     pb.since,
+		})
+		pb.mu.Unlock()
+	}
+	return ret
+}
+
+// setServePoolsLocked starts a backendPool for each handler of
+// serveConfig with an ipn.BackendPool, keeping the ones of unchanged
+// handlers, and stops those no longer needed. It should be called after
+// reloadServeConfigLocked.
+//
+// b.mu must be held.
+func (b *LocalBackend) setServePoolsLocked() {
+	old := b.servePools
+	b.servePools = nil
+	add := func(handler, primary string, pv ipn.BackendPoolView, web bool) {
+		if p, ok := old[handler]; ok && p.conf == backendPoolConf(handler, primary, pv) {
+			delete(old, handler)
+			mak.Set(&b.servePools, handler, p)
+			return
+		}
+		p := newBackendPool(b.logf, handler, primary, pv, web, b.dialer.SystemDial)
+		b.logf("serve: balancing %s over %d backends", handler, len(p.backends))
+		p.run(b.ctx)
+		mak.Set(&b.servePools, handler, p)
+	}
+	if b.serveConfig.Valid() {
+		b.serveConfig.RangeOverTCPs(func(port uint16, h ipn.TCPPortHandlerView) bool {
+			if h.Pool().Valid() && h.TCPForward() != "" {
+				add(fmt.Sprintf("tcp:%d", port), h.TCPForward(), h.Pool(), false)
+			}
+			return true
+		})
+		b.serveConfig.RangeOverWebs(func(hp ipn.HostPort, conf ipn.WebServerConfigView) bool {
+			conf.Handlers().Range(func(mount string, h ipn.HTTPHandlerView) bool {
+				if h.Pool().Valid() && h.Proxy() != "" {
+					add(string(hp)+mount, h.Proxy(), h.Pool(), true)
+				}
+				return true
+			})
+			return true
+		})
+	}
+	for _, p := range old {
+		p.close()
+	}
+}
+
+// servePool returns the running pool of the serve handler described by
+// handler, as in backendPool.handler, or nil if there's none.
+func (b *LocalBackend) servePool(handler string) *backendPool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.servePools[handler]
+}
+
+// ServeBackends returns the state of the backends of the serve handlers
+// with backend pools.
+func (b *LocalBackend) ServeBackends() []apitype.ServeBackendStatus {
+	b.mu.Lock()
+	pools := make([]*backendPool, 0, len(b.servePools))
+	for _, p := range b.servePools {
+		pools = append(pools, p)
+	}
+	b.mu.Unlock()
+
+	slices.SortFunc(pools, func(a, b *backendPool) int { return strings.Compare(a.handler, b.handler) })
+	ret := []apitype.ServeBackendStatus{}
+	for _, p := range pools {
+		ret = append(ret, p.status()...)
+	}
+	return ret
+}
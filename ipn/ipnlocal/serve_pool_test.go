@@ -0,0 +1,233 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestBackendPoolPick(t *testing.T) {
+	var d net.Dialer
+	newPool := func(policy string) *backendPool {
+		return newBackendPool(t.Logf, "tcp:2222", "127.0.0.1:1", (&ipn.BackendPool{
+			Backends: []string{"127.0.0.1:2", "127.0.0.1:3"},
+			Policy:   policy,
+		}).View(), false, d.DialContext)
+	}
+	picks := func(p *backendPool, n int) (ret []string) {
+		for i := 0; i < n; i++ {
+			if pb := p.pick(); pb != nil {
+				ret = append(ret, pb.target)
+			} else {
+				ret = append(ret, "none")
+			}
+		}
+		return ret
+	}
+	eject := func(p *backendPool, i int) {
+		for j := 0; j < servePoolUnhealthyThreshold; j++ {
+			p.setHealth(p.backends[i], errors.New("down"))
+		}
+	}
+
+	p := newPool("")
+	if got, want := picks(p, 4), []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:1"}; !slices.Equal(got, want) {
+		t.Errorf("round-robin picks = %q; want %q", got, want)
+	}
+	p.setHealth(p.backends[1], errors.New("down")) // once isn't enough
+	if !p.backends[1].isHealthy() {
+		t.Errorf("backend ejected after one failed check")
+	}
+	eject(p, 1)
+	if got, want := picks(p, 3), []string{"127.0.0.1:3", "127.0.0.1:3", "127.0.0.1:1"}; !slices.Equal(got, want) {
+		t.Errorf("round-robin picks with ejected backend = %q; want %q", got, want)
+	}
+	eject(p, 0)
+	eject(p, 2)
+	if got := p.pick(); got != nil {
+		t.Errorf("pick with all backends ejected = %q; want nil", got.target)
+	}
+	p.setHealth(p.backends[1], nil)
+	if got := p.pick(); got == nil || got.target != "127.0.0.1:2" {
+		t.Errorf("pick after backend recovered = %v; want 127.0.0.1:2", got)
+	}
+
+	p = newPool(ipn.LBLeastConn)
+	p.backends[0].active.Store(3)
+	p.backends[1].active.Store(1)
+	p.backends[2].active.Store(2)
+	if got, want := picks(p, 2), []string{"127.0.0.1:2", "127.0.0.1:2"}; !slices.Equal(got, want) {
+		t.Errorf("least-conn picks = %q; want %q", got, want)
+	}
+	eject(p, 1)
+	if got, want := picks(p, 1), []string{"127.0.0.1:3"}; !slices.Equal(got, want) {
+		t.Errorf("least-conn picks with ejected backend = %q; want %q", got, want)
+	}
+}
+
+func TestBackendPoolHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !healthy.Load() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	var d net.Dialer
+	ctx := context.Background()
+	checkAll := func(p *backendPool) {
+		for i := 0; i < servePoolUnhealthyThreshold; i++ {
+			p.checkAll(ctx)
+		}
+	}
+	healthyStatus := func(p *backendPool) (ret []bool) {
+		for _, st := range p.status() {
+			ret = append(ret, st.Healthy)
+		}
+		return ret
+	}
+
+	web := newBackendPool(t.Logf, "foo.ts.net:443/", s.URL, (&ipn.BackendPool{
+		Backends:        []string{"http://" + closedAddr},
+		HealthCheckPath: "/healthz",
+	}).View(), true, d.DialContext)
+	checkAll(web)
+	if got, want := healthyStatus(web), []bool{true, false}; !slices.Equal(got, want) {
+		t.Errorf("web backends healthy = %v; want %v", got, want)
+	}
+	healthy.Store(false)
+	checkAll(web)
+	if got, want := healthyStatus(web), []bool{false, false}; !slices.Equal(got, want) {
+		t.Errorf("web backends healthy = %v; want %v", got, want)
+	}
+	if st := web.status()[0]; st.LastError == "" {
+		t.Errorf("no error recorded for failing health check")
+	}
+
+	tcp := newBackendPool(t.Logf, "tcp:2222", s.Listener.Addr().String(), (&ipn.BackendPool{
+		Backends: []string{closedAddr},
+	}).View(), false, d.DialContext)
+	checkAll(tcp)
+	if got, want := healthyStatus(tcp), []bool{true, false}; !slices.Equal(got, want) {
+		t.Errorf("TCP backends healthy = %v; want %v", got, want)
+	}
+}
+
+func TestServeWebHandlerPool(t *testing.T) {
+	b := newTestBackend(t)
+
+	newBackend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	s1, s2 := newBackend("one"), newBackend("two")
+
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: s1.URL, Pool: &ipn.BackendPool{Backends: []string{s2.URL}}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		req := httptest.NewRequest("GET", "https://example.ts.net/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			return w.Result().Status
+		}
+		return w.Result().Header.Get("X-Backend")
+	}
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[get()]++
+	}
+	if seen["one"] != 2 || seen["two"] != 2 {
+		t.Errorf("requests per backend = %v; want 2 each", seen)
+	}
+
+	st := b.ServeBackends()
+	if len(st) != 2 || st[0].Handler != "example.ts.net:443/" || st[1].Backend != s2.URL {
+		t.Fatalf("ServeBackends = %+v", st)
+	}
+	p := b.servePool("example.ts.net:443/")
+	if p == nil {
+		t.Fatal("no pool")
+	}
+	// Take the backends down for real, so background health checks
+	// agree.
+	s1.Close()
+	for i := 0; i < servePoolUnhealthyThreshold; i++ {
+		p.setHealth(p.backends[0], errors.New("down"))
+	}
+	for i := 0; i < 2; i++ {
+		if got := get(); got != "two" {
+			t.Errorf("request with backend one ejected went to %q", got)
+		}
+	}
+	s2.Close()
+	p.setHealth(p.backends[1], errors.New("down"))
+	p.setHealth(p.backends[1], errors.New("down"))
+	if got := get(); got != "502 Bad Gateway" {
+		t.Errorf("request with all backends ejected = %q; want 502", got)
+	}
+
+	// Reloading an unchanged config keeps the pool and its state.
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if st := b.ServeBackends(); len(st) != 2 || st[0].Healthy || st[1].Healthy {
+		t.Errorf("ServeBackends after reload = %+v; want both ejected", st)
+	}
+	if got := get(); got != "502 Bad Gateway" {
+		t.Errorf("request after reload = %q; want 502", got)
+	}
+
+	// So does listing a backend twice.
+	conf.Web["example.ts.net:443"].Handlers["/"].Pool.Backends = []string{s2.URL, s2.URL}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b.servePool("example.ts.net:443/") != p {
+		t.Error("pool rebuilt after listing a backend twice")
+	}
+
+	conf.Web["example.ts.net:443"].Handlers["/"].Pool = nil
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if st := b.ServeBackends(); len(st) != 0 {
+		t.Errorf("ServeBackends without pools = %+v; want none", st)
+	}
+}
@@ -12,12 +12,15 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -26,8 +29,10 @@
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
+	"tailscale.com/tstime"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
 	"tailscale.com/util/cmpx"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
@@ -50,6 +55,9 @@ type res struct {
 		{"http://foo.com", res{"http://foo.com", false}},
 		{"https://foo.com", res{"https://foo.com", false}},
 		{"https+insecure://10.2.3.4", res{"https://10.2.3.4", true}},
+		{"h2c://127.0.0.1:50051", res{"http://127.0.0.1:50051", false}},
+		{"h2c://localhost", res{"http://localhost:80", false}},
+		{"h2c://[::1]/grpc", res{"http://[::1]:80/grpc", false}},
 	}
 	for _, tt := range tests {
 		target, insecure := expandProxyArg(tt.in)
@@ -149,6 +157,7 @@ func TestGetServeHandler(t *testing.T) {
 			b := &LocalBackend{
 				serveConfig: tt.conf.View(),
 				logf:        t.Logf,
+				clock:       tstime.StdClock{},
 			}
 			req := &http.Request{
 				URL: &url.URL{
@@ -347,6 +356,47 @@ func TestServeConfigETag(t *testing.T) {
 	}
 }
 
+func TestSetServeConfigRejectsBadStatus(t *testing.T) {
+	b := newTestBackend(t)
+	webConf := func(h *ipn.HTTPHandler) *ipn.ServeConfig {
+		return &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": h}},
+			},
+		}
+	}
+	for _, h := range []*ipn.HTTPHandler{
+		{Text: "hi", Status: 42},
+		{Text: "hi", Status: 1000},
+		{Status: -1},
+		{Redirect: "https://example.com/", Status: http.StatusOK},
+		{Redirect: "https://example.com/", Status: http.StatusNotFound},
+	} {
+		if err := b.SetServeConfig(webConf(h), ""); err == nil {
+			t.Errorf("SetServeConfig with %+v succeeded; want error", h)
+		}
+		fg := &ipn.ServeConfig{Foreground: map[string]*ipn.ServeConfig{"session": webConf(h)}}
+		if err := b.SetServeConfig(fg, ""); err == nil {
+			t.Errorf("SetServeConfig with foreground %+v succeeded; want error", h)
+		}
+	}
+	if b.ServeConfig().Valid() {
+		t.Errorf("rejected config was applied: %v", b.ServeConfig())
+	}
+
+	for _, h := range []*ipn.HTTPHandler{
+		{Text: "hi", Status: http.StatusTeapot},
+		{Status: http.StatusGone},
+		{Redirect: "https://example.com/", Status: http.StatusMovedPermanently},
+		{Redirect: "https://example.com/"},
+	} {
+		if err := b.SetServeConfig(webConf(h), ""); err != nil {
+			t.Errorf("SetServeConfig with %+v: %v", h, err)
+		}
+	}
+}
+
 func TestServeHTTPProxy(t *testing.T) {
 	b := newTestBackend(t)
 
@@ -446,6 +496,292 @@ type headerCheck struct {
 	}
 }
 
+func TestServeWebHandlerKinds(t *testing.T) {
+	b := newTestBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Echo the request headers, as in TestServeHTTPProxy.
+			for key, val := range r.Header {
+				w.Header().Add("Echo-"+key, strings.Join(val, ","))
+			}
+			w.Header().Set("X-Backend", "internal")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/old/":   {Redirect: "https://${HOST}/new${REQUEST_URI}", Status: http.StatusMovedPermanently},
+				"/docs":   {Redirect: "https://docs.example.com/"},
+				"/teapot": {Text: "short and stout", Status: http.StatusTeapot},
+				"/gone":   {Status: http.StatusGone},
+				"/proxy/": {
+					Proxy:                 testServ.URL,
+					AddRequestHeaders:     map[string]string{"X-Added": "yes", "Tailscale-User-Login": "forged@example.com"},
+					RemoveRequestHeaders:  []string{"X-Secret"},
+					AddResponseHeaders:    map[string]string{"Cache-Control": "no-store"},
+					RemoveResponseHeaders: []string{"X-Backend"},
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		reqHeaders  map[string]string
+		wantCode    int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "redirect-with-status",
+			path:        "/old/page?x=1",
+			wantCode:    http.StatusMovedPermanently,
+			wantHeaders: map[string]string{"Location": "https://example.ts.net/new/old/page?x=1"},
+		},
+		{
+			name:        "redirect-default-status",
+			path:        "/docs",
+			wantCode:    http.StatusFound,
+			wantHeaders: map[string]string{"Location": "https://docs.example.com/"},
+		},
+		{
+			name:     "text-with-status",
+			path:     "/teapot",
+			wantCode: http.StatusTeapot,
+			wantBody: "short and stout",
+		},
+		{
+			name:     "status-only",
+			path:     "/gone",
+			wantCode: http.StatusGone,
+		},
+		{
+			name:       "proxy-header-rules",
+			path:       "/proxy/",
+			reqHeaders: map[string]string{"X-Secret": "hunter2", "X-Kept": "1"},
+			wantCode:   http.StatusOK,
+			wantHeaders: map[string]string{
+				"Echo-X-Added":              "yes",
+				"Echo-X-Kept":               "1",
+				"Echo-X-Secret":             "",
+				"Echo-Tailscale-User-Login": "someone@example.com", // not forgeable
+				"Cache-Control":             "no-store",
+				"X-Backend":                 "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://example.ts.net"+tt.path, nil)
+			for k, v := range tt.reqHeaders {
+				req.Header.Set(k, v)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+
+			res := w.Result()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.wantCode)
+			}
+			if tt.wantBody != "" {
+				if got := w.Body.String(); got != tt.wantBody {
+					t.Errorf("body = %q; want %q", got, tt.wantBody)
+				}
+			}
+			for k, want := range tt.wantHeaders {
+				if got := res.Header.Get(k); got != want {
+					t.Errorf("header %q = %q; want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeAccessControl(t *testing.T) {
+	b := newTestBackend(t)
+	b.peers[154] = (&tailcfg.Node{
+		ID:           154,
+		ComputedName: "some-admin-peer",
+		User:         tailcfg.UserID(1),
+		CapMap:       tailcfg.NodeCapMap{"example.com/cap/admin": nil},
+	}).View()
+	b.nodeByAddr[netip.MustParseAddr("100.150.151.154")] = 154
+
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432", AllowFrom: []string{"tag:server"}},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Text: "open"},
+				"/user/":  {Text: "user", AllowFrom: []string{"someone@example.com"}},
+				"/tag/":   {Text: "tag", AllowFrom: []string{"tag:test"}},
+				"/admin/": {Text: "admin", AllowFrom: []string{"cap:example.com/cap/admin", "nobody@example.com"}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		user    = "100.150.151.152"
+		tagged  = "100.150.151.153" // also owned by someone@example.com
+		admin   = "100.150.151.154"
+		outside = "100.160.161.162" // funnel
+	)
+	tests := []struct {
+		path     string
+		srcIP    string
+		wantCode int
+	}{
+		{"/", outside, http.StatusOK},
+		{"/user/", user, http.StatusOK},
+		{"/user/", tagged, http.StatusForbidden},
+		{"/user/", outside, http.StatusForbidden},
+		{"/tag/", tagged, http.StatusOK},
+		{"/tag/", user, http.StatusForbidden},
+		{"/admin/", admin, http.StatusOK},
+		{"/admin/", user, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "https://example.ts.net"+tt.path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if got := w.Result().StatusCode; got != tt.wantCode {
+			t.Errorf("GET %s from %s: status = %d; want %d", tt.path, tt.srcIP, got, tt.wantCode)
+		}
+	}
+
+	// A denied TCP connection is closed without dialing the backend.
+	h := b.tcpHandlerForServe(5432, netip.MustParseAddrPort(user+":1234"))
+	if h == nil {
+		t.Fatal("no handler for denied TCP connection")
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go h(c1)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from denied TCP connection = %v; want EOF", err)
+	}
+}
+
+func TestMatchServeAccessRule(t *testing.T) {
+	user := tailcfg.UserProfile{LoginName: "alice@example.com"}
+	untagged := (&tailcfg.Node{
+		CapMap: tailcfg.NodeCapMap{"example.com/cap/node": nil},
+	}).View()
+	tagged := (&tailcfg.Node{Tags: []string{"tag:prod"}}).View()
+	caps := tailcfg.PeerCapMap{"example.com/cap/peer": nil}
+
+	tests := []struct {
+		rules    []string
+		node     tailcfg.NodeView
+		caps     tailcfg.PeerCapMap
+		wantRule string
+	}{
+		{[]string{"alice@example.com"}, untagged, nil, "alice@example.com"},
+		{[]string{"alice@example.com"}, tagged, nil, ""},
+		{[]string{"bob@example.com", "tag:prod"}, tagged, nil, "tag:prod"},
+		{[]string{"tag:prod"}, untagged, nil, ""},
+		{[]string{"cap:example.com/cap/node"}, untagged, nil, "cap:example.com/cap/node"},
+		{[]string{"cap:example.com/cap/peer"}, untagged, caps, "cap:example.com/cap/peer"},
+		{[]string{"cap:example.com/cap/peer"}, untagged, nil, ""},
+		{nil, untagged, caps, ""},
+	}
+	for _, tt := range tests {
+		rule, ok := matchServeAccessRule(views.SliceOf(tt.rules), tt.node, user, tt.caps)
+		if rule != tt.wantRule || ok != (tt.wantRule != "") {
+			t.Errorf("matchServeAccessRule(%q, %v) = %q, %v; want %q", tt.rules, tt.node.Tags(), rule, ok, tt.wantRule)
+		}
+	}
+}
+
+func TestServeConfigExpiry(t *testing.T) {
+	b := newTestBackend(t)
+	notified := make(chan []string, 1)
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		if len(n.ServeExpired) > 0 {
+			notified <- n.ServeExpired
+		}
+	})
+
+	expires := time.Now().Add(500 * time.Millisecond)
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Text: "always"},
+				"/tmp": {Text: "for now", Expires: &expires},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "https://example.ts.net"+path, nil)
+		req.TLS = &tls.ConnectionState{ServerName: "example.ts.net"}
+		req = req.WithContext(context.WithValue(req.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w.Body.String()
+	}
+	if got := get("/tmp"); got != "for now" {
+		t.Errorf("before expiry, /tmp = %q", got)
+	}
+
+	select {
+	case expired := <-notified:
+		if want := []string{"example.ts.net:443/tmp"}; !reflect.DeepEqual(expired, want) {
+			t.Errorf("ServeExpired = %q; want %q", expired, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ServeExpired notification")
+	}
+	if b.ServeConfig().Web().Get("example.ts.net:443").Handlers().Has("/tmp") {
+		t.Error("expired handler still in ServeConfig")
+	}
+	// The rest of the mount tree is still served.
+	if got := get("/tmp"); got != "always" {
+		t.Errorf("after expiry, /tmp = %q; want %q", got, "always")
+	}
+
+	// Even if the timer hasn't run yet, expired handlers aren't served.
+	b.mu.Lock()
+	sc := b.serveConfig.AsStruct()
+	past := time.Now().Add(-time.Second)
+	sc.Web["example.ts.net:443"].Handlers["/old"] = &ipn.HTTPHandler{Text: "stale", Expires: &past}
+	b.serveConfig = sc.View()
+	b.mu.Unlock()
+	if got := get("/old"); got != "always" {
+		t.Errorf("expired /old = %q; want %q", got, "always")
+	}
+}
+
 func newTestBackend(t *testing.T) *LocalBackend {
 	sys := &tsd.System{}
 	e, err := wgengine.NewUserspaceEngine(t.Logf, wgengine.Config{SetSubsystem: sys.Set})
@@ -483,12 +819,14 @@ func newTestBackend(t *testing.T) *LocalBackend {
 			ID:           152,
 			ComputedName: "some-peer",
 			User:         tailcfg.UserID(1),
+			Hostinfo:     (&tailcfg.Hostinfo{}).View(),
 		}).View(),
 		153: (&tailcfg.Node{
 			ID:           153,
 			ComputedName: "some-tagged-peer",
 			Tags:         []string{"tag:server", "tag:test"},
 			User:         tailcfg.UserID(1),
+			Hostinfo:     (&tailcfg.Hostinfo{}).View(),
 		}).View(),
 	}
 	b.nodeByAddr = map[netip.Addr]tailcfg.NodeID{
@@ -230,6 +230,11 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PeerRelay is the Tailscale IP of the peer relay that packets to
+	// this peer currently go through, if any, in which case CurAddr is
+	// empty.
+	PeerRelay string `json:",omitempty"`
+
 	RxBytes        int64
 	TxBytes        int64
 	Created        time.Time // time registered with tailcontrol
@@ -428,6 +433,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PeerRelay; v != "" {
+		e.PeerRelay = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -582,7 +590,9 @@ func (st *Status) WriteHTML(w io.Writer) {
 		f("<td>")
 
 		if ps.Active {
-			if ps.Relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer-relay <b>%s</b>", html.EscapeString(ps.PeerRelay))
+			} else if ps.Relay != "" && ps.CurAddr == "" {
 				f("relay <b>%s</b>", html.EscapeString(ps.Relay))
 			} else if ps.CurAddr != "" {
 				f("direct <b>%s</b>", html.EscapeString(ps.CurAddr))
@@ -646,6 +656,10 @@ type PingResult struct {
 	// It is not currently set for TSMP pings.
 	DERPRegionCode string
 
+	// PeerRelay is the Tailscale IP of the peer relay the ping went
+	// through, if any, in which case Endpoint is empty.
+	PeerRelay string `json:",omitempty"`
+
 	// PeerAPIPort is set by TSMP ping responses for peers that
 	// are running a peerapi server. This is the port they're
 	// running the server on.
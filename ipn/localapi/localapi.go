@@ -40,6 +40,7 @@
 	"tailscale.com/taildrop"
 	"tailscale.com/tka"
 	"tailscale.com/tstime"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
@@ -70,6 +71,7 @@
 	// The other /localapi/v0/NAME handlers are exact matches and contain only NAME
 	// without a trailing slash:
 	"bugreport":                   (*Handler).serveBugReport,
+	"captive-portal":              (*Handler).serveCaptivePortal,
 	"check-ip-forwarding":         (*Handler).serveCheckIPForwarding,
 	"check-prefs":                 (*Handler).serveCheckPrefs,
 	"component-debug-logging":     (*Handler).serveComponentDebugLogging,
@@ -93,6 +95,7 @@
 
 	"set-push-device-token":     (*Handler).serveSetPushDeviceToken,
 	"dial":                      (*Handler).serveDial,
+	"dns-query-log":             (*Handler).serveDNSQueryLog,
 	"file-targets":              (*Handler).serveFileTargets,
 	"goroutines":                (*Handler).serveGoroutines,
 	"id-token":                  (*Handler).serveIDToken,
@@ -105,6 +108,7 @@
 	"pprof":                     (*Handler).servePprof,
 	"reload-config":             (*Handler).reloadConfig,
 	"reset-auth":                (*Handler).serveResetAuth,
+	"serve-backends":            (*Handler).serveServeBackends,
 	"serve-config":              (*Handler).serveServeConfig,
 	"set-dns":                   (*Handler).serveSetDNS,
 	"set-expiry-sooner":         (*Handler).serveSetExpirySooner,
@@ -533,6 +537,43 @@ func (h *Handler) serveLogTap(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveDNSQueryLog streams the MagicDNS query log to the client as
+// newline-delimited JSON dnstype.QueryLogEntry values. With "follow=true",
+// it keeps streaming new entries until the client goes away.
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// Require write access (~root), like logtap, as which names were
+	// looked up is sensitive.
+	if !h.PermitWrite {
+		http.Error(w, "dns-query-log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	follow := defBool(r.FormValue("follow"), false)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	enc := json.NewEncoder(w)
+	err := h.b.StreamDNSQueryLog(r.Context(), follow, func(e dnstype.QueryLogEntry) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		f.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		h.logf("dns-query-log: %v", err)
+	}
+}
+
 func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
 	// Require write access out of paranoia that the metrics
 	// might contain something sensitive.
@@ -1010,6 +1051,19 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) serveServeBackends(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "serve backends access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.ServeBackends())
+}
+
 func (h *Handler) serveCheckIPForwarding(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "IP forwarding check access denied", http.StatusForbidden)
@@ -1027,6 +1081,36 @@ func (h *Handler) serveCheckIPForwarding(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// serveCaptivePortal reports whether the network is behind a captive
+// portal, and where to log in to it. A POST asks for the network to be
+// checked again, and returns the current status without waiting for that.
+func (h *Handler) serveCaptivePortal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "captive portal access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "captive portal check access denied", http.StatusForbidden)
+			return
+		}
+		h.b.CheckCaptivePortal()
+	default:
+		http.Error(w, "only GET or POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res apitype.CaptivePortalStatus
+	if e := health.CaptivePortal(); e != nil {
+		res.Detected = true
+		res.URL = e.URL
+		res.Since = e.Since
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "status access denied", http.StatusForbidden)
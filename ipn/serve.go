@@ -9,8 +9,10 @@
 	"net"
 	"net/netip"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -123,21 +125,104 @@ type TCPPortHandler struct {
 	// SNI name with this value. It is only used if TCPForward is non-empty.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// Expires, if non-nil, is when this handler stops being served and
+	// is removed from the ServeConfig, along with any ServeConfig.Web
+	// handlers and AllowFunnel entries for its port.
+	Expires *time.Time `json:",omitempty"`
+
+	// AllowFrom, if non-empty, restricts TCPForward connections to
+	// tailnet peers matching at least one of its rules; see
+	// CheckServeAccessRule for their syntax. Others, including all
+	// Funnel traffic, are disconnected. HTTP and HTTPS ports use the
+	// AllowFrom of their HTTPHandlers instead.
+	AllowFrom []string `json:",omitempty"`
+
+	// Pool, if non-nil, balances connections over TCPForward and
+	// the pool's other backends.
+	Pool *BackendPool `json:",omitempty"`
 }
 
-// HTTPHandler is either a path or a proxy to serve.
+// HTTPHandler is either a path or a proxy to serve, a redirect, or a static
+// response.
 type HTTPHandler struct {
-	// Exactly one of the following may be set.
+	// Exactly one of the following may be set. If none is set but Status
+	// is, the handler replies with Status and an empty body.
 
 	Path  string `json:",omitempty"` // absolute path to directory or file to serve
 	Proxy string `json:",omitempty"` // http://localhost:3000/, localhost:3030, 3030
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
-	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	// Redirect is the URL to redirect requests to. The strings ${HOST} and
+	// ${REQUEST_URI} in it are replaced by the request's Host header and
+	// its path and query, respectively.
+	Redirect string `json:",omitempty"`
+
+	// Status is the HTTP status code to reply with for Text and Redirect
+	// handlers. If zero, it's 200 for Text and 302 (Found) for Redirect.
+	// It must be a 3xx code for Redirect.
+	Status int `json:",omitempty"`
+
+	// AddRequestHeaders are headers to set on requests before they're
+	// handled, replacing any values sent by the client.
+	// RemoveRequestHeaders are headers to remove from them.
+	AddRequestHeaders    map[string]string `json:",omitempty"`
+	RemoveRequestHeaders []string          `json:",omitempty"`
+
+	// AddResponseHeaders and RemoveResponseHeaders are likewise headers
+	// to set on and remove from responses.
+	AddResponseHeaders    map[string]string `json:",omitempty"`
+	RemoveResponseHeaders []string          `json:",omitempty"`
+
+	// Expires, if non-nil, is when this handler stops being served and
+	// is removed from the ServeConfig. Once a port's last handler is
+	// removed, so are its TCPPortHandler and AllowFunnel entries.
+	Expires *time.Time `json:",omitempty"`
+
+	// AllowFrom, if non-empty, restricts the handler to tailnet peers
+	// matching at least one of its rules; see CheckServeAccessRule for
+	// their syntax. Others, including all Funnel traffic, get a 403.
+	AllowFrom []string `json:",omitempty"`
+
+	// Pool, if non-nil, balances requests over Proxy and the pool's
+	// other backends.
+	Pool *BackendPool `json:",omitempty"`
+
+	// TODO(bradfitz): bool to not enumerate directories?
+}
+
+// BackendPool load balances the traffic of a TCPPortHandler.TCPForward
+// or HTTPHandler.Proxy over several backends, skipping those that fail
+// health checks.
+type BackendPool struct {
+	// Backends are the backends to use besides the handler's
+	// TCPForward or Proxy, in the same format.
+	Backends []string `json:",omitempty"`
+
+	// Policy is how a healthy backend is picked for each connection or
+	// request: LBRoundRobin or LBLeastConn. If empty, it's LBRoundRobin.
+	Policy string `json:",omitempty"`
+
+	// HealthCheckPath, if non-empty, is the path on HTTPHandler.Proxy
+	// backends to GET to check their health, expecting a status below
+	// 400. Otherwise, backends are checked by connecting to them.
+	HealthCheckPath string `json:",omitempty"`
+
+	// HealthCheckIntervalSec is how often backends are checked, in
+	// seconds. If zero, it's DefaultHealthCheckIntervalSec.
+	HealthCheckIntervalSec int `json:",omitempty"`
 }
 
+// Load balancing policies for BackendPool.Policy.
+const (
+	LBRoundRobin = "round-robin" // take turns
+	LBLeastConn  = "least-conn"  // pick the backend with the fewest active connections or requests
+)
+
+// DefaultHealthCheckIntervalSec is the default BackendPool.HealthCheckIntervalSec.
+const DefaultHealthCheckIntervalSec = 10
+
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
 // the given host:port and mount point.
 func (sc *ServeConfig) WebHandlerExists(hp HostPort, mount string) bool {
@@ -331,6 +416,155 @@ func CheckFunnelPort(wantedPort uint16, node *ipnstate.PeerStatus) error {
 	return deny(portsStr)
 }
 
+// CheckServeAccessRule reports whether rule is a valid entry of
+// HTTPHandler.AllowFrom or TCPPortHandler.AllowFrom. A rule is one of:
+//
+//   - a user's login name, such as "alice@example.com", matching that
+//     user's untagged nodes
+//   - a tag, such as "tag:prod", matching nodes with that tag
+//   - "cap:" and a capability, such as "cap:example.com/cap/admin",
+//     matching nodes that have it as a node capability or that the
+//     tailnet policy grants it as a peer capability towards this node
+func CheckServeAccessRule(rule string) error {
+	switch {
+	case strings.HasPrefix(rule, "tag:"):
+		return tailcfg.CheckTag(rule)
+	case strings.HasPrefix(rule, "cap:"):
+		if rule == "cap:" || strings.ContainsAny(rule, " \t") {
+			return fmt.Errorf("invalid capability rule %q", rule)
+		}
+		return nil
+	case strings.Contains(rule, "@") && !strings.ContainsAny(rule, " \t"):
+		return nil
+	}
+	return fmt.Errorf("invalid access rule %q; want a login name, tag:<tag> or cap:<capability>", rule)
+}
+
+// CheckValid reports whether sc, including its foreground configs, can be
+// served. It checks the status codes of the web handlers: Status must be a
+// valid HTTP status code, and a 3xx code for a Redirect.
+func (sc *ServeConfig) CheckValid() error {
+	if sc == nil {
+		return nil
+	}
+	for hp, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			if h == nil || h.Status == 0 {
+				continue
+			}
+			if h.Status < 100 || h.Status > 999 {
+				return fmt.Errorf("%s%s: invalid HTTP status code %d", hp, mount, h.Status)
+			}
+			if h.Redirect != "" && (h.Status < 300 || h.Status > 399) {
+				return fmt.Errorf("%s%s: redirect status code %d is not a 3xx code", hp, mount, h.Status)
+			}
+		}
+	}
+	for _, fsc := range sc.Foreground {
+		if err := fsc.CheckValid(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasExpired reports whether the expiry time t, if any, is at or before now.
+func hasExpired(t *time.Time, now time.Time) bool {
+	return t != nil && !now.Before(*t)
+}
+
+// IsExpired reports whether the handler has expired as of now.
+func (v TCPPortHandlerView) IsExpired(now time.Time) bool { return hasExpired(v.ж.Expires, now) }
+
+// IsExpired reports whether the handler has expired as of now.
+func (v HTTPHandlerView) IsExpired(now time.Time) bool { return hasExpired(v.ж.Expires, now) }
+
+// RemoveExpired removes the TCP and web handlers of sc, including those of
+// its foreground configs, that have expired as of now, as well as the
+// configuration of ports left without handlers and the foreground configs
+// left without any. It returns descriptions
+// of the removed handlers, like "tcp:2222" or "foo.ts.net:443/docs", and
+// when the next remaining handler expires, or the zero time if none do.
+func (sc *ServeConfig) RemoveExpired(now time.Time) (expired []string, next time.Time) {
+	if sc == nil {
+		return nil, time.Time{}
+	}
+	noteNext := func(t *time.Time) {
+		if t != nil && (next.IsZero() || t.Before(next)) {
+			next = *t
+		}
+	}
+	removePort := func(port uint16) {
+		delete(sc.TCP, port)
+		for hp := range sc.Web {
+			if p, err := hp.Port(); err == nil && p == port {
+				delete(sc.Web, hp)
+			}
+		}
+		for hp := range sc.AllowFunnel {
+			if p, err := hp.Port(); err == nil && p == port {
+				delete(sc.AllowFunnel, hp)
+			}
+		}
+	}
+
+	for port, h := range sc.TCP {
+		if hasExpired(h.Expires, now) {
+			expired = append(expired, fmt.Sprintf("tcp:%d", port))
+			removePort(port)
+			continue
+		}
+		noteNext(h.Expires)
+	}
+	for hp, wsc := range sc.Web {
+		for mount, h := range wsc.Handlers {
+			if hasExpired(h.Expires, now) {
+				expired = append(expired, string(hp)+mount)
+				delete(wsc.Handlers, mount)
+				continue
+			}
+			noteNext(h.Expires)
+		}
+		if len(wsc.Handlers) > 0 {
+			continue
+		}
+		delete(sc.Web, hp)
+		port, err := hp.Port()
+		if err != nil {
+			continue
+		}
+		delete(sc.AllowFunnel, hp)
+		if h := sc.TCP[port]; h != nil && (h.HTTP || h.HTTPS) && !sc.hasWebOnPort(port) {
+			delete(sc.TCP, port)
+		}
+	}
+	for id, fsc := range sc.Foreground {
+		fexpired, fnext := fsc.RemoveExpired(now)
+		expired = append(expired, fexpired...)
+		if !fnext.IsZero() {
+			noteNext(&fnext)
+		}
+		if len(fexpired) > 0 && len(fsc.TCP) == 0 && len(fsc.Web) == 0 {
+			delete(sc.Foreground, id)
+		}
+	}
+	slices.Sort(expired)
+	return expired, next
+}
+
+// hasWebOnPort reports whether sc has web handlers for any host on port.
+func (sc *ServeConfig) hasWebOnPort(port uint16) bool {
+	for hp := range sc.Web {
+		if p, err := hp.Port(); err == nil && p == port {
+			return true
+		}
+	}
+	return false
+}
+
 // RangeOverTCPs ranges over both background and foreground TCPs.
 // If the returned bool from the given f is false, then this function stops
 // iterating immediately and does not check other foreground configs.
@@ -3,10 +3,14 @@
 package ipn
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
 )
 
 func TestCheckFunnelAccess(t *testing.T) {
@@ -43,3 +47,113 @@ func TestCheckFunnelAccess(t *testing.T) {
 		}
 	}
 }
+
+func TestServeConfigRemoveExpired(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Minute)
+	soon := now.Add(time.Hour)
+	later := now.Add(2 * time.Hour)
+
+	sc := &ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {HTTPS: true},
+			2222: {TCPForward: "127.0.0.1:22", Expires: &past},
+			5432: {TCPForward: "127.0.0.1:5432", Expires: &later},
+			9000: {HTTP: true, Expires: &past},
+		},
+		Web: map[HostPort]*WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:3000"},
+				"/docs": {Text: "hi", Expires: &past},
+				"/tmp":  {Text: "hi", Expires: &soon},
+			}},
+			"foo.test.ts.net:8443": {Handlers: map[string]*HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3001", Expires: &now},
+			}},
+			"foo.test.ts.net:9000": {Handlers: map[string]*HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3002"},
+			}},
+		},
+		AllowFunnel: map[HostPort]bool{
+			"foo.test.ts.net:443":  true,
+			"foo.test.ts.net:8443": true,
+		},
+		Foreground: map[string]*ServeConfig{
+			"sess": {
+				TCP: map[uint16]*TCPPortHandler{10000: {HTTPS: true}},
+				Web: map[HostPort]*WebServerConfig{
+					"foo.test.ts.net:10000": {Handlers: map[string]*HTTPHandler{
+						"/": {Text: "fg", Expires: &past},
+					}},
+				},
+			},
+			"sess2": {
+				TCP: map[uint16]*TCPPortHandler{
+					10001: {TCPForward: "127.0.0.1:22"},
+					10002: {TCPForward: "127.0.0.1:23", Expires: &past},
+				},
+			},
+		},
+	}
+	expired, next := sc.RemoveExpired(now)
+
+	wantExpired := []string{
+		"foo.test.ts.net:10000/",
+		"foo.test.ts.net:443/docs",
+		"foo.test.ts.net:8443/",
+		"tcp:10002",
+		"tcp:2222",
+		"tcp:9000",
+	}
+	if !reflect.DeepEqual(expired, wantExpired) {
+		t.Errorf("expired = %q; want %q", expired, wantExpired)
+	}
+	if !next.Equal(soon) {
+		t.Errorf("next = %v; want %v", next, soon)
+	}
+	want := &ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{
+			443:  {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432", Expires: &later},
+		},
+		Web: map[HostPort]*WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/tmp": {Text: "hi", Expires: &soon},
+			}},
+		},
+		AllowFunnel: map[HostPort]bool{
+			"foo.test.ts.net:443": true,
+		},
+		Foreground: map[string]*ServeConfig{
+			"sess2": {
+				TCP: map[uint16]*TCPPortHandler{10001: {TCPForward: "127.0.0.1:22"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(sc, want) {
+		t.Errorf("after RemoveExpired:\n got %s\nwant %s", must.Get(json.Marshal(sc)), must.Get(json.Marshal(want)))
+	}
+
+	// Nothing more to do until the next expiry.
+	if expired, _ := sc.RemoveExpired(now); len(expired) != 0 {
+		t.Errorf("second RemoveExpired = %q; want none", expired)
+	}
+	if expired, next := sc.RemoveExpired(later); len(expired) != 2 || !next.IsZero() {
+		t.Errorf("RemoveExpired(later) = %q, %v; want 2 expired and no next", expired, next)
+	}
+}
+
+func TestCheckServeAccessRule(t *testing.T) {
+	for _, rule := range []string{"alice@example.com", "alice@github", "tag:prod", "cap:example.com/cap/admin"} {
+		if err := CheckServeAccessRule(rule); err != nil {
+			t.Errorf("CheckServeAccessRule(%q) = %v; want nil", rule, err)
+		}
+	}
+	for _, rule := range []string{"", "alice", "tag:", "tag:no spaces", "cap:", "cap:a b", "a b@example.com"} {
+		if err := CheckServeAccessRule(rule); err == nil {
+			t.Errorf("CheckServeAccessRule(%q) = nil; want error", rule)
+		}
+	}
+}
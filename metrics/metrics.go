@@ -152,6 +152,16 @@ func (h *Histogram) Do(f func(expvar.KeyValue)) {
 	f(expvar.KeyValue{Key: "+Inf", Value: &h.count})
 }
 
+// Snapshot returns the bucket boundaries, the number of observations at or
+// below each, and the number and sum of all observations.
+func (h *Histogram) Snapshot() (buckets []float64, counts []int64, count int64, sum float64) {
+	counts = make([]int64, len(h.bucketVars))
+	for i := range h.bucketVars {
+		counts[i] = h.bucketVars[i].Value()
+	}
+	return slices.Clone(h.buckets), counts, h.count.Value(), h.sum.Value()
+}
+
 // PromExport writes the histogram to w in Prometheus exposition format.
 func (h *Histogram) PromExport(w io.Writer, name string) {
 	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
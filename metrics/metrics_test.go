@@ -5,6 +5,7 @@
 
 import (
 	"os"
+	"reflect"
 	"runtime"
 	"testing"
 
@@ -23,6 +24,17 @@ func TestLabelMap(t *testing.T) {
 	}
 }
 
+func TestHistogramSnapshot(t *testing.T) {
+	h := NewHistogram([]float64{1, 10})
+	for _, v := range []float64{0.5, 5, 50} {
+		h.Observe(v)
+	}
+	buckets, counts, count, sum := h.Snapshot()
+	if !reflect.DeepEqual(buckets, []float64{1, 10}) || !reflect.DeepEqual(counts, []int64{1, 2}) || count != 3 || sum != 55.5 {
+		t.Errorf("Snapshot = %v, %v, %v, %v; want [1 10], [1 2], 3, 55.5", buckets, counts, count, sum)
+	}
+}
+
 func TestCurrentFileDescriptors(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.Skipf("skipping on %v", runtime.GOOS)
@@ -44,6 +44,11 @@ type Config struct {
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
+	// Policy are rules blocking or rewriting queries for some DNS
+	// names. Queries have to go through 100.100.100.100 for them to
+	// apply, so a non-empty Policy makes it the OS resolver for all
+	// names where possible.
+	Policy []resolver.PolicyRule
 }
 
 func (c *Config) serviceIP() netip.Addr {
@@ -64,13 +69,20 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if len(c.Policy) > 0 {
+		fmt.Fprintf(w, " Policy:%v", len(c.Policy))
+	}
 	w.WriteString("}")
 }
 
 // needsAnyResolvers reports whether c requires a resolver to be set
 // at the OS level.
 func (c Config) needsOSResolver() bool {
-	return c.hasDefaultResolvers() || c.hasRoutes()
+	return c.hasDefaultResolvers() || c.hasRoutes() || c.hasPolicy()
+}
+
+func (c Config) hasPolicy() bool {
+	return len(c.Policy) > 0
 }
 
 func (c Config) hasRoutes() bool {
@@ -81,7 +93,7 @@ func (c Config) hasRoutes() bool {
 // DefaultResolvers, and that those resolvers are simple IP addresses
 // that speak regular port 53 DNS.
 func (c Config) hasDefaultIPResolversOnly() bool {
-	if !c.hasDefaultResolvers() || c.hasRoutes() {
+	if !c.hasDefaultResolvers() || c.hasRoutes() || c.hasPolicy() {
 		return false
 	}
 	for _, r := range c.DefaultResolvers {
@@ -153,6 +165,28 @@ func (c Config) matchDomains() []dnsname.FQDN {
 	return ret
 }
 
+// policyMatchDomains returns the match suffixes needed by Routes and
+// Policy, for when the OS can only send some names to quad-100. Policy
+// rules for the root can't be honored that way and are left out.
+func (c Config) policyMatchDomains() []dnsname.FQDN {
+	ret := c.matchDomains()
+	seen := make(map[dnsname.FQDN]bool, len(ret))
+	for _, d := range ret {
+		seen[d] = true
+	}
+	for _, r := range c.Policy {
+		if r.Suffix == "." || r.Suffix == "" || seen[r.Suffix] {
+			continue
+		}
+		seen[r.Suffix] = true
+		ret = append(ret, r.Suffix)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].WithTrailingDot() < ret[j].WithTrailingDot()
+	})
+	return ret
+}
+
 func sameResolverNames(a, b []*dnstype.Resolver) bool {
 	if len(a) != len(b) {
 		return false
@@ -163,6 +163,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.Policy = cfg.Policy
 	routes := map[dnsname.FQDN][]*dnstype.Resolver{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -228,7 +229,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// This bool is used in a couple of places below to implement this
 	// workaround.
 	isWindows := runtime.GOOS == "windows"
-	if cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !isWindows {
+	if cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !isWindows && !cfg.hasPolicy() {
 		// Split DNS configuration requested, where all split domains
 		// go to the same resolvers. We can let the OS do it.
 		ocfg.Nameservers = toIPsOnly(cfg.singleResolverSet())
@@ -250,25 +251,30 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// that as the forwarder for all DNS traffic that quad-100 doesn't handle.
 	const isApple = runtime.GOOS == "darwin" || runtime.GOOS == "ios"
 
-	if isApple || !m.os.SupportsSplitDNS() {
+	if isApple || !m.os.SupportsSplitDNS() || cfg.hasPolicy() {
 		// If the OS can't do native split-dns, read out the underlying
-		// resolver config and blend it into our config.
+		// resolver config and blend it into our config. Likewise if
+		// there's a DNS policy, which needs to see all queries.
 		cfg, err := m.os.GetBaseConfig()
 		if err == nil {
 			baseCfg = &cfg
 		} else if isApple && err == ErrGetBaseConfigNotSupported {
 			// This is currently (2022-10-13) expected on certain iOS and macOS
 			// builds.
+		} else if m.os.SupportsSplitDNS() && err == ErrGetBaseConfigNotSupported {
+			// Only the policy wanted the base config; make do with
+			// split DNS for the policy's suffixes.
 		} else {
 			health.SetDNSOSHealth(err)
 			return resolver.Config{}, OSConfig{}, err
 		}
 	}
 
-	if baseCfg == nil || isApple && len(baseCfg.Nameservers) == 0 {
-		// If there was no base config, or if we're on Apple and the base
-		// config is empty, then we need to fallback to SplitDNS mode.
-		ocfg.MatchDomains = cfg.matchDomains()
+	if baseCfg == nil || (isApple || m.os.SupportsSplitDNS()) && len(baseCfg.Nameservers) == 0 {
+		// If there was no base config, or if we're on Apple (or only
+		// wanted it for the policy) and the base config is empty, then
+		// we need to fallback to SplitDNS mode.
+		ocfg.MatchDomains = cfg.policyMatchDomains()
 	} else {
 		var defaultRoutes []*dnstype.Resolver
 		for _, ip := range baseCfg.Nameservers {
@@ -13,6 +13,7 @@
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/util/dnsname"
 )
@@ -422,6 +423,51 @@ func TestManager(t *testing.T) {
 					"bigco.net.", "3.3.3.3"),
 			},
 		},
+		{
+			name: "policy-split",
+			in: Config{
+				Routes:        upstreams("corp.com", "2.2.2.2"),
+				SearchDomains: fqdns("tailscale.com"),
+				Policy:        []resolver.PolicyRule{{Suffix: "ads.example.", Action: tailcfg.DNSPolicyBlock}},
+			},
+			split: true,
+			bs: OSConfig{
+				Nameservers:   mustIPs("8.8.8.8"),
+				SearchDomains: fqdns("coffee.shop"),
+			},
+			os: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("tailscale.com", "coffee.shop"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(
+					".", "8.8.8.8",
+					"corp.com.", "2.2.2.2"),
+				Policy: []resolver.PolicyRule{{Suffix: "ads.example.", Action: tailcfg.DNSPolicyBlock}},
+			},
+		},
+		{
+			name: "policy-split-no-base",
+			in: Config{
+				Routes: upstreams("corp.com", "2.2.2.2"),
+				Policy: []resolver.PolicyRule{
+					{Suffix: "ads.example.", Action: tailcfg.DNSPolicyBlock},
+					{Suffix: ".", Action: tailcfg.DNSPolicyPass},
+				},
+			},
+			split: true,
+			os: OSConfig{
+				Nameservers:  mustIPs("100.100.100.100"),
+				MatchDomains: fqdns("ads.example", "corp.com"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams("corp.com.", "2.2.2.2"),
+				Policy: []resolver.PolicyRule{
+					{Suffix: "ads.example.", Action: tailcfg.DNSPolicyBlock},
+					{Suffix: ".", Action: tailcfg.DNSPolicyPass},
+				},
+			},
+		},
 		{
 			name: "routes-multi-split",
 			in: Config{
@@ -0,0 +1,292 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// dnsCacheMaxEntries is the maximum number of responses cached.
+	dnsCacheMaxEntries = 1024
+
+	// dnsCacheMaxResponseBytes is the size of the largest response cached.
+	// Together with dnsCacheMaxEntries, it bounds the cache's memory use.
+	dnsCacheMaxResponseBytes = maxResponseBytes
+
+	// dnsCacheMaxTTL caps how long a positive response is cached,
+	// whatever its TTL.
+	dnsCacheMaxTTL = time.Hour
+
+	// dnsCacheMaxNegativeTTL caps how long a negative (NXDOMAIN or
+	// NODATA) response is cached, whatever the SOA says. RFC 2308,
+	// section 5, suggests one to three hours; we're more conservative
+	// as names that don't exist yet tend to be created soon after
+	// being looked up.
+	dnsCacheMaxNegativeTTL = 5 * time.Minute
+)
+
+var disableDNSCache = envknob.RegisterBool("TS_DEBUG_DNS_NO_CACHE")
+
+// cacheKey identifies the cacheable queries that get the same response.
+type cacheKey struct {
+	family           string // "udp" or "tcp", as UDP responses are limited in size
+	name             string // lowercase
+	typ              dns.Type
+	class            dns.Class
+	ednsSize         uint16 // the EDNS UDP payload size, or 0 without EDNS
+	dnssecOK         bool   // the DO bit, as DNSSEC records are only returned if set
+	checkingDisabled bool   // the CD bit, as the upstream doesn't validate if set
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	res     []byte
+	expires time.Time
+	added   time.Time
+}
+
+// responseCache caches responses from upstream resolvers for their TTL,
+// as well as negative responses per RFC 2308. It's safe for concurrent
+// use.
+type responseCache struct {
+	timeNow func() time.Time // or nil for time.Now
+
+	mu sync.Mutex
+	// entries is an LRU cache, to bound memory use without being
+	// emptied by a burst of one-off lookups.
+	entries lru.Cache[cacheKey, *cacheEntry]
+}
+
+func (c *responseCache) now() time.Time {
+	if c.timeNow != nil {
+		return c.timeNow()
+	}
+	return time.Now()
+}
+
+// get returns the cached response to q, if any, rewritten for q: with
+// its DNS ID and question, and TTLs decreased by the time spent in the
+// cache.
+func (c *responseCache) get(q cacheQuery) (res []byte, ok bool) {
+	if disableDNSCache() {
+		return nil, false
+	}
+	now := c.now()
+	c.mu.Lock()
+	e, ok := c.entries.GetOk(q.key)
+	if ok && !now.Before(e.expires) {
+		c.entries.Delete(q.key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		metricDNSCacheMiss.Add(1)
+		return nil, false
+	}
+
+	var msg dns.Message
+	if err := msg.Unpack(e.res); err != nil {
+		metricDNSCacheMiss.Add(1)
+		return nil, false
+	}
+	// Echo the ID and question exactly as asked, so that clients
+	// checking them (including 0x20 case randomization) accept the
+	// response.
+	msg.Header.ID = q.id
+	msg.Questions = []dns.Question{q.question}
+	elapsed := uint32(now.Sub(e.added) / time.Second)
+	for _, rrs := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range rrs {
+			h := &rrs[i].Header
+			if h.Type == dns.TypeOPT {
+				continue
+			}
+			h.TTL -= min(h.TTL, elapsed)
+		}
+	}
+	res, err := msg.Pack()
+	if err != nil {
+		metricDNSCacheMiss.Add(1)
+		return nil, false
+	}
+	metricDNSCacheHit.Add(1)
+	return res, true
+}
+
+// put caches res, the response to q, if it's cacheable.
+func (c *responseCache) put(q cacheQuery, res []byte) {
+	if disableDNSCache() || len(res) > dnsCacheMaxResponseBytes {
+		return
+	}
+	ttl, ok := cacheTTL(res)
+	if !ok || ttl <= 0 {
+		return
+	}
+	now := c.now()
+	e := &cacheEntry{
+		res:     append([]byte(nil), res...),
+		added:   now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.entries.Contains(q.key) && c.entries.Len() >= dnsCacheMaxEntries {
+		c.entries.DeleteOldest()
+		metricDNSCacheEvict.Add(1)
+	}
+	c.entries.Set(q.key, e)
+}
+
+// flush empties the cache.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.entries.Len(); n > 0 {
+		metricDNSCacheFlushed.Add(int64(n))
+	}
+	c.entries = lru.Cache[cacheKey, *cacheEntry]{}
+}
+
+// len returns the number of cached responses, including expired ones not
+// yet removed.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// cacheQuery is a cacheable query: its cache key, and the DNS ID and
+// question echoed in responses to it from the cache.
+type cacheQuery struct {
+	key      cacheKey
+	id       uint16
+	question dns.Question
+}
+
+// parseCacheQuery parses query, received over family ("udp" or "tcp"),
+// and reports whether it's a query whose response can be cached at all:
+// a standard query with a single question.
+//
+// It must be called before query is forwarded, as forwarding may rewrite
+// its EDNS options in place.
+func parseCacheQuery(query []byte, family string) (q cacheQuery, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return q, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return q, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return q, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return q, false
+	}
+	k := &q.key
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return q, false
+		}
+		if rh.Type == dns.TypeOPT {
+			k.ednsSize = uint16(rh.Class)
+			k.dnssecOK = rh.DNSSECAllowed()
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return q, false
+		}
+	}
+	k.family = family
+	k.name = strings.ToLower(qs[0].Name.String())
+	k.typ = qs[0].Type
+	k.class = qs[0].Class
+	k.checkingDisabled = h.CheckingDisabled
+	q.id = h.ID
+	q.question = qs[0]
+	return q, true
+}
+
+// cacheTTL returns how long res may be cached. Successful responses with
+// answers are cached for their smallest TTL. Negative responses (NXDOMAIN,
+// or success without answers, NODATA) are cached per RFC 2308, section 5,
+// for the smaller of the TTL of the SOA record in their authority section
+// and its MINIMUM field, and not at all without an SOA record.
+func cacheTTL(res []byte) (_ time.Duration, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(res)
+	if err != nil || !h.Response || h.Truncated {
+		return 0, false
+	}
+	if h.RCode != dns.RCodeSuccess && h.RCode != dns.RCodeNameError {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+
+	minTTL := ^uint32(0)
+	var answers int
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0, false
+		}
+		answers++
+		minTTL = min(minTTL, rh.TTL)
+		if err := p.SkipAnswer(); err != nil {
+			return 0, false
+		}
+	}
+
+	negative := h.RCode == dns.RCodeNameError || answers == 0
+	var sawSOA bool
+	for {
+		rh, err := p.AuthorityHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0, false
+		}
+		if !negative || rh.Type != dns.TypeSOA {
+			if !negative {
+				minTTL = min(minTTL, rh.TTL)
+			}
+			if err := p.SkipAuthority(); err != nil {
+				return 0, false
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0, false
+		}
+		sawSOA = true
+		minTTL = min(minTTL, rh.TTL, soa.MinTTL)
+	}
+	if negative {
+		if !sawSOA {
+			return 0, false
+		}
+		return min(time.Duration(minTTL)*time.Second, dnsCacheMaxNegativeTTL), true
+	}
+	return min(time.Duration(minTTL)*time.Second, dnsCacheMaxTTL), true
+}
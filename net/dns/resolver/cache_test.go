@@ -0,0 +1,265 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// soaTTLs are the TTL and MINIMUM field of an SOA record.
+type soaTTLs struct {
+	ttl, min uint32
+}
+
+// cacheTestResponse returns a response to a query for name of type A with
+// an A record for each of answerTTLs, and an SOA record in the authority
+// section if soa is non-nil.
+func cacheTestResponse(tb testing.TB, name string, rcode dns.RCode, answerTTLs []uint32, soa *soaTTLs) []byte {
+	tb.Helper()
+	n := dns.MustNewName(name)
+	b := dns.NewBuilder(nil, dns.Header{Response: true, RCode: rcode})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dns.Question{Name: n, Type: dns.TypeA, Class: dns.ClassINET})
+	b.StartAnswers()
+	for i, ttl := range answerTTLs {
+		b.AResource(dns.ResourceHeader{Name: n, Class: dns.ClassINET, TTL: ttl}, dns.AResource{A: [4]byte{192, 0, 2, byte(i)}})
+	}
+	b.StartAuthorities()
+	if soa != nil {
+		b.SOAResource(dns.ResourceHeader{Name: dns.MustNewName("example.com."), Class: dns.ClassINET, TTL: soa.ttl}, dns.SOAResource{
+			NS:     dns.MustNewName("ns.example.com."),
+			MBox:   dns.MustNewName("hostmaster.example.com."),
+			MinTTL: soa.min,
+		})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return res
+}
+
+func TestCacheTTL(t *testing.T) {
+	const name = "www.example.com."
+	truncated := cacheTestResponse(t, name, dns.RCodeSuccess, []uint32{300}, nil)
+	truncated[2] |= dnsFlagTruncated >> 8
+
+	tests := []struct {
+		name   string
+		res    []byte
+		want   time.Duration
+		wantOK bool
+	}{
+		{"answers", cacheTestResponse(t, name, dns.RCodeSuccess, []uint32{300, 60, 600}, nil), 60 * time.Second, true},
+		{"capped", cacheTestResponse(t, name, dns.RCodeSuccess, []uint32{86400}, nil), dnsCacheMaxTTL, true},
+		{"zero-ttl", cacheTestResponse(t, name, dns.RCodeSuccess, []uint32{0}, nil), 0, true},
+		{"nxdomain-soa-ttl", cacheTestResponse(t, name, dns.RCodeNameError, nil, &soaTTLs{30, 120}), 30 * time.Second, true},
+		{"nxdomain-soa-min", cacheTestResponse(t, name, dns.RCodeNameError, nil, &soaTTLs{120, 30}), 30 * time.Second, true},
+		{"nxdomain-capped", cacheTestResponse(t, name, dns.RCodeNameError, nil, &soaTTLs{3600, 3600}), dnsCacheMaxNegativeTTL, true},
+		{"nodata-soa", cacheTestResponse(t, name, dns.RCodeSuccess, nil, &soaTTLs{45, 60}), 45 * time.Second, true},
+		{"nxdomain-no-soa", cacheTestResponse(t, name, dns.RCodeNameError, nil, nil), 0, false},
+		{"nodata-no-soa", cacheTestResponse(t, name, dns.RCodeSuccess, nil, nil), 0, false},
+		{"servfail", cacheTestResponse(t, name, dns.RCodeServerFailure, nil, &soaTTLs{60, 60}), 0, false},
+		{"refused", cacheTestResponse(t, name, dns.RCodeRefused, []uint32{60}, nil), 0, false},
+		{"truncated", truncated, 0, false},
+		{"garbage", []byte{1, 2, 3}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cacheTTL(tt.res)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// answerTTLs returns the DNS ID, question name and answer TTLs of res.
+func answerTTLs(tb testing.TB, res []byte) (id uint16, name string, ttls []uint32) {
+	tb.Helper()
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		tb.Fatal(err)
+	}
+	for _, a := range msg.Answers {
+		ttls = append(ttls, a.Header.TTL)
+	}
+	return msg.Header.ID, msg.Questions[0].Name.String(), ttls
+}
+
+// udpCacheQuery returns the cacheable query in packet, received over UDP.
+func udpCacheQuery(tb testing.TB, packet []byte) cacheQuery {
+	tb.Helper()
+	q, ok := parseCacheQuery(packet, "udp")
+	if !ok {
+		tb.Fatal("query not cacheable")
+	}
+	return q
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &responseCache{timeNow: func() time.Time { return now }}
+
+	query := dnspacket("www.example.com.", dns.TypeA, noEdns)
+	c.put(udpCacheQuery(t, query), cacheTestResponse(t, "www.example.com.", dns.RCodeSuccess, []uint32{300, 100}, nil))
+	if c.len() != 1 {
+		t.Fatalf("len = %d; want 1", c.len())
+	}
+
+	// A later query with another ID and 0x20 case randomization.
+	query2 := dnspacket("WwW.eXample.com.", dns.TypeA, noEdns)
+	query2[0], query2[1] = 0x12, 0x34
+	now = now.Add(40 * time.Second)
+	res, ok := c.get(udpCacheQuery(t, query2))
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	id, name, ttls := answerTTLs(t, res)
+	if id != 0x1234 || name != "WwW.eXample.com." {
+		t.Errorf("got ID %#x, name %q; want the query's", id, name)
+	}
+	if len(ttls) != 2 || ttls[0] != 260 || ttls[1] != 60 {
+		t.Errorf("TTLs = %v; want [260 60]", ttls)
+	}
+
+	// Different query types and EDNS options don't share entries.
+	if _, ok := c.get(udpCacheQuery(t, dnspacket("www.example.com.", dns.TypeAAAA, noEdns))); ok {
+		t.Error("AAAA query hit A response")
+	}
+	if _, ok := c.get(udpCacheQuery(t, dnspacket("www.example.com.", dns.TypeA, 1232))); ok {
+		t.Error("EDNS query hit non-EDNS response")
+	}
+
+	// The entry expires with its smallest TTL.
+	now = now.Add(60 * time.Second)
+	if _, ok := c.get(udpCacheQuery(t, query)); ok {
+		t.Error("cache hit after expiry")
+	}
+	if c.len() != 0 {
+		t.Errorf("expired entry not removed")
+	}
+
+	// Negative responses are cached too.
+	nxQuery := dnspacket("nx.example.com.", dns.TypeA, noEdns)
+	c.put(udpCacheQuery(t, nxQuery), cacheTestResponse(t, "nx.example.com.", dns.RCodeNameError, nil, &soaTTLs{600, 30}))
+	res, ok = c.get(udpCacheQuery(t, nxQuery))
+	if !ok {
+		t.Fatal("negative response not cached")
+	}
+	if getRCode(res) != dns.RCodeNameError {
+		t.Errorf("rcode = %v; want NXDOMAIN", getRCode(res))
+	}
+	now = now.Add(30 * time.Second)
+	if _, ok := c.get(udpCacheQuery(t, nxQuery)); ok {
+		t.Error("negative response cached past SOA MINIMUM")
+	}
+
+	c.put(udpCacheQuery(t, query), cacheTestResponse(t, "www.example.com.", dns.RCodeSuccess, []uint32{300}, nil))
+	c.flush()
+	if _, ok := c.get(udpCacheQuery(t, query)); ok {
+		t.Error("cache hit after flush")
+	}
+}
+
+func TestResponseCacheEvict(t *testing.T) {
+	var c responseCache
+	evicted := metricDNSCacheEvict.Value()
+	for i := 0; i <= dnsCacheMaxEntries; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		c.put(udpCacheQuery(t, dnspacket(dnsname.FQDN(name), dns.TypeA, noEdns)), cacheTestResponse(t, name, dns.RCodeSuccess, []uint32{300}, nil))
+	}
+	if got := c.len(); got != dnsCacheMaxEntries {
+		t.Errorf("len = %d; want %d", got, dnsCacheMaxEntries)
+	}
+	if got := metricDNSCacheEvict.Value() - evicted; got != 1 {
+		t.Errorf("evictions = %d; want 1", got)
+	}
+	if _, ok := c.get(udpCacheQuery(t, dnspacket("host0.example.com.", dns.TypeA, noEdns))); ok {
+		t.Error("least recently used entry not evicted")
+	}
+}
+
+func TestResponseCacheFamily(t *testing.T) {
+	var c responseCache
+	query := dnspacket("big.example.com.", dns.TypeA, noEdns)
+	tcpQuery, ok := parseCacheQuery(query, "tcp")
+	if !ok {
+		t.Fatal("query not cacheable")
+	}
+	// A response too large for UDP without EDNS.
+	ttls := make([]uint32, 50)
+	for i := range ttls {
+		ttls[i] = 300
+	}
+	res := cacheTestResponse(t, "big.example.com.", dns.RCodeSuccess, ttls, nil)
+	if len(res) <= 512 {
+		t.Fatalf("response is %d bytes; want more than 512", len(res))
+	}
+	c.put(tcpQuery, res)
+
+	if _, ok := c.get(udpCacheQuery(t, query)); ok {
+		t.Error("UDP query hit response cached over TCP")
+	}
+	if _, ok := c.get(tcpQuery); !ok {
+		t.Error("TCP query missed")
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	const name = "cached.example.com."
+	var upstream atomic.Int32
+	port := runDNSServer(t, nil, cacheTestResponse(t, name, dns.RCodeSuccess, []uint32{300}, nil), func(bool, []byte) {
+		upstream.Add(1)
+	})
+
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: fmt.Sprintf("127.0.0.1:%d", port)}},
+	}
+	r.SetConfig(cfg)
+
+	query := func(ednsSize uint16) {
+		t.Helper()
+		res, err := r.Query(context.Background(), dnspacket(name, dns.TypeA, ednsSize), "udp", netip.MustParseAddrPort("127.0.0.1:12345"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got, _ := answerTTLs(t, res); got != name {
+			t.Fatalf("response for %q", got)
+		}
+	}
+	query(noEdns)
+	query(noEdns)
+	if got := upstream.Load(); got != 1 {
+		t.Errorf("upstream queries = %d; want 1", got)
+	}
+
+	// Queries with an EDNS size above maxResponseBytes, which the
+	// forwarder lowers, are cached too.
+	query(4096)
+	query(4096)
+	if got := upstream.Load(); got != 2 {
+		t.Errorf("upstream queries with EDNS = %d; want 2", got)
+	}
+
+	// Reconfiguring flushes the cache.
+	r.SetConfig(cfg)
+	query(noEdns)
+	if got := upstream.Load(); got != 3 {
+		t.Errorf("upstream queries after SetConfig = %d; want 3", got)
+	}
+}
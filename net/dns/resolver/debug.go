@@ -30,6 +30,9 @@ func init() {
 		}
 		fl.ServeHTTP(w, r)
 	}))
+	health.RegisterDebugHandler("dnspolicy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policyAtomic.Load().ServeHTTP(w, r)
+	}))
 }
 
 var fwdLogAtomic atomic.Pointer[fwdLog]
@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// DoHPath is the URL path at which DoHHandler answers queries, the one
+// suggested by RFC 8484.
+const DoHPath = "/dns-query"
+
+// maxDoHQueryLen is the size of the largest DNS-over-HTTPS query accepted.
+const maxDoHQueryLen = 256 << 10
+
+// dohServerTimeout bounds how long a DNS-over-HTTPS query may take. It's
+// short enough to be noticed by humans but longer than real DNS timeouts.
+const dohServerTimeout = 5 * time.Second
+
+// ParseDoHQuery returns the DNS query of the DNS-over-HTTPS (RFC 8484)
+// request r, which is either a GET with a base64url-encoded "dns"
+// parameter or a POST with an application/dns-message body.
+//
+// On failure, publicErr is the reason, suitable for an HTTP 400 response.
+func ParseDoHQuery(r *http.Request) (dnsQuery []byte, publicErr string) {
+	switch r.Method {
+	default:
+		return nil, "bad HTTP method"
+	case "GET":
+		q64 := r.FormValue("dns")
+		if q64 == "" {
+			return nil, "missing 'dns' parameter"
+		}
+		if base64.RawURLEncoding.DecodedLen(len(q64)) > maxDoHQueryLen {
+			return nil, "query too large"
+		}
+		q, err := base64.RawURLEncoding.DecodeString(q64)
+		if err != nil {
+			return nil, "invalid 'dns' base64 encoding"
+		}
+		return q, ""
+	case "POST":
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			return nil, "unexpected Content-Type"
+		}
+		q, err := io.ReadAll(io.LimitReader(r.Body, maxDoHQueryLen+1))
+		if err != nil {
+			return nil, "error reading post body with DNS query"
+		}
+		if len(q) > maxDoHQueryLen {
+			return nil, "query too large"
+		}
+		return q, ""
+	}
+}
+
+// DoHHandler returns an http.Handler serving DNS-over-HTTPS (RFC 8484)
+// queries at DoHPath, answered as r.Query would.
+//
+// If allow is non-nil, it's called with the remote address of each request
+// and reports whether that peer may query; requests from other peers are
+// refused with a 403.
+func (r *Resolver) DoHHandler(allow func(from netip.AddrPort) bool) http.Handler {
+	return &dohServer{r: r, allow: allow}
+}
+
+type dohServer struct {
+	r     *Resolver
+	allow func(netip.AddrPort) bool // or nil to allow all
+}
+
+func (s *dohServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != DoHPath {
+		http.NotFound(w, r)
+		return
+	}
+	from, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		metricDNSDoHServerErrorBadReq.Add(1)
+		http.Error(w, "bad remote address", http.StatusBadRequest)
+		return
+	}
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+	if s.allow != nil && !s.allow(from) {
+		metricDNSDoHServerDenied.Add(1)
+		http.Error(w, "DNS access denied", http.StatusForbidden)
+		return
+	}
+	q, publicErr := ParseDoHQuery(r)
+	if publicErr != "" {
+		metricDNSDoHServerErrorBadReq.Add(1)
+		http.Error(w, publicErr, http.StatusBadRequest)
+		return
+	}
+	metricDNSDoHServerQuery.Add(1)
+
+	ctx, cancel := context.WithTimeout(r.Context(), dohServerTimeout)
+	defer cancel()
+	// The response goes back over HTTP, so it's not subject to UDP size
+	// limits; ask for TCP semantics.
+	res, err := s.r.Query(ctx, q, "tcp", from)
+	if err != nil {
+		metricDNSDoHServerErrorQuery.Add(1)
+		s.r.logf("DoH query from %v: %v", from, err)
+		switch {
+		case errors.Is(err, net.ErrClosed):
+			http.Error(w, "DNS resolver shut down", http.StatusServiceUnavailable)
+		case ctx.Err() != nil:
+			http.Error(w, ctx.Err().Error(), http.StatusGatewayTimeout)
+		default:
+			http.Error(w, "DNS query failed", http.StatusBadGateway)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+	// Per RFC 8484, section 5.1, the freshness lifetime of the response
+	// mustn't exceed the smallest TTL in it.
+	if ttl, ok := cacheTTL(res); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.Write(res)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tailcfg"
+)
+
+func TestDoHServer(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Policy = []PolicyRule{{
+		Suffix:  "test1.ipn.dev.",
+		Sources: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+		Action:  tailcfg.DNSPolicyBlock,
+	}}
+	r.SetConfig(cfg)
+
+	var allowed netip.AddrPort
+	allow := true
+	ts := httptest.NewServer(r.DoHHandler(func(from netip.AddrPort) bool {
+		allowed = from
+		return allow
+	}))
+	defer ts.Close()
+
+	query := dnspacket("test2.ipn.dev.", dns.TypeAAAA, noEdns)
+	check := func(t *testing.T, res *http.Response, wantIP netip.Addr, wantRCode dns.RCode) {
+		t.Helper()
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status = %v", res.Status)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/dns-message" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := unpackResponse(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.rcode != wantRCode || resp.ip != wantIP {
+			t.Errorf("got rcode %v, IP %v; want %v, %v", resp.rcode, resp.ip, wantRCode, wantIP)
+		}
+	}
+
+	t.Run("get", func(t *testing.T) {
+		res, err := http.Get(ts.URL + DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cc := res.Header.Get("Cache-Control"); cc != "max-age=600" {
+			t.Errorf("Cache-Control = %q; want max-age=600", cc)
+		}
+		check(t, res, testipv6, dns.RCodeSuccess)
+		if allowed.Addr() != netip.MustParseAddr("127.0.0.1") || allowed.Port() == 0 {
+			t.Errorf("allow called with %v", allowed)
+		}
+	})
+	t.Run("post", func(t *testing.T) {
+		res, err := http.Post(ts.URL+DoHPath, "application/dns-message", bytes.NewReader(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, res, testipv6, dns.RCodeSuccess)
+	})
+	t.Run("policy-by-source", func(t *testing.T) {
+		q := dnspacket("test1.ipn.dev.", dns.TypeA, noEdns)
+		res, err := http.Post(ts.URL+DoHPath, "application/dns-message", bytes.NewReader(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, res, netip.Addr{}, dns.RCodeNameError)
+	})
+
+	errTests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		ctype      string
+		deny       bool
+		wantStatus int
+	}{
+		{name: "wrong-path", method: "GET", path: "/other?dns=AAAA", wantStatus: http.StatusNotFound},
+		{name: "no-param", method: "GET", path: DoHPath, wantStatus: http.StatusBadRequest},
+		{name: "bad-base64", method: "GET", path: DoHPath + "?dns=!!!", wantStatus: http.StatusBadRequest},
+		{name: "bad-ctype", method: "POST", path: DoHPath, body: "x", ctype: "text/plain", wantStatus: http.StatusBadRequest},
+		{name: "bad-method", method: "PUT", path: DoHPath, wantStatus: http.StatusBadRequest},
+		{name: "denied", method: "POST", path: DoHPath, body: string(query), ctype: "application/dns-message", deny: true, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow = !tt.deny
+			defer func() { allow = true }()
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.ctype != "" {
+				req.Header.Set("Content-Type", tt.ctype)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %v; want %v", res.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
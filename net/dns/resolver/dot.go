@@ -0,0 +1,437 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/types/dnstype"
+)
+
+const (
+	// dotDefaultPort is the port of DNS-over-TLS resolvers whose tls://
+	// address doesn't specify one (RFC 7858, section 3.1).
+	dotDefaultPort = 853
+
+	// dotIdleTimeout is how long to keep idle connections open to
+	// DNS-over-TLS servers. It matches dohTransportTimeout.
+	dotIdleTimeout = 30 * time.Second
+
+	// dotMaxConns is the maximum number of connections to a single
+	// DNS-over-TLS server.
+	dotMaxConns = 4
+
+	// dotMaxInFlight is the number of queries pipelined on a connection
+	// after which another connection is opened, if dotMaxConns allows.
+	dotMaxInFlight = 32
+)
+
+var errDoTConnClosed = errors.New("DNS-over-TLS connection closed")
+
+// parseDoTAddr parses a resolver address of the form "tls://host" or
+// "tls://host:port", where host may be a hostname or an IP address.
+func parseDoTAddr(addr string) (host string, port uint16, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return "", 0, fmt.Errorf("invalid DNS-over-TLS resolver %q", addr)
+	}
+	port = dotDefaultPort
+	if ps := u.Port(); ps != "" {
+		p, err := strconv.ParseUint(ps, 10, 16)
+		if err != nil || p == 0 {
+			return "", 0, fmt.Errorf("invalid port in DNS-over-TLS resolver %q", addr)
+		}
+		port = uint16(p)
+	}
+	return u.Hostname(), port, nil
+}
+
+// checkDoTResolver reports whether the tls:// resolver r can be used.
+//
+// A resolver naming its server by hostname needs a BootstrapResolution:
+// looking the hostname up through the system resolver could end up
+// querying MagicDNS, and so this forwarder, again.
+func checkDoTResolver(r *dnstype.Resolver) error {
+	host, _, err := parseDoTAddr(r.Addr)
+	if err != nil {
+		return err
+	}
+	if _, err := netip.ParseAddr(host); err != nil && len(r.BootstrapResolution) == 0 {
+		return fmt.Errorf("DNS-over-TLS resolver %q has a hostname but no bootstrap IPs", r.Addr)
+	}
+	return nil
+}
+
+// dotClient is a client for a single DNS-over-TLS server. It keeps a
+// small pool of TLS connections to the server and pipelines queries on
+// them, as recommended by RFC 7858, section 3.4.
+type dotClient struct {
+	f    *forwarder
+	host string // hostname or IP address; also the TLS server name
+	port uint16
+
+	mu        sync.Mutex
+	bootstrap []netip.Addr // from dnstype.Resolver.BootstrapResolution
+	conns     []*dotConn
+	closed    bool
+}
+
+// getDoTClient returns the client for the tls:// resolver r, creating it
+// if needed.
+func (f *forwarder) getDoTClient(r *dnstype.Resolver) (*dotClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := checkDoTResolver(r); err != nil {
+		return nil, err
+	}
+	c, ok := f.dotClient[r.Addr]
+	if !ok {
+		host, port, err := parseDoTAddr(r.Addr)
+		if err != nil {
+			return nil, err
+		}
+		c = &dotClient{
+			f:    f,
+			host: host,
+			port: port,
+		}
+		if f.dotClient == nil {
+			f.dotClient = map[string]*dotClient{}
+		}
+		f.dotClient[r.Addr] = c
+	}
+	c.mu.Lock()
+	c.bootstrap = r.BootstrapResolution
+	c.mu.Unlock()
+	return c, nil
+}
+
+// sendDoT sends packet to the DNS-over-TLS resolver r.
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, r *dnstype.Resolver) ([]byte, error) {
+	metricDNSFwdDoT.Add(1)
+	c, err := f.getDoTClient(r)
+	if err != nil {
+		metricDNSFwdErrorType.Add(1)
+		return nil, err
+	}
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+	ctx, cancel := context.WithTimeout(ctx, tcpQueryTimeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		conn, fresh, err := c.conn(ctx)
+		if err != nil {
+			metricDNSFwdDoTErrorDial.Add(1)
+			return nil, err
+		}
+		res, err := conn.query(ctx, fq.packet)
+		if err != nil {
+			if ctx.Err() == nil && !fresh && attempt == 0 {
+				// Servers close idle connections whenever they like
+				// (RFC 7858, section 3.4), so a pooled connection may
+				// be dead without us having noticed yet. Try once more
+				// on a new one.
+				continue
+			}
+			metricDNSFwdDoTErrorQuery.Add(1)
+			return nil, err
+		}
+		if getTxID(res) != fq.txid {
+			metricDNSFwdDoTErrorTxID.Add(1)
+			return nil, errTxIDMismatch
+		}
+		// don't forward transient errors back to the client when the server fails
+		if rcode := getRCode(res); rcode == dns.RCodeServerFailure {
+			f.logf("sendDoT: response code indicating server failure: %d", rcode)
+			metricDNSFwdDoTErrorServer.Add(1)
+			return nil, errServerFailure
+		}
+		if truncatedFlagSet(res) {
+			metricDNSFwdTruncated.Add(1)
+		}
+		metricDNSFwdDoTSuccess.Add(1)
+		return res, nil
+	}
+}
+
+// conn returns a connection to send a query on, dialing a new one if all
+// existing ones are busy. fresh reports whether the connection was just
+// dialed.
+func (c *dotClient) conn(ctx context.Context) (_ *dotConn, fresh bool, err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, false, net.ErrClosed
+	}
+	var best *dotConn
+	bestLoad := 0
+	live := c.conns[:0]
+	for _, dc := range c.conns {
+		load, ok := dc.load()
+		if !ok {
+			continue
+		}
+		live = append(live, dc)
+		if best == nil || load < bestLoad {
+			best, bestLoad = dc, load
+		}
+	}
+	clear(c.conns[len(live):])
+	c.conns = live
+	if best != nil && (bestLoad < dotMaxInFlight || len(c.conns) >= dotMaxConns) {
+		c.mu.Unlock()
+		return best, false, nil
+	}
+	bootstrap := c.bootstrap
+	c.mu.Unlock()
+
+	dc, err := c.dial(ctx, bootstrap)
+	if err != nil {
+		if best != nil {
+			// Fall back to pipelining more deeply.
+			return best, false, nil
+		}
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		dc.close(net.ErrClosed)
+		return nil, false, net.ErrClosed
+	}
+	c.conns = append(c.conns, dc)
+	return dc, true, nil
+}
+
+// addrs returns the IP addresses to dial for c, in order of preference.
+func (c *dotClient) addrs(ctx context.Context, bootstrap []netip.Addr) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(c.host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	if len(bootstrap) == 0 {
+		return nil, fmt.Errorf("no bootstrap IPs for DNS-over-TLS server %q", c.host)
+	}
+	return bootstrap, nil
+}
+
+// dial opens a new TLS connection to the server, trying its addresses in
+// order.
+func (c *dotClient) dial(ctx context.Context, bootstrap []netip.Addr) (*dotConn, error) {
+	ips, err := c.addrs(ctx, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP addresses for DNS-over-TLS server %q", c.host)
+	}
+	var firstErr error
+	for _, ip := range ips {
+		tc, err := c.f.dialer.SystemDial(ctx, "tcp", netip.AddrPortFrom(ip.Unmap(), c.port).String())
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		conn := tls.Client(tc, &tls.Config{
+			ServerName: c.host,
+			RootCAs:    c.f.dotRoots,
+			MinVersion: tls.VersionTLS12,
+		})
+		if err := conn.HandshakeContext(ctx); err != nil {
+			tc.Close()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		return newDoTConn(conn), nil
+	}
+	return nil, firstErr
+}
+
+// close closes all connections of c.
+func (c *dotClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, dc := range c.conns {
+		dc.close(net.ErrClosed)
+	}
+	c.conns = nil
+}
+
+// dotConn is a TLS connection to a DNS-over-TLS server, on which any
+// number of queries may be in flight at once. Responses may arrive out of
+// order, so each query is sent with an ID unique on the connection and
+// matched to its response by that ID.
+type dotConn struct {
+	conn *tls.Conn
+	done chan struct{} // closed when the connection is closed
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu      sync.Mutex
+	err     error                    // why the connection was closed, or nil
+	nextID  uint16                   // next query ID to try
+	pending map[uint16]chan<- []byte // by query ID on the wire
+	idle    *time.Timer              // closes the connection once idle
+}
+
+func newDoTConn(conn *tls.Conn) *dotConn {
+	dc := &dotConn{
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: map[uint16]chan<- []byte{},
+	}
+	dc.idle = time.AfterFunc(dotIdleTimeout, dc.closeIfIdle)
+	go dc.readLoop()
+	return dc
+}
+
+// load returns the number of queries in flight on dc, and whether dc is
+// still usable.
+func (dc *dotConn) load() (n int, ok bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return len(dc.pending), dc.err == nil
+}
+
+// query sends packet on dc and returns the response.
+func (dc *dotConn) query(ctx context.Context, packet []byte) ([]byte, error) {
+	if len(packet) < headerBytes {
+		return nil, errors.New("DNS query too short")
+	}
+	resc := make(chan []byte, 1)
+	dc.mu.Lock()
+	if dc.err != nil {
+		err := dc.err
+		dc.mu.Unlock()
+		return nil, err
+	}
+	if len(dc.pending) >= 1<<16 {
+		dc.mu.Unlock()
+		return nil, errors.New("too many DNS-over-TLS queries in flight")
+	}
+	id := dc.nextID
+	for dc.pending[id] != nil {
+		id++
+	}
+	dc.nextID = id + 1
+	dc.pending[id] = resc
+	dc.idle.Stop()
+	dc.mu.Unlock()
+	defer dc.forget(id)
+
+	msg := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(packet)))
+	copy(msg[2:], packet)
+	binary.BigEndian.PutUint16(msg[2:], id)
+
+	dc.wmu.Lock()
+	if d, ok := ctx.Deadline(); ok {
+		dc.conn.SetWriteDeadline(d)
+	}
+	_, err := dc.conn.Write(msg)
+	dc.wmu.Unlock()
+	if err != nil {
+		dc.close(err)
+		return nil, err
+	}
+
+	select {
+	case res := <-resc:
+		// Restore the ID the client used.
+		copy(res[:2], packet[:2])
+		return res, nil
+	case <-dc.done:
+		dc.mu.Lock()
+		defer dc.mu.Unlock()
+		return nil, dc.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes the query with the given ID from the pending queries,
+// arming the idle timer if it was the last one.
+func (dc *dotConn) forget(id uint16) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.pending, id)
+	if len(dc.pending) == 0 && dc.err == nil {
+		dc.idle.Reset(dotIdleTimeout)
+	}
+}
+
+func (dc *dotConn) closeIfIdle() {
+	dc.mu.Lock()
+	idle := len(dc.pending) == 0
+	dc.mu.Unlock()
+	if idle {
+		dc.close(errDoTConnClosed)
+	}
+}
+
+// readLoop reads responses from dc and hands them to the queries waiting
+// for them, until the connection fails.
+func (dc *dotConn) readLoop() {
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(dc.conn, hdr[:]); err != nil {
+			dc.close(err)
+			return
+		}
+		res := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(dc.conn, res); err != nil {
+			dc.close(err)
+			return
+		}
+		if len(res) < headerBytes {
+			dc.close(errors.New("DNS-over-TLS response too short"))
+			return
+		}
+		id := binary.BigEndian.Uint16(res)
+		dc.mu.Lock()
+		resc := dc.pending[id]
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		if resc != nil {
+			resc <- res // buffered
+		}
+		// Otherwise the query timed out; drop the late response.
+	}
+}
+
+// close closes dc with the given reason, failing any queries in flight.
+func (dc *dotConn) close(err error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.err != nil {
+		return
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = errDoTConnClosed
+	}
+	dc.err = err
+	dc.idle.Stop()
+	close(dc.done)
+	dc.conn.Close()
+}
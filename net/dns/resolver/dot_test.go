@@ -0,0 +1,353 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseDoTAddr(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantHost string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{in: "tls://dns.example.com", wantHost: "dns.example.com", wantPort: 853},
+		{in: "tls://dns.example.com/", wantHost: "dns.example.com", wantPort: 853},
+		{in: "tls://dns.example.com:8853", wantHost: "dns.example.com", wantPort: 8853},
+		{in: "tls://1.2.3.4", wantHost: "1.2.3.4", wantPort: 853},
+		{in: "tls://[2001:db8::1]:853", wantHost: "2001:db8::1", wantPort: 853},
+		{in: "tls://", wantErr: true},
+		{in: "tls://dns.example.com/path", wantErr: true},
+		{in: "tls://dns.example.com:0", wantErr: true},
+		{in: "tls://dns.example.com:99999", wantErr: true},
+		{in: "https://dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		host, port, err := parseDoTAddr(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDoTAddr(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("parseDoTAddr(%q) = %q, %d; want %q, %d", tt.in, host, port, tt.wantHost, tt.wantPort)
+		}
+	}
+}
+
+func TestDoTNeedsBootstrap(t *testing.T) {
+	f := newDoTTestForwarder(t, nil)
+	byName := &dnstype.Resolver{Addr: "tls://dns.example.com"}
+	byIP := &dnstype.Resolver{Addr: "tls://192.0.2.1"}
+	bootstrapped := &dnstype.Resolver{
+		Addr:                "tls://dns.example.com",
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+	}
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		"example.com.": {byName, byIP, bootstrapped},
+	})
+	var got []string
+	for _, r := range f.resolvers("foo.example.com.") {
+		got = append(got, r.name.Addr+fmt.Sprint(r.name.BootstrapResolution))
+	}
+	want := []string{"tls://192.0.2.1[]", "tls://dns.example.com[192.0.2.1]"}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolvers = %q; want %q", got, want)
+	}
+
+	if err := sendDoTTestQuery(t, f, byName, "foo.example.com."); err == nil {
+		t.Error("query via a hostname DoT resolver without bootstrap IPs succeeded")
+	}
+	if len(f.dotClient) != 0 {
+		t.Errorf("forwarder created DoT clients %v", f.dotClient)
+	}
+}
+
+// dotTestServer is a DNS-over-TLS stand-in. It answers every query with
+// the query itself, flagged as a response. Queries for names starting with
+// "slow" are answered after a delay, so responses go out of order.
+type dotTestServer struct {
+	tb    testing.TB
+	ln    net.Listener
+	roots *x509.CertPool
+	port  uint16
+
+	// closeAfterResponse, if set, makes the server close connections
+	// after their first response, like a server idling them out.
+	closeAfterResponse bool
+
+	conns   atomic.Int32 // connections accepted
+	queries atomic.Int32 // queries answered
+}
+
+// newDoTTestServer starts a DNS-over-TLS server on localhost with a
+// certificate for "dot.test".
+func newDoTTestServer(tb testing.TB) *dotTestServer {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dot.test"},
+		DNSNames:              []string{"dot.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &dotTestServer{tb: tb, roots: x509.NewCertPool()}
+	s.roots.AddCert(cert)
+
+	s.ln, err = tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.port = uint16(s.ln.Addr().(*net.TCPAddr).Port)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveConn(c)
+			}()
+		}
+	}()
+	tb.Cleanup(func() {
+		s.ln.Close()
+		wg.Wait()
+	})
+	return s
+}
+
+func (s *dotTestServer) serveConn(c net.Conn) {
+	defer c.Close()
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var length uint16
+		if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+			return
+		}
+		q := make([]byte, 2+int(length))
+		binary.BigEndian.PutUint16(q, length)
+		if _, err := io.ReadFull(c, q[2:]); err != nil {
+			return
+		}
+		q[2+2] |= 0x80 // QR: this is a response
+		var p dns.Parser
+		p.Start(q[2:])
+		qq, err := p.Question()
+		if err != nil {
+			s.tb.Logf("bad query: %v", err)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if strings.HasPrefix(qq.Name.String(), "slow") {
+				time.Sleep(200 * time.Millisecond)
+			}
+			wmu.Lock()
+			defer wmu.Unlock()
+			c.Write(q)
+			s.queries.Add(1)
+			if s.closeAfterResponse {
+				c.Close()
+			}
+		}()
+	}
+}
+
+func newDoTTestForwarder(tb testing.TB, roots *x509.CertPool) *forwarder {
+	netMon, err := netmon.New(tb.Logf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { netMon.Close() })
+
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+
+	f := newForwarder(tb.Logf, netMon, nil, &dialer, nil)
+	f.dotRoots = roots
+	tb.Cleanup(func() { f.Close() })
+	return f
+}
+
+func dotTestQuery(tb testing.TB, name string) []byte {
+	b := dns.NewBuilder(nil, dns.Header{ID: someDNSID, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dns.Question{
+		Name:  dns.MustNewName(name),
+		Type:  dns.TypeA,
+		Class: dns.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return msg
+}
+
+// sendDoTTestQuery sends a query for name to the resolver r via f and
+// checks the response is the one to that query.
+func sendDoTTestQuery(tb testing.TB, f *forwarder, r *dnstype.Resolver, name string) error {
+	query := dotTestQuery(tb, name)
+	fq := &forwardQuery{
+		txid:           getTxID(query),
+		packet:         query,
+		family:         "udp",
+		closeOnCtxDone: new(closePool),
+	}
+	defer fq.closeOnCtxDone.Close()
+	res, err := f.send(context.Background(), fq, resolverAndDelay{name: r})
+	if err != nil {
+		return err
+	}
+	var p dns.Parser
+	h, err := p.Start(res)
+	if err != nil {
+		return err
+	}
+	if !h.Response || h.ID != someDNSID {
+		return fmt.Errorf("bad response header %+v", h)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return err
+	}
+	if q.Name.String() != name {
+		return fmt.Errorf("response for %q; want %q", q.Name, name)
+	}
+	return nil
+}
+
+func TestDoT(t *testing.T) {
+	s := newDoTTestServer(t)
+	f := newDoTTestForwarder(t, s.roots)
+	r := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://dot.test:%d", s.port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+
+	// Warm up the pool, so the queries below share the connection.
+	if err := sendDoTTestQuery(t, f, r, "warm.example.com."); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both queries use the same DNS ID and are in flight at once, with
+	// the second one answered first.
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, name := range []string{"slow.example.com.", "fast.example.com."} {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = sendDoTTestQuery(t, f, r, name)
+		}(i, name)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("pipelined queries took %v", d)
+	}
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("server accepted %d connections; want 1", got)
+	}
+}
+
+func TestDoTServerName(t *testing.T) {
+	s := newDoTTestServer(t)
+	f := newDoTTestForwarder(t, s.roots)
+
+	// The certificate is for dot.test, not other.test.
+	r := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://other.test:%d", s.port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	err := sendDoTTestQuery(t, f, r, "example.com.")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("got error %v; want certificate verification error", err)
+	}
+	if got := s.queries.Load(); got != 0 {
+		t.Errorf("server answered %d queries", got)
+	}
+
+	// Nor for its IP address.
+	r = &dnstype.Resolver{Addr: fmt.Sprintf("tls://127.0.0.1:%d", s.port)}
+	if err := sendDoTTestQuery(t, f, r, "example.com."); err == nil {
+		t.Error("unexpected success querying by IP address")
+	}
+}
+
+func TestDoTReconnect(t *testing.T) {
+	s := newDoTTestServer(t)
+	s.closeAfterResponse = true
+	f := newDoTTestForwarder(t, s.roots)
+	r := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://dot.test:%d", s.port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	for i := 0; i < 3; i++ {
+		if err := sendDoTTestQuery(t, f, r, fmt.Sprintf("q%d.example.com.", i)); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if got := s.conns.Load(); got != 3 {
+		t.Errorf("server accepted %d connections; want 3", got)
+	}
+}
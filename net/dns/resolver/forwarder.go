@@ -6,6 +6,7 @@
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -199,6 +200,12 @@ type forwarder struct {
 	mu sync.Mutex // guards following
 
 	dohClient map[string]*http.Client // urlBase -> client
+	dotClient map[string]*dotClient   // tls:// resolver address -> client
+
+	// dotRoots, if non-nil, are the root CAs DNS-over-TLS servers'
+	// certificates are verified against instead of the system roots.
+	// It's only set by tests.
+	dotRoots *x509.CertPool
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
@@ -233,15 +240,34 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.dotClient {
+		c.close()
+	}
+	f.dotClient = nil
 	return nil
 }
 
 // resolversWithDelays maps from a set of DNS server names to a slice of a type
 // that included a startDelay, upgrading any well-known DoH (DNS-over-HTTP)
 // servers in the process, insert a DoH lookup first before UDP fallbacks.
+//
+// DoT (DNS-over-TLS) resolvers are likewise put first and started
+// immediately, with any classic resolvers alongside them only queried
+// after dohHeadStart as fallbacks.
 func resolversWithDelays(resolvers []*dnstype.Resolver) []resolverAndDelay {
 	rr := make([]resolverAndDelay, 0, len(resolvers)+2)
 
+	// Add the DoT ones first, starting immediately.
+	var haveDoT bool
+	for _, r := range resolvers {
+		if strings.HasPrefix(r.Addr, "tls://") {
+			haveDoT = true
+			rr = append(rr, resolverAndDelay{name: r})
+		}
+	}
+
 	type dohState uint8
 	const addedDoH = dohState(1)
 	const addedDoHAndDontAddUDP = dohState(2)
@@ -273,6 +299,9 @@ type hostAndFam struct {
 	for _, r := range resolvers {
 		ipp, ok := r.IPPort()
 		if !ok {
+			if strings.HasPrefix(r.Addr, "tls://") {
+				continue // added above
+			}
 			// Pass non-IP ones through unchanged, without delay.
 			// (e.g. DNS-over-ExitDNS when using an exit node)
 			rr = append(rr, resolverAndDelay{name: r})
@@ -280,6 +309,9 @@ type hostAndFam struct {
 		}
 		ip := ipp.Addr()
 		var startDelay time.Duration
+		if haveDoT {
+			startDelay = dohHeadStart
+		}
 		if host, _, ok := publicdns.DoHEndpointFromIP(ip); ok {
 			if didDoH[host] == addedDoHAndDontAddUDP {
 				continue
@@ -325,6 +357,7 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 
 	cloudHostFallback := cloudResolvers()
 	for suffix, rs := range routesBySuffix {
+		rs = f.usableResolvers(suffix, rs)
 		if suffix == "." && len(rs) == 0 && len(cloudHostFallback) > 0 {
 			routes = append(routes, route{
 				Suffix:    suffix,
@@ -358,6 +391,22 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 	f.cloudHostFallback = cloudHostFallback
 }
 
+// usableResolvers returns rs without the DNS-over-TLS resolvers that
+// can't be used, logging them.
+func (f *forwarder) usableResolvers(suffix dnsname.FQDN, rs []*dnstype.Resolver) []*dnstype.Resolver {
+	ret := make([]*dnstype.Resolver, 0, len(rs))
+	for _, r := range rs {
+		if strings.HasPrefix(r.Addr, "tls://") {
+			if err := checkDoTResolver(r); err != nil {
+				f.logf("dns: ignoring resolver for %q: %v", suffix, err)
+				continue
+			}
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
 
 func (f *forwarder) packetListener(ip netip.Addr) (nettype.PacketListenerWithNetIP, error) {
@@ -490,8 +539,7 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		return f.sendDoT(ctx, fq, rr.name)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -884,7 +932,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	}
 	defer fq.closeOnCtxDone.Close()
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
+	resc := make(chan packet, 1) // it's fine buffered or not
 	errc := make(chan error, 1)  // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
@@ -906,7 +954,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- packet{bs: resb, family: query.family, addr: query.addr, upstream: rr.name.Addr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -921,7 +969,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
 				return ctx.Err()
-			case responseChan <- packet{v, query.family, query.addr}:
+			case responseChan <- v:
 				metricDNSFwdSuccess.Add(1)
 				return nil
 			}
@@ -101,6 +101,16 @@ func TestResolversWithDelays(t *testing.T) {
 			in:   q("https://dns.nextdns.io/c3a884"),
 			want: o("https://dns.nextdns.io/c3a884"),
 		},
+		{
+			name: "dot-first",
+			in:   q("1.2.3.4", "tls://dns.example.com", "2.3.4.5"),
+			want: o("tls://dns.example.com", "1.2.3.4+0.5s", "2.3.4.5+0.5s"),
+		},
+		{
+			name: "dot-and-google",
+			in:   q("tls://dns.example.com", "8.8.8.8", "8.8.4.4"),
+			want: o("tls://dns.example.com", "https://dns.google/dns-query", "8.8.8.8+0.5s", "8.8.4.4+0.7s"),
+		},
 	}
 
 	for _, tt := range tests {
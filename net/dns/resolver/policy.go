@@ -0,0 +1,272 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+// policyTTL is the TTL of the records in responses made up by policy
+// rules. It's shorter than defaultTTL as policies change more often than
+// MagicDNS names.
+const policyTTL = 60 * time.Second
+
+// PolicyRule is a rule of the resolver's DNS policy. It's a
+// tailcfg.DNSPolicyRule, with its Sources resolved to addresses.
+type PolicyRule struct {
+	// Suffix is the DNS name suffix the rule applies to.
+	Suffix dnsname.FQDN
+	// Sources are the addresses of the peers the rule applies to
+	// queries from. If nil, the rule applies to all queries.
+	Sources []netip.Prefix
+	// Action is what to do with matching queries.
+	Action tailcfg.DNSPolicyAction
+	// Target is the name to rewrite queries to, for DNSPolicyRewrite.
+	Target dnsname.FQDN
+	// Addrs are the addresses to answer, for DNSPolicyAnswer.
+	Addrs []netip.Addr
+	// Origin describes where the rule comes from, for debugging, such
+	// as "control" or a file name.
+	Origin string
+}
+
+// policy is a compiled DNS policy.
+type policy struct {
+	// rules are the rules with the longest suffixes first, otherwise in
+	// their original order.
+	rules []*policyRule
+}
+
+type policyRule struct {
+	PolicyRule
+	hits atomic.Int64
+}
+
+// newPolicy compiles rules, or returns nil if there are none.
+func newPolicy(rules []PolicyRule) *policy {
+	if len(rules) == 0 {
+		return nil
+	}
+	p := &policy{rules: make([]*policyRule, len(rules))}
+	for i, r := range rules {
+		p.rules[i] = &policyRule{PolicyRule: r}
+	}
+	sort.SliceStable(p.rules, func(i, j int) bool {
+		return p.rules[i].Suffix.NumLabels() > p.rules[j].Suffix.NumLabels()
+	})
+	return p
+}
+
+// match returns the rule that applies to a query for name from the given
+// address, or nil if none does.
+func (p *policy) match(name dnsname.FQDN, from netip.Addr) *policyRule {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.rules {
+		if r.Suffix != "." && !r.Suffix.Contains(name) {
+			continue
+		}
+		if r.Sources != nil && !prefixesContain(r.Sources, from) {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+func prefixesContain(pfxs []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range pfxs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPolicy answers query per the DNS policy, if a rule applies to it.
+// handled reports whether one did; if not, the query is to be resolved
+// as usual.
+func (r *Resolver) applyPolicy(ctx context.Context, query []byte, family string, from netip.AddrPort) (res []byte, handled bool) {
+	r.mu.Lock()
+	pol := r.policy
+	r.mu.Unlock()
+	if pol == nil {
+		return nil, false
+	}
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, false
+	}
+	name, err := dnsname.ToFQDN(rawNameToLower(q.Name.Data[:q.Name.Length]))
+	if err != nil {
+		return nil, false
+	}
+	rule := pol.match(name, from.Addr())
+	if rule == nil {
+		return nil, false
+	}
+	rule.hits.Add(1)
+	metricDNSPolicyHit.Add(1)
+
+	switch rule.Action {
+	case tailcfg.DNSPolicyPass:
+		return nil, false
+	case tailcfg.DNSPolicyBlock:
+		res, err = policyResponse(h, q, dns.RCodeNameError, nil)
+	case tailcfg.DNSPolicyNull:
+		res, err = policyResponse(h, q, dns.RCodeSuccess, []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()})
+	case tailcfg.DNSPolicyAnswer:
+		res, err = policyResponse(h, q, dns.RCodeSuccess, rule.Addrs)
+	case tailcfg.DNSPolicyRewrite:
+		res, err = r.rewrite(ctx, h, q, rule.Target, family, from)
+	default:
+		r.logf("DNS policy rule for %q has unknown action %q; ignoring", rule.Suffix, rule.Action)
+		return nil, false
+	}
+	if err != nil {
+		r.logf("DNS policy %s for %q: %v", rule.Action, name, err)
+		metricDNSPolicyError.Add(1)
+		sf, err := servfailResponse(packet{bs: query})
+		if err != nil {
+			return nil, false
+		}
+		return sf.bs, true
+	}
+	return res, true
+}
+
+// policyResponse returns a response to the question q of a query with
+// header h, with rcode and the addresses among ips of the family asked.
+func policyResponse(h dns.Header, q dns.Question, rcode dns.RCode, ips []netip.Addr) ([]byte, error) {
+	h.Response = true
+	h.Authoritative = true
+	h.RecursionAvailable = h.RecursionDesired
+	h.RCode = rcode
+	b := dns.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dns.ResourceHeader{Name: q.Name, Class: dns.ClassINET, TTL: uint32(policyTTL / time.Second)}
+	for _, ip := range ips {
+		var err error
+		switch {
+		case ip.Is4() && (q.Type == dns.TypeA || q.Type == dns.TypeALL):
+			err = b.AResource(rh, dns.AResource{A: ip.As4()})
+		case ip.Is6() && (q.Type == dns.TypeAAAA || q.Type == dns.TypeALL):
+			err = b.AAAAResource(rh, dns.AAAAResource{AAAA: ip.As16()})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// rewrite answers the question q of a query with header h with a CNAME
+// to target, followed by the records of target, which it resolves as
+// usual (without applying the policy again).
+func (r *Resolver) rewrite(ctx context.Context, h dns.Header, q dns.Question, target dnsname.FQDN, family string, from netip.AddrPort) ([]byte, error) {
+	targetName, err := dns.NewName(target.WithTrailingDot())
+	if err != nil {
+		return nil, err
+	}
+	cname := dns.Resource{
+		Header: dns.ResourceHeader{Name: q.Name, Type: dns.TypeCNAME, Class: dns.ClassINET, TTL: uint32(policyTTL / time.Second)},
+		Body:   &dns.CNAMEResource{CNAME: targetName},
+	}
+	resp := dns.Message{
+		Header: dns.Header{
+			ID:                 h.ID,
+			Response:           true,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: h.RecursionDesired,
+			CheckingDisabled:   h.CheckingDisabled,
+		},
+		Questions: []dns.Question{q},
+		Answers:   []dns.Resource{cname},
+	}
+	if q.Type == dns.TypeCNAME {
+		return resp.Pack()
+	}
+
+	tq := dns.Message{
+		Header:    dns.Header{ID: h.ID, RecursionDesired: h.RecursionDesired, CheckingDisabled: h.CheckingDisabled},
+		Questions: []dns.Question{{Name: targetName, Type: q.Type, Class: q.Class}},
+	}
+	tqb, err := tq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	tres, err := r.query(ctx, tqb, family, from, new(queryInfo))
+	if err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", target, err)
+	}
+	var tm dns.Message
+	if err := tm.Unpack(tres); err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", target, err)
+	}
+	resp.Header.RCode = tm.Header.RCode
+	resp.Answers = append(resp.Answers, tm.Answers...)
+	resp.Authorities = tm.Authorities
+	return resp.Pack()
+}
+
+// policyAtomic is the policy of the most recently configured Resolver,
+// for the debug handler.
+var policyAtomic atomic.Pointer[policy]
+
+func (p *policy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "<html><h1>DNS policy</h1>")
+	if p == nil {
+		fmt.Fprintf(w, "No rules.")
+		return
+	}
+	fmt.Fprintf(w, "<table><tr><th>Suffix</th><th>Sources</th><th>Action</th><th>Answer</th><th>Origin</th><th>Hits</th></tr>\n")
+	for _, r := range p.rules {
+		sources := "*"
+		if r.Sources != nil {
+			sources = fmt.Sprint(r.Sources)
+		}
+		var answer string
+		switch r.Action {
+		case tailcfg.DNSPolicyRewrite:
+			answer = string(r.Target)
+		case tailcfg.DNSPolicyAnswer:
+			answer = fmt.Sprint(r.Addrs)
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td></tr>\n",
+			html.EscapeString(string(r.Suffix)),
+			html.EscapeString(sources),
+			html.EscapeString(string(r.Action)),
+			html.EscapeString(answer),
+			html.EscapeString(r.Origin),
+			r.hits.Load())
+	}
+	fmt.Fprintf(w, "</table>")
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+func TestPolicyMatch(t *testing.T) {
+	p := newPolicy([]PolicyRule{
+		{Suffix: ".", Action: tailcfg.DNSPolicyBlock, Origin: "root"},
+		{Suffix: "example.com.", Action: tailcfg.DNSPolicyNull, Origin: "example"},
+		{Suffix: "www.example.com.", Action: tailcfg.DNSPolicyPass, Sources: []netip.Prefix{netip.MustParsePrefix("100.64.0.0/24")}, Origin: "www-peers"},
+		{Suffix: "www.example.com.", Action: tailcfg.DNSPolicyBlock, Origin: "www"},
+	})
+	tests := []struct {
+		name dnsname.FQDN
+		from string
+		want string // Origin of the matching rule
+	}{
+		{"foo.org.", "100.64.0.1", "root"},
+		{"example.com.", "100.64.0.1", "example"},
+		{"a.example.com.", "100.64.0.1", "example"},
+		{"notexample.com.", "100.64.0.1", "root"},
+		{"www.example.com.", "100.64.0.1", "www-peers"},
+		{"x.www.example.com.", "100.64.0.1", "www-peers"},
+		{"www.example.com.", "::ffff:100.64.0.1", "www-peers"},
+		{"www.example.com.", "100.64.1.1", "www"},
+	}
+	for _, tt := range tests {
+		got := p.match(tt.name, netip.MustParseAddr(tt.from))
+		if got == nil || got.Origin != tt.want {
+			t.Errorf("match(%q, %s) = %+v; want rule %q", tt.name, tt.from, got, tt.want)
+		}
+	}
+
+	if newPolicy(nil) != nil {
+		t.Error("newPolicy(nil) != nil")
+	}
+	var nilPolicy *policy
+	if got := nilPolicy.match("example.com.", netip.MustParseAddr("100.64.0.1")); got != nil {
+		t.Errorf("nil policy matched %+v", got)
+	}
+}
+
+func TestResolverPolicy(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Policy = []PolicyRule{
+		{Suffix: "ads.ipn.dev.", Action: tailcfg.DNSPolicyBlock},
+		{Suffix: "null.ipn.dev.", Action: tailcfg.DNSPolicyNull},
+		{Suffix: "alias.ipn.dev.", Action: tailcfg.DNSPolicyRewrite, Target: "test1.ipn.dev."},
+		{Suffix: "test1.ipn.dev.", Action: tailcfg.DNSPolicyPass, Sources: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}},
+		{Suffix: "test1.ipn.dev.", Action: tailcfg.DNSPolicyAnswer, Addrs: []netip.Addr{netip.MustParseAddr("100.64.0.99"), netip.MustParseAddr("fd7a:115c:a1e0::99")}},
+	}
+	r.SetConfig(cfg)
+
+	type answer struct {
+		typ  dns.Type
+		data string // address or CNAME target
+	}
+	tests := []struct {
+		name    string
+		qname   dnsname.FQDN
+		qtype   dns.Type
+		from    string
+		rcode   dns.RCode
+		answers []answer
+	}{
+		{
+			name:  "block",
+			qname: "x.ads.ipn.dev.",
+			qtype: dns.TypeA,
+			from:  "100.64.0.2:53",
+			rcode: dns.RCodeNameError,
+		},
+		{
+			name:    "null-a",
+			qname:   "null.ipn.dev.",
+			qtype:   dns.TypeA,
+			from:    "100.64.0.2:53",
+			answers: []answer{{dns.TypeA, "0.0.0.0"}},
+		},
+		{
+			name:    "null-aaaa",
+			qname:   "null.ipn.dev.",
+			qtype:   dns.TypeAAAA,
+			from:    "100.64.0.2:53",
+			answers: []answer{{dns.TypeAAAA, "::"}},
+		},
+		{
+			name:    "pass-for-source",
+			qname:   "test1.ipn.dev.",
+			qtype:   dns.TypeA,
+			from:    "100.64.0.1:53",
+			answers: []answer{{dns.TypeA, testipv4.String()}},
+		},
+		{
+			name:    "answer-for-others",
+			qname:   "test1.ipn.dev.",
+			qtype:   dns.TypeA,
+			from:    "100.64.0.2:53",
+			answers: []answer{{dns.TypeA, "100.64.0.99"}},
+		},
+		{
+			name:  "rewrite",
+			qname: "alias.ipn.dev.",
+			qtype: dns.TypeA,
+			from:  "100.64.0.1:53",
+			answers: []answer{
+				{dns.TypeCNAME, "test1.ipn.dev."},
+				{dns.TypeA, testipv4.String()},
+			},
+		},
+		{
+			name:  "rewrite-then-answer",
+			qname: "alias.ipn.dev.",
+			qtype: dns.TypeA,
+			from:  "100.64.0.2:53",
+			answers: []answer{
+				{dns.TypeCNAME, "test1.ipn.dev."},
+				{dns.TypeA, testipv4.String()}, // the policy applies only once
+			},
+		},
+		{
+			name:    "no-rule",
+			qname:   "test2.ipn.dev.",
+			qtype:   dns.TypeAAAA,
+			from:    "100.64.0.2:53",
+			answers: []answer{{dns.TypeAAAA, testipv6.String()}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := r.Query(context.Background(), dnspacket(tt.qname, tt.qtype, noEdns), "udp", netip.MustParseAddrPort(tt.from))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(res); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.rcode {
+				t.Errorf("rcode = %v; want %v", msg.Header.RCode, tt.rcode)
+			}
+			var got []answer
+			for _, a := range msg.Answers {
+				switch b := a.Body.(type) {
+				case *dns.AResource:
+					got = append(got, answer{dns.TypeA, netip.AddrFrom4(b.A).String()})
+				case *dns.AAAAResource:
+					got = append(got, answer{dns.TypeAAAA, netip.AddrFrom16(b.AAAA).String()})
+				case *dns.CNAMEResource:
+					got = append(got, answer{dns.TypeCNAME, b.CNAME.String()})
+				}
+			}
+			if len(got) != len(tt.answers) {
+				t.Fatalf("answers = %v; want %v", got, tt.answers)
+			}
+			for i := range got {
+				if got[i] != tt.answers[i] {
+					t.Errorf("answers = %v; want %v", got, tt.answers)
+					break
+				}
+			}
+		})
+	}
+
+	var hits int64
+	for _, rule := range r.policy.rules {
+		hits += rule.hits.Load()
+	}
+	if hits != 7 {
+		t.Errorf("rule hits = %d; want 7", hits)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/set"
+)
+
+// QueryLogSize is the number of queries the query log of a Resolver keeps.
+const QueryLogSize = 512
+
+// queryInfo is how a query was answered, for the query log.
+type queryInfo struct {
+	resolution string // a dnstype.Resolution constant
+	upstream   string // resolver address, if forwarded
+}
+
+// queryLog is a ring buffer of the most recent queries answered by a
+// Resolver, which also sends new entries to its subscribers. It's safe for
+// concurrent use.
+type queryLog struct {
+	mu      sync.Mutex
+	entries []dnstype.QueryLogEntry // at most QueryLogSize
+	next    int                     // index of the oldest entry, once full
+	subs    set.HandleSet[chan<- dnstype.QueryLogEntry]
+}
+
+func (l *queryLog) add(e dnstype.QueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < QueryLogSize {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+		l.next = (l.next + 1) % QueryLogSize
+	}
+	for _, ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+			// Don't hold up DNS for a slow reader.
+			metricDNSQueryLogDropped.Add(1)
+		}
+	}
+}
+
+// snapshot returns the entries, oldest first.
+func (l *queryLog) snapshot() []dnstype.QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make([]dnstype.QueryLogEntry, 0, len(l.entries))
+	ret = append(ret, l.entries[l.next:]...)
+	return append(ret, l.entries[:l.next]...)
+}
+
+// QueryLog returns the most recent queries answered by r, oldest first.
+func (r *Resolver) QueryLog() []dnstype.QueryLogEntry {
+	return r.queryLog.snapshot()
+}
+
+// SubscribeQueryLog arranges for the entries of queries answered by r from
+// now on to be sent to ch, until the returned func is called. Entries are
+// dropped if ch isn't ready to receive them.
+//
+// If backlog is true, the entries QueryLog would return are sent first,
+// with none lost or repeated in between; ch needs a buffer of at least
+// QueryLogSize for none of them to be dropped.
+func (r *Resolver) SubscribeQueryLog(ch chan<- dnstype.QueryLogEntry, backlog bool) (unsubscribe func()) {
+	l := &r.queryLog
+	l.mu.Lock()
+	if backlog {
+		for _, part := range [][]dnstype.QueryLogEntry{l.entries[l.next:], l.entries[:l.next]} {
+			for _, e := range part {
+				select {
+				case ch <- e:
+				default:
+					metricDNSQueryLogDropped.Add(1)
+				}
+			}
+		}
+	}
+	if l.subs == nil {
+		l.subs = make(set.HandleSet[chan<- dnstype.QueryLogEntry])
+	}
+	h := l.subs.Add(ch)
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs, h)
+	}
+}
+
+// newQueryLogEntry returns the query log entry of query bs from the given
+// source, answered with res or err as described by qi, which started at
+// start.
+func newQueryLogEntry(bs, res []byte, err error, from netip.AddrPort, qi *queryInfo, start time.Time) dnstype.QueryLogEntry {
+	e := dnstype.QueryLogEntry{
+		Time:       start,
+		Source:     from,
+		Resolution: qi.resolution,
+		Upstream:   qi.upstream,
+		Latency:    time.Since(start),
+	}
+	var p dns.Parser
+	if _, perr := p.Start(bs); perr == nil {
+		if q, perr := p.Question(); perr == nil {
+			e.Name = q.Name.String()
+			e.Type = strings.TrimPrefix(q.Type.String(), "Type")
+		}
+	}
+	if len(res) > 0 {
+		if h, perr := p.Start(res); perr == nil {
+			e.RCode = rcodeName(h.RCode)
+		}
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	return e
+}
+
+// rcodeName returns the conventional name of rc, as dig prints it.
+func rcodeName(rc dns.RCode) string {
+	switch rc {
+	case dns.RCodeSuccess:
+		return "NOERROR"
+	case dns.RCodeFormatError:
+		return "FORMERR"
+	case dns.RCodeServerFailure:
+		return "SERVFAIL"
+	case dns.RCodeNameError:
+		return "NXDOMAIN"
+	case dns.RCodeNotImplemented:
+		return "NOTIMP"
+	case dns.RCodeRefused:
+		return "REFUSED"
+	}
+	return strings.TrimPrefix(rc.String(), "RCode")
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func TestQueryLogRing(t *testing.T) {
+	var l queryLog
+	for i := 0; i < QueryLogSize+10; i++ {
+		l.add(dnstype.QueryLogEntry{Name: fmt.Sprintf("q%d.", i)})
+	}
+	got := l.snapshot()
+	if len(got) != QueryLogSize {
+		t.Fatalf("len = %d; want %d", len(got), QueryLogSize)
+	}
+	if got[0].Name != "q10." || got[len(got)-1].Name != fmt.Sprintf("q%d.", QueryLogSize+9) {
+		t.Errorf("entries from %q to %q; want oldest first", got[0].Name, got[len(got)-1].Name)
+	}
+}
+
+func TestResolverQueryLog(t *testing.T) {
+	const fwdName = "fwd.example.com."
+	port := runDNSServer(t, nil, cacheTestResponse(t, fwdName, dns.RCodeSuccess, []uint32{300}, nil), func(bool, []byte) {})
+	upstream := fmt.Sprintf("127.0.0.1:%d", port)
+
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: upstream}},
+	}
+	cfg.Policy = []PolicyRule{{Suffix: "blocked.example.", Action: tailcfg.DNSPolicyBlock}}
+	r.SetConfig(cfg)
+
+	// Entries from before the subscription come first.
+	from := netip.MustParseAddrPort("100.64.0.2:5353")
+	query := func(name dnsname.FQDN, typ dns.Type) {
+		t.Helper()
+		if _, err := r.Query(context.Background(), dnspacket(name, typ, noEdns), "udp", from); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query("test1.ipn.dev.", dns.TypeA)
+	ch := make(chan dnstype.QueryLogEntry, QueryLogSize)
+	unsubscribe := r.SubscribeQueryLog(ch, true)
+	query(fwdName, dns.TypeA)
+	query(fwdName, dns.TypeA)
+	query("blocked.example.", dns.TypeAAAA)
+	unsubscribe()
+	query("test2.ipn.dev.", dns.TypeAAAA)
+
+	want := []dnstype.QueryLogEntry{
+		{Name: "test1.ipn.dev.", Type: "A", RCode: "NOERROR", Resolution: dnstype.ResolutionLocal},
+		{Name: fwdName, Type: "A", RCode: "NOERROR", Resolution: dnstype.ResolutionForward, Upstream: upstream},
+		{Name: fwdName, Type: "A", RCode: "NOERROR", Resolution: dnstype.ResolutionCache},
+		{Name: "blocked.example.", Type: "AAAA", RCode: "NXDOMAIN", Resolution: dnstype.ResolutionPolicy},
+	}
+	check := func(what string, got []dnstype.QueryLogEntry) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d entries; want %d: %+v", what, len(got), len(want), got)
+		}
+		for i, e := range got {
+			if e.Source != from || e.Time.IsZero() || e.Err != "" {
+				t.Errorf("%s[%d]: source %v, time %v, error %q", what, i, e.Source, e.Time, e.Err)
+			}
+			e.Source, e.Time, e.Latency = netip.AddrPort{}, want[i].Time, 0
+			if e != want[i] {
+				t.Errorf("%s[%d] = %+v; want %+v", what, i, e, want[i])
+			}
+		}
+	}
+
+	var subscribed []dnstype.QueryLogEntry
+	for len(ch) > 0 {
+		subscribed = append(subscribed, <-ch)
+	}
+	check("subscription", subscribed)
+
+	all := r.QueryLog()
+	if len(all) != len(want)+1 || all[len(all)-1].Name != "test2.ipn.dev." {
+		t.Fatalf("QueryLog = %+v", all)
+	}
+	check("QueryLog", all[:len(want)])
+}
@@ -57,11 +57,16 @@ type packet struct {
 	bs     []byte
 	family string         // either "tcp" or "udp"
 	addr   netip.AddrPort // src for a request, dst for a response
+
+	// upstream is the address of the upstream resolver that sent the
+	// response, if forwarded.
+	upstream string
 }
 
 // Config is a resolver configuration.
 // Given a Config, queries are resolved in the following order:
-// If the query is an exact match for an entry in LocalHosts, return that.
+// If a Policy rule applies to the query, answer per the rule.
+// Else if the query is an exact match for an entry in LocalHosts, return that.
 // Else if the query suffix matches an entry in LocalDomains, return NXDOMAIN.
 // Else forward the query to the most specific matching entry in Routes.
 // Else return SERVFAIL.
@@ -76,6 +81,9 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// Policy are rules to block, rewrite or answer queries for
+	// certain names, possibly only from certain peers.
+	Policy []PolicyRule
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -101,6 +109,9 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	if arpa > 0 {
 		fmt.Fprintf(w, "+%darpa", arpa)
 	}
+	if len(c.Policy) > 0 {
+		fmt.Fprintf(w, " Policy:%d", len(c.Policy))
+	}
 	if c := cloudenv.Get(); c != "" {
 		fmt.Fprintf(w, ", cloud=%q", string(c))
 	}
@@ -186,6 +197,13 @@ type Resolver struct {
 	saveConfigForTests func(cfg Config) // used in tests to capture resolver config
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// cache caches the responses of upstream nameservers.
+	cache responseCache
+	// queryLog records the queries answered.
+	queryLog queryLog
+	// unregisterNetMon unregisters the link change callback that flushes
+	// cache. It's nil if netMon is.
+	unregisterNetMon func()
 
 	// closed signals all goroutines to stop.
 	closed chan struct{}
@@ -197,6 +215,7 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	policy       *policy // or nil
 }
 
 type ForwardLinkSelector interface {
@@ -221,6 +240,15 @@ func New(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkSelector,
 		dialer:   dialer,
 	}
 	r.forwarder = newForwarder(r.logf, netMon, linkSel, dialer, knobs)
+	if netMon != nil {
+		// Cached responses may be specific to the network we were on
+		// (split-horizon DNS, captive portals, etc).
+		r.unregisterNetMon = netMon.RegisterChangeCallback(func(delta *netmon.ChangeDelta) {
+			if delta.Major {
+				r.cache.flush()
+			}
+		})
+	}
 	return r
 }
 
@@ -240,12 +268,17 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	}
 
 	r.forwarder.setRoutes(cfg.Routes)
+	r.cache.flush()
+
+	pol := newPolicy(cfg.Policy)
+	policyAtomic.Store(pol)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.policy = pol
 	return nil
 }
 
@@ -260,6 +293,9 @@ func (r *Resolver) Close() {
 	}
 	close(r.closed)
 
+	if r.unregisterNetMon != nil {
+		r.unregisterNetMon()
+	}
 	r.forwarder.Close()
 }
 
@@ -277,13 +313,39 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 	default:
 	}
 
+	start := time.Now()
+	var qi queryInfo
+	res, err := r.queryWithPolicy(ctx, bs, family, from, &qi)
+	r.queryLog.add(newQueryLogEntry(bs, res, err, from, &qi, start))
+	return res, err
+}
+
+func (r *Resolver) queryWithPolicy(ctx context.Context, bs []byte, family string, from netip.AddrPort, qi *queryInfo) ([]byte, error) {
+	if res, ok := r.applyPolicy(ctx, bs, family, from); ok {
+		qi.resolution = dnstype.ResolutionPolicy
+		return res, nil
+	}
+	return r.query(ctx, bs, family, from, qi)
+}
+
+// query resolves the query in bs locally or by forwarding it, ignoring
+// the policy. It records how in qi.
+func (r *Resolver) query(ctx context.Context, bs []byte, family string, from netip.AddrPort, qi *queryInfo) ([]byte, error) {
 	out, err := r.respond(bs)
 	if err == errNotOurName {
+		cq, cacheable := parseCacheQuery(bs, family)
+		if cacheable {
+			if res, ok := r.cache.get(cq); ok {
+				qi.resolution = dnstype.ResolutionCache
+				return res, nil
+			}
+		}
+		qi.resolution = dnstype.ResolutionForward
 		responses := make(chan packet, 1)
 		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
 		defer close(responses)
 		defer cancel()
-		err = r.forwarder.forwardWithDestChan(ctx, packet{bs, family, from}, responses)
+		err = r.forwarder.forwardWithDestChan(ctx, packet{bs: bs, family: family, addr: from}, responses)
 		if err != nil {
 			select {
 			// Best effort: use any error response sent by forwardWithDestChan.
@@ -295,9 +357,15 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 				return nil, err
 			}
 		}
-		return (<-responses).bs, nil
+		resp := <-responses
+		qi.upstream = resp.upstream
+		if cacheable {
+			r.cache.put(cq, resp.bs)
+		}
+		return resp.bs, nil
 	}
 
+	qi.resolution = dnstype.ResolutionLocal
 	return out, err
 }
 
@@ -339,6 +407,9 @@ func (r *Resolver) HandleExitNodeDNSQuery(ctx context.Context, q []byte, from ne
 		resp.Header.RCode = dns.RCodeRefused
 		return marshalResponse(resp)
 	}
+	if res, ok := r.applyPolicy(ctx, q, "tcp", from); ok {
+		return res, nil
+	}
 
 	switch runtime.GOOS {
 	default:
@@ -374,7 +445,7 @@ func (r *Resolver) HandleExitNodeDNSQuery(ctx context.Context, q []byte, from ne
 			}}
 		}
 
-		err = r.forwarder.forwardWithDestChan(ctx, packet{q, "tcp", from}, ch, resolvers...)
+		err = r.forwarder.forwardWithDestChan(ctx, packet{bs: q, family: "tcp", addr: from}, ch, resolvers...)
 		if err != nil {
 			metricDNSExitProxyErrorForward.Add(1)
 			return nil, err
@@ -1297,6 +1368,13 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSExitProxyErrorForward    = clientmetric.NewCounter("dns_exit_node_error_forward")
 	metricDNSExitProxyErrorResolvConf = clientmetric.NewCounter("dns_exit_node_error_resolvconf")
 
+	metricDNSQueryLogDropped = clientmetric.NewCounter("dns_query_log_dropped")
+
+	metricDNSDoHServerQuery       = clientmetric.NewCounter("dns_doh_server_query")
+	metricDNSDoHServerDenied      = clientmetric.NewCounter("dns_doh_server_denied")
+	metricDNSDoHServerErrorBadReq = clientmetric.NewCounter("dns_doh_server_error_bad_request")
+	metricDNSDoHServerErrorQuery  = clientmetric.NewCounter("dns_doh_server_error_query")
+
 	metricDNSFwd                     = clientmetric.NewCounter("dns_query_fwd")
 	metricDNSFwdDropBonjour          = clientmetric.NewCounter("dns_query_fwd_drop_bonjour")
 	metricDNSFwdErrorName            = clientmetric.NewCounter("dns_query_fwd_error_name")
@@ -1331,6 +1409,21 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT            = clientmetric.NewCounter("dns_query_fwd_dot") // on entry
+	metricDNSFwdDoTErrorDial   = clientmetric.NewCounter("dns_query_fwd_dot_error_dial")
+	metricDNSFwdDoTErrorQuery  = clientmetric.NewCounter("dns_query_fwd_dot_error_query")
+	metricDNSFwdDoTErrorServer = clientmetric.NewCounter("dns_query_fwd_dot_error_server")
+	metricDNSFwdDoTErrorTxID   = clientmetric.NewCounter("dns_query_fwd_dot_error_txid")
+	metricDNSFwdDoTSuccess     = clientmetric.NewCounter("dns_query_fwd_dot_success")
+
+	metricDNSPolicyHit   = clientmetric.NewCounter("dns_policy_hit")
+	metricDNSPolicyError = clientmetric.NewCounter("dns_policy_error")
+
+	metricDNSCacheHit     = clientmetric.NewCounter("dns_cache_hit")
+	metricDNSCacheMiss    = clientmetric.NewCounter("dns_cache_miss")
+	metricDNSCacheEvict   = clientmetric.NewCounter("dns_cache_evict")
+	metricDNSCacheFlushed = clientmetric.NewCounter("dns_cache_flushed") // entries dropped by flushes
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
@@ -0,0 +1,450 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"time"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/types/nettype"
+	"tailscale.com/util/mak"
+)
+
+// NATBehavior is the mapping or filtering behavior of a NAT, as classified
+// by RFC 4787.
+type NATBehavior string
+
+const (
+	// EndpointIndependent mapping reuses a mapping for all destinations;
+	// EndpointIndependent filtering lets anyone reach a mapping, once
+	// it's been used.
+	EndpointIndependent NATBehavior = "endpoint-independent"
+	// AddressDependent mapping makes a new mapping per destination IP
+	// address; AddressDependent filtering only lets in packets from IP
+	// addresses the mapping has sent to.
+	AddressDependent NATBehavior = "address-dependent"
+	// AddressAndPortDependent mapping makes a new mapping per destination
+	// IP address and port; AddressAndPortDependent filtering only lets in
+	// packets from IP:ports the mapping has sent to.
+	AddressAndPortDependent NATBehavior = "address-and-port-dependent"
+)
+
+// short returns an abbreviation of b, for logs.
+func (b NATBehavior) short() string {
+	switch b {
+	case EndpointIndependent:
+		return "ei"
+	case AddressDependent:
+		return "ad"
+	case AddressAndPortDependent:
+		return "apd"
+	}
+	return "?"
+}
+
+// The NAT behavior tests of a full report wait for answers for twice the
+// latency of the STUN server they use, within these bounds.
+const (
+	natBehaviorMinWait = 100 * time.Millisecond
+	natBehaviorMaxWait = 500 * time.Millisecond
+)
+
+// classifyMapping returns the mapping behavior implied by mapped, our IPv4
+// address as seen by each STUN server address we probed, or the empty
+// string if that doesn't tell.
+func classifyMapping(mapped map[netip.AddrPort]netip.AddrPort) NATBehavior {
+	var sameAcrossIPs, variesByIP, sameAcrossPorts bool
+	for a, ma := range mapped {
+		for b, mb := range mapped {
+			if a == b {
+				continue
+			}
+			switch {
+			case a.Addr() == b.Addr() && ma != mb:
+				return AddressAndPortDependent
+			case a.Addr() == b.Addr():
+				sameAcrossPorts = true
+			case ma != mb:
+				variesByIP = true
+			default:
+				sameAcrossIPs = true
+			}
+		}
+	}
+	switch {
+	case variesByIP && sameAcrossPorts:
+		return AddressDependent
+	case variesByIP:
+		// It's one of the dependent kinds, but without two ports of
+		// one server to compare, it's not clear which.
+		return ""
+	case sameAcrossIPs:
+		return EndpointIndependent
+	}
+	return ""
+}
+
+// stunQuery is a STUN request sent by classifyNAT.
+type stunQuery struct {
+	dst netip.AddrPort
+	tx  stun.TxID
+	req []byte
+}
+
+func newSTUNQuery(dst netip.AddrPort, changeIP, changePort bool) stunQuery {
+	q := stunQuery{dst: dst, tx: stun.NewTxID()}
+	if changeIP || changePort {
+		q.req = stun.ChangeRequest(q.tx, changeIP, changePort)
+	} else {
+		q.req = stun.Request(q.tx)
+	}
+	return q
+}
+
+// stunAnswer is the answer to a stunQuery; it's the zero value if there
+// was none.
+type stunAnswer struct {
+	mapped netip.AddrPort // our address, as seen by the server
+	from   netip.AddrPort // where the answer came from
+}
+
+// query sends qs, each twice in case one is lost, and waits up to wait for
+// their answers, which it returns in the same order.
+func (rs *reportState) query(ctx context.Context, wait time.Duration, qs ...stunQuery) []stunAnswer {
+	answers := make([]stunAnswer, len(qs))
+	answered := make(chan struct{}, len(qs))
+	rs.mu.Lock()
+	for i, q := range qs {
+		i := i
+		rs.inFlight[q.tx] = func(mapped, from netip.AddrPort) {
+			rs.mu.Lock()
+			answers[i] = stunAnswer{mapped, from}
+			rs.mu.Unlock()
+			answered <- struct{}{}
+		}
+	}
+	rs.mu.Unlock()
+
+	for _, q := range qs {
+		for i := 0; i < 2; i++ {
+			rs.c.SendPacket(q.req, q.dst)
+		}
+		rs.c.vlogf("sent NAT behavior probe to %v", q.dst)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+wait:
+	for range qs {
+		select {
+		case <-answered:
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, q := range qs {
+		delete(rs.inFlight, q.tx)
+	}
+	return append([]stunAnswer(nil), answers...)
+}
+
+// natBehaviorServerLocked returns the STUN server that the NAT behavior
+// tests use: of those that answered and advertised their alternate address,
+// the nearest, preferring those with an alternate IP address. It returns the
+// zero value if there's none.
+//
+// rs.mu must be held.
+func (rs *reportState) natBehaviorServerLocked() (server, other netip.AddrPort, latency time.Duration) {
+	better := func(s, o netip.AddrPort, l time.Duration) bool {
+		if !server.IsValid() {
+			return true
+		}
+		if a, b := o.Addr() != s.Addr(), other.Addr() != server.Addr(); a != b {
+			return a
+		}
+		if l != latency {
+			return l < latency
+		}
+		return s.Addr().Less(server.Addr())
+	}
+	for s, o := range rs.other4 {
+		if l, ok := rs.latency4[s]; ok && better(s, o, l) {
+			server, other, latency = s, o, l
+		}
+	}
+	return server, other, latency
+}
+
+// classifyNAT sets the NAT's mapping and filtering behavior in the report,
+// as far as it can tell. Incremental reports copy them from the last one.
+//
+// The filtering tests need a STUN server that supports RFC 5780 and
+// advertised its alternate address in OTHER-ADDRESS. Without an alternate
+// IP address, they can't tell endpoint-independent filtering from
+// address-dependent filtering. Mapping behavior also comes from comparing
+// the answers of different servers.
+func (rs *reportState) classifyNAT(ctx context.Context) {
+	rs.mu.Lock()
+	if rs.incremental {
+		if last := rs.c.last; last != nil {
+			rs.report.MappingBehavior = last.MappingBehavior
+			rs.report.FilteringBehavior = last.FilteringBehavior
+		}
+		rs.mu.Unlock()
+		return
+	}
+	if !rs.report.IPv4 || rs.c.SendPacket == nil {
+		rs.mu.Unlock()
+		return
+	}
+	mapped := maps.Clone(rs.mapped4)
+	server, other, latency := rs.natBehaviorServerLocked()
+	rs.mu.Unlock()
+
+	var filtering NATBehavior
+	defer func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		rs.report.MappingBehavior = classifyMapping(mapped)
+		rs.report.FilteringBehavior = filtering
+	}()
+	if !server.IsValid() {
+		return
+	}
+	wait := min(max(2*latency, natBehaviorMinWait), natBehaviorMaxWait)
+	hasAltIP := other.Addr() != server.Addr()
+	altPort := netip.AddrPortFrom(server.Addr(), other.Port())
+
+	// Test filtering first, as the mapping tests send to the very
+	// addresses that the filtering tests want answers from.
+	qs := []stunQuery{newSTUNQuery(server, false, true)}
+	if hasAltIP {
+		qs = append(qs, newSTUNQuery(server, true, true))
+	}
+	ans := rs.query(ctx, wait, qs...)
+	if ctx.Err() != nil {
+		return
+	}
+	switch {
+	case hasAltIP && ans[1].from == other:
+		filtering = EndpointIndependent
+	case ans[0].from == altPort:
+		if hasAltIP {
+			filtering = AddressDependent
+		}
+		// Otherwise, it may yet be endpoint-independent.
+	default:
+		filtering = AddressAndPortDependent
+	}
+
+	qs = []stunQuery{newSTUNQuery(altPort, false, false)}
+	if hasAltIP {
+		qs = append(qs, newSTUNQuery(other, false, false))
+	}
+	for i, a := range rs.query(ctx, wait, qs...) {
+		if a.mapped.Addr().Is4() {
+			mak.Set(&mapped, qs[i].dst, a.mapped)
+		}
+	}
+}
+
+// mappingLifetime is the state of the measurement of how long the NAT keeps
+// an idle UDP mapping on IPv4, which spans many reports.
+//
+// It has a socket of its own, which sends a STUN request to the same server
+// on every report that's due for one, after ever longer idle periods (see
+// mappingLifetimeSteps), until its mapped address changes. A NAT that
+// reuses a port when it makes a new mapping looks like it kept the old one.
+type mappingLifetime struct {
+	dst      netip.AddrPort     // STUN server
+	pc       nettype.PacketConn // nil before the first probe and once done
+	mapped   netip.AddrPort     // pc's mapped address as of lastSent
+	lastSent time.Time          // zero if mapped is unknown
+	step     int                // index into the steps of the next idle period
+	misses   int                // probes in a row without an answer
+	done     bool
+
+	// min and max are the results so far, as in Report.
+	min, max time.Duration
+}
+
+// mappingLifetimeSteps are the idle periods after which the mapping
+// lifetime measurement checks whether its mapping survived, in order.
+var mappingLifetimeSteps = []time.Duration{
+	20 * time.Second,
+	45 * time.Second,
+	90 * time.Second,
+	180 * time.Second,
+}
+
+// maxMappingLifetimeMisses is the number of probes in a row without an
+// answer after which the mapping lifetime measurement gives up.
+const maxMappingLifetimeMisses = 3
+
+func (c *Client) mappingLifetimeSteps() []time.Duration {
+	if c.testMappingLifetimeSteps != nil {
+		return c.testMappingLifetimeSteps
+	}
+	return mappingLifetimeSteps
+}
+
+// stepMappingLifetime sends the mapping lifetime measurement's next probe,
+// if it's due, and waits for its answer until ctx is done.
+//
+// It's called during GetReport, which ensures it doesn't run concurrently
+// with itself.
+func (c *Client) stepMappingLifetime(ctx context.Context) {
+	c.mu.Lock()
+	ml := c.lifetime
+	c.mu.Unlock()
+	if ml == nil || ml.done {
+		return
+	}
+	steps := c.mappingLifetimeSteps()
+	now := c.timeNow()
+	idle := now.Sub(ml.lastSent)
+	if !ml.lastSent.IsZero() && idle < steps[ml.step] {
+		return
+	}
+	if ml.pc == nil {
+		pc, err := c.packetListener().ListenPacket(ctx, "udp4", ":0")
+		if err != nil {
+			c.logf("netcheck: mapping lifetime: %v", err)
+			ml.done = true
+			return
+		}
+		ml.pc = pc
+	}
+
+	mapped := ml.probe(ctx)
+	if !mapped.IsValid() {
+		ml.misses++
+		if ml.misses >= maxMappingLifetimeMisses {
+			c.vlogf("mapping lifetime: no answers from %v; giving up", ml.dst)
+			ml.finish()
+		}
+		// Start over from the current step, as the probe may have
+		// refreshed the mapping or made a new one.
+		ml.lastSent = time.Time{}
+		return
+	}
+	ml.misses = 0
+	switch {
+	case ml.lastSent.IsZero():
+	case mapped != ml.mapped:
+		c.vlogf("mapping lifetime: mapping changed from %v to %v after %v idle", ml.mapped, mapped, idle.Round(time.Second))
+		ml.max = idle
+		ml.finish()
+	default:
+		c.vlogf("mapping lifetime: mapping %v survived %v idle", mapped, idle.Round(time.Second))
+		ml.min = idle
+		ml.step++
+		if ml.step == len(steps) {
+			ml.finish()
+		}
+	}
+	ml.mapped = mapped
+	ml.lastSent = now
+}
+
+// probe sends a STUN request from ml's socket and returns the mapped address
+// in the answer, or the zero value if there's none before ctx is done.
+func (ml *mappingLifetime) probe(ctx context.Context) netip.AddrPort {
+	tx := stun.NewTxID()
+	req := stun.Request(tx)
+	ml.pc.SetReadDeadline(time.Time{})
+	got := make(chan netip.AddrPort, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		var buf [1500]byte
+		for {
+			n, _, err := ml.pc.ReadFromUDPAddrPort(buf[:])
+			if err != nil {
+				return
+			}
+			if rtx, mapped, err := stun.ParseResponse(buf[:n]); err == nil && rtx == tx {
+				got <- mapped
+				return
+			}
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		ml.pc.WriteToUDPAddrPort(req, ml.dst)
+	}
+
+	var mapped netip.AddrPort
+	select {
+	case mapped = <-got:
+	case <-ctx.Done():
+	}
+	// Unblock the reader, if it's still going.
+	ml.pc.SetReadDeadline(time.Now().Add(-time.Second))
+	<-readDone
+	return mapped
+}
+
+// finish ends the measurement, keeping its results.
+func (ml *mappingLifetime) finish() {
+	ml.done = true
+	if ml.pc != nil {
+		ml.pc.Close()
+		ml.pc = nil
+	}
+}
+
+// resetMappingLifetimeLocked discards the mapping lifetime measurement, so
+// that a new one starts after the next report.
+//
+// c.mu must be held.
+func (c *Client) resetMappingLifetimeLocked() {
+	if c.lifetime != nil {
+		c.lifetime.finish()
+		c.lifetime = nil
+	}
+}
+
+// recordMappingLifetime sets the mapping lifetime in the report so far, and
+// starts the measurement if it hasn't started, with the nearest STUN server
+// that answered. If our IPv4 address changed, the network must have, and it
+// starts over.
+//
+// It must not be called concurrently with stepMappingLifetime.
+func (c *Client) recordMappingLifetime(rs *reportState) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ml := c.lifetime
+	global, _ := netip.ParseAddrPort(rs.report.GlobalV4)
+	if ml != nil && ml.mapped.IsValid() && global.IsValid() && global.Addr() != ml.mapped.Addr() {
+		c.vlogf("mapping lifetime: IPv4 address changed from %v to %v; starting over", ml.mapped.Addr(), global.Addr())
+		c.resetMappingLifetimeLocked()
+		ml = nil
+	}
+	if ml == nil {
+		var dst netip.AddrPort
+		var latency time.Duration
+		for s, l := range rs.latency4 {
+			if !dst.IsValid() || l < latency {
+				dst, latency = s, l
+			}
+		}
+		if dst.IsValid() {
+			c.lifetime = &mappingLifetime{dst: dst}
+		}
+		return
+	}
+	rs.report.MappingLifetimeMin = ml.min
+	rs.report.MappingLifetimeMax = ml.max
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/tstest/natlab"
+	"tailscale.com/types/nettype"
+)
+
+func TestClassifyMapping(t *testing.T) {
+	ap := netip.MustParseAddrPort
+	var (
+		s1     = ap("1.0.0.1:3478")
+		s1Alt  = ap("1.0.0.1:3479")
+		s2     = ap("2.0.0.2:3478")
+		m1, m2 = ap("9.9.9.9:1000"), ap("9.9.9.9:2000")
+	)
+	tests := []struct {
+		name   string
+		mapped map[netip.AddrPort]netip.AddrPort
+		want   NATBehavior
+	}{
+		{"none", nil, ""},
+		{"one", map[netip.AddrPort]netip.AddrPort{s1: m1}, ""},
+		{"same-across-ips", map[netip.AddrPort]netip.AddrPort{s1: m1, s2: m1}, EndpointIndependent},
+		{"same-everywhere", map[netip.AddrPort]netip.AddrPort{s1: m1, s1Alt: m1, s2: m1}, EndpointIndependent},
+		{"varies-by-ip", map[netip.AddrPort]netip.AddrPort{s1: m1, s1Alt: m1, s2: m2}, AddressDependent},
+		{"varies-by-ip-only-known", map[netip.AddrPort]netip.AddrPort{s1: m1, s2: m2}, ""},
+		{"varies-by-port", map[netip.AddrPort]netip.AddrPort{s1: m1, s1Alt: m2}, AddressAndPortDependent},
+	}
+	for _, tt := range tests {
+		if got := classifyMapping(tt.mapped); got != tt.want {
+			t.Errorf("%s: classifyMapping = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// natLab is a client machine behind a NAT, and an RFC 5780 STUN server on
+// the internet with two IP addresses.
+type natLab struct {
+	nat    *natlab.SNAT44
+	client *natlab.Machine
+	dm     *tailcfg.DERPMap
+}
+
+func newNATLab(t *testing.T, natType natlab.NATType, fwType natlab.FirewallType, clock *tstest.Clock) *natLab {
+	stun := &natlab.Machine{Name: "stun"}
+	stunAlt := &natlab.Machine{Name: "stun-alt"}
+	nat := &natlab.Machine{Name: "nat"}
+	client := &natlab.Machine{Name: "client"}
+
+	inet := natlab.NewInternet()
+	lan := &natlab.Network{Name: "lan", Prefix4: netip.MustParsePrefix("192.168.0.0/24")}
+	stunIf := stun.Attach("eth0", inet)
+	stunAltIf := stunAlt.Attach("eth0", inet)
+	natWAN := nat.Attach("wan", inet)
+	natLAN := nat.Attach("lan", lan)
+	client.Attach("eth0", lan)
+	lan.SetDefaultGateway(natLAN)
+
+	fw := &natlab.Firewall{Type: fwType, TrustedInterface: natLAN}
+	snat := &natlab.SNAT44{
+		Machine:           nat,
+		ExternalInterface: natWAN,
+		Type:              natType,
+		Firewall:          fw,
+	}
+	if clock != nil {
+		fw.TimeNow = clock.Now
+		snat.TimeNow = clock.Now
+	}
+	nat.PacketHandler = snat
+
+	addr, cleanup := stuntest.ServeWithAlternate(t, stun, stunIf.V4(), stunAlt, stunAltIf.V4())
+	t.Cleanup(cleanup)
+	return &natLab{
+		nat:    snat,
+		client: client,
+		dm:     stuntest.DERPMapOf(addr.String()),
+	}
+}
+
+// newClient returns a Client on the lab's client machine.
+func (l *natLab) newClient(t *testing.T, ctx context.Context) *Client {
+	pc, err := l.client.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{
+		Logf:                t.Logf,
+		SkipExternalNetwork: true,
+		SendPacket:          pc.(nettype.PacketConn).WriteToUDPAddrPort,
+		testPacketListener:  l.client,
+		testEnoughRegions:   1,
+	}
+	go readPackets(ctx, t.Logf, pc.(nettype.PacketConn), c.ReceiveSTUNPacket)
+	return c
+}
+
+func TestNATBehavior(t *testing.T) {
+	tests := []struct {
+		nat           natlab.NATType
+		fw            natlab.FirewallType
+		wantMapping   NATBehavior
+		wantFiltering NATBehavior
+	}{
+		{natlab.EndpointIndependentNAT, natlab.EndpointIndependentFirewall, EndpointIndependent, EndpointIndependent},
+		{natlab.EndpointIndependentNAT, natlab.AddressDependentFirewall, EndpointIndependent, AddressDependent},
+		{natlab.EndpointIndependentNAT, natlab.AddressAndPortDependentFirewall, EndpointIndependent, AddressAndPortDependent},
+		{natlab.AddressDependentNAT, natlab.AddressAndPortDependentFirewall, AddressDependent, AddressAndPortDependent},
+		{natlab.AddressAndPortDependentNAT, natlab.AddressAndPortDependentFirewall, AddressAndPortDependent, AddressAndPortDependent},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.wantMapping)+"/"+string(tt.wantFiltering), func(t *testing.T) {
+			l := newNATLab(t, tt.nat, tt.fw, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c := l.newClient(t, ctx)
+
+			r, err := c.GetReport(ctx, l.dm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.MappingBehavior != tt.wantMapping || r.FilteringBehavior != tt.wantFiltering {
+				t.Errorf("got mapping %q, filtering %q; want %q, %q", r.MappingBehavior, r.FilteringBehavior, tt.wantMapping, tt.wantFiltering)
+			}
+
+			// Incremental reports keep the classification.
+			r, err = c.GetReport(ctx, l.dm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.MappingBehavior != tt.wantMapping || r.FilteringBehavior != tt.wantFiltering {
+				t.Errorf("incremental report has mapping %q, filtering %q; want %q, %q", r.MappingBehavior, r.FilteringBehavior, tt.wantMapping, tt.wantFiltering)
+			}
+		})
+	}
+}
+
+func TestMappingLifetime(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Now()})
+	l := newNATLab(t, natlab.EndpointIndependentNAT, natlab.AddressAndPortDependentFirewall, clock)
+	l.nat.MappingTimeout = 60 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := l.newClient(t, ctx)
+	c.TimeNow = clock.Now
+	c.testMappingLifetimeSteps = []time.Duration{20 * time.Second, 45 * time.Second, 90 * time.Second}
+
+	report := func() *Report {
+		t.Helper()
+		r, err := c.GetReport(ctx, l.dm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	check := func(r *Report, wantMin, wantMax time.Duration) {
+		t.Helper()
+		if r.MappingLifetimeMin != wantMin || r.MappingLifetimeMax != wantMax {
+			t.Errorf("mapping lifetime = [%v, %v]; want [%v, %v]", r.MappingLifetimeMin, r.MappingLifetimeMax, wantMin, wantMax)
+		}
+	}
+
+	// The first report picks the STUN server, the second learns the
+	// measurement socket's mapping.
+	check(report(), 0, 0)
+	check(report(), 0, 0)
+	clock.Advance(20 * time.Second)
+	check(report(), 20*time.Second, 0)
+	clock.Advance(30 * time.Second) // not yet due
+	check(report(), 20*time.Second, 0)
+	clock.Advance(15 * time.Second)
+	check(report(), 45*time.Second, 0)
+	clock.Advance(90 * time.Second)
+	check(report(), 45*time.Second, 90*time.Second)
+
+	// It's done.
+	clock.Advance(time.Hour)
+	check(report(), 45*time.Second, 90*time.Second)
+}
@@ -16,6 +16,7 @@
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"runtime"
 	"sort"
 	"strings"
@@ -122,6 +123,28 @@ type Report struct {
 	// intercepting HTTP traffic.
 	CaptivePortal opt.Bool
 
+	// CaptivePortalURL is, if CaptivePortal is true, the URL at which the
+	// user can log in to the captive portal: where it redirected us to, or
+	// else the URL it intercepted.
+	CaptivePortalURL string
+
+	// MappingBehavior and FilteringBehavior are the NAT's behavior (on
+	// IPv4), as far as it could be classified. Empty means unknown.
+	// Filtering behavior can only be classified with the help of STUN
+	// servers that support RFC 5780.
+	MappingBehavior   NATBehavior
+	FilteringBehavior NATBehavior
+
+	// MappingLifetimeMin and MappingLifetimeMax bound how long the NAT
+	// keeps an idle UDP mapping (on IPv4): one survived
+	// MappingLifetimeMin of idleness, and another didn't survive
+	// MappingLifetimeMax. They're measured over several minutes of
+	// reports, and are zero until then. MappingLifetimeMin stays zero if
+	// no mapping survived the shortest idle period tried, and
+	// MappingLifetimeMax if none expired.
+	MappingLifetimeMin time.Duration
+	MappingLifetimeMax time.Duration
+
 	// TODO: update Clone when adding new fields
 }
 
@@ -199,8 +222,10 @@ type Client struct {
 	UseDNSCache bool
 
 	// For tests
-	testEnoughRegions      int
-	testCaptivePortalDelay time.Duration
+	testEnoughRegions        int
+	testCaptivePortalDelay   time.Duration
+	testPacketListener       nettype.PacketListener // for the sockets GetReport opens, if non-nil
+	testMappingLifetimeSteps []time.Duration
 
 	mu       sync.Mutex            // guards following
 	nextFull bool                  // do a full region scan, even if last != nil
@@ -209,6 +234,7 @@ type Client struct {
 	lastFull time.Time             // time of last full (non-incremental) report
 	curState *reportState          // non-nil if we're in a call to GetReport
 	resolver *dnscache.Resolver    // only set if UseDNSCache is true
+	lifetime *mappingLifetime      // measurement of the NAT's mapping lifetime, if started
 }
 
 func (c *Client) enoughRegions() int {
@@ -231,6 +257,15 @@ func (c *Client) captivePortalDelay() time.Duration {
 	return 200 * time.Millisecond
 }
 
+// packetListener returns the listener for the sockets that GetReport opens
+// itself.
+func (c *Client) packetListener() nettype.PacketListenerWithNetIP {
+	if c.testPacketListener != nil {
+		return nettype.MakePacketListenerWithNetIP(c.testPacketListener)
+	}
+	return nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, c.NetMon))
+}
+
 func (c *Client) logf(format string, a ...any) {
 	if c.Logf != nil {
 		c.Logf(format, a...)
@@ -307,13 +342,22 @@ func (c *Client) ReceiveSTUNPacket(pkt []byte, src netip.AddrPort) {
 	}
 
 	rs.mu.Lock()
+	if other := stun.ParseOtherAddress(pkt); other.IsValid() && src.Addr().Unmap().Is4() {
+		// The server supports RFC 5780 (see classifyNAT). Its
+		// alternate IP is unspecified if it's the same.
+		src := netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if other.Addr().IsUnspecified() {
+			other = netip.AddrPortFrom(src.Addr(), other.Port())
+		}
+		mak.Set(&rs.other4, src, other)
+	}
 	onDone, ok := rs.inFlight[tx]
 	if ok {
 		delete(rs.inFlight, tx)
 	}
 	rs.mu.Unlock()
 	if ok {
-		onDone(addrPort)
+		onDone(addrPort, src)
 	}
 }
 
@@ -533,10 +577,16 @@ type reportState struct {
 
 	mu            sync.Mutex
 	sentHairCheck bool
-	report        *Report                            // to be returned by GetReport
-	inFlight      map[stun.TxID]func(netip.AddrPort) // called without c.mu held
+	report        *Report                                     // to be returned by GetReport
+	inFlight      map[stun.TxID]func(ipp, src netip.AddrPort) // called without c.mu held
 	gotEP4        string
 	timers        []*time.Timer
+
+	// For classifyNAT and the mapping lifetime measurement, keyed by
+	// the STUN server addresses that answered on IPv4:
+	mapped4  map[netip.AddrPort]netip.AddrPort // our mapped address
+	latency4 map[netip.AddrPort]time.Duration
+	other4   map[netip.AddrPort]netip.AddrPort // alternate address, from OTHER-ADDRESS
 }
 
 func (rs *reportState) anyUDP() bool {
@@ -766,7 +816,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	rs := &reportState{
 		c:           c,
 		report:      newReport(),
-		inFlight:    map[stun.TxID]func(netip.AddrPort){},
+		inFlight:    map[stun.TxID]func(netip.AddrPort, netip.AddrPort){},
 		hairTX:      stun.NewTxID(), // random payload
 		gotHairSTUN: make(chan netip.AddrPort, 1),
 		hairTimeout: make(chan struct{}),
@@ -796,6 +846,9 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	if !doFull && last != nil {
 		doFull = !last.UDP && last.CaptivePortal.EqualBool(true)
 	}
+	if c.nextFull {
+		c.resetMappingLifetimeLocked()
+	}
 	if doFull {
 		last = nil // causes makeProbePlan below to do a full (initial) plan
 		c.nextFull = false
@@ -841,13 +894,26 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	}
 
 	// Create a UDP4 socket used for sending to our discovered IPv4 address.
-	rs.pc4Hair, err = nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, c.NetMon)).ListenPacket(ctx, "udp4", ":0")
+	rs.pc4Hair, err = c.packetListener().ListenPacket(ctx, "udp4", ":0")
 	if err != nil {
 		c.logf("udp4: %v", err)
 		return nil, err
 	}
 	defer rs.pc4Hair.Close()
 
+	// Measure the NAT's mapping lifetime a step further, if it's due,
+	// while the other probes run. It gets as long as they do.
+	lifetimeCtx, lifetimeCancel := context.WithCancel(ctx)
+	lifetimeDone := make(chan struct{})
+	go func() {
+		defer close(lifetimeDone)
+		c.stepMappingLifetime(lifetimeCtx)
+	}()
+	defer func() {
+		lifetimeCancel()
+		<-lifetimeDone
+	}()
+
 	if !c.SkipExternalNetwork && c.PortMapper != nil {
 		rs.waitPortMap.Add(1)
 		go rs.probePortMapServices()
@@ -885,12 +951,13 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 
 		tmr := time.AfterFunc(c.captivePortalDelay(), func() {
 			defer close(ch)
-			found, err := c.checkCaptivePortal(ctx, dm, preferredDERP)
+			found, portalURL, err := c.checkCaptivePortal(ctx, dm, preferredDERP)
 			if err != nil {
 				c.logf("[v1] checkCaptivePortal: %v", err)
 				return
 			}
 			rs.report.CaptivePortal.Set(found)
+			rs.report.CaptivePortalURL = portalURL
 		})
 
 		captivePortalStop = func() {
@@ -947,6 +1014,10 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 
 	rs.waitHairCheck(ctx)
 	c.vlogf("hairCheck done")
+	rs.classifyNAT(ctx)
+	lifetimeCancel()
+	<-lifetimeDone
+	c.recordMappingLifetime(rs)
 	if !c.SkipExternalNetwork && c.PortMapper != nil {
 		rs.waitPortMap.Wait()
 		c.vlogf("portMap done")
@@ -1044,8 +1115,9 @@ func (c *Client) finishAndStoreReport(rs *reportState, dm *tailcfg.DERPMap) *Rep
 // captive portal, detected by making a request to a URL that we know should
 // return a "204 No Content" response and checking if that's what we get.
 //
-// The boolean return is whether we think we have a captive portal.
-func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, preferredDERP int) (bool, error) {
+// The boolean return is whether we think we have a captive portal. If so,
+// portalURL is where the user can log in to it.
+func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, preferredDERP int) (found bool, portalURL string, err error) {
 	defer noRedirectClient.CloseIdleConnections()
 
 	// If we have a preferred DERP region with more than one node, try
@@ -1060,7 +1132,7 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 			rids = append(rids, id)
 		}
 		if len(rids) == 0 {
-			return false, nil
+			return false, "", nil
 		}
 		preferredDERP = rids[rand.Intn(len(rids))]
 	}
@@ -1071,12 +1143,12 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 		// Don't try to connect to invalid hostnames. This occurred in tests:
 		// https://github.com/tailscale/tailscale/issues/6207
 		// TODO(bradfitz,andrew-d): how to actually handle this nicely?
-		return false, nil
+		return false, "", nil
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+node.HostName+"/generate_204", nil)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 
 	// Note: the set of valid characters in a challenge and the total
@@ -1086,7 +1158,7 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 	req.Header.Set("X-Tailscale-Challenge", chal)
 	r, err := noRedirectClient.Do(req)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 	defer r.Body.Close()
 
@@ -1094,7 +1166,23 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 	validResponse := r.Header.Get("X-Tailscale-Response") == expectedResponse
 
 	c.logf("[v2] checkCaptivePortal url=%q status_code=%d valid_response=%v", req.URL.String(), r.StatusCode, validResponse)
-	return r.StatusCode != 204 || !validResponse, nil
+	if r.StatusCode == 204 && validResponse {
+		return false, "", nil
+	}
+	return true, captivePortalURL(req.URL, r), nil
+}
+
+// captivePortalURL returns the URL at which the user can log in to the
+// captive portal that answered our request to reqURL with res: where the
+// portal redirects to, if it does, or otherwise reqURL itself, which the
+// portal will intercept again in the user's browser.
+func captivePortalURL(reqURL *url.URL, res *http.Response) string {
+	if res.StatusCode >= 300 && res.StatusCode < 400 {
+		if loc, err := res.Location(); err == nil && (loc.Scheme == "http" || loc.Scheme == "https") {
+			return loc.String()
+		}
+	}
+	return reqURL.String()
 }
 
 // runHTTPOnlyChecks is the netcheck done by environments that can
@@ -1323,6 +1411,14 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		if r.CaptivePortal != "" {
 			fmt.Fprintf(w, " captiveportal=%v", r.CaptivePortal)
 		}
+		if r.MappingBehavior != "" || r.FilteringBehavior != "" {
+			fmt.Fprintf(w, " nat=%v/%v", r.MappingBehavior.short(), r.FilteringBehavior.short())
+		}
+		if r.MappingLifetimeMax != 0 {
+			fmt.Fprintf(w, " maplife=%v-%v", r.MappingLifetimeMin.Round(time.Second), r.MappingLifetimeMax.Round(time.Second))
+		} else if r.MappingLifetimeMin != 0 {
+			fmt.Fprintf(w, " maplife=>%v", r.MappingLifetimeMin.Round(time.Second))
+		}
 		fmt.Fprintf(w, " derp=%v", r.PreferredDERP)
 		if r.PreferredDERP != 0 {
 			fmt.Fprintf(w, " derpdist=")
@@ -1516,8 +1612,15 @@ func (rs *reportState) runProbe(ctx context.Context, dm *tailcfg.DERPMap, probe
 	sent := time.Now() // after DNS lookup above
 
 	rs.mu.Lock()
-	rs.inFlight[txID] = func(ipp netip.AddrPort) {
-		rs.addNodeLatency(node, ipp, time.Since(sent))
+	rs.inFlight[txID] = func(ipp, _ netip.AddrPort) {
+		d := time.Since(sent)
+		if ipp.Addr().Is4() {
+			rs.mu.Lock()
+			mak.Set(&rs.mapped4, addr, ipp)
+			mak.Set(&rs.latency4, addr, d)
+			rs.mu.Unlock()
+		}
+		rs.addNodeLatency(node, ipp, d)
 		cancelSet() // abort other nodes in this set
 	}
 	rs.mu.Unlock()
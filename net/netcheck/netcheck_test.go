@@ -7,6 +7,7 @@
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/netip"
@@ -782,6 +783,18 @@ func TestLogConciseReport(t *testing.T) {
 			},
 			want: "udp=true v4=false v6=false mapvarydest= hair= portmap=UC derp=0",
 		},
+		{
+			name: "nat_behavior",
+			r: &Report{
+				UDP:                true,
+				IPv4:               true,
+				MappingBehavior:    EndpointIndependent,
+				FilteringBehavior:  AddressAndPortDependent,
+				MappingLifetimeMin: 45 * time.Second,
+				MappingLifetimeMax: 90 * time.Second,
+			},
+			want: "udp=true v6=false mapvarydest= hair= portmap=? nat=ei/apd maplife=45s-1m30s derp=0",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -882,6 +895,72 @@ func TestNoCaptivePortalWhenUDP(t *testing.T) {
 	}
 }
 
+func TestCheckCaptivePortal(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a", RegionID: 1, HostName: "derp1.example.com"}}},
+	}}
+	tests := []struct {
+		name      string
+		res       func(req *http.Request) *http.Response
+		wantFound bool
+		wantURL   string
+	}{
+		{
+			name: "no-portal",
+			res: func(req *http.Request) *http.Response {
+				h := make(http.Header)
+				h.Set("X-Tailscale-Response", "response "+req.Header.Get("X-Tailscale-Challenge"))
+				return &http.Response{StatusCode: http.StatusNoContent, Header: h}
+			},
+		},
+		{
+			name: "redirect",
+			res: func(req *http.Request) *http.Response {
+				h := make(http.Header)
+				h.Set("Location", "https://login.hotel.example/portal?orig=x")
+				return &http.Response{StatusCode: http.StatusFound, Header: h}
+			},
+			wantFound: true,
+			wantURL:   "https://login.hotel.example/portal?orig=x",
+		},
+		{
+			name: "relative-redirect",
+			res: func(req *http.Request) *http.Response {
+				h := make(http.Header)
+				h.Set("Location", "/login")
+				return &http.Response{StatusCode: http.StatusTemporaryRedirect, Header: h, Request: req}
+			},
+			wantFound: true,
+			wantURL:   "http://derp1.example.com/login",
+		},
+		{
+			name: "intercepted",
+			res: func(req *http.Request) *http.Response {
+				return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+			},
+			wantFound: true,
+			wantURL:   "http://derp1.example.com/generate_204",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstest.Replace(t, &noRedirectClient.Transport, http.RoundTripper(RoundTripFunc(func(req *http.Request) *http.Response {
+				res := tt.res(req)
+				res.Body = io.NopCloser(strings.NewReader(""))
+				return res
+			})))
+			c := &Client{Logf: t.Logf}
+			found, portalURL, err := c.checkCaptivePortal(context.Background(), dm, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.wantFound || portalURL != tt.wantURL {
+				t.Errorf("checkCaptivePortal = %v, %q; want %v, %q", found, portalURL, tt.wantFound, tt.wantURL)
+			}
+		})
+	}
+}
+
 type RoundTripFunc func(req *http.Request) *http.Response
 
 func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -26,3 +26,9 @@ func (c *Client) getUPnPPortMapping(
 ) (external netip.AddrPort, ok bool) {
 	return netip.AddrPort{}, false
 }
+
+type upnpPinhole struct{ mapping }
+
+func (c *Client) getUPnPPinhole(ctx context.Context, gw netip.Addr, internal netip.AddrPort) (external netip.AddrPort, ok bool) {
+	return netip.AddrPort{}, false
+}
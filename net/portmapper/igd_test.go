@@ -5,7 +5,9 @@
 
 import (
 	"bytes"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -18,6 +20,7 @@
 	"tailscale.com/net/netaddr"
 	"tailscale.com/syncs"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 )
 
 // TestIGD is an IGD (Internet Gateway Device) for testing. It supports fake
@@ -25,6 +28,7 @@
 type TestIGD struct {
 	upnpConn net.PacketConn // for UPnP discovery
 	pxpConn  net.PacketConn // for NAT-PMP and/or PCP
+	pxpConn6 net.PacketConn // for PCP over IPv6 on the same port; nil if IPv6 is unavailable
 	ts       *httptest.Server
 	upnpHTTP syncs.AtomicValue[http.Handler]
 	logf     logger.Logf
@@ -56,6 +60,7 @@ type igdCounters struct {
 	numPCPRecv           int32
 	numPCPDiscoRecv      int32
 	numPCPMapRecv        int32
+	numPCPMap6Recv       int32
 	numPCPOtherRecv      int32
 	numPMPPublicAddrRecv int32
 	numPMPBogusRecv      int32
@@ -82,13 +87,16 @@ func NewTestIGD(logf logger.Logf, t TestIGDOptions) (*TestIGD, error) {
 	if d.upnpConn, err = testListenUDP(); err != nil {
 		return nil, err
 	}
-	if d.pxpConn, err = testListenUDP(); err != nil {
+	if d.pxpConn, d.pxpConn6, err = testListenPxP(); err != nil {
 		d.upnpConn.Close()
 		return nil, err
 	}
 	d.ts = httptest.NewServer(http.HandlerFunc(d.serveUPnPHTTP))
 	go d.serveUPnPDiscovery()
-	go d.servePxP()
+	go d.servePxP(d.pxpConn)
+	if d.pxpConn6 != nil {
+		go d.servePxP(d.pxpConn6)
+	}
 	return d, nil
 }
 
@@ -96,6 +104,25 @@ func testListenUDP() (net.PacketConn, error) {
 	return net.ListenPacket("udp4", "127.0.0.1:0")
 }
 
+// testListenPxP listens for NAT-PMP and PCP on localhost, over IPv4 and, if
+// possible, over IPv6 on the same port.
+func testListenPxP() (pc4, pc6 net.PacketConn, err error) {
+	for i := 0; i < 10; i++ {
+		if pc4, err = testListenUDP(); err != nil {
+			return nil, nil, err
+		}
+		port := pc4.LocalAddr().(*net.UDPAddr).Port
+		pc6, err = net.ListenPacket("udp6", fmt.Sprintf("[::1]:%d", port))
+		if err == nil {
+			return pc4, pc6, nil
+		}
+		pc4.Close()
+	}
+	// No IPv6 on this machine, most likely.
+	pc4, err = testListenUDP()
+	return pc4, nil, err
+}
+
 func (d *TestIGD) TestPxPPort() uint16 {
 	return uint16(d.pxpConn.LocalAddr().(*net.UDPAddr).Port)
 }
@@ -108,11 +135,18 @@ func testIPAndGateway() (gw, ip netip.Addr, ok bool) {
 	return netaddr.IPv4(127, 0, 0, 1), netaddr.IPv4(1, 2, 3, 4), true
 }
 
+func testIPv6AndGateway() (gw, ip netip.Addr, ok bool) {
+	return netip.IPv6Loopback(), netip.IPv6Loopback(), true
+}
+
 func (d *TestIGD) Close() error {
 	d.closed.Store(true)
 	d.ts.Close()
 	d.upnpConn.Close()
 	d.pxpConn.Close()
+	if d.pxpConn6 != nil {
+		d.pxpConn6.Close()
+	}
 	return nil
 }
 
@@ -167,11 +201,11 @@ func (d *TestIGD) serveUPnPDiscovery() {
 	}
 }
 
-// servePxP serves NAT-PMP and PCP, which share a port number.
-func (d *TestIGD) servePxP() {
+// servePxP serves NAT-PMP and PCP, which share a port number, on pc.
+func (d *TestIGD) servePxP(pc net.PacketConn) {
 	buf := make([]byte, 1500)
 	for {
-		n, a, err := d.pxpConn.ReadFrom(buf)
+		n, a, err := pc.ReadFrom(buf)
 		if err != nil {
 			if !d.closed.Load() {
 				d.logf("servePxP failed: %v", err)
@@ -193,7 +227,7 @@ func (d *TestIGD) servePxP() {
 		case pmpVersion:
 			d.handlePMPQuery(pkt, src)
 		case pcpVersion:
-			d.handlePCPQuery(pkt, src)
+			d.handlePCPQuery(pc, pkt, src)
 		}
 	}
 }
@@ -216,7 +250,7 @@ func (d *TestIGD) handlePMPQuery(pkt []byte, src netip.AddrPort) {
 	// TODO
 }
 
-func (d *TestIGD) handlePCPQuery(pkt []byte, src netip.AddrPort) {
+func (d *TestIGD) handlePCPQuery(pc net.PacketConn, pkt []byte, src netip.AddrPort) {
 	d.inc(&d.counters.numPCPRecv)
 	if len(pkt) < 24 {
 		return
@@ -237,7 +271,7 @@ func (d *TestIGD) handlePCPQuery(pkt []byte, src netip.AddrPort) {
 			return
 		}
 		resp := buildPCPDiscoResponse(pkt)
-		if _, err := d.pxpConn.WriteTo(resp, net.UDPAddrFromAddrPort(src)); err != nil {
+		if _, err := pc.WriteTo(resp, net.UDPAddrFromAddrPort(src)); err != nil {
 			d.inc(&d.counters.numFailedWrites)
 		}
 	case pcpOpMap:
@@ -247,11 +281,14 @@ func (d *TestIGD) handlePCPQuery(pkt []byte, src netip.AddrPort) {
 			return
 		}
 		d.inc(&d.counters.numPCPMapRecv)
+		if src.Addr().Is6() {
+			d.inc(&d.counters.numPCPMap6Recv)
+		}
 		if !d.doPCP {
 			return
 		}
 		resp := buildPCPMapResponse(pkt)
-		d.pxpConn.WriteTo(resp, net.UDPAddrFromAddrPort(src))
+		pc.WriteTo(resp, net.UDPAddrFromAddrPort(src))
 	default:
 		// unknown op code, ignore it for now.
 		d.inc(&d.counters.numPCPOtherRecv)
@@ -268,5 +305,166 @@ func newTestClient(t *testing.T, igd *TestIGD) *Client {
 	c.testPxPPort = igd.TestPxPPort()
 	c.testUPnPPort = igd.TestUPnPPort()
 	c.SetGatewayLookupFunc(testIPAndGateway)
+	c.SetIPv6GatewayLookupFunc(testIPv6AndGateway)
 	return c
 }
+
+// testUPnPFirewall is a fake UPnP IGDv2 whose only service is
+// WANIPv6FirewallControl:1, for use with TestIGD.SetUPnPHandler.
+type testUPnPFirewall struct {
+	t               *testing.T
+	disabled        bool // firewall is off
+	pinholesAllowed bool
+
+	mu       sync.Mutex
+	nextID   uint16
+	pinholes map[uint16]string // ID => "[internal client]:port"
+	updates  int
+}
+
+func (f *testUPnPFirewall) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/rootDesc.xml":
+		io.WriteString(w, testFirewallRootDesc)
+		return
+	case "/ctl/IP6FCtl":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Body struct {
+			Action struct {
+				XMLName        xml.Name
+				InternalClient string
+				InternalPort   string
+				Protocol       string
+				LeaseTime      string
+				UniqueID       uint16
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("bad UPnP request: %v", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	a := req.Body.Action
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch a.XMLName.Local {
+	case "GetFirewallStatus":
+		fmt.Fprintf(w, testFirewallResponse, "GetFirewallStatus",
+			fmt.Sprintf("<FirewallEnabled>%d</FirewallEnabled><InboundPinholeAllowed>%d</InboundPinholeAllowed>", b2i(!f.disabled), b2i(f.pinholesAllowed)))
+	case "AddPinhole":
+		if !f.pinholesAllowed {
+			io.WriteString(w, testFirewallNotAllowed)
+			return
+		}
+		if a.Protocol != "17" || a.LeaseTime == "0" {
+			f.t.Errorf("AddPinhole with protocol %q, lease %q", a.Protocol, a.LeaseTime)
+		}
+		f.nextID++
+		mak.Set(&f.pinholes, f.nextID, net.JoinHostPort(a.InternalClient, a.InternalPort))
+		fmt.Fprintf(w, testFirewallResponse, "AddPinhole", fmt.Sprintf("<UniqueID>%d</UniqueID>", f.nextID))
+	case "UpdatePinhole":
+		if _, ok := f.pinholes[a.UniqueID]; !ok {
+			io.WriteString(w, testFirewallNoSuchEntry)
+			return
+		}
+		f.updates++
+		fmt.Fprintf(w, testFirewallResponse, "UpdatePinhole", "")
+	case "DeletePinhole":
+		delete(f.pinholes, a.UniqueID)
+		fmt.Fprintf(w, testFirewallResponse, "DeletePinhole", "")
+	default:
+		f.t.Errorf("unhandled UPnP request type %q", a.XMLName.Local)
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+const testFirewallRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>1</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType>
+    <friendlyName>Tailscale Test Router</friendlyName>
+    <manufacturer>Tailscale</manufacturer>
+    <UDN>uuid:1974e83b-6dc7-4635-92b3-6a85a4037295</UDN>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:2</deviceType>
+        <friendlyName>WANDevice</friendlyName>
+        <UDN>uuid:1974e83b-6dc7-4635-92b3-6a85a4037296</UDN>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:2</deviceType>
+            <friendlyName>WANConnectionDevice</friendlyName>
+            <UDN>uuid:1974e83b-6dc7-4635-92b3-6a85a4037297</UDN>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPv6FirewallControl:1</serviceType>
+                <serviceId>urn:upnp-org:serviceId:WANIPv6Firewall1</serviceId>
+                <SCPDURL>/WANIP6FC.xml</SCPDURL>
+                <controlURL>/ctl/IP6FCtl</controlURL>
+                <eventSubURL>/evt/IP6FCtl</eventSubURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>
+`
+
+// testFirewallResponse is a WANIPv6FirewallControl response to the action
+// in the first verb, with the output arguments in the second.
+const testFirewallResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <u:%[1]sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPv6FirewallControl:1">%[2]s</u:%[1]sResponse>
+  </s:Body>
+</s:Envelope>
+`
+
+const testFirewallNotAllowed = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <s:Fault>
+      <faultCode>s:Client</faultCode>
+      <faultString>UPnPError</faultString>
+      <detail>
+        <UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+          <errorCode>703</errorCode>
+          <errorDescription>InboundPinholeNotAllowed</errorDescription>
+        </UPnPError>
+      </detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>
+`
+
+const testFirewallNoSuchEntry = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <s:Fault>
+      <faultCode>s:Client</faultCode>
+      <faultString>UPnPError</faultString>
+      <detail>
+        <UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+          <errorCode>704</errorCode>
+          <errorDescription>NoSuchEntry</errorDescription>
+        </UPnPError>
+      </detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>
+`
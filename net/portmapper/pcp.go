@@ -8,6 +8,7 @@
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"net"
 	"net/netip"
 	"time"
 )
@@ -62,7 +63,12 @@ func (p *pcpMapping) GoodUntil() time.Time     { return p.goodUntil }
 func (p *pcpMapping) RenewAfter() time.Time    { return p.renewAfter }
 func (p *pcpMapping) External() netip.AddrPort { return p.external }
 func (p *pcpMapping) Release(ctx context.Context) {
-	uc, err := p.c.listenPacket(ctx, "udp4", ":0")
+	network, laddr := "udp4", ":0"
+	if p.gw.Addr().Is6() {
+		// An IPv6 pinhole; the request must come from the pinholed address.
+		network, laddr = "udp6", net.JoinHostPort(p.internal.Addr().String(), "0")
+	}
+	uc, err := p.c.listenPacket(ctx, network, laddr)
 	if err != nil {
 		return
 	}
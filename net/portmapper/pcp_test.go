@@ -53,6 +53,14 @@ func buildPCPMapResponse(req []byte) []byte {
 	// copy nonce, protocol and internal port
 	copy(mapResp[:13], mapReq[:13])
 	copy(mapResp[16:18], mapReq[16:18])
+	clientIP := netip.AddrFrom16([16]byte(req[8:24]))
+	if !clientIP.Is4In6() {
+		// An IPv6 pinhole: grant the suggested address and port, which
+		// are the client's own.
+		binary.BigEndian.PutUint32(out[4:8], pcpMapLifetimeSec)
+		copy(mapResp[18:36], mapReq[18:36])
+		return out
+	}
 	// assign external port
 	binary.BigEndian.PutUint16(mapResp[18:20], 4242)
 	assignedIP := netaddr.IPv4(127, 0, 0, 1)
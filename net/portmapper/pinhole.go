@@ -0,0 +1,273 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmapper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/neterror"
+)
+
+// IPv6 doesn't need NAT, but many residential routers run a stateful
+// firewall that drops unsolicited inbound UDP. A pinhole is a firewall
+// rule letting anyone on the internet reach our IPv6 address and local
+// port. Pinholes are requested with PCP (a MAP request whose suggested
+// external address is our own) or UPnP IGDv2's WANIPv6FirewallControl
+// service, and are tracked separately from the IPv4 port mapping.
+//
+// References:
+//
+// PCP anycast address: https://www.rfc-editor.org/rfc/rfc7723
+// WANIPv6FirewallControl: http://upnp.org/specs/gw/UPnP-gw-WANIPv6FirewallControl-v1-Service.pdf
+
+// pcpAnycastIPv6 is the well-known PCP server anycast address. We send
+// IPv6 PCP requests there by default, since the IPv6 default router is
+// usually only known by its link-local address.
+var pcpAnycastIPv6 = netip.MustParseAddr("2001:1::1")
+
+var errNoLocalPort6 = errors.New("skipping pinhole; no local IPv6 port")
+
+// likelyPCPServerAndSelfIPv6 is the default IPv6 lookup func. It returns
+// the PCP anycast address and the machine's first global unicast IPv6
+// address.
+func likelyPCPServerAndSelfIPv6() (gw, myIP netip.Addr, ok bool) {
+	ips, _, err := interfaces.LocalAddresses()
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	for _, ip := range ips {
+		if ip.Is6() && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return pcpAnycastIPv6, ip, true
+		}
+	}
+	return netip.Addr{}, netip.Addr{}, false
+}
+
+// SetIPv6GatewayLookupFunc sets the func that returns the PCP server to
+// ask for IPv6 pinholes and the machine's global IPv6 address. It must be
+// called before the client is used. If not called, the PCP anycast address
+// and the first global unicast address of the machine are used.
+func (c *Client) SetIPv6GatewayLookupFunc(f func() (gw, myIP netip.Addr, ok bool)) {
+	c.ipAndGateway6 = f
+}
+
+// SetLocalPort6 updates the local IPv6 port number for which we want a
+// firewall pinhole. Zero means that no pinhole is wanted.
+func (c *Client) SetLocalPort6(localPort uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localPort6 == localPort {
+		return
+	}
+	c.localPort6 = localPort
+	c.invalidatePinholeLocked(true)
+}
+
+func (c *Client) gatewayAndSelfIP6() (gw, myIP netip.Addr, ok bool) {
+	gw, myIP, ok = c.ipAndGateway6()
+	if !ok {
+		gw = netip.Addr{}
+		myIP = netip.Addr{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gw != c.lastGW6 || myIP != c.lastMyIP6 || !ok {
+		c.lastMyIP6 = myIP
+		c.lastGW6 = gw
+		c.invalidatePinholeLocked(true)
+	}
+	return
+}
+
+func (c *Client) invalidatePinholeLocked(releaseOld bool) {
+	if c.pinhole != nil {
+		if releaseOld {
+			c.pinhole.Release(context.Background())
+		}
+		c.pinhole = nil
+	}
+	c.pcp6MissTime = time.Time{}
+}
+
+// HavePinhole reports whether we have a current valid IPv6 firewall
+// pinhole.
+func (c *Client) HavePinhole() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pinhole != nil && c.pinhole.GoodUntil().After(time.Now())
+}
+
+// GetCachedPinholeOrStartCreatingOne is like
+// GetCachedMappingOrStartCreatingOne, but for an IPv6 firewall pinhole. It
+// quickly returns our current pinhole's address, if any, and otherwise
+// starts a background goroutine to create (or renew) one. The onChange
+// hook fires if that goroutine creates one.
+func (c *Client) GetCachedPinholeOrStartCreatingOne() (external netip.AddrPort, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if m := c.pinhole; m != nil {
+		if now.Before(m.GoodUntil()) {
+			if now.After(m.RenewAfter()) {
+				c.maybeStartPinholeLocked()
+			}
+			return m.External(), true
+		}
+	}
+
+	c.maybeStartPinholeLocked()
+	return netip.AddrPort{}, false
+}
+
+// maybeStartPinholeLocked starts a createPinhole goroutine up, if one
+// isn't already running and there's a local port to open.
+//
+// c.mu must be held.
+func (c *Client) maybeStartPinholeLocked() {
+	if !c.runningPinhole && c.localPort6 != 0 && !c.closed {
+		c.runningPinhole = true
+		go c.createPinhole()
+	}
+}
+
+func (c *Client) createPinhole() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.runningPinhole = false
+	}()
+
+	if _, err := c.createOrGetPinhole(ctx); err == nil && c.onChange != nil {
+		go c.onChange()
+	} else if err != nil && !IsNoMappingError(err) {
+		c.logf("createOrGetPinhole: %v", err)
+	}
+}
+
+// createOrGetPinhole either creates (or renews) an IPv6 firewall pinhole,
+// or returns a cached valid one. It tries PCP first, then UPnP.
+//
+// If no pinhole is available, the error will be of type NoMappingError;
+// see IsNoMappingError.
+func (c *Client) createOrGetPinhole(ctx context.Context) (external netip.AddrPort, err error) {
+	if c.debug.DisableUPnP && c.debug.DisablePCP {
+		return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+	}
+	gw6, myIP6, ok := c.gatewayAndSelfIP6()
+	if !ok {
+		return netip.AddrPort{}, NoMappingError{ErrNoGlobalIPv6}
+	}
+
+	c.mu.Lock()
+	internal := netip.AddrPortFrom(myIP6, c.localPort6)
+	if internal.Port() == 0 {
+		c.mu.Unlock()
+		return netip.AddrPort{}, NoMappingError{errNoLocalPort6}
+	}
+	now := time.Now()
+	_, renewUPnP := c.pinhole.(*upnpPinhole)
+	if m := c.pinhole; m != nil {
+		if now.Before(m.RenewAfter()) {
+			defer c.mu.Unlock()
+			return m.External(), nil
+		}
+	}
+	// Don't bother with PCP if it recently didn't answer, or if the
+	// pinhole we're renewing came from UPnP.
+	tryPCP := !c.debug.DisablePCP && !renewUPnP &&
+		!c.pcp6MissTime.After(now.Add(-trustServiceStillAvailableDuration))
+	c.mu.Unlock()
+
+	if tryPCP {
+		external, err := c.getPCPPinhole(ctx, netip.AddrPortFrom(gw6, c.pxpPort()), internal)
+		if err == nil {
+			return external, nil
+		}
+		if ctx.Err() != nil {
+			return netip.AddrPort{}, err
+		}
+		if !IsNoMappingError(err) {
+			c.logf("PCP pinhole: %v", err)
+		}
+		c.mu.Lock()
+		c.pcp6MissTime = time.Now()
+		c.mu.Unlock()
+	}
+
+	// UPnP is spoken to the IPv4 gateway, which is also the IGD
+	// controlling the IPv6 firewall.
+	if gw, _, ok := c.gatewayAndSelfIP(); ok {
+		if external, ok := c.getUPnPPinhole(ctx, gw, internal); ok {
+			return external, nil
+		}
+	}
+	return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+}
+
+// getPCPPinhole asks the PCP server at pcpAddr to open a pinhole to
+// internal. On success the resulting mapping is stored as c.pinhole.
+func (c *Client) getPCPPinhole(ctx context.Context, pcpAddr, internal netip.AddrPort) (external netip.AddrPort, err error) {
+	// Bind to our global address so the source of the request matches
+	// the client address in it; PCP servers reject mismatches.
+	uc, err := c.listenPacket(ctx, "udp6", net.JoinHostPort(internal.Addr().String(), "0"))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	defer uc.Close()
+
+	uc.SetReadDeadline(time.Now().Add(portMapServiceTimeout))
+	defer closeCloserOnContextDone(ctx, uc)()
+
+	// Ask for our own address and port on the outside: there's no NAT,
+	// only a firewall.
+	pkt := buildPCPRequestMappingPacket(internal.Addr(), internal.Port(), internal.Port(), pcpMapLifetimeSec, internal.Addr())
+	metricPCPPinholeSent.Add(1)
+	if _, err := uc.WriteToUDPAddrPort(pkt, pcpAddr); err != nil {
+		if neterror.TreatAsLostUDP(err) {
+			err = NoMappingError{ErrNoPortMappingServices}
+		}
+		return netip.AddrPort{}, err
+	}
+
+	res := make([]byte, 1500)
+	for {
+		n, src, err := uc.ReadFromUDPAddrPort(res)
+		if err != nil {
+			if ctx.Err() != nil {
+				return netip.AddrPort{}, err
+			}
+			return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+		}
+		if src != pcpAddr {
+			continue
+		}
+		m, err := parsePCPMapResponse(res[:n])
+		if err != nil {
+			c.logf("failed to get PCP pinhole: %v", err)
+			return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+		}
+		if !m.external.Addr().Is6() {
+			c.logf("PCP pinhole response has non-IPv6 address %v", m.external)
+			return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+		}
+		metricPCPPinholeOK.Add(1)
+		m.c = c
+		m.gw = pcpAddr
+		m.internal = internal
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.pinhole = m
+		return m.external, nil
+	}
+}
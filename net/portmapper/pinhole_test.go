@@ -0,0 +1,187 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmapper
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPCPPinhole(t *testing.T) {
+	igd, err := NewTestIGD(t.Logf, TestIGDOptions{PCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer igd.Close()
+	if igd.pxpConn6 == nil {
+		t.Skip("no IPv6 loopback")
+	}
+
+	c := newTestClient(t, igd)
+	defer c.Close()
+	c.SetLocalPort6(41641)
+
+	want := netip.MustParseAddrPort("[::1]:41641")
+	ext, err := c.createOrGetPinhole(context.Background())
+	if err != nil {
+		t.Fatalf("createOrGetPinhole: %v", err)
+	}
+	if ext != want {
+		t.Errorf("pinhole = %v; want %v", ext, want)
+	}
+	if !c.HavePinhole() {
+		t.Errorf("HavePinhole = false")
+	}
+	if got := igd.stats().numPCPMap6Recv; got != 1 {
+		t.Errorf("IGD got %d IPv6 PCP map requests; want 1", got)
+	}
+	// The IPv4 mapping is separate.
+	if c.HaveMapping() {
+		t.Errorf("HaveMapping = true")
+	}
+
+	// A valid pinhole is returned from the cache.
+	if got, ok := c.GetCachedPinholeOrStartCreatingOne(); !ok || got != want {
+		t.Errorf("GetCachedPinholeOrStartCreatingOne = %v, %v; want %v, true", got, ok, want)
+	}
+
+	// Once it's due for renewal, it's requested again.
+	c.mu.Lock()
+	c.pinhole.(*pcpMapping).renewAfter = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	if _, err := c.createOrGetPinhole(context.Background()); err != nil {
+		t.Fatalf("renewing: %v", err)
+	}
+	if got := igd.stats().numPCPMap6Recv; got != 2 {
+		t.Errorf("IGD got %d IPv6 PCP map requests after renewal; want 2", got)
+	}
+
+	// Changing the local port releases the old pinhole.
+	c.SetLocalPort6(41642)
+	if c.HavePinhole() {
+		t.Errorf("HavePinhole = true after port change")
+	}
+	// The release is fire-and-forget.
+	for deadline := time.Now().Add(5 * time.Second); igd.stats().numPCPMap6Recv != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("IGD got %d IPv6 PCP map requests after release; want 3", igd.stats().numPCPMap6Recv)
+		}
+	}
+}
+
+func TestUPnPPinhole(t *testing.T) {
+	igd, err := NewTestIGD(t.Logf, TestIGDOptions{UPnP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer igd.Close()
+	fw := &testUPnPFirewall{t: t, pinholesAllowed: true}
+	igd.SetUPnPHandler(fw)
+
+	c := newTestClient(t, igd)
+	defer c.Close()
+	c.debug.DisablePCP = true
+	c.SetLocalPort6(41641)
+	if _, err := c.Probe(context.Background()); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+
+	want := netip.MustParseAddrPort("[::1]:41641")
+	ext, err := c.createOrGetPinhole(context.Background())
+	if err != nil {
+		t.Fatalf("createOrGetPinhole: %v", err)
+	}
+	if ext != want {
+		t.Errorf("pinhole = %v; want %v", ext, want)
+	}
+	fw.mu.Lock()
+	if len(fw.pinholes) != 1 || fw.pinholes[1] != want.String() {
+		t.Errorf("IGD pinholes = %v; want {1: %v}", fw.pinholes, want)
+	}
+	fw.mu.Unlock()
+
+	// Renewal updates the pinhole's lease rather than adding another.
+	c.mu.Lock()
+	c.pinhole.(*upnpPinhole).renewAfter = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	if _, err := c.createOrGetPinhole(context.Background()); err != nil {
+		t.Fatalf("renewing: %v", err)
+	}
+	fw.mu.Lock()
+	if len(fw.pinholes) != 1 || fw.updates != 1 {
+		t.Errorf("after renewal, IGD has pinholes %v and %d updates; want 1 pinhole, 1 update", fw.pinholes, fw.updates)
+	}
+	// If the router forgot the pinhole, renewal adds a new one.
+	clear(fw.pinholes)
+	fw.mu.Unlock()
+	c.mu.Lock()
+	c.pinhole.(*upnpPinhole).renewAfter = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	if _, err := c.createOrGetPinhole(context.Background()); err != nil {
+		t.Fatalf("renewing forgotten pinhole: %v", err)
+	}
+	fw.mu.Lock()
+	if len(fw.pinholes) != 1 || fw.pinholes[2] != want.String() {
+		t.Errorf("after re-adding, IGD pinholes = %v; want {2: %v}", fw.pinholes, want)
+	}
+	fw.mu.Unlock()
+
+	// Closing the client deletes it.
+	c.Close()
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if len(fw.pinholes) != 0 {
+		t.Errorf("after Close, IGD pinholes = %v; want none", fw.pinholes)
+	}
+}
+
+func TestUPnPPinholeNotAllowed(t *testing.T) {
+	for _, fw := range []*testUPnPFirewall{
+		{t: t, disabled: true, pinholesAllowed: true},
+		{t: t, pinholesAllowed: false},
+	} {
+		igd, err := NewTestIGD(t.Logf, TestIGDOptions{UPnP: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer igd.Close()
+		igd.SetUPnPHandler(fw)
+
+		c := newTestClient(t, igd)
+		defer c.Close()
+		c.debug.DisablePCP = true
+		c.SetLocalPort6(41641)
+		if _, err := c.Probe(context.Background()); err != nil {
+			t.Fatalf("Probe: %v", err)
+		}
+		if ext, err := c.createOrGetPinhole(context.Background()); !IsNoMappingError(err) {
+			t.Errorf("firewall disabled=%v, allowed=%v: createOrGetPinhole = %v, %v; want NoMappingError", fw.disabled, fw.pinholesAllowed, ext, err)
+		}
+		if len(fw.pinholes) != 0 {
+			t.Errorf("IGD pinholes = %v; want none", fw.pinholes)
+		}
+	}
+}
+
+func TestPinholeNoGlobalIPv6(t *testing.T) {
+	igd, err := NewTestIGD(t.Logf, TestIGDOptions{PCP: true, UPnP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer igd.Close()
+
+	c := newTestClient(t, igd)
+	defer c.Close()
+	c.SetIPv6GatewayLookupFunc(func() (gw, myIP netip.Addr, ok bool) { return })
+	c.SetLocalPort6(41641)
+	if _, err := c.createOrGetPinhole(context.Background()); !errors.Is(err, ErrNoGlobalIPv6) {
+		t.Errorf("createOrGetPinhole error = %v; want %v", err, ErrNoGlobalIPv6)
+	}
+	if got := igd.stats().numPCPRecv; got != 0 {
+		t.Errorf("IGD got %d PCP packets; want 0", got)
+	}
+}
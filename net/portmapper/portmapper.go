@@ -2,7 +2,7 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // Package portmapper is a UDP port mapping client. It currently allows for mapping over
-// NAT-PMP, UPnP, and PCP.
+// NAT-PMP, UPnP, and PCP, and for opening IPv6 firewall pinholes over PCP and UPnP.
 package portmapper
 
 import (
@@ -66,14 +66,15 @@ type DebugKnobs struct {
 
 // Client is a port mapping client.
 type Client struct {
-	logf         logger.Logf
-	netMon       *netmon.Monitor // optional; nil means interfaces will be looked up on-demand
-	controlKnobs *controlknobs.Knobs
-	ipAndGateway func() (gw, ip netip.Addr, ok bool)
-	onChange     func() // or nil
-	debug        DebugKnobs
-	testPxPPort  uint16 // if non-zero, pxpPort to use for tests
-	testUPnPPort uint16 // if non-zero, uPnPPort to use for tests
+	logf          logger.Logf
+	netMon        *netmon.Monitor // optional; nil means interfaces will be looked up on-demand
+	controlKnobs  *controlknobs.Knobs
+	ipAndGateway  func() (gw, ip netip.Addr, ok bool)
+	ipAndGateway6 func() (gw, ip netip.Addr, ok bool) // PCP server and global IPv6 address
+	onChange      func()                              // or nil
+	debug         DebugKnobs
+	testPxPPort   uint16 // if non-zero, pxpPort to use for tests
+	testUPnPPort  uint16 // if non-zero, uPnPPort to use for tests
 
 	mu sync.Mutex // guards following, and all fields thereof
 
@@ -101,6 +102,16 @@ type Client struct {
 	localPort uint16
 
 	mapping mapping // non-nil if we have a mapping
+
+	// runningPinhole is whether a createPinhole goroutine is running.
+	runningPinhole bool
+
+	lastMyIP6    netip.Addr
+	lastGW6      netip.Addr
+	pcp6MissTime time.Time // time PCP last didn't answer a pinhole request
+	localPort6   uint16
+
+	pinhole mapping // non-nil if we have an IPv6 firewall pinhole
 }
 
 // mapping represents a created port-mapping over some protocol.  It specifies a lease duration,
@@ -177,11 +188,12 @@ func (m *pmpMapping) Release(ctx context.Context) {
 // callback.
 func NewClient(logf logger.Logf, netMon *netmon.Monitor, debug *DebugKnobs, controlKnobs *controlknobs.Knobs, onChange func()) *Client {
 	ret := &Client{
-		logf:         logf,
-		netMon:       netMon,
-		ipAndGateway: interfaces.LikelyHomeRouterIP,
-		onChange:     onChange,
-		controlKnobs: controlKnobs,
+		logf:          logf,
+		netMon:        netMon,
+		ipAndGateway:  interfaces.LikelyHomeRouterIP,
+		ipAndGateway6: likelyPCPServerAndSelfIPv6,
+		onChange:      onChange,
+		controlKnobs:  controlKnobs,
 	}
 	if debug != nil {
 		ret.debug = *debug
@@ -303,6 +315,7 @@ func (c *Client) invalidateMappingsLocked(releaseOld bool) {
 		}
 		c.mapping = nil
 	}
+	c.invalidatePinholeLocked(releaseOld)
 	c.pmpPubIP = netip.Addr{}
 	c.pmpPubIPTime = time.Time{}
 	c.pcpSawTime = time.Time{}
@@ -374,6 +387,7 @@ func IsNoMappingError(err error) bool {
 	ErrNoPortMappingServices = errors.New("no port mapping services were found")
 	ErrGatewayRange          = errors.New("skipping portmap; gateway range likely lacks support")
 	ErrGatewayIPv6           = errors.New("skipping portmap; no IPv6 support for portmapping")
+	ErrNoGlobalIPv6          = errors.New("skipping pinhole; no global IPv6 address")
 )
 
 // GetCachedMappingOrStartCreatingOne quickly returns with our current cached portmapping, if any.
@@ -975,6 +989,14 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 	// we received an (as yet) unhandled PCP result code.
 	metricPCPUnhandledResponseCode = clientmetric.NewCounter("portmap_pcp_unhandled_response_code")
 
+	// metricPCPPinholeSent counts the number of times we sent a PCP
+	// request for an IPv6 firewall pinhole.
+	metricPCPPinholeSent = clientmetric.NewCounter("portmap_pcp_pinhole_sent")
+
+	// metricPCPPinholeOK counts the number of times
+	// we got an IPv6 firewall pinhole over PCP.
+	metricPCPPinholeOK = clientmetric.NewCounter("portmap_pcp_pinhole_ok")
+
 	// metricPMPSent counts the number of times we sent a PMP request.
 	metricPMPSent = clientmetric.NewCounter("portmap_pmp_sent")
 
@@ -1024,6 +1046,10 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 	// metricUPnPUpdatedMeta counts the number of times
 	// we received a UPnP response with a new meta.
 	metricUPnPUpdatedMeta = clientmetric.NewCounter("portmap_upnp_updated_meta")
+
+	// metricUPnPPinholeOK counts the number of times we added or
+	// renewed an IPv6 firewall pinhole over UPnP.
+	metricUPnPPinholeOK = clientmetric.NewCounter("portmap_upnp_pinhole_ok")
 )
 
 // UPnP error metric that's keyed by code; lazily registered on first read
@@ -194,12 +194,44 @@ func addAnyPortMapping(
 // The provided ctx is not retained in the returned upnpClient, but
 // its associated HTTP client is (if set via goupnp.WithHTTPClient).
 func getUPnPClient(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw netip.Addr, meta uPnPDiscoResponse) (client upnpClient, err error) {
+	root, u, err := getUPnPRootDevice(ctx, logf, debug, gw, meta)
+	if root == nil || err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if client == nil {
+			return
+		}
+		logf("saw UPnP type %v at %v; %v (%v)",
+			strings.TrimPrefix(fmt.Sprintf("%T", client), "*internetgateway2."),
+			meta.Location, root.Device.FriendlyName, root.Device.Manufacturer)
+	}()
+
+	// These parts don't do a network fetch.
+	// Pick the best service type available.
+	if cc, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
+		return cc[0], nil
+	}
+	if cc, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
+		return cc[0], nil
+	}
+	if cc, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
+		return cc[0], nil
+	}
+	return nil, nil
+}
+
+// getUPnPRootDevice fetches the root device description of the Internet
+// Gateway Device described by meta. It returns a nil device if UPnP is
+// disabled or no device was discovered.
+func getUPnPRootDevice(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw netip.Addr, meta uPnPDiscoResponse) (*goupnp.RootDevice, *url.URL, error) {
 	if debug.DisableUPnP {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if meta.Location == "" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if debug.VerboseLogs {
@@ -207,12 +239,12 @@ func getUPnPClient(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw n
 	}
 	u, err := url.Parse(meta.Location)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	ipp, err := netip.ParseAddrPort(u.Host)
 	if err != nil {
-		return nil, fmt.Errorf("unexpected host %q in %q", u.Host, meta.Location)
+		return nil, nil, fmt.Errorf("unexpected host %q in %q", u.Host, meta.Location)
 	}
 	if ipp.Addr() != gw {
 		// https://github.com/tailscale/tailscale/issues/5502
@@ -231,30 +263,9 @@ func getUPnPClient(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw n
 	// This part does a network fetch.
 	root, err := goupnp.DeviceByURL(ctx, u)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	defer func() {
-		if client == nil {
-			return
-		}
-		logf("saw UPnP type %v at %v; %v (%v)",
-			strings.TrimPrefix(fmt.Sprintf("%T", client), "*internetgateway2."),
-			meta.Location, root.Device.FriendlyName, root.Device.Manufacturer)
-	}()
-
-	// These parts don't do a network fetch.
-	// Pick the best service type available.
-	if cc, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
-		return cc[0], nil
-	}
-	if cc, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
-		return cc[0], nil
-	}
-	if cc, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
-		return cc[0], nil
-	}
-	return nil, nil
+	return root, u, nil
 }
 
 func (c *Client) upnpHTTPClientLocked() *http.Client {
@@ -0,0 +1,228 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !js
+
+package portmapper
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/tailscale/goupnp"
+	"github.com/tailscale/goupnp/soap"
+	"tailscale.com/types/logger"
+)
+
+// urnWANIPv6FirewallControl1 is the UPnP IGDv2 service controlling the
+// router's IPv6 firewall.
+const urnWANIPv6FirewallControl1 = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+
+// upnpFirewallClient is a client of the WANIPv6FirewallControl:1 service,
+// which goupnp doesn't generate a client for. It only implements the
+// actions we need.
+type upnpFirewallClient struct {
+	goupnp.ServiceClient
+}
+
+// GetFirewallStatus reports whether the IPv6 firewall is enabled, and if
+// so, whether clients may open pinholes in it.
+func (client *upnpFirewallClient) GetFirewallStatus(ctx context.Context) (firewallEnabled, inboundPinholeAllowed bool, err error) {
+	response := &struct {
+		FirewallEnabled       string
+		InboundPinholeAllowed string
+	}{}
+	if err = client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "GetFirewallStatus", nil, response); err != nil {
+		return
+	}
+	if firewallEnabled, err = soap.UnmarshalBoolean(response.FirewallEnabled); err != nil {
+		return
+	}
+	if inboundPinholeAllowed, err = soap.UnmarshalBoolean(response.InboundPinholeAllowed); err != nil {
+		return
+	}
+	return
+}
+
+// AddPinhole opens a pinhole letting remoteHost:remotePort reach
+// internalClient:internalPort over the given IP protocol number for
+// leaseTimeSec seconds. An empty remoteHost and zero remotePort are
+// wildcards. It returns the pinhole's ID, for UpdatePinhole and
+// DeletePinhole.
+func (client *upnpFirewallClient) AddPinhole(ctx context.Context, remoteHost string, remotePort uint16, internalClient string, internalPort, protocol uint16, leaseTimeSec uint32) (uniqueID uint16, err error) {
+	request := &struct {
+		RemoteHost     string
+		RemotePort     string
+		InternalClient string
+		InternalPort   string
+		Protocol       string
+		LeaseTime      string
+	}{}
+	if request.RemoteHost, err = soap.MarshalString(remoteHost); err != nil {
+		return
+	}
+	if request.RemotePort, err = soap.MarshalUi2(remotePort); err != nil {
+		return
+	}
+	if request.InternalClient, err = soap.MarshalString(internalClient); err != nil {
+		return
+	}
+	if request.InternalPort, err = soap.MarshalUi2(internalPort); err != nil {
+		return
+	}
+	if request.Protocol, err = soap.MarshalUi2(protocol); err != nil {
+		return
+	}
+	if request.LeaseTime, err = soap.MarshalUi4(leaseTimeSec); err != nil {
+		return
+	}
+
+	response := &struct {
+		UniqueID string
+	}{}
+	if err = client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "AddPinhole", request, response); err != nil {
+		return
+	}
+	return soap.UnmarshalUi2(response.UniqueID)
+}
+
+// UpdatePinhole extends the lease of the pinhole uniqueID to
+// leaseTimeSec seconds from now.
+func (client *upnpFirewallClient) UpdatePinhole(ctx context.Context, uniqueID uint16, leaseTimeSec uint32) (err error) {
+	request := &struct {
+		UniqueID     string
+		NewLeaseTime string
+	}{}
+	if request.UniqueID, err = soap.MarshalUi2(uniqueID); err != nil {
+		return
+	}
+	if request.NewLeaseTime, err = soap.MarshalUi4(leaseTimeSec); err != nil {
+		return
+	}
+	return client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "UpdatePinhole", request, nil)
+}
+
+// DeletePinhole closes the pinhole uniqueID.
+func (client *upnpFirewallClient) DeletePinhole(ctx context.Context, uniqueID uint16) (err error) {
+	request := &struct {
+		UniqueID string
+	}{}
+	if request.UniqueID, err = soap.MarshalUi2(uniqueID); err != nil {
+		return
+	}
+	return client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "DeletePinhole", request, nil)
+}
+
+// getUPnPFirewallClient returns a client for the IPv6 firewall of the
+// Internet Gateway Device described by meta, or nil if it doesn't have one.
+func getUPnPFirewallClient(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw netip.Addr, meta uPnPDiscoResponse) (*upnpFirewallClient, error) {
+	root, u, err := getUPnPRootDevice(ctx, logf, debug, gw, meta)
+	if root == nil || err != nil {
+		return nil, err
+	}
+	cc, _ := goupnp.NewServiceClientsFromRootDevice(ctx, root, u, urnWANIPv6FirewallControl1)
+	if len(cc) == 0 {
+		return nil, nil
+	}
+	logf("saw UPnP IPv6 firewall control at %v; %v (%v)", meta.Location, root.Device.FriendlyName, root.Device.Manufacturer)
+	return &upnpFirewallClient{cc[0]}, nil
+}
+
+// upnpPinhole is an IPv6 firewall pinhole opened over UPnP. After being
+// created it is immutable, but the client field may be shared across
+// pinhole instances.
+type upnpPinhole struct {
+	id         uint16
+	internal   netip.AddrPort
+	goodUntil  time.Time
+	renewAfter time.Time
+
+	client *upnpFirewallClient
+}
+
+func (u *upnpPinhole) GoodUntil() time.Time     { return u.goodUntil }
+func (u *upnpPinhole) RenewAfter() time.Time    { return u.renewAfter }
+func (u *upnpPinhole) External() netip.AddrPort { return u.internal }
+func (u *upnpPinhole) Release(ctx context.Context) {
+	u.client.DeletePinhole(ctx, u.id)
+}
+
+// getUPnPPinhole attempts to open (or renew) an IPv6 firewall pinhole to
+// internal over UPnP, talking to the IGD at the IPv4 gateway gw. On
+// success, it stores the pinhole as c.pinhole and returns its address.
+func (c *Client) getUPnPPinhole(ctx context.Context, gw netip.Addr, internal netip.AddrPort) (external netip.AddrPort, ok bool) {
+	if disableUPnpEnv() || c.debug.DisableUPnP || (c.controlKnobs != nil && c.controlKnobs.DisableUPnP.Load()) {
+		return netip.AddrPort{}, false
+	}
+
+	c.mu.Lock()
+	old, _ := c.pinhole.(*upnpPinhole)
+	meta := c.uPnPMeta
+	httpClient := c.upnpHTTPClientLocked()
+	c.mu.Unlock()
+
+	const lease = pmpMapLifetimeSec * time.Second
+	now := time.Now()
+	var client *upnpFirewallClient
+	var id uint16
+	if old != nil && old.internal == internal {
+		client = old.client
+		err := client.UpdatePinhole(ctx, old.id, uint32(lease.Seconds()))
+		if c.debug.VerboseLogs {
+			c.logf("UpdatePinhole(%d): err=%v", old.id, err)
+		}
+		if err == nil {
+			id = old.id
+		} else {
+			// The router might've forgotten it; add a new one.
+			old = nil
+		}
+	} else {
+		ctx := goupnp.WithHTTPClient(ctx, httpClient)
+		var err error
+		client, err = getUPnPFirewallClient(ctx, c.logf, c.debug, gw, meta)
+		if c.debug.VerboseLogs {
+			c.logf("getUPnPFirewallClient: %v, %v", client != nil, err)
+		}
+		if client == nil || err != nil {
+			return netip.AddrPort{}, false
+		}
+		enabled, allowed, err := client.GetFirewallStatus(ctx)
+		if err != nil {
+			c.logf("UPnP GetFirewallStatus: %v", err)
+			return netip.AddrPort{}, false
+		}
+		if !enabled || !allowed {
+			// Either there's nothing to open, or we can't.
+			c.logf("UPnP IPv6 firewall enabled=%v, inbound pinholes allowed=%v", enabled, allowed)
+			return netip.AddrPort{}, false
+		}
+	}
+	if old == nil {
+		var err error
+		id, err = client.AddPinhole(ctx, "", 0, internal.Addr().String(), internal.Port(), pcpUDPMapping, uint32(lease.Seconds()))
+		if c.debug.VerboseLogs {
+			c.logf("AddPinhole: %v, err=%v", id, err)
+		}
+		if err != nil {
+			if code, ok := getUPnPErrorCode(err); ok {
+				getUPnPErrorsMetric(code).Add(1)
+			}
+			return netip.AddrPort{}, false
+		}
+	}
+	metricUPnPPinholeOK.Add(1)
+
+	p := &upnpPinhole{
+		id:         id,
+		internal:   internal,
+		goodUntil:  now.Add(lease),
+		renewAfter: now.Add(lease / 2),
+		client:     client,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinhole = p
+	return p.External(), true
+}
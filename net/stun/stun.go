@@ -19,6 +19,8 @@
 	attrNumFingerprint   = 0x8028
 	attrMappedAddress    = 0x0001
 	attrXorMappedAddress = 0x0020
+	attrChangeRequest    = 0x0003 // RFC 5780 Section 7.2
+	attrOtherAddress     = 0x802c // RFC 5780 Section 7.4
 	// This alternative attribute type is not
 	// mentioned in the RFC, but the shift into
 	// the "comprehension-optional" range seems
@@ -48,11 +50,30 @@ func NewTxID() TxID {
 // Request generates a binding request STUN packet.
 // The transaction ID, tID, should be a random sequence of bytes.
 func Request(tID TxID) []byte {
+	return request(tID, false, false, false)
+}
+
+// ChangeRequest generates a binding request STUN packet, like Request, that
+// asks the server to send its response from its alternate IP address and/or
+// port, with an RFC 5780 CHANGE-REQUEST attribute. It should only be sent to
+// servers that advertised their alternate address in OTHER-ADDRESS (see
+// ParseOtherAddress); others are likely to ignore the attribute and respond
+// from the address the request was sent to.
+func ChangeRequest(tID TxID, changeIP, changePort bool) []byte {
+	return request(tID, true, changeIP, changePort)
+}
+
+func request(tID TxID, change, changeIP, changePort bool) []byte {
 	// STUN header, RFC5389 Section 6.
 	const lenAttrSoftware = 4 + len(software)
-	b := make([]byte, 0, headerLen+lenAttrSoftware+lenFingerprint)
+	const lenAttrChangeRequest = 4 + 4
+	attrsLen := lenAttrSoftware + lenFingerprint
+	if change {
+		attrsLen += lenAttrChangeRequest
+	}
+	b := make([]byte, 0, headerLen+attrsLen)
 	b = append(b, bindingRequest...)
-	b = appendU16(b, uint16(lenAttrSoftware+lenFingerprint)) // number of bytes following header
+	b = appendU16(b, uint16(attrsLen)) // number of bytes following header
 	b = append(b, magicCookie...)
 	b = append(b, tID[:]...)
 
@@ -61,6 +82,20 @@ func Request(tID TxID) []byte {
 	b = appendU16(b, uint16(len(software)))
 	b = append(b, software...)
 
+	// Attribute CHANGE-REQUEST, RFC5780 Section 7.2.
+	if change {
+		var flags uint32
+		if changeIP {
+			flags |= changeIPFlag
+		}
+		if changePort {
+			flags |= changePortFlag
+		}
+		b = appendU16(b, attrChangeRequest)
+		b = appendU16(b, 4)
+		b = appendU32(b, flags)
+	}
+
 	// Attribute FINGERPRINT, RFC5389 Section 15.5.
 	fp := fingerPrint(b)
 	b = appendU16(b, attrNumFingerprint)
@@ -70,6 +105,12 @@ func Request(tID TxID) []byte {
 	return b
 }
 
+// Flags of the CHANGE-REQUEST attribute.
+const (
+	changeIPFlag   = 0x4
+	changePortFlag = 0x2
+)
+
 func fingerPrint(b []byte) uint32 { return crc32.ChecksumIEEE(b) ^ 0x5354554e }
 
 func appendU16(b []byte, v uint16) []byte {
@@ -121,6 +162,25 @@ func ParseBindingRequest(b []byte) (TxID, error) {
 	return txID, nil
 }
 
+// ParseChangeRequest reports which of its alternate IP address and port the
+// sender of binding request b asked the server to respond from, with an
+// RFC 5780 CHANGE-REQUEST attribute. b should already have been checked with
+// ParseBindingRequest.
+func ParseChangeRequest(b []byte) (changeIP, changePort bool) {
+	if !Is(b) {
+		return false, false
+	}
+	foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		if attrType == attrChangeRequest && len(a) == 4 {
+			flags := binary.BigEndian.Uint32(a)
+			changeIP = flags&changeIPFlag != 0
+			changePort = flags&changePortFlag != 0
+		}
+		return nil
+	})
+	return changeIP, changePort
+}
+
 var (
 	ErrNotSTUN            = errors.New("response is not a STUN packet")
 	ErrNotSuccessResponse = errors.New("STUN packet is not a response")
@@ -153,17 +213,29 @@ func foreachAttr(b []byte, fn func(attrType uint16, a []byte) error) error {
 
 // Response generates a binding response.
 func Response(txID TxID, addrPort netip.AddrPort) []byte {
+	return ResponseWithOtherAddress(txID, addrPort, netip.AddrPort{})
+}
+
+// ResponseWithOtherAddress generates a binding response, like Response,
+// that also advertises the server's alternate address in an RFC 5780
+// OTHER-ADDRESS attribute, if other is valid. Clients may then send
+// requests made with ChangeRequest.
+//
+// other's IP may be unspecified (0.0.0.0 or ::) if the server has no
+// alternate IP address, or doesn't know its own, in which case only its
+// port differs.
+func ResponseWithOtherAddress(txID TxID, addrPort, other netip.AddrPort) []byte {
 	addr := addrPort.Addr()
 
-	var fam byte
-	if addr.Is4() {
-		fam = 1
-	} else if addr.Is6() {
-		fam = 2
-	} else {
+	fam := familyOf(addr)
+	if fam == 0 {
 		return nil
 	}
 	attrsLen := 8 + addr.BitLen()/8
+	otherFam := familyOf(other.Addr())
+	if otherFam != 0 {
+		attrsLen += 8 + other.Addr().BitLen()/8
+	}
 	b := make([]byte, 0, headerLen+attrsLen)
 
 	// Header
@@ -187,9 +259,62 @@ func Response(txID TxID, addrPort netip.AddrPort) []byte {
 			b = append(b, o^txID[i-len(magicCookie)])
 		}
 	}
+
+	// OTHER-ADDRESS, RFC5780 Section 7.4, which has the format of
+	// MAPPED-ADDRESS.
+	if otherFam != 0 {
+		b = appendU16(b, attrOtherAddress)
+		b = appendU16(b, uint16(4+other.Addr().BitLen()/8))
+		b = append(b,
+			0, // unused byte
+			otherFam)
+		b = appendU16(b, other.Port())
+		b = append(b, other.Addr().AsSlice()...)
+	}
 	return b
 }
 
+// familyOf returns the STUN address family of addr, or 0 if it's invalid.
+func familyOf(addr netip.Addr) byte {
+	switch {
+	case addr.Is4():
+		return 0x01
+	case addr.Is6():
+		return 0x02
+	}
+	return 0
+}
+
+// ParseOtherAddress returns the alternate address of the server that sent
+// binding response b, from its RFC 5780 OTHER-ADDRESS attribute, or the zero
+// value if it has none. Its IP may be unspecified, meaning the server's
+// alternate address differs only in its port.
+func ParseOtherAddress(b []byte) netip.AddrPort {
+	if !Is(b) {
+		return netip.AddrPort{}
+	}
+	attrsLen := int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[headerLen:]
+	if attrsLen < len(b) {
+		b = b[:attrsLen]
+	}
+	var other netip.AddrPort
+	foreachAttr(b, func(attrType uint16, attr []byte) error {
+		if attrType != attrOtherAddress {
+			return nil
+		}
+		ipSlice, port, err := mappedAddress(attr)
+		if err != nil {
+			return nil
+		}
+		if ip, ok := netip.AddrFromSlice(ipSlice); ok {
+			other = netip.AddrPortFrom(ip.Unmap(), port)
+		}
+		return nil
+	})
+	return other
+}
+
 // ParseResponse parses a successful binding response STUN packet.
 // The IP address is extracted from the XOR-MAPPED-ADDRESS attribute.
 func ParseResponse(b []byte) (tID TxID, addr netip.AddrPort, err error) {
@@ -283,3 +283,53 @@ func TestResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestChangeRequest(t *testing.T) {
+	for _, tt := range []struct{ changeIP, changePort bool }{
+		{false, false},
+		{false, true},
+		{true, false},
+		{true, true},
+	} {
+		tx := stun.NewTxID()
+		req := stun.ChangeRequest(tx, tt.changeIP, tt.changePort)
+		gotTx, err := stun.ParseBindingRequest(req)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt, err)
+		}
+		if gotTx != tx {
+			t.Errorf("%+v: txID = %x; want %x", tt, gotTx, tx)
+		}
+		if ip, port := stun.ParseChangeRequest(req); ip != tt.changeIP || port != tt.changePort {
+			t.Errorf("%+v: ParseChangeRequest = %v, %v", tt, ip, port)
+		}
+	}
+	if ip, port := stun.ParseChangeRequest(stun.Request(stun.NewTxID())); ip || port {
+		t.Errorf("ParseChangeRequest of plain request = %v, %v; want false, false", ip, port)
+	}
+}
+
+func TestResponseWithOtherAddress(t *testing.T) {
+	tx := stun.NewTxID()
+	mapped := netip.MustParseAddrPort("1.2.3.4:5678")
+	for _, other := range []netip.AddrPort{
+		netip.MustParseAddrPort("5.6.7.8:3479"),
+		netip.MustParseAddrPort("0.0.0.0:3479"),
+		netip.MustParseAddrPort("[2001:db8::1]:3479"),
+	} {
+		res := stun.ResponseWithOtherAddress(tx, mapped, other)
+		gotTx, gotMapped, err := stun.ParseResponse(res)
+		if err != nil {
+			t.Fatalf("%v: %v", other, err)
+		}
+		if gotTx != tx || gotMapped != mapped {
+			t.Errorf("%v: ParseResponse = %x, %v; want %x, %v", other, gotTx, gotMapped, tx, mapped)
+		}
+		if got := stun.ParseOtherAddress(res); got != other {
+			t.Errorf("ParseOtherAddress = %v; want %v", got, other)
+		}
+	}
+	if got := stun.ParseOtherAddress(stun.Response(tx, mapped)); got.IsValid() {
+		t.Errorf("ParseOtherAddress of plain response = %v; want none", got)
+	}
+}
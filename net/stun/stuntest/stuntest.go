@@ -45,14 +45,91 @@ func ServeWithPacketListener(t testing.TB, ln nettype.PacketListener) (addr *net
 		addr.IP = net.ParseIP("127.0.0.1")
 	}
 	doneCh := make(chan struct{})
-	go runSTUN(t, pc.(nettype.PacketConn), &stats, doneCh)
+	go runSTUN(t, pc.(nettype.PacketConn), &stats, doneCh, nil)
 	return addr, func() {
 		pc.Close()
 		<-doneCh
 	}
 }
 
-func runSTUN(t testing.TB, pc nettype.PacketConn, stats *stunStats, done chan<- struct{}) {
+// alternates are the sockets of a STUN server that supports RFC 5780 NAT
+// behavior discovery.
+type alternates struct {
+	// pcs are the server's sockets, by whether they're on its alternate
+	// IP address and whether they're on its alternate port. pcs[0][0] is
+	// its primary address. Missing ones are nil.
+	pcs [2][2]nettype.PacketConn
+
+	// other is the server's alternate address, for OTHER-ADDRESS.
+	other netip.AddrPort
+}
+
+// ServeWithAlternate is like ServeWithPacketListener, but it also serves
+// STUN on a second port, from which it answers RFC 5780 requests to change
+// port, and which it advertises with OTHER-ADDRESS. ip is the address of ln.
+//
+// If altLn is non-nil, the server also listens on that second port with
+// altLn, whose address is altIP, and answers requests to change both IP
+// address and port from there. With natlab, altLn can be a second Machine.
+func ServeWithAlternate(t testing.TB, ln nettype.PacketListener, ip netip.Addr, altLn nettype.PacketListener, altIP netip.Addr) (addr *net.UDPAddr, cleanupFn func()) {
+	t.Helper()
+
+	var stats stunStats
+	var alt alternates
+	listen := func(ln nettype.PacketListener, port uint16) nettype.PacketConn {
+		pc, err := ln.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(int(port)))
+		if err != nil {
+			t.Fatalf("failed to open STUN listener: %v", err)
+		}
+		return pc.(nettype.PacketConn)
+	}
+	port := func(pc nettype.PacketConn) uint16 {
+		return uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	}
+	alt.pcs[0][0] = listen(ln, 0)
+	alt.pcs[0][1] = listen(ln, 0)
+	alt.other = netip.AddrPortFrom(netip.IPv4Unspecified(), port(alt.pcs[0][1]))
+	if altLn != nil {
+		alt.pcs[1][1] = listen(altLn, port(alt.pcs[0][1]))
+		alt.other = netip.AddrPortFrom(altIP, alt.other.Port())
+	}
+
+	var dones []chan struct{}
+	for i := range alt.pcs {
+		for j, pc := range alt.pcs[i] {
+			if pc == nil {
+				continue
+			}
+			done := make(chan struct{})
+			dones = append(dones, done)
+			go runSTUN(t, pc, &stats, done, &alternates{
+				pcs: [2][2]nettype.PacketConn{
+					{alt.pcs[i][j], alt.pcs[i][1-j]},
+					{alt.pcs[1-i][j], alt.pcs[1-i][1-j]},
+				},
+				other: alt.other,
+			})
+		}
+	}
+	addr = &net.UDPAddr{IP: ip.AsSlice(), Port: int(port(alt.pcs[0][0]))}
+	return addr, func() {
+		for i := range alt.pcs {
+			for _, pc := range alt.pcs[i] {
+				if pc != nil {
+					pc.Close()
+				}
+			}
+		}
+		for _, done := range dones {
+			<-done
+		}
+	}
+}
+
+// runSTUN serves STUN on pc until it's closed. If alt is non-nil, pc is one
+// of the sockets of a server that supports RFC 5780, and alt holds the
+// others, relative to pc.
+func runSTUN(t testing.TB, pc nettype.PacketConn, stats *stunStats, done chan<- struct{}, alt *alternates) {
 	defer close(done)
 
 	var buf [64 << 10]byte
@@ -84,12 +161,28 @@ func runSTUN(t testing.TB, pc nettype.PacketConn, stats *stunStats, done chan<-
 		stats.mu.Unlock()
 
 		res := stun.Response(txid, src)
-		if _, err := pc.WriteToUDPAddrPort(res, src); err != nil {
+		from := pc
+		if alt != nil {
+			res = stun.ResponseWithOtherAddress(txid, src, alt.other)
+			changeIP, changePort := stun.ParseChangeRequest(pkt)
+			from = alt.pcs[b2i(changeIP)][b2i(changePort)]
+			if from == nil {
+				continue
+			}
+		}
+		if _, err := from.WriteToUDPAddrPort(res, src); err != nil {
 			t.Logf("STUN server write failed: %v", err)
 		}
 	}
 }
 
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func DERPMapOf(stun ...string) *tailcfg.DERPMap {
 	m := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{},
@@ -161,6 +161,13 @@ type DERPNode struct {
 	// If zero, 443 is used.
 	DERPPort int `json:",omitempty"`
 
+	// QUICPort optionally provides a UDP port on which the node
+	// serves DERP over QUIC. Clients that support it try QUIC
+	// first and fall back to DERPPort over TCP if UDP is blocked.
+	//
+	// If zero, the node doesn't support QUIC.
+	QUICPort int `json:",omitempty"`
+
 	// InsecureForTests is used by unit tests to disable TLS verification.
 	// It should not be set by users.
 	InsecureForTests bool `json:",omitempty"`
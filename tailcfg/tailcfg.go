@@ -3,7 +3,7 @@
 
 package tailcfg
 
-//go:generate go run tailscale.com/cmd/viewer --type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile --clonefunc
+//go:generate go run tailscale.com/cmd/viewer --type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,DNSPolicyRule,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile --clonefunc
 
 import (
 	"bytes"
@@ -119,7 +119,12 @@
 //   - 76: 2023-09-20: Client understands ExitNodeDNSResolvers for IsWireGuardOnly nodes
 //   - 77: 2023-10-03: Client understands Peers[].SelfNodeV6MasqAddrForThisPeer
 //   - 78: 2023-10-05: can handle c2n Wake-on-LAN sending
-const CurrentCapabilityVersion CapabilityVersion = 78
+//   - 79: 2026-10-17: Client can dial DERPNode.QUICPort (DERP over QUIC)
+//   - 80: 2026-10-17: Client applies DNSConfig.Policy in its MagicDNS resolver
+//   - 81: 2026-10-17: Client understands NodeAttrServeDoH
+//   - 82: 2026-10-17: Client understands NodeAttrMagicsockMultipath
+//   - 83: 2026-10-17: Client can relay UDP for, and through, NodeAttrPeerRelay nodes
+const CurrentCapabilityVersion CapabilityVersion = 83
 
 type StableID string
 
@@ -1547,6 +1552,57 @@ type DNSConfig struct {
 	// It contains a user inputed URL that should have a list of domains to be blocked.
 	// See https://github.com/tailscale/corp/issues/13969.
 	TempCorpIssue13969 string `json:",omitempty"`
+
+	// Policy are rules for the MagicDNS resolver to block, rewrite or
+	// answer queries itself, for the names and peers they apply to.
+	// Clients only apply them to queries that go through MagicDNS.
+	Policy []*DNSPolicyRule `json:",omitempty"`
+}
+
+// DNSPolicyAction is what the MagicDNS resolver does with a query matching
+// a DNSPolicyRule.
+type DNSPolicyAction string
+
+const (
+	// DNSPolicyBlock answers NXDOMAIN.
+	DNSPolicyBlock DNSPolicyAction = "block"
+	// DNSPolicyNull answers 0.0.0.0 to A queries, :: to AAAA queries,
+	// and no records to other queries.
+	DNSPolicyNull DNSPolicyAction = "null"
+	// DNSPolicyRewrite answers a CNAME record to the rule's Target,
+	// along with the records of Target.
+	DNSPolicyRewrite DNSPolicyAction = "rewrite"
+	// DNSPolicyAnswer answers the rule's Addrs of the queried family,
+	// and no records to queries of types other than A and AAAA.
+	DNSPolicyAnswer DNSPolicyAction = "answer"
+	// DNSPolicyPass resolves the query as if no rule matched. It's
+	// for exceptions to rules with shorter suffixes.
+	DNSPolicyPass DNSPolicyAction = "pass"
+)
+
+// DNSPolicyRule is a rule of the MagicDNS resolver's policy.
+type DNSPolicyRule struct {
+	// Suffix is the DNS name suffix the rule applies to, such as
+	// "ads.example.com", which matches that name and its subdomains.
+	// "." matches all names. When several rules match a query, the one
+	// with the longest Suffix applies; among those, the first listed.
+	Suffix string
+
+	// Sources, if non-empty, restricts the rule to queries from the
+	// listed peers, each one of: an IP address or CIDR prefix, a tag
+	// ("tag:server"), or a user's login name. Queries from other peers
+	// skip the rule.
+	Sources []string `json:",omitempty"`
+
+	// Action is what to do with matching queries.
+	Action DNSPolicyAction
+
+	// Target is the name that queries are rewritten to, for
+	// DNSPolicyRewrite.
+	Target string `json:",omitempty"`
+
+	// Addrs are the addresses to answer, for DNSPolicyAnswer.
+	Addrs []netip.Addr `json:",omitempty"`
 }
 
 // DNSRecord is an extra DNS record to add to MagicDNS.
@@ -2134,6 +2190,23 @@ type Oauth2Token struct {
 	// NodeAttrDNSForwarderDisableTCPRetries disables retrying truncated
 	// DNS queries over TCP if the response is truncated.
 	NodeAttrDNSForwarderDisableTCPRetries NodeCapability = "dns-forwarder-disable-tcp-retries"
+
+	// NodeAttrServeDoH makes the client answer DNS-over-HTTPS (RFC 8484)
+	// queries from its peers with its MagicDNS resolver, at
+	// https://<its cert domain>/dns-query on its Tailscale IPs. It
+	// requires HTTPS certificates to be enabled for the tailnet.
+	NodeAttrServeDoH NodeCapability = "serve-dns-over-https"
+
+	// NodeAttrMagicsockMultipath makes the client keep several validated
+	// UDP paths to each active peer warm and fail over between them,
+	// rather than relying on a single best path.
+	NodeAttrMagicsockMultipath NodeCapability = "magicsock-multipath"
+
+	// NodeAttrPeerRelay, on a node, makes it relay disco and WireGuard UDP
+	// packets between its peers that can't reach each other directly. Its
+	// peers see it in their netmaps and use it as a path ranked between
+	// direct UDP and DERP.
+	NodeAttrPeerRelay NodeCapability = "peer-relay"
 )
 
 // SetDNSRequest is a request to add a DNS record.
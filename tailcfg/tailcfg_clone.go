@@ -262,6 +262,12 @@ func (src *DNSConfig) Clone() *DNSConfig {
 	dst.CertDomains = append(src.CertDomains[:0:0], src.CertDomains...)
 	dst.ExtraRecords = append(src.ExtraRecords[:0:0], src.ExtraRecords...)
 	dst.ExitNodeFilteredSet = append(src.ExitNodeFilteredSet[:0:0], src.ExitNodeFilteredSet...)
+	if src.Policy != nil {
+		dst.Policy = make([]*DNSPolicyRule, len(src.Policy))
+		for i := range dst.Policy {
+			dst.Policy[i] = src.Policy[i].Clone()
+		}
+	}
 	return dst
 }
 
@@ -277,6 +283,29 @@ func (src *DNSConfig) Clone() *DNSConfig {
 	ExtraRecords        []DNSRecord
 	ExitNodeFilteredSet []string
 	TempCorpIssue13969  string
+	Policy              []*DNSPolicyRule
+}{})
+
+// Clone makes a deep copy of DNSPolicyRule.
+// The result aliases no memory with the original.
+func (src *DNSPolicyRule) Clone() *DNSPolicyRule {
+	if src == nil {
+		return nil
+	}
+	dst := new(DNSPolicyRule)
+	*dst = *src
+	dst.Sources = append(src.Sources[:0:0], src.Sources...)
+	dst.Addrs = append(src.Addrs[:0:0], src.Addrs...)
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _DNSPolicyRuleCloneNeedsRegeneration = DNSPolicyRule(struct {
+	Suffix  string
+	Sources []string
+	Action  DNSPolicyAction
+	Target  string
+	Addrs   []netip.Addr
 }{})
 
 // Clone makes a deep copy of RegisterResponse.
@@ -455,6 +484,7 @@ func (src *DERPNode) Clone() *DERPNode {
 	STUNPort         int
 	STUNOnly         bool
 	DERPPort         int
+	QUICPort         int
 	InsecureForTests bool
 	STUNTestIP       string
 	CanPort80        bool
@@ -601,7 +631,7 @@ func (src *UserProfile) Clone() *UserProfile {
 
 // Clone duplicates src into dst and reports whether it succeeded.
 // To succeed, <src, dst> must be of types <*T, *T> or <*T, **T>,
-// where T is one of User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile.
+// where T is one of User,Node,Hostinfo,NetInfo,Login,DNSConfig,DNSPolicyRule,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile.
 func Clone(dst, src any) bool {
 	switch src := src.(type) {
 	case *User:
@@ -658,6 +688,15 @@ func Clone(dst, src any) bool {
 			*dst = src.Clone()
 			return true
 		}
+	case *DNSPolicyRule:
+		switch dst := dst.(type) {
+		case *DNSPolicyRule:
+			*dst = *src.Clone()
+			return true
+		case **DNSPolicyRule:
+			*dst = src.Clone()
+			return true
+		}
 	case *RegisterResponse:
 		switch dst := dst.(type) {
 		case *RegisterResponse:
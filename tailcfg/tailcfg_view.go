@@ -19,7 +19,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=true -type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=true -type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,DNSPolicyRule,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile
 
 // View returns a readonly view of User.
 func (p *User) View() UserView {
@@ -573,6 +573,9 @@ func (v DNSConfigView) ExitNodeFilteredSet() views.Slice[string] {
 	return views.SliceOf(v.ж.ExitNodeFilteredSet)
 }
 func (v DNSConfigView) TempCorpIssue13969() string { return v.ж.TempCorpIssue13969 }
+func (v DNSConfigView) Policy() views.SliceView[*DNSPolicyRule, DNSPolicyRuleView] {
+	return views.SliceOfViews[*DNSPolicyRule, DNSPolicyRuleView](v.ж.Policy)
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _DNSConfigViewNeedsRegeneration = DNSConfig(struct {
@@ -586,6 +589,67 @@ func (v DNSConfigView) TempCorpIssue13969() string { return v.ж.TempCorpIssue13
 	ExtraRecords        []DNSRecord
 	ExitNodeFilteredSet []string
 	TempCorpIssue13969  string
+	Policy              []*DNSPolicyRule
+}{})
+
+// View returns a readonly view of DNSPolicyRule.
+func (p *DNSPolicyRule) View() DNSPolicyRuleView {
+	return DNSPolicyRuleView{ж: p}
+}
+
+// DNSPolicyRuleView provides a read-only view over DNSPolicyRule.
+//
+// Its methods should only be called if `Valid()` returns true.
+type DNSPolicyRuleView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *DNSPolicyRule
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v DNSPolicyRuleView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v DNSPolicyRuleView) AsStruct() *DNSPolicyRule {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v DNSPolicyRuleView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *DNSPolicyRuleView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x DNSPolicyRule
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v DNSPolicyRuleView) Suffix() string                 { return v.ж.Suffix }
+func (v DNSPolicyRuleView) Sources() views.Slice[string]   { return views.SliceOf(v.ж.Sources) }
+func (v DNSPolicyRuleView) Action() DNSPolicyAction        { return v.ж.Action }
+func (v DNSPolicyRuleView) Target() string                 { return v.ж.Target }
+func (v DNSPolicyRuleView) Addrs() views.Slice[netip.Addr] { return views.SliceOf(v.ж.Addrs) }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _DNSPolicyRuleViewNeedsRegeneration = DNSPolicyRule(struct {
+	Suffix  string
+	Sources []string
+	Action  DNSPolicyAction
+	Target  string
+	Addrs   []netip.Addr
 }{})
 
 // View returns a readonly view of RegisterResponse.
@@ -1045,6 +1109,7 @@ func (v DERPNodeView) IPv6() string           { return v.ж.IPv6 }
 func (v DERPNodeView) STUNPort() int          { return v.ж.STUNPort }
 func (v DERPNodeView) STUNOnly() bool         { return v.ж.STUNOnly }
 func (v DERPNodeView) DERPPort() int          { return v.ж.DERPPort }
+func (v DERPNodeView) QUICPort() int          { return v.ж.QUICPort }
 func (v DERPNodeView) InsecureForTests() bool { return v.ж.InsecureForTests }
 func (v DERPNodeView) STUNTestIP() string     { return v.ж.STUNTestIP }
 func (v DERPNodeView) CanPort80() bool        { return v.ж.CanPort80 }
@@ -1060,6 +1125,7 @@ func (v DERPNodeView) CanPort80() bool        { return v.ж.CanPort80 }
 	STUNPort         int
 	STUNOnly         bool
 	DERPPort         int
+	QUICPort         int
 	InsecureForTests bool
 	STUNTestIP       string
 	CanPort80        bool
@@ -113,6 +113,13 @@ type Server struct {
 	// field at zero unless you know what you are doing.
 	Port uint16
 
+	// ServeDoH, if true, makes the server answer DNS-over-HTTPS (RFC
+	// 8484) queries from its peers at https://<its cert domain>/dns-query
+	// on its Tailscale IPs, with its MagicDNS resolver. It requires
+	// HTTPS certificates to be enabled for the tailnet, and takes over
+	// port 443, so listeners on it get no connections.
+	ServeDoH bool
+
 	getCertForTesting func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 
 	initOnce         sync.Once
@@ -564,6 +571,7 @@ func (s *Server) start() (reterr error) {
 	}
 	lb.SetTCPHandlerForFunnelFlow(s.getTCPHandlerForFunnelFlow)
 	lb.SetVarRoot(s.rootPath)
+	lb.SetServeDoH(s.ServeDoH)
 	logf("tsnet starting with hostname %q, varRoot %q", s.hostname, s.rootPath)
 	s.lb = lb
 	if err := ns.Start(lb); err != nil {
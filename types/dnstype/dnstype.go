@@ -21,7 +21,10 @@ type Resolver struct {
 	//    as of 2022-09-08 only used for certain well-known resolvers
 	//    (see the publicdns package) for which the IP addresses to dial DoH are
 	//    known ahead of time, so bootstrap DNS resolution is not required.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+	//  - "tls://resolver.com" or "tls://resolver.com:port" for DNS over
+	//    TCP+TLS (RFC 7858). The host may also be an IP address, and the
+	//    port defaults to 853. The server's certificate is verified
+	//    against the host. A hostname requires BootstrapResolution.
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -31,7 +34,9 @@ type Resolver struct {
 	// look up the DoT/DoH server using their local "classic" DNS
 	// resolver.
 	//
-	// As of 2022-09-08, BootstrapResolution is not yet used.
+	// As of 2026-10-17, BootstrapResolution is only used for DoT, and
+	// clients ignore DoT resolvers with a hostname and no
+	// BootstrapResolution rather than looking them up.
 	BootstrapResolution []netip.Addr `json:",omitempty"`
 }
 
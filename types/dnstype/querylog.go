@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dnstype
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Ways a query in the MagicDNS query log was answered, for
+// QueryLogEntry.Resolution.
+const (
+	ResolutionLocal   = "local"   // from MagicDNS names or local domains
+	ResolutionCache   = "cache"   // from the response cache
+	ResolutionForward = "forward" // by an upstream resolver
+	ResolutionPolicy  = "policy"  // by a DNS policy rule
+)
+
+// QueryLogEntry is a record of a DNS query answered by the MagicDNS
+// resolver, as kept in its query log.
+type QueryLogEntry struct {
+	// Time is when the query arrived.
+	Time time.Time
+
+	// Source is the address the query came from.
+	Source netip.AddrPort
+
+	// Name is the name queried, with a trailing dot.
+	Name string
+
+	// Type is the record type queried, such as "A" or "AAAA".
+	Type string
+
+	// RCode is the response code, such as "NOERROR" or "NXDOMAIN". It's
+	// empty if there was no response.
+	RCode string `json:",omitempty"`
+
+	// Resolution is how the query was answered, one of the Resolution
+	// constants.
+	Resolution string
+
+	// Upstream is the address of the upstream resolver that answered
+	// the query, if it was forwarded.
+	Upstream string `json:",omitempty"`
+
+	// Latency is how long the query took to answer.
+	Latency time.Duration
+
+	// Err is the error resolving the query, if any.
+	Err string `json:",omitempty"`
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netmon"
+)
+
+// While the network is behind a captive portal, we re-run netcheck every
+// captivePortalReprobeMin, backing off to captivePortalReprobeMax, so we
+// notice soon after the user logs in to it. Any network change reported by
+// netmon (as often follows logging in) re-probes at once and resets the
+// backoff. netcheck makes every report a full one, including the captive
+// portal check, while the last one found a portal blocking UDP.
+const (
+	captivePortalReprobeMin = 3 * time.Second
+	captivePortalReprobeMax = time.Minute
+)
+
+// updateCaptivePortal updates the captive portal health state from the
+// netcheck report r, and starts or stops re-probing for the portal to be
+// cleared.
+func (c *Conn) updateCaptivePortal(r *netcheck.Report) {
+	var detected bool
+	switch {
+	case r.CaptivePortal.EqualBool(true):
+		detected = true
+	case r.CaptivePortal.EqualBool(false), r.UDP:
+		// Either there's no portal, or it's no longer blocking UDP
+		// (which netcheck only checks for portals without).
+	default:
+		// Not checked, and nothing to say it's gone.
+		return
+	}
+
+	health.SetCaptivePortal(detected, r.CaptivePortalURL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	switch {
+	case detected && c.captivePortalTimer == nil:
+		c.logf("magicsock: network is behind a captive portal (login URL %q); re-probing", r.CaptivePortalURL)
+		metricCaptivePortalDetected.Add(1)
+		c.captivePortalReprobe = captivePortalReprobeMin
+		c.captivePortalTimer = time.AfterFunc(c.captivePortalReprobe, c.reprobeCaptivePortal)
+	case !detected && c.captivePortalTimer != nil:
+		c.logf("magicsock: captive portal cleared")
+		c.stopCaptivePortalTimerLocked()
+	}
+}
+
+// reprobeCaptivePortal is called by captivePortalTimer to re-run netcheck,
+// and schedules the next run.
+func (c *Conn) reprobeCaptivePortal() {
+	c.mu.Lock()
+	if c.closed || c.captivePortalTimer == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.captivePortalReprobe = min(c.captivePortalReprobe*2, captivePortalReprobeMax)
+	c.captivePortalTimer.Reset(c.captivePortalReprobe)
+	c.mu.Unlock()
+
+	c.ReSTUN("captive-portal")
+}
+
+// onNetMonChange is the netmon callback. Behind a captive portal, it
+// re-probes right away in case the change means the portal was cleared.
+func (c *Conn) onNetMonChange(*netmon.ChangeDelta) {
+	c.mu.Lock()
+	if c.closed || c.captivePortalTimer == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.captivePortalReprobe = captivePortalReprobeMin
+	c.captivePortalTimer.Reset(c.captivePortalReprobe)
+	c.mu.Unlock()
+
+	c.ReSTUN("captive-portal-link-change")
+}
+
+func (c *Conn) stopCaptivePortalTimerLocked() {
+	if t := c.captivePortalTimer; t != nil {
+		t.Stop()
+		c.captivePortalTimer = nil
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"testing"
+
+	"tailscale.com/health"
+	"tailscale.com/net/netcheck"
+)
+
+func TestUpdateCaptivePortal(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	defer health.SetCaptivePortal(false, "")
+
+	check := func(wantURL string, wantTimer bool) {
+		t.Helper()
+		var gotURL string
+		if e := health.CaptivePortal(); e != nil {
+			gotURL = e.URL
+		}
+		if gotURL != wantURL {
+			t.Errorf("health captive portal URL = %q; want %q", gotURL, wantURL)
+		}
+		c.mu.Lock()
+		gotTimer := c.captivePortalTimer != nil
+		c.mu.Unlock()
+		if gotTimer != wantTimer {
+			t.Errorf("re-probing = %v; want %v", gotTimer, wantTimer)
+		}
+	}
+
+	const portal = "http://login.example.com/"
+	c.updateCaptivePortal(&netcheck.Report{CaptivePortal: "true", CaptivePortalURL: portal})
+	check(portal, true)
+
+	// A report that didn't check for a portal changes nothing.
+	c.updateCaptivePortal(&netcheck.Report{})
+	check(portal, true)
+
+	// Once UDP works, the portal is gone.
+	c.updateCaptivePortal(&netcheck.Report{UDP: true})
+	check("", false)
+
+	c.updateCaptivePortal(&netcheck.Report{CaptivePortal: "true", CaptivePortalURL: portal})
+	check(portal, true)
+	c.updateCaptivePortal(&netcheck.Report{CaptivePortal: "false"})
+	check("", false)
+
+	// Close stops re-probing.
+	c.updateCaptivePortal(&netcheck.Report{CaptivePortal: "true", CaptivePortalURL: portal})
+	c.mu.Lock()
+	c.closed = true
+	c.stopCaptivePortalTimerLocked()
+	c.mu.Unlock()
+	if c.captivePortalTimer != nil {
+		t.Error("timer still set after stop")
+	}
+}
@@ -56,6 +56,13 @@
 	debugEnablePMTUD = envknob.RegisterOptBool("TS_DEBUG_ENABLE_PMTUD")
 	// debugPMTUD prints extra debugging about peer MTU path discovery.
 	debugPMTUD = envknob.RegisterBool("TS_DEBUG_PMTUD")
+	// debugEnableMultipath keeps several validated UDP paths to each peer
+	// warm and fails over between them, as NodeAttrMagicsockMultipath does.
+	debugEnableMultipath = envknob.RegisterBool("TS_DEBUG_MAGICSOCK_MULTIPATH")
+	// debugPathPrefs pins the preferred interface or address family of the
+	// UDP paths to some or all peers, overriding Options.PathPrefs. See
+	// parsePathPrefs for the format.
+	debugPathPrefs = envknob.RegisterString("TS_DEBUG_MAGICSOCK_PATH_PREFS")
 	// Hey you! Adding a new debugknob? Make sure to stub it out in the
 	// debugknobs_stubs.go file too.
 )
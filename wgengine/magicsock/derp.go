@@ -23,6 +23,7 @@
 	"tailscale.com/health"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
@@ -135,6 +136,86 @@ func (c *Conn) derpRegionCodeLocked(regionID int) string {
 	return ""
 }
 
+// derpDrainAvoidTime is how long, after its announced close, a DERP region
+// that said it's draining is avoided as our home.
+const derpDrainAvoidTime = 30 * time.Minute
+
+// noteDERPDraining records that regionID announced that it's draining and
+// will close our connection in closeIn. If it's our home, we move home to
+// the best other region now rather than when the connection drops, at the
+// time of the server's choosing, to spread out the reconnects.
+//
+// c.mu must NOT be held.
+func (c *Conn) noteDERPDraining(regionID int, closeIn time.Duration) {
+	c.mu.Lock()
+	mak.Set(&c.derpDraining, regionID, time.Now().Add(closeIn+derpDrainAvoidTime))
+	isHome := regionID == c.myDerp
+	c.mu.Unlock()
+	c.logf("magicsock: derp-%d is draining; closing in %v", regionID, closeIn.Round(time.Second))
+	if !isHome {
+		return
+	}
+
+	alt := c.preferNonDrainingDERP(c.lastNetCheckReport.Load(), regionID)
+	if alt == regionID {
+		c.logf("magicsock: no other DERP region to move home to")
+		return
+	}
+	c.logf("magicsock: moving derp home from draining derp-%d to derp-%d", regionID, alt)
+	if !c.setNearestDERP(alt) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.netInfoLast != nil {
+		ni2 := c.netInfoLast.Clone()
+		ni2.PreferredDERP = alt
+		c.callNetInfoCallbackLocked(ni2)
+	}
+}
+
+// preferNonDrainingDERP returns preferred if that DERP region hasn't
+// announced that it's draining. Otherwise it returns the lowest latency
+// region in report (which may be nil) that isn't draining, or any such
+// region, or preferred if all are draining.
+//
+// c.mu must NOT be held.
+func (c *Conn) preferNonDrainingDERP(report *netcheck.Report, preferred int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	draining := func(regionID int) bool {
+		until, ok := c.derpDraining[regionID]
+		return ok && now.Before(until)
+	}
+	if !draining(preferred) || c.derpMap == nil {
+		return preferred
+	}
+	best, bestLatency := 0, time.Duration(0)
+	if report != nil {
+		for regionID, d := range report.RegionLatency {
+			if draining(regionID) || c.derpMap.Regions[regionID] == nil {
+				continue
+			}
+			if best == 0 || d < bestLatency {
+				best, bestLatency = regionID, d
+			}
+		}
+	}
+	if best == 0 {
+		for _, regionID := range c.derpMap.RegionIDs() {
+			if !draining(regionID) {
+				best = regionID
+				break
+			}
+		}
+	}
+	if best == 0 {
+		return preferred
+	}
+	return best
+}
+
 // c.mu must NOT be held.
 func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 	c.mu.Lock()
@@ -548,6 +629,9 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 			continue
 		case derp.HealthMessage:
 			health.SetDERPRegionHealth(regionID, m.Problem)
+		case derp.ServerDrainingMessage:
+			go c.noteDERPDraining(regionID, m.CloseIn)
+			continue
 		case derp.PeerGoneMessage:
 			switch m.Reason {
 			case derp.PeerGoneReasonDisconnected:
@@ -69,6 +69,9 @@ type endpoint struct {
 
 	disco atomic.Pointer[endpointDisco] // if the peer supports disco, the key and short string
 
+	isPeerRelay        atomic.Bool // whether the peer relays UDP for its peers; see relay.go
+	supportsPeerRelays atomic.Bool // whether the peer can be reached through peer relays
+
 	// mu protects all following fields.
 	mu sync.Mutex // Lock ordering: Conn.mu, then endpoint.mu
 
@@ -89,6 +92,12 @@ type endpoint struct {
 	// See #540 for background.
 	heartbeatDisabled bool
 
+	// multipath is whether to keep several validated paths warm and fail
+	// over between them; see multipath.go. pathPref is the operator's
+	// preferred path to this peer, if any, which also implies multipath.
+	multipath bool
+	pathPref  pathPreference
+
 	expired         bool // whether the node has expired
 	isWireguardOnly bool // whether the endpoint is WireGuard only
 }
@@ -137,6 +146,8 @@ type endpointState struct {
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
+	wireMTU tstun.WireMTU // largest path MTU confirmed by a pong, if any
+
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
 }
 
@@ -427,11 +438,20 @@ func (de *endpoint) heartbeat() {
 	}
 
 	now := mono.Now()
+	de.failOverExpiredPathLocked(now)
 	udpAddr, _, _ := de.addrForSendLocked(now)
 	if udpAddr.IsValid() {
 		// We have a preferred path. Ping that every 2 seconds.
 		de.startDiscoPingLocked(udpAddr, now, pingHeartbeat, 0, nil)
 	}
+	if de.multipathLocked() {
+		// And keep the paths we'd fail over to warm.
+		for _, ep := range de.warmPathsLocked(now) {
+			if ep != udpAddr {
+				de.startDiscoPingLocked(ep, now, pingHeartbeat, 0, nil)
+			}
+		}
+	}
 
 	if de.wantFullPingLocked(now) {
 		de.sendDiscoPingsLocked(now, true)
@@ -538,6 +558,7 @@ func (de *endpoint) send(buffs [][]byte) error {
 	}
 
 	now := mono.Now()
+	de.failOverExpiredPathLocked(now)
 	udpAddr, derpAddr, startWGPing := de.addrForSendLocked(now)
 
 	if de.isWireguardOnly {
@@ -554,7 +575,16 @@ func (de *endpoint) send(buffs [][]byte) error {
 		return errNoUDPOrDERP
 	}
 	var err error
-	if udpAddr.IsValid() {
+	if isRelayAddr(udpAddr) {
+		_, err = de.c.sendRelayBatch(udpAddr, de.publicKey, buffs)
+		if stats := de.c.stats.Load(); err == nil && stats != nil {
+			var txBytes int
+			for _, b := range buffs {
+				txBytes += len(b)
+			}
+			stats.UpdateTxPhysical(de.nodeAddr, udpAddr, txBytes)
+		}
+	} else if udpAddr.IsValid() {
 		_, err = de.c.sendUDPBatch(udpAddr, buffs)
 
 		// If the error is known to indicate that the endpoint is no longer
@@ -703,7 +733,7 @@ func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpo
 	sizes := []int{size}
 	if de.c.PeerMTUEnabled() {
 		isDerp := ep.Addr() == tailcfg.DerpMagicIPAddr
-		if !isDerp && ((purpose == pingDiscovery) || (purpose == pingCLI && size == 0)) {
+		if !isDerp && !isRelayAddr(ep) && ((purpose == pingDiscovery) || (purpose == pingCLI && size == 0)) {
 			de.c.dlogf("[v1] magicsock: starting MTU probe")
 			sizes = mtuProbePingSizesV4
 			if ep.Addr().Is6() {
@@ -849,15 +879,35 @@ func (de *endpoint) setLastPing(ipp netip.AddrPort, now mono.Time) {
 
 // updateFromNode updates the endpoint based on a tailcfg.Node from a NetMap
 // update.
-func (de *endpoint) updateFromNode(n tailcfg.NodeView, heartbeatDisabled bool) {
+//
+// relays are the node IDs of the peer relays in the NetMap.
+func (de *endpoint) updateFromNode(n tailcfg.NodeView, flags debugFlags, pathPrefs map[string]pathPreference, relays []tailcfg.NodeID) {
 	if !n.Valid() {
 		panic("nil node when updating endpoint")
 	}
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
-	de.heartbeatDisabled = heartbeatDisabled
+	de.heartbeatDisabled = flags.heartbeatDisabled
 	de.expired = n.Expired()
+	de.isPeerRelay.Store(isPeerRelayNode(n))
+	de.supportsPeerRelays.Store(supportsPeerRelays(n))
+	if !supportsPeerRelays(n) {
+		relays = nil
+	}
+	de.multipath = flags.multipath
+	if pref := pathPrefForNode(pathPrefs, n); pref != de.pathPref {
+		de.debugUpdates.Add(EndpointChange{
+			When: time.Now(),
+			What: "updateFromNode-pathPref",
+			From: de.pathPref.String(),
+			To:   pref.String(),
+		})
+		de.pathPref = pref
+		if de.bestAddr.IsValid() && de.multipathLocked() {
+			de.selectPathLocked(mono.Now(), "pathPref")
+		}
+	}
 
 	epDisco := de.disco.Load()
 	var discoKey key.DiscoPublic
@@ -900,13 +950,17 @@ func (de *endpoint) updateFromNode(n tailcfg.NodeView, heartbeatDisabled bool) {
 	}
 
 	de.setEndpointsLocked(n.Endpoints())
+	de.setPeerRelaysLocked(relays)
 }
 
 func (de *endpoint) setEndpointsLocked(eps interface {
 	LenIter() []struct{}
 	At(i int) netip.AddrPort
 }) {
-	for _, st := range de.endpointState {
+	for ep, st := range de.endpointState {
+		if isRelayAddr(ep) {
+			continue // see setPeerRelaysLocked
+		}
 		st.index = indexSentinelDeleted // assume deleted until updated in next loop
 	}
 
@@ -1006,11 +1060,17 @@ func (de *endpoint) noteBadEndpoint(ipp netip.AddrPort) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
-	de.clearBestAddrLocked()
-
 	if st, ok := de.endpointState[ipp]; ok {
 		st.clear()
 	}
+
+	if de.multipathLocked() && de.bestAddr.AddrPort == ipp {
+		// Fail over to another warm path right away, if there is one.
+		if de.selectPathLocked(mono.Now(), "bad-endpoint") {
+			return
+		}
+	}
+	de.clearBestAddrLocked()
 }
 
 // noteConnectivityChange is called when connectivity changes enough
@@ -1099,7 +1159,9 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 			return
 		}
 
-		de.c.peerMap.setNodeKeyForIPPort(src, de.publicKey)
+		if !isRelayAddr(src) {
+			de.c.peerMap.setNodeKeyForIPPort(src, de.publicKey)
+		}
 
 		st.addPongReplyLocked(pongReply{
 			latency: latency,
@@ -1107,6 +1169,7 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 			from:    src,
 			pongSrc: m.Src,
 		})
+		st.wireMTU = max(st.wireMTU, tstun.WireMTU(pktLen))
 	}
 
 	if sp.purpose != pingHeartbeat {
@@ -1125,6 +1188,12 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 		go sp.resCB.cb(sp.resCB.res)
 	}
 
+	if !isDerp && de.multipathLocked() {
+		// Re-evaluate all the validated paths, not just this one.
+		de.selectPathLocked(now, "pong")
+		return
+	}
+
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
@@ -1185,6 +1254,11 @@ func betterAddr(a, b addrQuality) bool {
 		return false
 	}
 
+	// Any direct path is better than one through a peer relay.
+	if ar, br := isRelayAddr(a.AddrPort), isRelayAddr(b.AddrPort); ar != br {
+		return br
+	}
+
 	// Each address starts with a set of points (from 0 to 100) that
 	// represents how much faster they are than the highest-latency
 	// endpoint. For example, if a has latency 200ms and b has latency
@@ -1320,7 +1394,9 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	ps.LastWrite = de.lastSend.WallTime()
 	ps.Active = now.Sub(de.lastSend) < sessionActiveTimeout
 
-	if udpAddr, derpAddr, _ := de.addrForSendLocked(now); udpAddr.IsValid() && !derpAddr.IsValid() {
+	if udpAddr, derpAddr, _ := de.addrForSendLocked(now); isRelayAddr(udpAddr) && !derpAddr.IsValid() {
+		ps.PeerRelay = de.c.peerRelayNameLocked(udpAddr)
+	} else if udpAddr.IsValid() && !derpAddr.IsValid() {
 		ps.CurAddr = udpAddr.String()
 	}
 }
@@ -89,7 +89,9 @@ type Conn struct {
 	testOnlyPacketListener nettype.PacketListener
 	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
 	netMon                 *netmon.Monitor      // or nil
+	netMonUnregister       func()               // or nil; unregisters onNetMonChange
 	controlKnobs           *controlknobs.Knobs  // or nil
+	pathPrefs              string               // Options.PathPrefs
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -156,6 +158,10 @@ type Conn struct {
 	havePrivateKey  atomic.Bool
 	publicKeyAtomic syncs.AtomicValue[key.NodePublic] // or NodeKey zero value if !havePrivateKey
 
+	// peerRelay is whether this node relays UDP packets for its peers, per
+	// NodeAttrPeerRelay. See relay.go.
+	peerRelay atomic.Bool
+
 	// derpMapAtomic is the same as derpMap, but without requiring
 	// sync.Mutex. For use with NewRegionClient's callback, to avoid
 	// lock ordering deadlocks. See issue 3726 and mu field docs.
@@ -207,6 +213,12 @@ type Conn struct {
 	// that will call Conn.doPeriodicSTUN.
 	periodicReSTUNTimer *time.Timer
 
+	// captivePortalTimer, when non-nil, is an AfterFunc timer that
+	// re-probes for a captive portal to be cleared; see
+	// captiveportal.go. captivePortalReprobe is its current interval.
+	captivePortalTimer   *time.Timer
+	captivePortalReprobe time.Duration
+
 	// endpointsUpdateActive indicates that updateEndpoints is
 	// currently running. It's used to deduplicate concurrent endpoint
 	// update requests.
@@ -272,6 +284,10 @@ type Conn struct {
 	activeDerp       map[int]activeDerp            // DERP regionID -> connection to a node in that region
 	prevDerp         map[int]*syncs.WaitGroupChan
 
+	// derpDraining maps DERP regions that told us they're draining to
+	// when we can consider them as our home again.
+	derpDraining map[int]time.Time
+
 	// derpRoute contains optional alternate routes to use as an
 	// optimization instead of contacting a peer via their home
 	// DERP connection.  If they sent us a message on a different
@@ -352,6 +368,12 @@ type Options struct {
 	// ControlKnobs are the set of control knobs to use.
 	// If nil, they're ignored and not updated.
 	ControlKnobs *controlknobs.Knobs
+
+	// PathPrefs optionally pins the preferred interface or address
+	// family of the UDP paths to some or all peers, which also enables
+	// multipath mode for them. See parsePathPrefs for the format.
+	// Entries of TS_DEBUG_MAGICSOCK_PATH_PREFS override these.
+	PathPrefs string
 }
 
 func (o *Options) logf() logger.Logf {
@@ -410,9 +432,13 @@ func newConn() *Conn {
 // As the set of possible endpoints for a Conn changes, the
 // callback opts.EndpointsFunc is called.
 func NewConn(opts Options) (*Conn, error) {
+	if _, err := parsePathPrefs(opts.PathPrefs); err != nil {
+		return nil, err
+	}
 	c := newConn()
 	c.port.Store(uint32(opts.Port))
 	c.controlKnobs = opts.ControlKnobs
+	c.pathPrefs = opts.PathPrefs
 	c.logf = opts.logf()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
@@ -424,6 +450,9 @@ func NewConn(opts Options) (*Conn, error) {
 		c.portMapper.SetGatewayLookupFunc(opts.NetMon.GatewayAndSelfIP)
 	}
 	c.netMon = opts.NetMon
+	if c.netMon != nil {
+		c.netMonUnregister = c.netMon.RegisterChangeCallback(c.onNetMonChange)
+	}
 
 	if err := c.rebind(keepCurrentPort); err != nil {
 		return nil, err
@@ -475,6 +504,34 @@ func (c *Conn) InstallCaptureHook(cb capture.Callback) {
 // periodicReSTUNTimer when periodic STUNs are active.
 func (c *Conn) doPeriodicSTUN() { c.ReSTUN("periodic") }
 
+// minReSTUNInterval is the least time between periodic re-STUNs, however
+// short netcheck finds the NAT's mapping lifetime to be.
+const minReSTUNInterval = 5 * time.Second
+
+// reSTUNInterval returns a random duration to wait before the next periodic
+// re-STUN, which keeps the NAT's mappings alive. That's between 20 and 26
+// seconds (just under 30s, a common UDP NAT timeout on Linux, etc), unless
+// the last report r has an idle mapping expiring sooner than that, in which
+// case it's well within the time a mapping was seen to last.
+func reSTUNInterval(r *netcheck.Report) time.Duration {
+	const lo, hi = 20 * time.Second, 26 * time.Second
+	if r == nil || r.MappingLifetimeMax == 0 {
+		return tstime.RandomDurationBetween(lo, hi)
+	}
+	// The mapping lasted at least MappingLifetimeMin, or if it didn't last
+	// the first idle period measured, make a guess.
+	d := r.MappingLifetimeMin
+	if d == 0 {
+		d = r.MappingLifetimeMax / 2
+	}
+	d = d * 9 / 10
+	if d >= hi {
+		return tstime.RandomDurationBetween(lo, hi)
+	}
+	d = max(d, minReSTUNInterval)
+	return tstime.RandomDurationBetween(d*3/4, d)
+}
+
 func (c *Conn) stopPeriodicReSTUNTimerLocked() {
 	if t := c.periodicReSTUNTimer; t != nil {
 		t.Stop()
@@ -496,11 +553,7 @@ func (c *Conn) updateEndpoints(why string) {
 				return
 			}
 			if c.shouldDoPeriodicReSTUNLocked() {
-				// Pick a random duration between 20
-				// and 26 seconds (just under 30s, a
-				// common UDP NAT timeout on Linux,
-				// etc)
-				d := tstime.RandomDurationBetween(20*time.Second, 26*time.Second)
+				d := reSTUNInterval(c.lastNetCheckReport.Load())
 				if t := c.periodicReSTUNTimer; t != nil {
 					if debugReSTUNStopOnIdle() {
 						c.logf("resetting existing periodicSTUN to run in %v", d)
@@ -622,6 +675,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 
 	c.lastNetCheckReport.Store(report)
+	c.updateCaptivePortal(report)
 	c.noV4.Store(!report.IPv4)
 	c.noV6.Store(!report.IPv6)
 	c.noV4Send.Store(!report.IPv4CanSend)
@@ -652,6 +706,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 		// one.
 		ni.PreferredDERP = c.pickDERPFallback()
 	}
+	ni.PreferredDERP = c.preferNonDrainingDERP(report, ni.PreferredDERP)
 	if !c.setNearestDERP(ni.PreferredDERP) {
 		ni.PreferredDERP = 0
 	}
@@ -763,6 +818,10 @@ func (c *Conn) Ping(peer tailcfg.NodeView, res *ipnstate.PingResult, size int, c
 // c.mu must be held
 func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netip.AddrPort) {
 	res.LatencySeconds = latency.Seconds()
+	if isRelayAddr(ep) {
+		res.PeerRelay = c.peerRelayNameLocked(ep)
+		return
+	}
 	if ep.Addr() != tailcfg.DerpMagicIPAddr {
 		res.Endpoint = ep.String()
 		return
@@ -801,10 +860,11 @@ func (c *Conn) DiscoPublicKey() key.DiscoPublic {
 //
 // c.mu must NOT be held.
 func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, error) {
-	var havePortmap bool
-	var portmapExt netip.AddrPort
+	var havePortmap, havePinhole bool
+	var portmapExt, pinholeExt netip.AddrPort
 	if runtime.GOOS != "js" {
 		portmapExt, havePortmap = c.portMapper.GetCachedMappingOrStartCreatingOne()
+		pinholeExt, havePinhole = c.portMapper.GetCachedPinholeOrStartCreatingOne()
 	}
 
 	nr, err := c.updateNetInfo(ctx)
@@ -850,6 +910,14 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		addAddr(portmapExt, tailcfg.EndpointPortmapped)
 		c.setNetInfoHavePortMap()
 	}
+	// Likewise for an IPv6 firewall pinhole, which is also advertised as
+	// a port-mapped endpoint.
+	if !havePinhole {
+		pinholeExt, havePinhole = c.portMapper.GetCachedPinholeOrStartCreatingOne()
+	}
+	if havePinhole {
+		addAddr(pinholeExt, tailcfg.EndpointPortmapped)
+	}
 
 	if nr.GlobalV4 != "" {
 		addAddr(ipp(nr.GlobalV4), tailcfg.EndpointSTUN)
@@ -1056,8 +1124,9 @@ func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error)
 	return err == nil, err
 }
 
-// sendAddr sends packet b to addr, which is either a real UDP address
-// or a fake UDP address representing a DERP server (see derpmap.go).
+// sendAddr sends packet b to addr, which is either a real UDP address,
+// a fake UDP address representing a DERP server (see derpmap.go), or
+// one representing a peer relay (see relay.go).
 // The provided public key identifies the recipient.
 //
 // The returned err is whether there was an error writing when it
@@ -1067,6 +1136,9 @@ func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error)
 // IPv6 address when the local machine doesn't have IPv6 support
 // returns (false, nil); it's not an error, but nothing was sent.
 func (c *Conn) sendAddr(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (sent bool, err error) {
+	if isRelayAddr(addr) {
+		return c.sendRelayBatch(addr, pubKey, [][]byte{b})
+	}
 	if addr.Addr() != tailcfg.DerpMagicIPAddr {
 		return c.sendUDP(addr, b)
 	}
@@ -1162,12 +1234,12 @@ func (c *Conn) mkReceiveFunc(ruc *RebindingUDPConn, healthItem *health.ReceiveFu
 					continue
 				}
 				ipp := msg.Addr.(*net.UDPAddr).AddrPort()
-				if ep, ok := c.receiveIP(msg.Buffers[0][:msg.N], ipp, &epCache); ok {
+				if ep, size, ok := c.receiveIP(msg.Buffers[0][:msg.N], ipp, &epCache); ok {
 					if metric != nil {
 						metric.Add(1)
 					}
 					eps[i] = ep
-					sizes[i] = msg.N
+					sizes[i] = size
 					reportToCaller = true
 				} else {
 					sizes[i] = 0
@@ -1183,20 +1255,25 @@ func (c *Conn) mkReceiveFunc(ruc *RebindingUDPConn, healthItem *health.ReceiveFu
 // receiveIP is the shared bits of ReceiveIPv4 and ReceiveIPv6.
 //
 // ok is whether this read should be reported up to wireguard-go (our
-// caller).
-func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache) (ep *endpoint, ok bool) {
+// caller), in which case size is the length of the WireGuard packet at the
+// start of b.
+func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache) (ep *endpoint, size int, ok bool) {
 	if stun.Is(b) {
 		c.netChecker.ReceiveSTUNPacket(b, ipp)
-		return nil, false
+		return nil, 0, false
 	}
 	if c.handleDiscoMessage(b, ipp, key.NodePublic{}, discoRXPathUDP) {
-		return nil, false
+		return nil, 0, false
+	}
+	if looksLikeRelayFrame(b) {
+		ep, size = c.receiveRelayFrame(b, ipp)
+		return ep, size, ep != nil
 	}
 	if !c.havePrivateKey.Load() {
 		// If we have no private key, we're logged out or
 		// stopped. Don't try to pass these wireguard packets
 		// up to wireguard-go; it'll just complain (issue 1167).
-		return nil, false
+		return nil, 0, false
 	}
 	if cache.ipp == ipp && cache.de != nil && cache.gen == cache.de.numStopAndReset() {
 		ep = cache.de
@@ -1205,7 +1282,7 @@ func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache)
 		de, ok := c.peerMap.endpointForIPPort(ipp)
 		c.mu.Unlock()
 		if !ok {
-			return nil, false
+			return nil, 0, false
 		}
 		cache.ipp = ipp
 		cache.de = de
@@ -1216,7 +1293,7 @@ func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache)
 	if stats := c.stats.Load(); stats != nil {
 		stats.UpdateRxPhysical(ep.nodeAddr, ipp, len(b))
 	}
-	return ep, true
+	return ep, len(b), true
 }
 
 // discoLogLevel controls the verbosity of discovery log messages.
@@ -1306,6 +1383,7 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 	discoRXPathUDP       discoRXPath = "UDP socket"
 	discoRXPathDERP      discoRXPath = "DERP"
 	discoRXPathRawSocket discoRXPath = "raw socket"
+	discoRXPathPeerRelay discoRXPath = "peer relay"
 )
 
 // handleDiscoMessage handles a discovery message and reports whether
@@ -1320,8 +1398,10 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 //
 // For messages received over DERP, the src.Addr() will be derpMagicIP (with
 // src.Port() being the region ID) and the derpNodeSrc will be the node key
-// it was received from at the DERP layer. derpNodeSrc is zero when received
-// over UDP.
+// it was received from at the DERP layer. Likewise, for messages received
+// through a peer relay, src is the relay's fake address (see relayAddr) and
+// derpNodeSrc is the node key of the peer it was forwarded from. derpNodeSrc
+// is zero when received directly over UDP.
 func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc key.NodePublic, via discoRXPath) (isDiscoMsg bool) {
 	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
 	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
@@ -1505,6 +1585,9 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 	di.lastPingFrom = src
 	di.lastPingTime = time.Now()
 	isDerp := src.Addr() == tailcfg.DerpMagicIPAddr
+	// Pings through a peer relay come with the sender's node key, like those
+	// over DERP.
+	isRelayed := isDerp || isRelayAddr(src)
 
 	// If we can figure out with certainty which node key this disco
 	// message is for, eagerly update our IP<>node and disco<>node
@@ -1514,7 +1597,7 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 	// mapping, and on subsequent disco handlePongLocked to establish
 	// the IP<>disco mapping.
 	if nk, ok := c.unambiguousNodeKeyOfPingLocked(dm, di.discoKey, derpNodeSrc); ok {
-		if !isDerp {
+		if !isRelayed {
 			c.peerMap.setNodeKeyForIPPort(src, nk)
 		}
 	}
@@ -1529,7 +1612,7 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 	// Remember this route if not present.
 	var numNodes int
 	var dup bool
-	if isDerp {
+	if isRelayed {
 		if ep, ok := c.peerMap.endpointForNodeKey(derpNodeSrc); ok {
 			if ep.addCandidateEndpoint(src, dm.TxID) {
 				return
@@ -1794,10 +1877,14 @@ func debugRingBufferSize(numPeers int) int {
 // The value is comparable.
 type debugFlags struct {
 	heartbeatDisabled bool
+	multipath         bool
+	pathPrefs         string // unparsed; see parsePathPrefs
 }
 
 func (c *Conn) debugFlagsLocked() (f debugFlags) {
 	f.heartbeatDisabled = debugEnableSilentDisco() // TODO(bradfitz): controlknobs too, later
+	f.multipath = debugEnableMultipath() || (c.controlKnobs != nil && c.controlKnobs.MagicsockMultipath.Load())
+	f.pathPrefs = joinPathPrefs(c.pathPrefs, debugPathPrefs())
 	return
 }
 
@@ -1820,6 +1907,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	// Update c.netMap regardless, before the following early return.
 	curPeers := views.SliceOf(nm.Peers)
 	c.peers = curPeers
+	c.peerRelay.Store(nm.SelfNode.Valid() && nm.SelfNode.HasCap(tailcfg.NodeAttrPeerRelay))
 
 	flags := c.debugFlagsLocked()
 	if addrs := nm.GetAddresses(); addrs.Len() > 0 {
@@ -1839,6 +1927,18 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 
 	c.logf("[v1] magicsock: got updated network map; %d peers", len(nm.Peers))
 
+	pathPrefs, err := parsePathPrefs(flags.pathPrefs)
+	if err != nil {
+		c.logf("magicsock: ignoring some path preferences: %v", err)
+	}
+
+	var relays []tailcfg.NodeID
+	for _, n := range nm.Peers {
+		if isPeerRelayNode(n) {
+			relays = append(relays, n.ID())
+		}
+	}
+
 	entriesPerBuffer := debugRingBufferSize(len(nm.Peers))
 
 	// Try a pass of just upserting nodes and creating missing
@@ -1882,7 +1982,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			if epDisco := ep.disco.Load(); epDisco != nil {
 				oldDiscoKey = epDisco.key
 			}
-			ep.updateFromNode(n, flags.heartbeatDisabled)
+			ep.updateFromNode(n, flags, pathPrefs, relays)
 			c.peerMap.upsertEndpoint(ep, oldDiscoKey) // maybe update discokey mappings in peerMap
 			continue
 		}
@@ -1935,7 +2035,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			c.logEndpointCreated(n)
 		}
 
-		ep.updateFromNode(n, flags.heartbeatDisabled)
+		ep.updateFromNode(n, flags, pathPrefs, relays)
 		c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
 	}
 
@@ -2121,6 +2221,10 @@ func (c *Conn) Close() error {
 		c.derpCleanupTimer.Stop()
 	}
 	c.stopPeriodicReSTUNTimerLocked()
+	c.stopCaptivePortalTimerLocked()
+	if c.netMonUnregister != nil {
+		c.netMonUnregister()
+	}
 	c.portMapper.Close()
 
 	c.peerMap.forEachEndpoint(func(ep *endpoint) {
@@ -2353,6 +2457,7 @@ func (c *Conn) rebind(curPortFate currentPortFate) error {
 		return fmt.Errorf("magicsock: Rebind IPv4 failed: %w", err)
 	}
 	c.portMapper.SetLocalPort(c.LocalPort())
+	c.portMapper.SetLocalPort6(uint16(c.pconn6.LocalAddr().Port))
 	c.UpdatePMTUD()
 	return nil
 }
@@ -2676,6 +2781,17 @@ func (c *Conn) SetStatistics(stats *connstats.Statistics) {
 	// path (without using DERP) without having heard a Pong reply.
 	trustUDPAddrDuration = 6500 * time.Millisecond
 
+	// multipathTrustDuration is how long, in multipath mode, we trust a
+	// UDP path without having heard a Pong reply on it. It's shorter than
+	// trustUDPAddrDuration (but longer than heartbeatInterval) so that when
+	// the path in use stops answering heartbeats, we move to another warm
+	// path within discoPingInterval.
+	multipathTrustDuration = heartbeatInterval + 1500*time.Millisecond
+
+	// multipathMaxWarmPaths is how many validated UDP paths per peer,
+	// including the one in use, multipath mode keeps warm with heartbeats.
+	multipathMaxWarmPaths = 3
+
 	// goodEnoughLatency is the latency at or under which we don't
 	// try to upgrade to a better path.
 	goodEnoughLatency = 5 * time.Millisecond
@@ -2808,6 +2924,8 @@ type discoInfo struct {
 	metricReSTUNCalls     = clientmetric.NewCounter("magicsock_restun_calls")
 	metricUpdateEndpoints = clientmetric.NewCounter("magicsock_update_endpoints")
 
+	metricCaptivePortalDetected = clientmetric.NewCounter("magicsock_captive_portal_detected")
+
 	// Sends (data or disco)
 	metricSendDERPQueued      = clientmetric.NewCounter("magicsock_send_derp_queued")
 	metricSendDERPErrorChan   = clientmetric.NewCounter("magicsock_send_derp_error_chan")
@@ -44,6 +44,7 @@
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/connstats"
 	"tailscale.com/net/netaddr"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/ping"
 	"tailscale.com/net/stun/stuntest"
@@ -482,6 +483,77 @@ func TestPickDERPFallback(t *testing.T) {
 	// have fixed DERP fallback logic.
 }
 
+func TestPreferNonDrainingDERP(t *testing.T) {
+	c := newConn()
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {},
+			2: {},
+			3: {},
+		},
+	}
+	report := &netcheck.Report{
+		RegionLatency: map[int]time.Duration{
+			1: 10 * time.Millisecond,
+			2: 30 * time.Millisecond,
+			3: 20 * time.Millisecond,
+		},
+	}
+	if got := c.preferNonDrainingDERP(report, 1); got != 1 {
+		t.Errorf("nothing draining: got %d; want 1", got)
+	}
+
+	c.derpDraining = map[int]time.Time{1: time.Now().Add(time.Hour)}
+	if got := c.preferNonDrainingDERP(report, 1); got != 3 {
+		t.Errorf("home draining: got %d; want next best 3", got)
+	}
+	if got := c.preferNonDrainingDERP(report, 2); got != 2 {
+		t.Errorf("other region draining: got %d; want 2", got)
+	}
+	if got := c.preferNonDrainingDERP(nil, 1); got == 1 {
+		t.Errorf("no report: got draining region 1")
+	}
+
+	c.derpDraining[1] = time.Now().Add(-time.Second)
+	if got := c.preferNonDrainingDERP(report, 1); got != 1 {
+		t.Errorf("drain expired: got %d; want 1", got)
+	}
+
+	c.derpDraining = map[int]time.Time{1: time.Now().Add(time.Hour), 2: time.Now().Add(time.Hour), 3: time.Now().Add(time.Hour)}
+	if got := c.preferNonDrainingDERP(report, 1); got != 1 {
+		t.Errorf("all draining: got %d; want 1", got)
+	}
+}
+
+func TestReSTUNInterval(t *testing.T) {
+	const s = time.Second
+	tests := []struct {
+		name     string
+		min, max time.Duration // of the mapping lifetime
+		wantLo   time.Duration
+		wantHi   time.Duration
+	}{
+		{"no-report", -1, -1, 20 * s, 26 * s},
+		{"not-measured", 0, 0, 20 * s, 26 * s},
+		{"never-expired", 180 * s, 0, 20 * s, 26 * s},
+		{"long", 45 * s, 90 * s, 20 * s, 26 * s},
+		{"short", 20 * s, 45 * s, 13500 * time.Millisecond, 18 * s},
+		{"shorter-than-first-step", 0, 20 * s, 6750 * time.Millisecond, 9 * s},
+		{"very-short", 0, 5 * s, 3750 * time.Millisecond, 5 * s},
+	}
+	for _, tt := range tests {
+		var r *netcheck.Report
+		if tt.min >= 0 {
+			r = &netcheck.Report{MappingLifetimeMin: tt.min, MappingLifetimeMax: tt.max}
+		}
+		for i := 0; i < 100; i++ {
+			if d := reSTUNInterval(r); d < tt.wantLo || d > tt.wantHi {
+				t.Fatalf("%s: reSTUNInterval = %v; want between %v and %v", tt.name, d, tt.wantLo, tt.wantHi)
+			}
+		}
+	}
+}
+
 // TestDeviceStartStop exercises the startup and shutdown logic of
 // wireguard-go, which is intimately intertwined with magicsock's own
 // lifecycle. We seem to be good at generating deadlocks here, so if
@@ -0,0 +1,342 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+// This file implements multipath mode, in which an endpoint keeps several
+// validated UDP paths to its peer warm instead of only bestAddr, so that when
+// the path in use stops answering it can move to another one within
+// discoPingInterval, without waiting for a new round of discovery. It's
+// enabled by NodeAttrMagicsockMultipath or TS_DEBUG_MAGICSOCK_MULTIPATH, or
+// for a single peer by pinning a path preference for it, with
+// Options.PathPrefs (tailscaled's --path-prefs flag) or
+// TS_DEBUG_MAGICSOCK_PATH_PREFS.
+//
+// Packets are still sent over one path at a time.
+
+// pathPreference is an operator's preferred kind of UDP path to a peer. The
+// zero value means no preference.
+type pathPreference struct {
+	family int    // 4 or 6, or 0 for any
+	iface  string // local interface name, or empty for any
+}
+
+func (p pathPreference) String() string {
+	switch {
+	case p.family != 0:
+		return fmt.Sprintf("ipv%d", p.family)
+	case p.iface != "":
+		return p.iface
+	}
+	return ""
+}
+
+// matches reports whether a path to ap, leaving from the local interface
+// iface, is of the preferred kind.
+func (p pathPreference) matches(ap netip.AddrPort, iface string) bool {
+	switch {
+	case p.family == 4:
+		return ap.Addr().Unmap().Is4()
+	case p.family == 6:
+		return ap.Addr().Is6() && !ap.Addr().Is4In6()
+	case p.iface != "":
+		return p.iface == iface
+	}
+	return true
+}
+
+// parsePathPrefs parses path preferences, as in Options.PathPrefs and
+// TS_DEBUG_MAGICSOCK_PATH_PREFS: a comma-separated list of peer=preference
+// pairs. The peer is one of its Tailscale IPs, its name as in the netmap
+// (such as "laptop"), or "*" for all peers without an entry of their own.
+// The preference is "ipv4", "ipv6" or the name of a local interface, such
+// as "eth0".
+//
+// It returns the valid entries, even if there's an error parsing others.
+func parsePathPrefs(s string) (map[string]pathPreference, error) {
+	var ret map[string]pathPreference
+	var errs []error
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		peer, pref, ok := strings.Cut(f, "=")
+		peer, pref = strings.TrimSpace(peer), strings.TrimSpace(pref)
+		if !ok || peer == "" || pref == "" {
+			errs = append(errs, fmt.Errorf("invalid path preference %q; want peer=preference", f))
+			continue
+		}
+		var p pathPreference
+		switch strings.ToLower(pref) {
+		case "ipv4":
+			p.family = 4
+		case "ipv6":
+			p.family = 6
+		default:
+			p.iface = pref
+		}
+		if ip, err := netip.ParseAddr(peer); err == nil {
+			peer = ip.String()
+		}
+		if ret == nil {
+			ret = map[string]pathPreference{}
+		}
+		ret[peer] = p
+	}
+	return ret, errors.Join(errs...)
+}
+
+// joinPathPrefs returns the path preferences of all of prefs, in the format
+// of parsePathPrefs. Entries for the same peer in later ones win.
+func joinPathPrefs(prefs ...string) string {
+	var nonEmpty []string
+	for _, p := range prefs {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+// pathPrefForNode returns the path preference in prefs that applies to n.
+func pathPrefForNode(prefs map[string]pathPreference, n tailcfg.NodeView) pathPreference {
+	if len(prefs) == 0 {
+		return pathPreference{}
+	}
+	for i := range n.Addresses().LenIter() {
+		if p, ok := prefs[n.Addresses().At(i).Addr().String()]; ok {
+			return p
+		}
+	}
+	if name := n.ComputedName(); name != "" {
+		if p, ok := prefs[name]; ok {
+			return p
+		}
+	}
+	return prefs["*"]
+}
+
+// pathInterface returns the name of the local interface that packets to ap
+// most likely leave from: the one with an address prefix containing ap's
+// address, or else the one with the default route. It returns the empty
+// string if that's unknown.
+func (c *Conn) pathInterface(ap netip.AddrPort) string {
+	if c.netMon == nil {
+		return ""
+	}
+	st := c.netMon.InterfaceState()
+	if st == nil {
+		return ""
+	}
+	ip := ap.Addr().Unmap()
+	for name, pfxs := range st.InterfaceIPs {
+		for _, pfx := range pfxs {
+			if pfx.Contains(ip) {
+				return name
+			}
+		}
+	}
+	return st.DefaultRouteInterface
+}
+
+// pathChoice describes a path picked by multipath mode, for EndpointChange.
+type pathChoice struct {
+	Addr      netip.AddrPort
+	Latency   time.Duration `json:",omitempty"`
+	WireMTU   tstun.WireMTU `json:",omitempty"`
+	Interface string        `json:",omitempty"`
+	Preferred bool          `json:",omitempty"` // whether it's of the operator's preferred kind
+	Validated int           `json:",omitempty"` // number of validated paths to choose from
+}
+
+// multipathLocked reports whether de is in multipath mode.
+//
+// de.mu must be held.
+func (de *endpoint) multipathLocked() bool {
+	if de.isWireguardOnly {
+		return false
+	}
+	return de.multipath || de.pathPref != (pathPreference{})
+}
+
+// validatedPathLocked returns the quality of the path to ep as of its most
+// recent pong, and when that pong arrived. It reports false if there's been
+// no pong on it within multipathTrustDuration of now.
+//
+// de.mu must be held.
+func (de *endpoint) validatedPathLocked(ep netip.AddrPort, now mono.Time) (q addrQuality, at mono.Time, ok bool) {
+	st, ok := de.endpointState[ep]
+	if !ok || len(st.recentPongs) == 0 {
+		return q, 0, false
+	}
+	pong := st.recentPongs[st.recentPong]
+	if now.Sub(pong.pongAt) > multipathTrustDuration {
+		return q, 0, false
+	}
+	return addrQuality{ep, pong.latency, st.wireMTU}, pong.pongAt, true
+}
+
+// preferredPathLocked reports whether the path to ap is of the operator's
+// preferred kind, which it is if there's no preference.
+//
+// de.mu must be held.
+func (de *endpoint) preferredPathLocked(ap netip.AddrPort) bool {
+	var iface string
+	if de.pathPref.iface != "" {
+		iface = de.c.pathInterface(ap)
+	}
+	return de.pathPref.matches(ap, iface)
+}
+
+// betterPathLocked reports whether a is a better path to use than b: it's
+// of the operator's preferred kind and b isn't, or else betterAddr says so.
+//
+// de.mu must be held.
+func (de *endpoint) betterPathLocked(a, b addrQuality) bool {
+	if ap, bp := de.preferredPathLocked(a.AddrPort), de.preferredPathLocked(b.AddrPort); ap != bp {
+		return ap
+	}
+	return betterAddr(a, b)
+}
+
+// failOverExpiredPathLocked moves de, in multipath mode, from a bestAddr
+// that's no longer trusted to another warm path, if there is one. It's
+// only called when sending, so that looking up the current path for
+// status doesn't change it.
+//
+// de.mu must be held.
+func (de *endpoint) failOverExpiredPathLocked(now mono.Time) {
+	if de.bestAddr.IsValid() && now.After(de.trustBestAddrUntil) && de.multipathLocked() {
+		de.selectPathLocked(now, "expired")
+	}
+}
+
+// selectPathLocked makes the best of the validated paths to de's peer its
+// bestAddr, recording why in debugUpdates if that's a change. It reports
+// whether there was a validated path; if not, bestAddr is left alone.
+//
+// de.mu must be held.
+func (de *endpoint) selectPathLocked(now mono.Time, why string) bool {
+	// Start from the path in use, so betterAddr's hysteresis applies to
+	// moving away from it.
+	best, bestAt, ok := de.validatedPathLocked(de.bestAddr.AddrPort, now)
+	n := 0
+	if ok {
+		n++
+		best.wireMTU = max(best.wireMTU, de.bestAddr.wireMTU)
+	}
+	for ep := range de.endpointState {
+		if ep == de.bestAddr.AddrPort {
+			continue
+		}
+		q, at, ok := de.validatedPathLocked(ep, now)
+		if !ok {
+			continue
+		}
+		n++
+		if !best.IsValid() || de.betterPathLocked(q, best) {
+			best, bestAt = q, at
+		}
+	}
+	if !best.IsValid() {
+		return false
+	}
+	if best.AddrPort != de.bestAddr.AddrPort {
+		to := de.pathChoiceLocked(best)
+		to.Validated = n
+		de.c.logf("magicsock: disco: node %v %v now using %v (multipath %s, %d validated paths)", de.publicKey.ShortString(), de.discoShort(), best.AddrPort, why, n)
+		de.debugUpdates.Add(EndpointChange{
+			When: time.Now(),
+			What: "multipath-" + why,
+			From: de.pathChoiceLocked(de.bestAddr),
+			To:   to,
+		})
+	}
+	de.bestAddr = best
+	de.bestAddrAt = bestAt
+	de.trustBestAddrUntil = bestAt.Add(multipathTrustDuration)
+	return true
+}
+
+// pathChoiceLocked returns the description of the path q for EndpointChange.
+//
+// de.mu must be held.
+func (de *endpoint) pathChoiceLocked(q addrQuality) pathChoice {
+	if !q.IsValid() {
+		return pathChoice{}
+	}
+	iface := de.c.pathInterface(q.AddrPort)
+	return pathChoice{
+		Addr:      q.AddrPort,
+		Latency:   q.latency,
+		WireMTU:   q.wireMTU,
+		Interface: iface,
+		Preferred: de.pathPref != (pathPreference{}) && de.pathPref.matches(q.AddrPort, iface),
+	}
+}
+
+// warmPathsLocked returns the paths other than bestAddr that heartbeats should
+// keep warm: up to multipathMaxWarmPaths-1 of those that have answered a ping
+// within sessionActiveTimeout, preferred kinds first, then lowest latency.
+//
+// de.mu must be held.
+func (de *endpoint) warmPathsLocked(now mono.Time) []netip.AddrPort {
+	type warm struct {
+		ep        netip.AddrPort
+		preferred bool
+		latency   time.Duration
+	}
+	var paths []warm
+	for ep, st := range de.endpointState {
+		if ep == de.bestAddr.AddrPort || len(st.recentPongs) == 0 {
+			continue
+		}
+		pong := st.recentPongs[st.recentPong]
+		if now.Sub(pong.pongAt) > sessionActiveTimeout {
+			continue
+		}
+		paths = append(paths, warm{
+			ep:        ep,
+			preferred: de.preferredPathLocked(ep),
+			latency:   pong.latency,
+		})
+	}
+	slices.SortFunc(paths, func(a, b warm) int {
+		if a.preferred != b.preferred {
+			if a.preferred {
+				return -1
+			}
+			return 1
+		}
+		if c := cmp.Compare(a.latency, b.latency); c != 0 {
+			return c
+		}
+		if c := a.ep.Addr().Compare(b.ep.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ep.Port(), b.ep.Port())
+	})
+	ret := make([]netip.AddrPort, 0, min(len(paths), multipathMaxWarmPaths-1))
+	for _, p := range paths {
+		if len(ret) == cap(ret) {
+			break
+		}
+		ret = append(ret, p.ep)
+	}
+	return ret
+}
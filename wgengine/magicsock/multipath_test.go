@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/ringbuffer"
+)
+
+func TestPathPrefsOption(t *testing.T) {
+	if _, err := NewConn(Options{Logf: t.Logf, PathPrefs: "laptop"}); err == nil {
+		t.Error("NewConn accepted invalid PathPrefs")
+	}
+
+	// The envknob's entries override those of the option.
+	got, err := parsePathPrefs(joinPathPrefs("laptop=eth0,*=ipv4", "", "laptop=ipv6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]pathPreference{
+		"laptop": {family: 6},
+		"*":      {family: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("joined path prefs = %v; want %v", got, want)
+	}
+	if got := joinPathPrefs("", ""); got != "" {
+		t.Errorf("joinPathPrefs of nothing = %q", got)
+	}
+}
+
+func TestParsePathPrefs(t *testing.T) {
+	got, err := parsePathPrefs(" 100.64.0.2=ipv6, laptop=eth0,*=IPv4,bogus,=x ")
+	if err == nil {
+		t.Error("no error for bogus entries")
+	}
+	want := map[string]pathPreference{
+		"100.64.0.2": {family: 6},
+		"laptop":     {iface: "eth0"},
+		"*":          {family: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePathPrefs = %v; want %v", got, want)
+	}
+
+	node := func(name string, ips ...string) tailcfg.NodeView {
+		n := &tailcfg.Node{ComputedName: name}
+		for _, ip := range ips {
+			n.Addresses = append(n.Addresses, netip.PrefixFrom(netip.MustParseAddr(ip), 32))
+		}
+		return n.View()
+	}
+	for _, tt := range []struct {
+		n    tailcfg.NodeView
+		want pathPreference
+	}{
+		{node("other", "100.64.0.2"), pathPreference{family: 6}},
+		{node("laptop", "100.64.0.3"), pathPreference{iface: "eth0"}},
+		{node("other", "100.64.0.4"), pathPreference{family: 4}},
+	} {
+		if got := pathPrefForNode(want, tt.n); got != tt.want {
+			t.Errorf("pathPrefForNode(%v) = %v; want %v", tt.n.ComputedName(), got, tt.want)
+		}
+	}
+	if got := pathPrefForNode(nil, node("laptop")); got != (pathPreference{}) {
+		t.Errorf("pathPrefForNode without prefs = %v; want none", got)
+	}
+}
+
+func TestMultipathFailover(t *testing.T) {
+	// discoPingInterval is shortened for tests, so compare with its default.
+	if multipathTrustDuration <= heartbeatInterval || multipathTrustDuration >= 5*time.Second {
+		t.Fatalf("multipathTrustDuration %v doesn't fail over between heartbeats within discoPingInterval", multipathTrustDuration)
+	}
+
+	const ms = time.Millisecond
+	var (
+		wired = netip.MustParseAddrPort("192.168.1.2:41641")
+		lte   = netip.MustParseAddrPort("203.0.113.9:41641")
+		v6    = netip.MustParseAddrPort("[2001:db8::2]:41641")
+		derp  = netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	)
+	de := &endpoint{
+		c:            &Conn{logf: t.Logf},
+		debugUpdates: ringbuffer.New[EndpointChange](10),
+		derpAddr:     derp,
+		multipath:    true,
+		endpointState: map[netip.AddrPort]*endpointState{
+			wired: {},
+			lte:   {},
+			v6:    {},
+		},
+	}
+	pong := func(ep netip.AddrPort, latency time.Duration, at mono.Time) {
+		de.endpointState[ep].addPongReplyLocked(pongReply{latency: latency, pongAt: at, from: ep})
+	}
+	lastChange := func(what string, from, to netip.AddrPort) {
+		t.Helper()
+		all := de.debugUpdates.GetAll()
+		if len(all) == 0 {
+			t.Fatalf("no endpoint changes; want %s", what)
+		}
+		c := all[len(all)-1]
+		if c.What != what || c.From.(pathChoice).Addr != from || c.To.(pathChoice).Addr != to {
+			t.Fatalf("last endpoint change = %+v; want %s from %v to %v", c, what, from, to)
+		}
+	}
+
+	// Discovery validates all three paths; the wired one wins. It happens
+	// in the past, so that now below is close to the real clock, which
+	// noteBadEndpoint reads.
+	start := mono.Now().Add(-multipathTrustDuration - ms)
+	pong(wired, 2*ms, start)
+	pong(lte, 40*ms, start)
+	pong(v6, 30*ms, start)
+	if !de.selectPathLocked(start, "pong") || de.bestAddr.AddrPort != wired {
+		t.Fatalf("bestAddr = %v; want %v", de.bestAddr, wired)
+	}
+	lastChange("multipath-pong", netip.AddrPort{}, wired)
+	if got, want := de.warmPathsLocked(start), []netip.AddrPort{v6, lte}; !reflect.DeepEqual(got, want) {
+		t.Errorf("warm paths = %v; want %v", got, want)
+	}
+
+	// The wired path stops answering heartbeats; the others keep going.
+	// Once it's no longer trusted, sends move to the best warm path, without
+	// falling back to DERP.
+	beat := start.Add(heartbeatInterval)
+	pong(lte, 40*ms, beat)
+	pong(v6, 30*ms, beat)
+	now := start.Add(multipathTrustDuration + ms)
+
+	// Status doesn't fail over.
+	de.lastSend = start
+	var ps ipnstate.PeerStatus
+	de.populatePeerStatus(&ps)
+	if de.bestAddr.AddrPort != wired {
+		t.Fatalf("after status, bestAddr = %v; want %v", de.bestAddr, wired)
+	}
+	lastChange("multipath-pong", netip.AddrPort{}, wired)
+
+	de.failOverExpiredPathLocked(now)
+	udp, derpAddr, _ := de.addrForSendLocked(now)
+	if udp != v6 || derpAddr.IsValid() {
+		t.Fatalf("after wired path failed, sending to %v, %v; want %v only", udp, derpAddr, v6)
+	}
+	lastChange("multipath-expired", wired, v6)
+	if c := de.debugUpdates.GetAll(); c[len(c)-1].To.(pathChoice).Validated != 2 {
+		t.Errorf("choice = %+v; want 2 validated paths", c[len(c)-1].To)
+	}
+
+	// Pinning IPv4 moves to the IPv4 path, despite its latency.
+	de.pathPref = pathPreference{family: 4}
+	if !de.selectPathLocked(now, "pathPref") || de.bestAddr.AddrPort != lte {
+		t.Fatalf("with IPv4 preferred, bestAddr = %v; want %v", de.bestAddr, lte)
+	}
+	lastChange("multipath-pathPref", v6, lte)
+	if c := de.debugUpdates.GetAll(); !c[len(c)-1].To.(pathChoice).Preferred {
+		t.Errorf("choice = %+v; want preferred", c[len(c)-1].To)
+	}
+
+	// A send error on it fails over to what's left.
+	de.noteBadEndpoint(lte)
+	if de.bestAddr.AddrPort != v6 {
+		t.Fatalf("after bad endpoint, bestAddr = %v; want %v", de.bestAddr, v6)
+	}
+	lastChange("multipath-bad-endpoint", lte, v6)
+
+	// With nothing left, it's back to DERP.
+	de.noteBadEndpoint(v6)
+	if de.bestAddr.IsValid() {
+		t.Fatalf("with no paths left, bestAddr = %v; want none", de.bestAddr)
+	}
+	if udp, derpAddr, _ := de.addrForSendLocked(now); udp.IsValid() || derpAddr != derp {
+		t.Errorf("with no paths left, sending to %v, %v; want DERP only", udp, derpAddr)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"slices"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+)
+
+// This file implements peer relays: nodes with NodeAttrPeerRelay forward
+// disco and WireGuard UDP packets between two of their peers that can't
+// reach each other directly, which is usually quicker than DERP, being UDP
+// all the way.
+//
+// To its other peers, each relay is an extra candidate path to every peer
+// that isn't the relay itself. It's addressed by a fake UDP address (see
+// relayAddr), pinged and chosen like any other path, but betterAddr ranks
+// it below every direct path. DERP remains the fallback when neither works.
+//
+// A packet sent through a relay is framed as:
+//
+//   - relayMagic [6]byte
+//   - frame type [1]byte: relayFrameTo or relayFrameFrom
+//   - peer node key [32]byte: the destination for relayFrameTo, the source
+//     for relayFrameFrom
+//   - the disco or WireGuard packet
+//
+// A node sends relayFrameTo frames to a relay over its direct path to it.
+// The relay only accepts them from a peer's validated address and forwards
+// them, as relayFrameFrom frames, over its own direct path to the
+// destination, if it has one; it never forwards through DERP or another
+// relay.
+//
+// Only peers whose capability version is at least peerRelayCapVer
+// understand these frames, so other peers neither act as relays nor are
+// reached through them.
+
+// peerRelayCapVer is the first capability version of clients that can relay
+// for, and be reached through, peer relays.
+const peerRelayCapVer tailcfg.CapabilityVersion = 83
+
+// relayMagic is the prefix of packets to and from peer relays. It differs
+// from disco.Magic in its last two bytes, and likewise can't be the start of
+// a WireGuard packet.
+const relayMagic = "TS\xf0\x9f\x94\x81" // 6 bytes: TS🔁
+
+// Frame types of packets to and from peer relays.
+const (
+	relayFrameTo   = 1 // from a peer to the relay, to forward
+	relayFrameFrom = 2 // from the relay, forwarded from a peer
+)
+
+// relayHeaderLen is the length of the header of packets to and from peer
+// relays.
+const relayHeaderLen = len(relayMagic) + 1 + key.NodePublicRawLen
+
+// relayAddrPrefix holds the fake addresses that stand for the paths through
+// peer relays. It's the RFC 6666 discard-only prefix, so the fake addresses
+// are never those of real endpoints.
+var relayAddrPrefix = netip.MustParsePrefix("100::/64")
+
+// relayAddr returns the fake address of the path through the peer relay
+// with the given node ID.
+func relayAddr(relay tailcfg.NodeID) netip.AddrPort {
+	a := relayAddrPrefix.Addr().As16()
+	binary.BigEndian.PutUint64(a[8:], uint64(relay))
+	return netip.AddrPortFrom(netip.AddrFrom16(a), 0)
+}
+
+// isRelayAddr reports whether ap is the fake address of a path through a
+// peer relay.
+func isRelayAddr(ap netip.AddrPort) bool {
+	return relayAddrPrefix.Contains(ap.Addr())
+}
+
+// relayNodeID returns the node ID of the peer relay that relay, a fake
+// address from relayAddr, stands for.
+func relayNodeID(relay netip.AddrPort) tailcfg.NodeID {
+	a := relay.Addr().As16()
+	return tailcfg.NodeID(binary.BigEndian.Uint64(a[8:]))
+}
+
+// supportsPeerRelays reports whether n understands the frames of peer
+// relays.
+func supportsPeerRelays(n tailcfg.NodeView) bool {
+	return n.Cap() >= peerRelayCapVer && !n.IsWireGuardOnly() && !n.DiscoKey().IsZero()
+}
+
+// isPeerRelayNode reports whether n relays UDP packets for its peers.
+func isPeerRelayNode(n tailcfg.NodeView) bool {
+	return n.HasCap(tailcfg.NodeAttrPeerRelay) && supportsPeerRelays(n)
+}
+
+// looksLikeRelayFrame reports whether b looks like a packet to or from a
+// peer relay.
+func looksLikeRelayFrame(b []byte) bool {
+	return len(b) >= relayHeaderLen && string(b[:len(relayMagic)]) == relayMagic
+}
+
+var (
+	errNoPeerRelay     = errors.New("unknown peer relay")
+	errNoPeerRelayPath = errors.New("no direct path to peer relay")
+)
+
+// sendRelayBatch sends buffs to dst through the peer relay that relay, a
+// fake address from relayAddr, stands for. See sendAddr's docs on the return
+// value meanings.
+func (c *Conn) sendRelayBatch(relay netip.AddrPort, dst key.NodePublic, buffs [][]byte) (sent bool, err error) {
+	c.mu.Lock()
+	rde, ok := c.peerMap.endpointForNodeID(relayNodeID(relay))
+	c.mu.Unlock()
+	if !ok || !rde.isPeerRelay.Load() || dst.IsZero() {
+		metricSendPeerRelayError.Add(int64(len(buffs)))
+		return false, errNoPeerRelay
+	}
+	udpAddr, ok := rde.directPathForRelaying()
+	if !ok {
+		metricSendPeerRelayError.Add(int64(len(buffs)))
+		return false, errNoPeerRelayPath
+	}
+
+	// TODO: this makes garbage, like sendAddr does for DERP; use a
+	// buffer pool if it matters.
+	frames := make([][]byte, len(buffs))
+	for i, b := range buffs {
+		f := make([]byte, 0, relayHeaderLen+len(b))
+		f = append(f, relayMagic...)
+		f = append(f, relayFrameTo)
+		f = dst.AppendTo(f)
+		frames[i] = append(f, b...)
+	}
+	sent, err = c.sendUDPBatch(udpAddr, frames)
+	if err != nil {
+		metricSendPeerRelayError.Add(int64(len(buffs)))
+	} else if sent {
+		metricSendPeerRelay.Add(int64(len(buffs)))
+	}
+	return sent, err
+}
+
+// directPathForRelaying returns the direct UDP path to de, for sending
+// packets that a peer relay (either de or this node) forwards. It reports
+// false if there's none, in which case it starts discovery so that there
+// might be one soon.
+//
+// Either way, it marks de as active, so that heartbeats keep its path warm
+// for as long as packets are relayed over it.
+func (de *endpoint) directPathForRelaying() (udpAddr netip.AddrPort, ok bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.expired || de.isWireguardOnly {
+		return udpAddr, false
+	}
+	now := mono.Now()
+	de.failOverExpiredPathLocked(now)
+	udpAddr, _, _ = de.addrForSendLocked(now)
+	if !udpAddr.IsValid() || isRelayAddr(udpAddr) || now.After(de.trustBestAddrUntil) {
+		de.sendDiscoPingsLocked(now, true)
+	}
+	de.noteActiveLocked()
+	if !udpAddr.IsValid() || isRelayAddr(udpAddr) {
+		return netip.AddrPort{}, false
+	}
+	return udpAddr, true
+}
+
+// receiveRelayFrame handles b, which looksLikeRelayFrame, received over UDP
+// from src.
+//
+// If it was relayed to us from a peer and carries a WireGuard packet, it
+// moves that packet to the start of b and returns the peer's endpoint and the
+// packet's length, for wireguard-go. Otherwise it returns a nil endpoint.
+func (c *Conn) receiveRelayFrame(b []byte, src netip.AddrPort) (ep *endpoint, size int) {
+	typ := b[len(relayMagic)]
+	peer := key.NodePublicFromRaw32(mem.B(b[len(relayMagic)+1 : relayHeaderLen]))
+	payload := b[relayHeaderLen:]
+
+	// Frames are only accepted from an address that's been verified to be
+	// the peer's, as with WireGuard packets.
+	c.mu.Lock()
+	from, ok := c.peerMap.endpointForIPPort(src)
+	other, otherOK := c.peerMap.endpointForNodeKey(peer)
+	c.mu.Unlock()
+	if !ok || !otherOK || from == other {
+		metricRecvPeerRelayBadPeer.Add(1)
+		return nil, 0
+	}
+
+	switch typ {
+	case relayFrameTo:
+		if !c.peerRelay.Load() {
+			metricRecvPeerRelayBadPeer.Add(1)
+			return nil, 0
+		}
+		c.forwardRelayFrame(b, from, other)
+		return nil, 0
+	case relayFrameFrom:
+		if !from.isPeerRelay.Load() {
+			metricRecvPeerRelayBadPeer.Add(1)
+			return nil, 0
+		}
+		via := relayAddr(from.nodeID)
+		if c.handleDiscoMessage(payload, via, peer, discoRXPathPeerRelay) {
+			return nil, 0
+		}
+		if !c.havePrivateKey.Load() {
+			return nil, 0
+		}
+		n := copy(b, payload)
+		other.noteRecvActivity(via)
+		if stats := c.stats.Load(); stats != nil {
+			stats.UpdateRxPhysical(other.nodeAddr, via, n)
+		}
+		metricRecvDataPeerRelay.Add(1)
+		return other, n
+	}
+	metricRecvPeerRelayBadPeer.Add(1)
+	return nil, 0
+}
+
+// forwardRelayFrame forwards frame, a relayFrameTo frame from the peer from,
+// to the peer to over this node's direct path to it, as a peer relay.
+func (c *Conn) forwardRelayFrame(frame []byte, from, to *endpoint) {
+	if !to.supportsPeerRelays.Load() {
+		metricPeerRelayDropped.Add(1)
+		return
+	}
+	udpAddr, ok := to.directPathForRelaying()
+	if !ok {
+		metricPeerRelayDropped.Add(1)
+		return
+	}
+	frame[len(relayMagic)] = relayFrameFrom
+	src := from.publicKey.Raw32()
+	copy(frame[len(relayMagic)+1:relayHeaderLen], src[:])
+	if sent, _ := c.sendUDP(udpAddr, frame); sent {
+		metricPeerRelayForwarded.Add(1)
+	} else {
+		metricPeerRelayDropped.Add(1)
+	}
+}
+
+// setPeerRelaysLocked makes the paths through the given peer relays
+// candidate paths to de's peer, and forgets those through any other relays.
+//
+// de.mu must be held.
+func (de *endpoint) setPeerRelaysLocked(relays []tailcfg.NodeID) {
+	var added []netip.AddrPort
+	for _, id := range relays {
+		if id == de.nodeID {
+			continue
+		}
+		ap := relayAddr(id)
+		if _, ok := de.endpointState[ap]; !ok {
+			de.endpointState[ap] = &endpointState{}
+			added = append(added, ap)
+		}
+	}
+	if len(added) > 0 {
+		de.debugUpdates.Add(EndpointChange{
+			When: time.Now(),
+			What: "updateFromNode-new-peerRelays",
+			To:   added,
+		})
+	}
+	for ap, st := range de.endpointState {
+		if isRelayAddr(ap) && st.lastGotPing.IsZero() && !slices.Contains(relays, relayNodeID(ap)) {
+			de.deleteEndpointLocked("peerRelayRemoved", ap)
+		}
+	}
+}
+
+// peerRelayNameLocked returns the name of the peer relay that relay, a fake
+// address from relayAddr, stands for, for status: its first Tailscale IP.
+//
+// c.mu must be held.
+func (c *Conn) peerRelayNameLocked(relay netip.AddrPort) string {
+	if rde, ok := c.peerMap.endpointForNodeID(relayNodeID(relay)); ok && rde.nodeAddr.IsValid() {
+		return rde.nodeAddr.String()
+	}
+	return relay.String()
+}
+
+var (
+	metricSendPeerRelay        = clientmetric.NewCounter("magicsock_send_peer_relay")
+	metricSendPeerRelayError   = clientmetric.NewCounter("magicsock_send_peer_relay_error")
+	metricRecvDataPeerRelay    = clientmetric.NewCounter("magicsock_recv_data_peer_relay")
+	metricRecvPeerRelayBadPeer = clientmetric.NewCounter("magicsock_recv_peer_relay_bad_peer")
+	metricPeerRelayForwarded   = clientmetric.NewCounter("magicsock_peer_relay_forwarded")
+	metricPeerRelayDropped     = clientmetric.NewCounter("magicsock_peer_relay_dropped")
+)
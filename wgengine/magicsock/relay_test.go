@@ -0,0 +1,196 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/tstest/natlab"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+func TestRelayAddr(t *testing.T) {
+	for _, id := range []tailcfg.NodeID{1, 12345, 1<<63 - 1} {
+		ap := relayAddr(id)
+		if !isRelayAddr(ap) {
+			t.Errorf("isRelayAddr(relayAddr(%d) = %v) = false", id, ap)
+		}
+		if got := relayNodeID(ap); got != id {
+			t.Errorf("relayNodeID(relayAddr(%d)) = %d", id, got)
+		}
+	}
+	for _, s := range []string{"1.2.3.4:41641", "[2001:db8::1]:41641", "127.3.3.40:1"} {
+		if ap := netip.MustParseAddrPort(s); isRelayAddr(ap) {
+			t.Errorf("isRelayAddr(%v) = true", ap)
+		}
+	}
+
+	// A direct path wins over a peer relay, however slow it is.
+	direct := addrQuality{AddrPort: netip.MustParseAddrPort("1.2.3.4:41641"), latency: 300 * time.Millisecond}
+	relayed := addrQuality{AddrPort: relayAddr(3), latency: 10 * time.Millisecond}
+	if !betterAddr(direct, relayed) || betterAddr(relayed, direct) {
+		t.Errorf("betterAddr doesn't prefer %v to %v", direct, relayed)
+	}
+	if !betterAddr(relayed, addrQuality{}) {
+		t.Errorf("betterAddr doesn't prefer %v to nothing", relayed)
+	}
+}
+
+func TestIsPeerRelayNode(t *testing.T) {
+	relayCap := tailcfg.NodeCapMap{tailcfg.NodeAttrPeerRelay: nil}
+	discoKey := key.NewDisco().Public()
+	tests := []struct {
+		name          string
+		n             *tailcfg.Node
+		wantRelay     bool
+		wantSupported bool
+	}{
+		{
+			name:          "relay",
+			n:             &tailcfg.Node{Cap: peerRelayCapVer, DiscoKey: discoKey, CapMap: relayCap},
+			wantRelay:     true,
+			wantSupported: true,
+		},
+		{
+			name:          "not-relay",
+			n:             &tailcfg.Node{Cap: peerRelayCapVer, DiscoKey: discoKey},
+			wantSupported: true,
+		},
+		{
+			name: "old-client",
+			n:    &tailcfg.Node{Cap: peerRelayCapVer - 1, DiscoKey: discoKey, CapMap: relayCap},
+		},
+		{
+			name: "no-disco",
+			n:    &tailcfg.Node{Cap: peerRelayCapVer, CapMap: relayCap},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := tt.n.View()
+			if got := isPeerRelayNode(n); got != tt.wantRelay {
+				t.Errorf("isPeerRelayNode = %v; want %v", got, tt.wantRelay)
+			}
+			if got := supportsPeerRelays(n); got != tt.wantSupported {
+				t.Errorf("supportsPeerRelays = %v; want %v", got, tt.wantSupported)
+			}
+		})
+	}
+}
+
+// TestPeerRelay verifies that two magicStacks behind NATs that defeat
+// direct connections reach each other through a third acting as a peer
+// relay, rather than DERP.
+func TestPeerRelay(t *testing.T) {
+	tstest.ResourceCheck(t)
+	tstest.PanicOnLog()
+
+	mstun := &natlab.Machine{Name: "stun"}
+	mrelay := &natlab.Machine{Name: "relay"}
+	m1 := &natlab.Machine{Name: "m1", PacketHandler: &natlab.Firewall{}}
+	nat1 := &natlab.Machine{Name: "nat1"}
+	m2 := &natlab.Machine{Name: "m2", PacketHandler: &natlab.Firewall{}}
+	nat2 := &natlab.Machine{Name: "nat2"}
+
+	inet := natlab.NewInternet()
+	lan1 := &natlab.Network{Name: "lan1", Prefix4: netip.MustParsePrefix("192.168.0.0/24")}
+	lan2 := &natlab.Network{Name: "lan2", Prefix4: netip.MustParsePrefix("192.168.1.0/24")}
+
+	sif := mstun.Attach("eth0", inet)
+	mrelay.Attach("eth0", inet)
+	nat1WAN := nat1.Attach("wan", inet)
+	nat1LAN := nat1.Attach("lan1", lan1)
+	nat2WAN := nat2.Attach("wan", inet)
+	nat2LAN := nat2.Attach("lan2", lan2)
+	m1.Attach("eth0", lan1)
+	m2.Attach("eth0", lan2)
+	lan1.SetDefaultGateway(nat1LAN)
+	lan2.SetDefaultGateway(nat2LAN)
+
+	// Both NATs map each destination to a different port, so m1 and m2
+	// can't traverse them to reach each other.
+	nat1.PacketHandler = &natlab.SNAT44{
+		Machine:           nat1,
+		ExternalInterface: nat1WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall:          &natlab.Firewall{TrustedInterface: nat1LAN},
+	}
+	nat2.PacketHandler = &natlab.SNAT44{
+		Machine:           nat2,
+		ExternalInterface: nat2WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall:          &natlab.Firewall{TrustedInterface: nat2LAN},
+	}
+
+	logf, closeLogf := logger.LogfCloser(t.Logf)
+	defer closeLogf()
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	ms1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), m1, derpMap)
+	defer ms1.Close()
+	ms2 := newMagicStack(t, logger.WithPrefix(logf, "conn2: "), m2, derpMap)
+	defer ms2.Close()
+	msRelay := newMagicStack(t, logger.WithPrefix(logf, "relay: "), mrelay, derpMap)
+	defer msRelay.Close()
+
+	// meshStacks numbers nodes from 1, in order.
+	const relayIdx, relayID = 2, tailcfg.NodeID(3)
+	relayCap := tailcfg.NodeCapMap{tailcfg.NodeAttrPeerRelay: nil}
+	setRelayCap := func(idx int, nm *netmap.NetworkMap) {
+		if idx == relayIdx {
+			self := nm.SelfNode.AsStruct()
+			self.CapMap = relayCap
+			nm.SelfNode = self.View()
+		}
+		for i, p := range nm.Peers {
+			n := p.AsStruct()
+			n.Cap = tailcfg.CurrentCapabilityVersion
+			if p.ID() == relayID {
+				n.CapMap = relayCap
+			}
+			nm.Peers[i] = n.View()
+		}
+	}
+	cleanup = meshStacks(logf, setRelayCap, ms1, ms2, msRelay)
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	mustPeerRelay(t, logf, ms1, ms2, msRelay)
+	mustPeerRelay(t, logf, ms2, ms1, msRelay)
+
+	if n := metricPeerRelayForwarded.Value(); n == 0 {
+		t.Errorf("relay forwarded no packets")
+	}
+}
+
+// mustPeerRelay waits for m1 to send to m2 through the peer relay, failing
+// the test if it doesn't within 30 seconds.
+func mustPeerRelay(t *testing.T, logf logger.Logf, m1, m2, relay *magicStack) {
+	t.Helper()
+	want := relay.IP().String()
+	var last string
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pst := m1.Status().Peer[m2.Public()]
+		if pst.CurAddr != "" {
+			t.Fatalf("direct link %s->%s found with addr %s; NATs should prevent it", m1, m2, pst.CurAddr)
+		}
+		if pst.PeerRelay == want {
+			logf("link %s->%s goes through peer relay %s", m1, m2, pst.PeerRelay)
+			return
+		}
+		last = fmt.Sprintf("peer relay %q, DERP %q", pst.PeerRelay, pst.Relay)
+	}
+	t.Fatalf("link %s->%s doesn't go through peer relay %s; %s", m1, m2, want, last)
+}
@@ -191,6 +191,10 @@ type Config struct {
 	// If zero, a port is automatically selected.
 	ListenPort uint16
 
+	// PathPrefs optionally pins the preferred interface or address
+	// family of the UDP paths to peers. See magicsock.Options.PathPrefs.
+	PathPrefs string
+
 	// RespondToPing determines whether this engine should internally
 	// reply to ICMP pings, without involving the OS.
 	// Used in "fake" mode for development.
@@ -328,6 +332,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	magicsockOpts := magicsock.Options{
 		Logf:             logf,
 		Port:             conf.ListenPort,
+		PathPrefs:        conf.PathPrefs,
 		EndpointsFunc:    endpointsFn,
 		DERPActiveFunc:   e.RequestStatus,
 		IdleFunc:         e.tundev.IdleDuration,